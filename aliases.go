@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MediaAlias is another name a media item has been known by, e.g. the
+// filename of a duplicate upload or a path it was previously stored at.
+type MediaAlias struct {
+	ID        int       `db:"id" json:"id"`
+	MediaID   int       `db:"media_id" json:"media_id"`
+	Filename  string    `db:"filename" json:"filename"`
+	Path      string    `db:"path" json:"path"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// addAlias records filename and path as an alias of the media item. Adding
+// the same alias twice is a no-op.
+func (app *App) addAlias(mediaID int, filename, path string) error {
+	_, err := app.DB.Exec(
+		"INSERT OR IGNORE INTO media_aliases (media_id, filename, path) VALUES (?, ?, ?)",
+		mediaID, filename, path,
+	)
+	return err
+}
+
+func (app *App) getAliases(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	aliases := []MediaAlias{}
+	err := app.DB.Select(&aliases, "SELECT * FROM media_aliases WHERE media_id = ? ORDER BY created_at, id", item.ID)
+	if err != nil {
+		log.Error("Failed to fetch aliases:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, aliases)
+}
+
+func (app *App) createAlias(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		Filename string `json:"filename"`
+		Path     string `json:"path"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Filename == "" && req.Path != "" {
+		req.Filename = filepath.Base(req.Path)
+	}
+	if req.Filename == "" {
+		http.Error(w, "Filename or path is required", http.StatusBadRequest)
+		return
+	}
+
+	if err := app.addAlias(item.ID, req.Filename, req.Path); err != nil {
+		log.Error("Failed to add alias:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"success": true,
+	})
+}
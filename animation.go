@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// imageFrames counts the frames of an image by walking its blocks or
+// chunks, without decoding the pixels. GIF, PNG (APNG) and WebP images can
+// be animated; every other format has a single frame.
+func imageFrames(path string) (int, error) {
+	var count func(*bufio.Reader) (int, error)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gif":
+		count = gifFrames
+	case ".png":
+		count = pngFrames
+	case ".webp":
+		count = webpFrames
+	default:
+		return 1, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return count(bufio.NewReader(f))
+}
+
+// gifFrames counts the image descriptors of a GIF file.
+func gifFrames(r *bufio.Reader) (int, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:3]) != "GIF" {
+		return 0, errUnknownImageFormat
+	}
+	if err := skipColorTable(r, header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			// Some encoders leave out the trailer
+			if err == io.EOF && frames > 0 {
+				return frames, nil
+			}
+			return 0, errUnknownImageFormat
+		}
+
+		switch introducer {
+		case 0x21: // Extension: a label, then data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return 0, errUnknownImageFormat
+			}
+		case 0x2c: // Image descriptor, then the LZW code size and data
+			var descriptor [9]byte
+			if _, err := io.ReadFull(r, descriptor[:]); err != nil {
+				return 0, errUnknownImageFormat
+			}
+			if err := skipColorTable(r, descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err := r.ReadByte(); err != nil {
+				return 0, errUnknownImageFormat
+			}
+			frames++
+		case 0x3b: // Trailer
+			return frames, nil
+		default:
+			return 0, errUnknownImageFormat
+		}
+
+		if err := skipSubBlocks(r); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// skipColorTable skips the color table that follows a GIF screen or image
+// descriptor whose packed fields byte has the table flag set.
+func skipColorTable(r *bufio.Reader, packed byte) error {
+	if packed&0x80 == 0 {
+		return nil
+	}
+	if _, err := r.Discard(3 << (packed&0x07 + 1)); err != nil {
+		return errUnknownImageFormat
+	}
+	return nil
+}
+
+// skipSubBlocks skips GIF data sub-blocks up to the empty block ending them.
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return errUnknownImageFormat
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return errUnknownImageFormat
+		}
+	}
+}
+
+// pngFrames reads the frame count of an APNG from its animation control
+// chunk, which comes before the image data. Plain PNGs have one frame.
+func pngFrames(r *bufio.Reader) (int, error) {
+	var signature [8]byte
+	if _, err := io.ReadFull(r, signature[:]); err != nil || string(signature[:]) != "\x89PNG\r\n\x1a\n" {
+		return 0, errUnknownImageFormat
+	}
+
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return 0, errUnknownImageFormat
+		}
+		length := binary.BigEndian.Uint32(chunk[:4])
+
+		switch string(chunk[4:]) {
+		case "acTL":
+			var frames [4]byte
+			if _, err := io.ReadFull(r, frames[:]); err != nil {
+				return 0, errUnknownImageFormat
+			}
+			return int(binary.BigEndian.Uint32(frames[:])), nil
+		case "IDAT", "IEND":
+			return 1, nil
+		}
+
+		// The chunk data, then its CRC
+		if _, err := r.Discard(int(length) + 4); err != nil {
+			return 0, errUnknownImageFormat
+		}
+	}
+}
+
+// webpFrames counts the animation frame chunks of a WebP file. Only
+// extended (VP8X) files can be animated.
+func webpFrames(r *bufio.Reader) (int, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return 0, errUnknownImageFormat
+	}
+
+	frames := 0
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return 0, errUnknownImageFormat
+		}
+		if bytes.Equal(chunk[:4], []byte("ANMF")) {
+			frames++
+		}
+
+		// Chunks are padded to an even size
+		size := binary.LittleEndian.Uint32(chunk[4:])
+		if _, err := r.Discard(int(size + size&1)); err != nil {
+			// A truncated last chunk still counts
+			break
+		}
+	}
+
+	if frames == 0 {
+		return 1, nil
+	}
+	return frames, nil
+}
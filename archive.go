@@ -0,0 +1,204 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventIntegrityAlert is published when a file of an immutable library is
+// found to have changed.
+const eventIntegrityAlert = "integrity_alert"
+
+// Results of verifying an item against its baseline checksum.
+const (
+	verifyOK        = "verified"
+	verifyBaselined = "baselined"
+	verifyModified  = "modified"
+	verifyMissing   = "missing"
+)
+
+// immutable reports whether the item is in an archive library, whose files
+// must never change once added.
+func (app *App) immutable(item *MediaItem) bool {
+	lib := app.Config.libraryOf(item.Path)
+	return lib != nil && lib.Immutable
+}
+
+// baseline computes the checksum of a new item of an immutable library,
+// which later verifications compare against. Items that already have one
+// keep it.
+func (app *App) baseline(item *MediaItem) error {
+	if item.Checksum != "" || !app.immutable(item) {
+		return nil
+	}
+
+	checksum, err := fileChecksum(item.Path)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if _, err := app.DB.Exec("UPDATE media SET checksum = ?, verified_at = ? WHERE id = ?", checksum, now, item.ID); err != nil {
+		return err
+	}
+	item.Checksum, item.VerifiedAt = checksum, &now
+	return nil
+}
+
+// unbaselined returns the items of immutable libraries after the given ID
+// that have no baseline checksum yet.
+func (app *App) unbaselined(afterID int) ([]MediaItem, error) {
+	var conds []string
+	args := []interface{}{afterID}
+	for _, lib := range app.Config.Libraries {
+		if !lib.Immutable {
+			continue
+		}
+		for _, v := range lib.volumes() {
+			prefix := v + string(os.PathSeparator)
+			conds = append(conds, "substr(path, 1, length(?)) = ?")
+			args = append(args, prefix, prefix)
+		}
+	}
+	if len(conds) == 0 {
+		return nil, nil
+	}
+
+	var items []MediaItem
+	err := app.DB.Select(&items,
+		"SELECT * FROM media WHERE checksum = '' AND id > ? AND ("+strings.Join(conds, " OR ")+") ORDER BY id",
+		args...,
+	)
+	return items, err
+}
+
+// reportModified flags an item of an immutable library whose file changed
+// and raises an alert. The item's record is left as it was, so it keeps
+// describing the original file.
+func (app *App) reportModified(item *MediaItem, source, reason string) error {
+	log.Warnf("Immutable file %s was modified: %s", item.Path, reason)
+	if err := app.setFlag(item.ID, flagModified, source); err != nil {
+		return err
+	}
+	app.Events.publish(eventIntegrityAlert, map[string]interface{}{
+		"media_id": item.ID,
+		"path":     item.Path,
+		"reason":   reason,
+	})
+	return nil
+}
+
+// checkUnchanged compares the size and modification time of the files of
+// immutable libraries below root with their records, as a cheap check
+// during scans. Only verifying reads the content.
+func (app *App) checkUnchanged(root string) error {
+	prefix := filepath.Clean(root) + string(os.PathSeparator)
+
+	var items []MediaItem
+	err := app.DB.Select(&items, "SELECT * FROM media WHERE substr(path, 1, length(?)) = ?", prefix, prefix)
+	if err != nil {
+		return err
+	}
+
+	for i := range items {
+		item := &items[i]
+		if !app.immutable(item) {
+			continue
+		}
+		info, err := os.Stat(item.Path)
+		if err != nil {
+			// Missing files are flagged as missing
+			continue
+		}
+
+		reason := ""
+		switch {
+		case info.Size() != item.Size:
+			reason = "size changed"
+		case item.FileModTime != nil && !info.ModTime().UTC().Equal(*item.FileModTime):
+			reason = "modification time changed"
+		default:
+			continue
+		}
+		if err := app.reportModified(item, sourceScan, reason); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyItem compares the content of an item of an immutable library with
+// its baseline checksum, taking the baseline if it has none. A file that
+// matches again, e.g. after being restored from a backup, loses its
+// modified flag.
+func (app *App) verifyItem(item *MediaItem) (string, error) {
+	if _, err := os.Stat(item.Path); os.IsNotExist(err) {
+		return verifyMissing, app.setFlag(item.ID, flagMissing, sourceVerify)
+	}
+
+	if item.Checksum == "" {
+		return verifyBaselined, app.baseline(item)
+	}
+
+	checksum, err := fileChecksum(item.Path)
+	if err != nil {
+		return "", err
+	}
+	if checksum != item.Checksum {
+		return verifyModified, app.reportModified(item, sourceVerify, "checksum mismatch")
+	}
+
+	if _, err := app.DB.Exec("UPDATE media SET verified_at = ? WHERE id = ?", time.Now().UTC(), item.ID); err != nil {
+		return "", err
+	}
+	return verifyOK, app.clearFlag(item.ID, flagModified)
+}
+
+// verifyMedia checks the files of the items of immutable libraries that
+// match the media filters in the query string against their checksums.
+func (app *App) verifyMedia(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items []MediaItem
+	where, args := filter.where()
+	if err := app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY id", args...); err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	counts := map[string]int{verifyOK: 0, verifyBaselined: 0, verifyModified: 0, verifyMissing: 0}
+	skipped, failed := 0, 0
+	for i := range items {
+		if !app.immutable(&items[i]) {
+			skipped++
+			continue
+		}
+
+		result, err := app.verifyItem(&items[i])
+		if err != nil {
+			log.Warnf("Failed to verify %s: %v", items[i].Path, err)
+			failed++
+			continue
+		}
+		counts[result]++
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"verified":  counts[verifyOK],
+		"baselined": counts[verifyBaselined],
+		"modified":  counts[verifyModified],
+		"missing":   counts[verifyMissing],
+		"skipped":   skipped,
+		"failed":    failed,
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxArtworkSize caps how much is downloaded for a single artwork image.
+const maxArtworkSize = 20 << 20
+
+// cacheArtwork downloads the image at rawURL into the artwork cache unless it
+// is already there, and returns the cached file's name. Files are named after
+// the URL, so items sharing artwork share the cached copy.
+func (app *App) cacheArtwork(rawURL string) (string, error) {
+	sum := sha256.Sum256([]byte(rawURL))
+	key := hex.EncodeToString(sum[:])
+
+	if matches, _ := filepath.Glob(filepath.Join(artworkDir, key+".*")); len(matches) > 0 {
+		return filepath.Base(matches[0]), nil
+	}
+
+	resp, err := app.Providers[providerArtwork].get(rawURL, maxArtworkSize)
+	if err != nil {
+		return "", err
+	}
+	if resp.Status != http.StatusOK {
+		return "", fmt.Errorf("fetching artwork: %d %s", resp.Status, http.StatusText(resp.Status))
+	}
+
+	contentType, _, _ := mime.ParseMediaType(resp.ContentType)
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", fmt.Errorf("artwork is not an image: %s", contentType)
+	}
+
+	ext := "." + strings.TrimPrefix(contentType, "image/")
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		ext = exts[0]
+	}
+
+	if err := os.MkdirAll(artworkDir, 0755); err != nil {
+		return "", err
+	}
+
+	// Write to a temporary file first so a failed write never leaves a
+	// truncated image in the cache
+	tmp, err := ioutil.TempFile(artworkDir, ".download-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(resp.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	name := key + ext
+	if err := os.Rename(tmp.Name(), filepath.Join(artworkDir, name)); err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+func (app *App) setArtwork(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "A http or https URL is required", http.StatusBadRequest)
+		return
+	}
+
+	name, err := app.cacheArtwork(req.URL)
+	if err != nil {
+		log.Warnf("Failed to cache artwork %s: %v", req.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	_, err = app.DB.Exec("UPDATE media SET artwork_url = ?, artwork = ? WHERE id = ?", req.URL, name, item.ID)
+	if err != nil {
+		log.Error("Failed to update artwork:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	item.ArtworkURL, item.Artwork = req.URL, name
+	app.writeJSON(w, r, http.StatusOK, item)
+}
+
+func (app *App) getArtwork(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if item.ArtworkURL == "" {
+		http.Error(w, "Media item has no artwork", http.StatusNotFound)
+		return
+	}
+
+	// Re-fetch artwork that has been removed from the cache
+	path := filepath.Join(artworkDir, item.Artwork)
+	if _, err := os.Stat(path); item.Artwork == "" || err != nil {
+		name, err := app.cacheArtwork(item.ArtworkURL)
+		if err != nil {
+			log.Warnf("Failed to cache artwork %s: %v", item.ArtworkURL, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if _, err := app.DB.Exec("UPDATE media SET artwork = ? WHERE id = ?", name, item.ID); err != nil {
+			log.Warnf("Failed to update artwork of item %d: %v", item.ID, err)
+		}
+		path = filepath.Join(artworkDir, name)
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, path)
+}
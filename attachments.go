@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxAttachmentSize is the largest file that can be attached to an item.
+const maxAttachmentSize = 256 << 20
+
+// Attachment is an auxiliary file kept with a media item, such as a
+// receipt, project notes or an alternate edit. The file is stored in the
+// attachment folder of the data directory, not next to the item.
+type Attachment struct {
+	ID          int       `db:"id" json:"id"`
+	MediaID     int       `db:"media_id" json:"media_id"`
+	Filename    string    `db:"filename" json:"filename"`
+	Size        int64     `db:"size" json:"size"`
+	ContentType string    `db:"content_type" json:"content_type"`
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+}
+
+// path is where the attachment's file is stored: a folder per item, with
+// the file named by its ID so any filename is safe.
+func (a *Attachment) path() string {
+	return filepath.Join(attachmentDir, strconv.Itoa(a.MediaID), strconv.Itoa(a.ID))
+}
+
+// attachmentFromURL loads the attachment identified by the {attachmentID}
+// URL parameter of the item, writing an error response and returning nil if
+// it can't.
+func (app *App) attachmentFromURL(w http.ResponseWriter, r *http.Request, item *MediaItem) *Attachment {
+	id, err := strconv.Atoi(chi.URLParam(r, "attachmentID"))
+	if err != nil {
+		http.Error(w, "Invalid attachment ID", http.StatusBadRequest)
+		return nil
+	}
+
+	var a Attachment
+	err = app.DB.Get(&a, "SELECT * FROM media_attachments WHERE id = ? AND media_id = ?", id, item.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Attachment not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch attachment:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return &a
+}
+
+func (app *App) getAttachments(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	attachments := []Attachment{}
+	if err := app.DB.Select(&attachments, "SELECT * FROM media_attachments WHERE media_id = ? ORDER BY id", item.ID); err != nil {
+		log.Error("Failed to fetch attachments:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, attachments)
+}
+
+// addAttachment stores the file of a multipart upload's "file" field as an
+// attachment of the item. Locked items can still be given attachments,
+// since they don't change the item.
+func (app *App) addAttachment(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1<<20)
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	if header.Size > maxAttachmentSize {
+		http.Error(w, fmt.Sprintf("Attachments are limited to %d bytes", maxAttachmentSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	filename := filepath.Base(header.Filename)
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(file, head)
+		contentType = http.DetectContentType(head[:n])
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			log.Error("Failed to rewind attachment:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	a := Attachment{MediaID: item.ID, Filename: filename, Size: header.Size, ContentType: contentType, CreatedAt: time.Now().UTC()}
+	res, err := app.DB.NamedExec(
+		`INSERT INTO media_attachments (media_id, filename, size, content_type, created_at)
+			VALUES (:media_id, :filename, :size, :content_type, :created_at)`,
+		a,
+	)
+	var id int64
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err != nil {
+		log.Error("Failed to record attachment:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	a.ID = int(id)
+
+	err = os.MkdirAll(filepath.Dir(a.path()), 0755)
+	var out *os.File
+	if err == nil {
+		out, err = os.Create(a.path())
+	}
+	if err == nil {
+		_, err = io.Copy(out, file)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		os.Remove(a.path())
+		app.DB.Exec("DELETE FROM media_attachments WHERE id = ?", a.ID)
+		log.Error("Failed to store attachment:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Attached %s to media item %d", filename, item.ID)
+	app.writeJSON(w, r, http.StatusCreated, a)
+}
+
+// getAttachment serves the file of an attachment for download.
+func (app *App) getAttachment(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+	a := app.attachmentFromURL(w, r, item)
+	if a == nil {
+		return
+	}
+
+	f, err := os.Open(a.path())
+	if os.IsNotExist(err) {
+		http.Error(w, "Attachment file is missing", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to open attachment:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", a.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	http.ServeContent(w, r, "", a.CreatedAt, f)
+}
+
+func (app *App) deleteAttachment(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+	a := app.attachmentFromURL(w, r, item)
+	if a == nil {
+		return
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM media_attachments WHERE id = ?", a.ID); err != nil {
+		log.Error("Failed to delete attachment:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := os.Remove(a.path()); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove attachment file %s: %v", a.path(), err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
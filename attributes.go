@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// attributeKeyPattern restricts attribute keys to names that can't be
+// confused with the "key=value" syntax of the attr filter.
+var attributeKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// AttributeSummary is an attribute key and how many items have it.
+type AttributeSummary struct {
+	Key   string `db:"key" json:"key"`
+	Count int    `db:"count" json:"count"`
+}
+
+// itemAttributes returns the custom attributes of a media item, writing an
+// error response and returning nil if it can't.
+func (app *App) itemAttributes(w http.ResponseWriter, item *MediaItem) map[string]string {
+	var rows []struct {
+		Key   string `db:"key"`
+		Value string `db:"value"`
+	}
+	if err := app.DB.Select(&rows, "SELECT key, value FROM media_attributes WHERE media_id = ?", item.ID); err != nil {
+		log.Error("Failed to fetch attributes:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	attributes := make(map[string]string, len(rows))
+	for _, row := range rows {
+		attributes[row.Key] = row.Value
+	}
+	return attributes
+}
+
+// attributeFilter splits an attr filter value into its key and, after an
+// "=", the value. Without one, any value matches.
+func attributeFilter(v string) (key string, value *string) {
+	if i := strings.IndexByte(v, '='); i >= 0 {
+		value := v[i+1:]
+		return v[:i], &value
+	}
+	return v, nil
+}
+
+// getAttributes lists the attribute keys in use, most used first.
+func (app *App) getAttributes(w http.ResponseWriter, r *http.Request) {
+	keys := []AttributeSummary{}
+	err := app.DB.Select(&keys, "SELECT key, COUNT(*) AS count FROM media_attributes GROUP BY key ORDER BY count DESC, key")
+	if err != nil {
+		log.Error("Failed to fetch attributes:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, keys)
+}
+
+func (app *App) getMediaAttributes(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if attributes := app.itemAttributes(w, item); attributes != nil {
+		app.writeJSON(w, r, http.StatusOK, attributes)
+	}
+}
+
+// setMediaAttribute sets one attribute of an item, replacing its value if
+// it already has it.
+func (app *App) setMediaAttribute(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	key := chi.URLParam(r, "key")
+	if !attributeKeyPattern.MatchString(key) {
+		http.Error(w, fmt.Sprintf("Invalid attribute key %q: use up to 64 letters, digits, '_', '.' or '-'", key), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Value *string `json:"value"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Value == nil {
+		http.Error(w, "value is required", http.StatusBadRequest)
+		return
+	}
+
+	_, err := app.DB.Exec(
+		`INSERT INTO media_attributes (media_id, key, value) VALUES (?, ?, ?)
+			ON CONFLICT (media_id, key) DO UPDATE SET value = excluded.value`,
+		item.ID, key, *req.Value,
+	)
+	if err != nil {
+		log.Error("Failed to set attribute:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if attributes := app.itemAttributes(w, item); attributes != nil {
+		app.writeJSON(w, r, http.StatusOK, attributes)
+	}
+}
+
+func (app *App) deleteMediaAttribute(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	_, err := app.DB.Exec("DELETE FROM media_attributes WHERE media_id = ? AND key = ?", item.ID, chi.URLParam(r, "key"))
+	if err != nil {
+		log.Error("Failed to delete attribute:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if attributes := app.itemAttributes(w, item); attributes != nil {
+		app.writeJSON(w, r, http.StatusOK, attributes)
+	}
+}
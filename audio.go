@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// errUnknownAudioFormat is returned for audio files whose format isn't
+// recognized from their first bytes.
+var errUnknownAudioFormat = errors.New("unknown audio format")
+
+// maxAudioTag caps how much of a file is read for its tags. Tags holding
+// large cover art are skipped rather than read in full.
+const maxAudioTag = 16 << 20
+
+// audioInfo is what is read from an audio file. Title, Artist and Album
+// come from its ID3, Vorbis or iTunes tags and are empty if it has none;
+// Duration is in seconds.
+type audioInfo struct {
+	Title    string
+	Artist   string
+	Album    string
+	Duration float64
+	Codec    string
+	// SampleRate is in Hz.
+	SampleRate int
+	Channels   int
+}
+
+// readAudio reads the tags and duration of an audio file. The format is
+// told from the first bytes rather than the extension, so renamed files
+// are read all the same.
+func readAudio(path string) (*audioInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var head [12]byte
+	n, _ := io.ReadFull(f, head[:])
+	b := head[:n]
+	switch {
+	case bytes.HasPrefix(b, []byte("fLaC")):
+		return readFLAC(f)
+	case bytes.HasPrefix(b, []byte("OggS")):
+		return readOgg(f, fi.Size())
+	case len(b) >= 8 && string(b[4:8]) == "ftyp":
+		return readM4A(f, fi.Size())
+	case bytes.HasPrefix(b, []byte("ID3")), len(b) >= 2 && b[0] == 0xff && b[1]&0xe0 == 0xe0:
+		return readMP3(f, fi.Size())
+	}
+	return nil, errUnknownAudioFormat
+}
+
+// readMP3 reads the ID3v2 tag at the start of an MP3 file, falling back on
+// the ID3v1 tag at its end. The duration comes from the TLEN frame, the
+// frame count of a Xing or VBRI header, or else is estimated from the
+// bitrate of the first frame.
+func readMP3(f *os.File, size int64) (*audioInfo, error) {
+	info := &audioInfo{Codec: "mp3"}
+	var audioStart int64
+	var length float64
+
+	var header [10]byte
+	if _, err := f.ReadAt(header[:], 0); err == nil && string(header[:3]) == "ID3" {
+		tagSize := int64(syncsafe(header[6:10]))
+		audioStart = 10 + tagSize
+		if header[5]&0x10 != 0 {
+			audioStart += 10
+		}
+		if tagSize <= maxAudioTag {
+			tag := make([]byte, tagSize)
+			if _, err := f.ReadAt(tag, 10); err == nil {
+				length = parseID3v2(tag, header[3], header[5], info)
+			}
+		}
+	}
+
+	// ID3v1 tags are fixed size fields at the very end
+	end := size
+	var v1 [128]byte
+	if size >= 128 {
+		if _, err := f.ReadAt(v1[:], size-128); err == nil && string(v1[:3]) == "TAG" {
+			end -= 128
+			if info.Title == "" {
+				info.Title = latin1(v1[3:33])
+			}
+			if info.Artist == "" {
+				info.Artist = latin1(v1[33:63])
+			}
+			if info.Album == "" {
+				info.Album = latin1(v1[63:93])
+			}
+		}
+	}
+
+	// Find the first frame after the tag, skipping padding
+	buf := make([]byte, 64<<10)
+	n, _ := f.ReadAt(buf, audioStart)
+	buf = buf[:n]
+	for i := 0; i+4 <= len(buf); i++ {
+		frame, ok := parseMP3Frame(buf[i:])
+		if !ok {
+			continue
+		}
+		info.SampleRate = frame.sampleRate
+		info.Channels = frame.channels
+
+		switch {
+		case length > 0:
+			info.Duration = length
+		case frame.frames > 0:
+			info.Duration = float64(frame.frames) * float64(frame.samples) / float64(frame.sampleRate)
+		case frame.bitrate > 0:
+			info.Duration = float64(end-audioStart-int64(i)) * 8 / float64(frame.bitrate)
+		}
+		break
+	}
+	return info, nil
+}
+
+// mp3Frame is the header of an MP3 frame. Frames is the frame count of the
+// whole stream if the frame is a Xing or VBRI header, as variable bitrate
+// files start with.
+type mp3Frame struct {
+	bitrate    int
+	sampleRate int
+	channels   int
+	samples    int
+	frames     uint32
+}
+
+var (
+	mp3Bitrates = [2][15]int{
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160},
+	}
+	mp3SampleRates = [3][3]int{
+		{44100, 48000, 32000},
+		{22050, 24000, 16000},
+		{11025, 12000, 8000},
+	}
+)
+
+// parseMP3Frame parses the MPEG layer III frame header at the start of b.
+func parseMP3Frame(b []byte) (mp3Frame, bool) {
+	if b[0] != 0xff || b[1]&0xe0 != 0xe0 || (b[1]>>1)&3 != 1 {
+		return mp3Frame{}, false
+	}
+	bitrateIndex, rateIndex := b[2]>>4, (b[2]>>2)&3
+	if bitrateIndex == 15 || rateIndex == 3 {
+		return mp3Frame{}, false
+	}
+
+	// MPEG 1, 2 and 2.5 differ in their tables and frame size
+	frame := mp3Frame{channels: 2, samples: 576}
+	table, sideInfo := 1, 17
+	switch (b[1] >> 3) & 3 {
+	case 3:
+		frame.sampleRate = mp3SampleRates[0][rateIndex]
+		table, sideInfo, frame.samples = 0, 32, 1152
+	case 2:
+		frame.sampleRate = mp3SampleRates[1][rateIndex]
+	case 0:
+		frame.sampleRate = mp3SampleRates[2][rateIndex]
+	default:
+		return mp3Frame{}, false
+	}
+	if b[3]>>6 == 3 {
+		frame.channels = 1
+		if sideInfo = 9; table == 0 {
+			sideInfo = 17
+		}
+	}
+	frame.bitrate = mp3Bitrates[table][bitrateIndex] * 1000
+
+	if xing := 4 + sideInfo; len(b) >= xing+12 {
+		tag := string(b[xing : xing+4])
+		if (tag == "Xing" || tag == "Info") && binary.BigEndian.Uint32(b[xing+4:])&1 != 0 {
+			frame.frames = binary.BigEndian.Uint32(b[xing+8:])
+		}
+	}
+	if len(b) >= 36+18 && string(b[36:40]) == "VBRI" {
+		frame.frames = binary.BigEndian.Uint32(b[36+14:])
+	}
+	return frame, true
+}
+
+// parseID3v2 reads the title, artist and album frames of an ID3v2.2, 2.3
+// or 2.4 tag into info, returning the length its TLEN frame gives in
+// seconds, or zero.
+func parseID3v2(tag []byte, version, flags byte, info *audioInfo) float64 {
+	if version < 2 || version > 4 {
+		return 0
+	}
+	// Unsynchronisation escapes false frame syncs with a zero byte
+	if flags&0x80 != 0 && version < 4 {
+		tag = bytes.ReplaceAll(tag, []byte{0xff, 0x00}, []byte{0xff})
+	}
+	if flags&0x40 != 0 && version > 2 && len(tag) >= 4 {
+		// The extended header's size includes itself in 2.4 only
+		skip := int(binary.BigEndian.Uint32(tag)) + 4
+		if version == 4 {
+			skip = int(syncsafe(tag))
+		}
+		if skip < 0 || skip > len(tag) {
+			return 0
+		}
+		tag = tag[skip:]
+	}
+
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	var length float64
+	for len(tag) >= headerLen && tag[0] != 0 {
+		id := string(tag[:idLen])
+		var size int
+		switch version {
+		case 2:
+			size = int(tag[3])<<16 | int(tag[4])<<8 | int(tag[5])
+		case 3:
+			size = int(binary.BigEndian.Uint32(tag[4:]))
+		case 4:
+			size = int(syncsafe(tag[4:8]))
+		}
+		if size < 0 || headerLen+size > len(tag) {
+			break
+		}
+		data := tag[headerLen : headerLen+size]
+		tag = tag[headerLen+size:]
+
+		switch id {
+		case "TIT2", "TT2":
+			info.Title = id3Text(data)
+		case "TPE1", "TP1":
+			info.Artist = id3Text(data)
+		case "TALB", "TAL":
+			info.Album = id3Text(data)
+		case "TLEN", "TLE":
+			if ms, err := strconv.Atoi(id3Text(data)); err == nil && ms > 0 {
+				length = float64(ms) / 1000
+			}
+		}
+	}
+	return length
+}
+
+// id3Text decodes an ID3v2 text frame, whose first byte is its encoding:
+// Latin-1, UTF-16 with a byte order mark, UTF-16BE or UTF-8. Frames with
+// several values keep the first.
+func id3Text(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	encoding, data := data[0], data[1:]
+	var text string
+	switch encoding {
+	case 0:
+		text = latin1(data)
+	case 1, 2:
+		order := binary.ByteOrder(binary.BigEndian)
+		if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			order, data = binary.LittleEndian, data[2:]
+		} else if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			data = data[2:]
+		}
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		text = string(utf16.Decode(units))
+	default:
+		text = string(data)
+	}
+	if i := strings.IndexByte(text, 0); i >= 0 {
+		text = text[:i]
+	}
+	return strings.TrimSpace(text)
+}
+
+// latin1 decodes ISO-8859-1 text, which maps byte for byte to the first
+// Unicode code points, up to the first NUL.
+func latin1(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// syncsafe decodes an ID3v2 syncsafe integer, 7 bits per byte.
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7f)<<21 | uint32(b[1]&0x7f)<<14 | uint32(b[2]&0x7f)<<7 | uint32(b[3]&0x7f)
+}
+
+// readFLAC reads the STREAMINFO and VORBIS_COMMENT metadata blocks of a
+// FLAC file, which come before the audio.
+func readFLAC(f *os.File) (*audioInfo, error) {
+	info := &audioInfo{Codec: "flac"}
+	offset := int64(4)
+	for {
+		var header [4]byte
+		if _, err := f.ReadAt(header[:], offset); err != nil {
+			return nil, err
+		}
+		last, typ := header[0]&0x80 != 0, header[0]&0x7f
+		size := int64(header[1])<<16 | int64(header[2])<<8 | int64(header[3])
+		offset += 4
+
+		if (typ == 0 || typ == 4) && size <= maxAudioTag {
+			block := make([]byte, size)
+			if _, err := f.ReadAt(block, offset); err != nil {
+				return nil, err
+			}
+			if typ == 0 && len(block) >= 18 {
+				info.SampleRate = int(block[10])<<12 | int(block[11])<<4 | int(block[12])>>4
+				info.Channels = int(block[12]>>1&7) + 1
+				samples := uint64(block[13]&0x0f)<<32 | uint64(binary.BigEndian.Uint32(block[14:]))
+				if info.SampleRate > 0 {
+					info.Duration = float64(samples) / float64(info.SampleRate)
+				}
+			}
+			if typ == 4 {
+				parseVorbisComment(block, info)
+			}
+		}
+
+		offset += size
+		if last {
+			return info, nil
+		}
+	}
+}
+
+// parseVorbisComment reads the TITLE, ARTIST and ALBUM fields of a Vorbis
+// comment block, as FLAC, Ogg Vorbis and Opus files use. Field names are
+// case insensitive; the first of repeated fields is kept.
+func parseVorbisComment(b []byte, info *audioInfo) {
+	next := func() ([]byte, bool) {
+		if len(b) < 4 {
+			return nil, false
+		}
+		n := binary.LittleEndian.Uint32(b)
+		if uint64(n)+4 > uint64(len(b)) {
+			return nil, false
+		}
+		field := b[4 : 4+n]
+		b = b[4+n:]
+		return field, true
+	}
+
+	// The vendor string comes first, then the field count
+	if _, ok := next(); !ok || len(b) < 4 {
+		return
+	}
+	count := binary.LittleEndian.Uint32(b)
+	b = b[4:]
+	for i := uint32(0); i < count; i++ {
+		field, ok := next()
+		if !ok {
+			return
+		}
+		name, value, ok := strings.Cut(string(field), "=")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch strings.ToUpper(name) {
+		case "TITLE":
+			if info.Title == "" {
+				info.Title = value
+			}
+		case "ARTIST":
+			if info.Artist == "" {
+				info.Artist = value
+			}
+		case "ALBUM":
+			if info.Album == "" {
+				info.Album = value
+			}
+		}
+	}
+}
+
+// readOgg reads the identification and comment packets of an Ogg Vorbis
+// or Opus file, at its start. The duration is the granule position of the
+// last page, counted in samples.
+func readOgg(f *os.File, size int64) (*audioInfo, error) {
+	packets, err := oggPackets(io.NewSectionReader(f, 0, size), 2)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(packets) == 0 {
+		return nil, errUnknownAudioFormat
+	}
+
+	info := &audioInfo{}
+	var preSkip int64
+	ident := packets[0]
+	switch {
+	case bytes.HasPrefix(ident, []byte("\x01vorbis")) && len(ident) >= 16:
+		info.Codec = "vorbis"
+		info.Channels = int(ident[11])
+		info.SampleRate = int(binary.LittleEndian.Uint32(ident[12:]))
+	case bytes.HasPrefix(ident, []byte("OpusHead")) && len(ident) >= 12:
+		// Opus always counts granules at 48 kHz
+		info.Codec = "opus"
+		info.Channels = int(ident[9])
+		preSkip = int64(binary.LittleEndian.Uint16(ident[10:]))
+		info.SampleRate = 48000
+	default:
+		return nil, errUnknownAudioFormat
+	}
+
+	if len(packets) > 1 {
+		comment := packets[1]
+		if bytes.HasPrefix(comment, []byte("\x03vorbis")) {
+			parseVorbisComment(comment[7:], info)
+		} else if bytes.HasPrefix(comment, []byte("OpusTags")) {
+			parseVorbisComment(comment[8:], info)
+		}
+	}
+
+	tail := int64(64 << 10)
+	if tail > size {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	if _, err := f.ReadAt(buf, size-tail); err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i := bytes.LastIndex(buf, []byte("OggS")); i >= 0; i = bytes.LastIndex(buf[:i], []byte("OggS")) {
+		if i+14 > len(buf) {
+			continue
+		}
+		granule := int64(binary.LittleEndian.Uint64(buf[i+6:]))
+		if granule > 0 && info.SampleRate > 0 {
+			info.Duration = float64(granule-preSkip) / float64(info.SampleRate)
+			break
+		}
+	}
+	return info, nil
+}
+
+// oggPackets reassembles the first n packets of an Ogg stream from its
+// pages. Fewer are returned if the stream ends or they grow past
+// maxAudioTag.
+func oggPackets(r io.Reader, n int) ([][]byte, error) {
+	var packets [][]byte
+	var packet []byte
+pages:
+	for len(packets) < n {
+		var header [27]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "OggS" {
+			break
+		}
+		segments := make([]byte, header[26])
+		if _, err := io.ReadFull(r, segments); err != nil {
+			break
+		}
+		for _, length := range segments {
+			data := make([]byte, length)
+			if _, err := io.ReadFull(r, data); err != nil {
+				break pages
+			}
+			packet = append(packet, data...)
+			// A segment shorter than 255 bytes ends its packet
+			if length < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+			if len(packet) > maxAudioTag {
+				break pages
+			}
+		}
+	}
+	if len(packets) == 0 {
+		return nil, errUnknownAudioFormat
+	}
+	return packets, nil
+}
+
+// readM4A reads the duration in the movie header of an MPEG-4 audio file
+// and the ©nam, ©ART and ©alb items of its iTunes metadata.
+func readM4A(f *os.File, size int64) (*audioInfo, error) {
+	info := &audioInfo{Codec: "aac"}
+	err := walkBoxes(f, 0, size, func(typ string, start, end int64) error {
+		if end-start > maxAudioTag {
+			return nil
+		}
+		switch typ {
+		case "mvhd":
+			b := make([]byte, end-start)
+			if _, err := f.ReadAt(b, start); err != nil {
+				return err
+			}
+			var timescale uint32
+			var duration uint64
+			if len(b) >= 32 && b[0] == 1 {
+				timescale, duration = binary.BigEndian.Uint32(b[20:]), binary.BigEndian.Uint64(b[24:])
+			} else if len(b) >= 20 {
+				timescale, duration = binary.BigEndian.Uint32(b[12:]), uint64(binary.BigEndian.Uint32(b[16:]))
+			}
+			if timescale > 0 {
+				info.Duration = float64(duration) / float64(timescale)
+			}
+		case "\xa9nam", "\xa9ART", "\xa9alb":
+			// The value is in a data box: type and locale, then the text
+			b := make([]byte, end-start)
+			if _, err := f.ReadAt(b, start); err != nil {
+				return err
+			}
+			if len(b) < 16 || string(b[4:8]) != "data" {
+				return nil
+			}
+			value := strings.TrimSpace(string(b[16:]))
+			switch typ {
+			case "\xa9nam":
+				info.Title = value
+			case "\xa9ART":
+				info.Artist = value
+			case "\xa9alb":
+				info.Album = value
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// walkBoxes calls visit with the content range of every MPEG-4 box between
+// start and end, descending into the boxes that lead to the movie header
+// and the iTunes metadata.
+func walkBoxes(f *os.File, start, end int64, visit func(typ string, start, end int64) error) error {
+	for start+8 <= end {
+		var header [16]byte
+		if _, err := f.ReadAt(header[:8], start); err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[:]))
+		typ := string(header[4:8])
+		content := start + 8
+		switch size {
+		case 0:
+			size = end - start
+		case 1:
+			if _, err := f.ReadAt(header[8:], start+8); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:]))
+			content += 8
+		}
+		if size < content-start || size > end-start {
+			return nil
+		}
+
+		switch typ {
+		case "moov", "udta", "ilst":
+			if err := walkBoxes(f, content, start+size, visit); err != nil {
+				return err
+			}
+		case "meta":
+			// A full box: version and flags precede the children
+			if err := walkBoxes(f, content+4, start+size, visit); err != nil {
+				return err
+			}
+		default:
+			if err := visit(typ, content, start+size); err != nil {
+				return err
+			}
+		}
+		start += size
+	}
+	return nil
+}
+
+// probeAudio stores the duration and stream details of an audio file, and
+// the title, artist and album of its tags unless the item is locked.
+func (app *App) probeAudio(item *MediaItem) error {
+	info, err := readAudio(item.Path)
+	if err != nil {
+		return err
+	}
+
+	if !item.Locked {
+		if info.Title != "" {
+			item.Title = info.Title
+		}
+		item.Artist = info.Artist
+		item.Album = info.Album
+	}
+
+	_, err = app.DB.Exec(
+		`UPDATE media SET duration = ?, audio_codec = ?, sample_rate = ?, audio_channels = ?,
+			title = ?, artist = ?, album = ?, probed = 1 WHERE id = ?`,
+		info.Duration, info.Codec, info.SampleRate, info.Channels,
+		item.Title, item.Artist, item.Album, item.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	item.Duration = info.Duration
+	item.AudioCodec = info.Codec
+	item.SampleRate = info.SampleRate
+	item.AudioChannels = info.Channels
+	item.Probed = true
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadAudioTruncated(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{"mp3 tag header only", "ID3\x03", false},
+		{"mp3 tag past end", "ID3\x03\x00\x00\x7f\x7f\x7f\x7fTIT2", false},
+		{"mp3 extended header past end", "ID3\x03\x00\x40\x00\x00\x00\x08\xff\xff\xff\xff\x00\x00\x00\x00", false},
+		{"mp3 frame header only", "\xff\xfb\x90", false},
+		{"flac marker only", "fLaC", true},
+		{"flac block past end", "fLaC\x00\x00\x00\x22\x00\x00", true},
+		{"ogg page header only", "OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01", true},
+		{"ogg short segment", "OggS" + "0000000000000000000000" + "\b00000000", true},
+		{"ogg identification only", "OggS\x00\x02\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x08OpusHead", true},
+		{"m4a ftyp only", "\x00\x00\x00\x08ftyp", false},
+		{"m4a box past end", "\x00\x00\x00\x08ftyp\x00\x00\x10\x00moov\x00\x00", false},
+		{"m4a huge large size", "\x00\x00\x00\x08ftyp\x00\x00\x00\x01moov\x7f\xff\xff\xff\xff\xff\xff\xff", false},
+		{"m4a truncated mvhd", "\x00\x00\x00\x08ftyp\x00\x00\x00\x14moov\x00\x00\x00\x0cmvhd\x01\x00\x00\x00", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "track")
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := readAudio(path)
+			if tt.wantErr && err == nil {
+				t.Errorf("readAudio(%q) succeeded, want an error", tt.data)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of a packet's first
+// byte.
+const (
+	mqttConnect = 1
+	mqttConnack = 2
+	mqttPublish = 3
+	mqttPuback  = 4
+)
+
+// mqttPublisher publishes events with QoS 1 to the topic <prefix>/<type>,
+// e.g. for Home Assistant automations. Events are published on a single
+// connection, each after the broker acknowledged the last.
+type mqttPublisher struct {
+	addr     string
+	tls      bool
+	clientID string
+	username string
+	password *string
+	prefix   string
+
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+func newMQTTPublisher(u *url.URL, c SinkConfig) (*mqttPublisher, error) {
+	p := &mqttPublisher{
+		addr:     u.Host,
+		tls:      u.Scheme == "mqtts",
+		clientID: "media-organizer-" + c.Name,
+		prefix:   strings.TrimSuffix(c.Topic, "/"),
+	}
+	if u.Port() == "" {
+		if p.tls {
+			p.addr = net.JoinHostPort(u.Hostname(), "8883")
+		} else {
+			p.addr = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	}
+	if u.User != nil {
+		p.username = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			p.password = &password
+		}
+	}
+	return p, nil
+}
+
+// dialBroker connects to a broker, over TLS if asked to.
+func dialBroker(addr string, useTLS bool) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: sinkTimeout}
+	if useTLS {
+		return tls.DialWithDialer(dialer, "tcp", addr, nil)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// connect opens a clean session without keep alive, so an idle connection
+// is never dropped by the broker.
+func (p *mqttPublisher) connect() error {
+	conn, err := dialBroker(p.addr, p.tls)
+	if err != nil {
+		return err
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(sinkTimeout))
+
+	flags := byte(0x02)
+	payload := mqttString(p.clientID)
+	if p.username != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(p.username)...)
+		if p.password != nil {
+			flags |= 0x40
+			payload = append(payload, mqttString(*p.password)...)
+		}
+	}
+	body := append(mqttString("MQTT"), 4, flags, 0, 0)
+	if err := p.write(mqttConnect<<4, append(body, payload...)); err != nil {
+		return err
+	}
+
+	typ, ack, err := p.read()
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(ack) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", typ)
+	}
+	if ack[1] != 0 {
+		return fmt.Errorf("connection refused by broker, return code %d", ack[1])
+	}
+	return nil
+}
+
+func (p *mqttPublisher) publish(e *outboxEvent, body []byte) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			p.close()
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(sinkTimeout))
+
+	// Packet IDs must not be zero
+	if p.packetID++; p.packetID == 0 {
+		p.packetID = 1
+	}
+	packet := mqttString(p.prefix + "/" + e.Type)
+	packet = binary.BigEndian.AppendUint16(packet, p.packetID)
+	if err := p.write(mqttPublish<<4|0x02, append(packet, body...)); err != nil {
+		return err
+	}
+
+	for {
+		typ, ack, err := p.read()
+		if err != nil {
+			return err
+		}
+		if typ == mqttPuback && len(ack) == 2 && binary.BigEndian.Uint16(ack) == p.packetID {
+			return nil
+		}
+	}
+}
+
+func (p *mqttPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.r = nil, nil
+	}
+}
+
+// write sends a packet with its remaining length.
+func (p *mqttPublisher) write(header byte, body []byte) error {
+	packet := []byte{header}
+	for n := len(body); ; {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := p.conn.Write(append(packet, body...))
+	return err
+}
+
+// read reads a packet and returns its type and body.
+func (p *mqttPublisher) read() (byte, []byte, error) {
+	header, err := p.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, shift := 0, 0
+	for {
+		b, err := p.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7f) << shift
+		if b&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(p.r, body); err != nil {
+		return 0, nil, err
+	}
+	return header >> 4, body, nil
+}
+
+// mqttString encodes a string as MQTT does, prefixed by its length.
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+// natsPublisher publishes events to the subject <prefix>.<type>. Each is
+// followed by a PING, and counts as delivered once the server's PONG shows
+// it was processed.
+type natsPublisher struct {
+	addr     string
+	username string
+	password string
+	token    string
+	prefix   string
+
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATSPublisher(u *url.URL, c SinkConfig) (*natsPublisher, error) {
+	p := &natsPublisher{addr: u.Host, prefix: strings.TrimSuffix(c.Topic, ".")}
+	if u.Port() == "" {
+		p.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		// A user without a password is a token, as in NATS client URLs
+		if password, ok := u.User.Password(); ok {
+			p.username, p.password = u.User.Username(), password
+		} else {
+			p.token = u.User.Username()
+		}
+	}
+	return p, nil
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := dialBroker(p.addr, false)
+	if err != nil {
+		return err
+	}
+	p.conn, p.r = conn, bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(sinkTimeout))
+
+	line, err := p.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return fmt.Errorf("expected INFO, got %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		return err
+	}
+	if info.TLSRequired {
+		return errors.New("server requires TLS, which is not supported")
+	}
+
+	options, err := json.Marshal(struct {
+		Verbose  bool   `json:"verbose"`
+		Pedantic bool   `json:"pedantic"`
+		Name     string `json:"name"`
+		Lang     string `json:"lang"`
+		User     string `json:"user,omitempty"`
+		Pass     string `json:"pass,omitempty"`
+		Token    string `json:"auth_token,omitempty"`
+	}{Name: "media-organizer", Lang: "go", User: p.username, Pass: p.password, Token: p.token})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", options); err != nil {
+		return err
+	}
+	return p.awaitPong()
+}
+
+func (p *natsPublisher) publish(e *outboxEvent, body []byte) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			p.close()
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(sinkTimeout))
+
+	subject := p.prefix + "." + e.Type
+	if _, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\nPING\r\n", subject, len(body), body); err != nil {
+		return err
+	}
+	return p.awaitPong()
+}
+
+// awaitPong reads until the server answers a PING, answering its own PINGs
+// meanwhile.
+func (p *natsPublisher) awaitPong() error {
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(p.conn, "PONG\r\n"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(line[len("-ERR"):]))
+		}
+	}
+}
+
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.r = nil, nil
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bulkOperations are the operations POST /api/media/bulk performs.
+var bulkOperations = map[string]bool{
+	"add_tags":      true,
+	"remove_tags":   true,
+	"set_rating":    true,
+	"set_organized": true,
+	"delete":        true,
+	"move":          true,
+}
+
+const actionBulkMedia = "bulk_media"
+
+// bulkPlan is what a bulk confirmation token executes: the previewed
+// items, and the operation and folder it was previewed with.
+type bulkPlan struct {
+	Operation string `json:"operation"`
+	IDs       []int  `json:"ids"`
+	Folder    string `json:"folder"`
+}
+
+// bulkRequest is an operation on many items, selected by IDs, a filter or
+// both. Tags are for add_tags and remove_tags, Rating is the content
+// rating set_rating gives, Organized the state set_organized gives, and
+// Folder the directory move puts the files in. Token confirms a previewed
+// delete or move, and replaces the rest of the request.
+type bulkRequest struct {
+	IDs       []int        `json:"ids"`
+	Filter    *MediaFilter `json:"filter"`
+	Operation string       `json:"operation"`
+	Tags      []string     `json:"tags"`
+	Rating    *string      `json:"rating"`
+	Organized *bool        `json:"organized"`
+	Folder    string       `json:"folder"`
+	Token     string       `json:"token"`
+}
+
+// validate checks the request, cleaning up its tag names.
+func (req *bulkRequest) validate() error {
+	// An empty filter matches everything, so it has to be given explicitly
+	if len(req.IDs) == 0 && req.Filter == nil {
+		return fmt.Errorf("ids or filter is required")
+	}
+	if !bulkOperations[req.Operation] {
+		return fmt.Errorf("unknown operation %q: use add_tags, remove_tags, set_rating, set_organized, delete or move", req.Operation)
+	}
+
+	switch req.Operation {
+	case "add_tags", "remove_tags":
+		if len(req.Tags) == 0 {
+			return fmt.Errorf("tags is required")
+		}
+		for i, tag := range req.Tags {
+			name, err := tagName(tag)
+			if err != nil {
+				return err
+			}
+			req.Tags[i] = name
+		}
+	case "set_rating":
+		if req.Rating == nil {
+			return fmt.Errorf("rating is required; use \"\" to clear it")
+		}
+	case "set_organized":
+		if req.Organized == nil {
+			return fmt.Errorf("organized is required")
+		}
+	case "move":
+		if !filepath.IsAbs(req.Folder) {
+			return fmt.Errorf("folder must be an absolute path")
+		}
+		req.Folder = filepath.Clean(req.Folder)
+	}
+	return nil
+}
+
+// applyBulk performs a tag, rating or review operation on the items in one
+// transaction.
+func (app *App) applyBulk(req *bulkRequest, items []MediaItem) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, item := range items {
+		switch req.Operation {
+		case "add_tags":
+			for _, tag := range req.Tags {
+				if err := tagMedia(tx, item.ID, tag); err != nil {
+					return err
+				}
+			}
+		case "remove_tags":
+			for _, tag := range req.Tags {
+				_, err := tx.Exec(
+					`DELETE FROM media_tags WHERE media_id = ? AND tag_id IN (
+						SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ?)`,
+					item.ID, tag, tag,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		case "set_rating":
+			var age *int
+			if a, ok := ratingAge(*req.Rating); ok {
+				age = &a
+			}
+			if _, err := tx.Exec("UPDATE media SET content_rating = ?, rating_age = ? WHERE id = ?", *req.Rating, age, item.ID); err != nil {
+				return err
+			}
+		case "set_organized":
+			if _, err := tx.Exec("UPDATE media SET organized = ? WHERE id = ?", *req.Organized, item.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// bulkMedia performs one operation on many items at once. Tag and rating
+// changes are made in one transaction, deletes move the items to the trash
+// in one, and moves run as one move batch, so each operation happens to
+// all of the items or none of them. Locked items are left out. Deletes and
+// moves work like a bulk delete: the first request only previews them and
+// returns a token, and repeating it with the token carries them out.
+func (app *App) bulkMedia(w http.ResponseWriter, r *http.Request) {
+	var req bulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	confirmed := req.Token != ""
+	if confirmed {
+		var plan bulkPlan
+		err := app.redeemConfirmation(req.Token, actionBulkMedia, &plan)
+		if err == errInvalidConfirmation {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to redeem confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		req = bulkRequest{IDs: plan.IDs, Operation: plan.Operation, Folder: plan.Folder}
+	} else if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := app.selectMedia(req.IDs, req.Filter)
+	if err != nil {
+		log.Error("Failed to select media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var unlocked []MediaItem
+	var ids []int
+	locked := 0
+	for _, item := range items {
+		if item.Locked {
+			locked++
+			continue
+		}
+		unlocked = append(unlocked, item)
+		ids = append(ids, item.ID)
+	}
+
+	result := map[string]interface{}{
+		"success":   true,
+		"operation": req.Operation,
+		"matched":   len(items),
+		"locked":    locked,
+	}
+
+	if (req.Operation == "delete" || req.Operation == "move") && !confirmed {
+		app.previewBulk(w, r, &req, unlocked, result)
+		return
+	}
+
+	switch req.Operation {
+	case "delete":
+		deleted, err := app.trashMediaItems(ids, false)
+		if err != nil {
+			log.Error("Failed to delete media items:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result["changed"] = deleted
+
+	case "move":
+		var moves []moveRequest
+		for _, item := range unlocked {
+			if dst := filepath.Join(req.Folder, filepath.Base(item.Path)); dst != item.Path {
+				moves = append(moves, moveRequest{ID: item.ID, Path: dst})
+			}
+		}
+		result["changed"] = 0
+		if len(moves) > 0 {
+			batch, err := app.planMoves(moves)
+			var moveErr moveError
+			if errors.As(err, &moveErr) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			}
+			if err == nil {
+				batch, err = app.runBatch(batch)
+			}
+			if err != nil {
+				log.Error("Failed to move media items:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			result["success"] = batch.Status == moveCompleted
+			result["batch"] = batch
+			if batch.Status == moveCompleted {
+				result["changed"] = len(moves)
+			}
+		}
+
+	default:
+		if err := app.applyBulk(&req, unlocked); err != nil {
+			log.Error("Failed to update media items:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		result["changed"] = len(unlocked)
+		for i := range unlocked {
+			item := &unlocked[i]
+			if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err == nil {
+				app.writeBack(item)
+			}
+		}
+	}
+
+	log.Infof("Bulk %s on %v media items", req.Operation, result["changed"])
+	app.writeJSON(w, r, http.StatusOK, result)
+}
+
+// previewBulk answers a delete or move without a token: it lists the
+// items that would change and issues the token that changes them.
+// Nothing is deleted or moved by this request.
+func (app *App) previewBulk(w http.ResponseWriter, r *http.Request, req *bulkRequest, items []MediaItem, preview map[string]interface{}) {
+	var ids []int
+	var size int64
+	for _, item := range items {
+		ids = append(ids, item.ID)
+		size += item.Size
+	}
+
+	sample := items
+	if len(sample) > deleteSampleSize {
+		sample = sample[:deleteSampleSize]
+	}
+	delete(preview, "success")
+	preview["count"] = len(ids)
+	preview["size"] = size
+	preview["sample"] = append([]MediaItem{}, sample...)
+
+	// The token is bound to the previewed IDs, so items matching the
+	// filter by the time it is used are not changed unseen
+	if len(ids) > 0 {
+		token, expires, err := app.issueConfirmation(actionBulkMedia, bulkPlan{req.Operation, ids, req.Folder})
+		if err != nil {
+			log.Error("Failed to issue confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		preview["token"] = token
+		preview["expires_at"] = expires
+	}
+
+	app.writeJSON(w, r, http.StatusOK, preview)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Tool is an optional external binary, and where it was found.
+type Tool struct {
+	Available bool   `json:"available"`
+	Path      string `json:"path,omitempty"`
+}
+
+func tool(path string) Tool {
+	return Tool{Available: path != "", Path: path}
+}
+
+// getCapabilities reports which of the optional binaries were found at
+// startup and which features are active as a result, so clients can hide
+// the controls of features that would only fail.
+func (app *App) getCapabilities(w http.ResponseWriter, r *http.Request) {
+	workers := len(app.Config.Thumbnails.Workers) > 0
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"tools": map[string]Tool{
+			"ffprobe":   tool(app.FFprobe),
+			"ffmpeg":    tool(app.FFmpeg),
+			"pdfinfo":   tool(app.PDF.Info),
+			"pdftotext": tool(app.PDF.Text),
+			"pdftoppm":  tool(app.PDF.Render),
+			"unrar":     tool(app.Unrar),
+			"exiftool":  tool(app.ExifTool),
+		},
+		"features": map[string]bool{
+			"video_metadata":     app.FFprobe != "",
+			"video_fingerprints": app.FFmpeg != "",
+			"video_thumbnails":   app.FFmpeg != "" || workers,
+			"thumbnail_workers":  workers,
+			"pdf_page_counts":    app.PDF.Info != "",
+			"pdf_text":           app.PDF.Text != "",
+			"pdf_thumbnails":     app.PDF.Render != "",
+			"cbr_comics":         app.Unrar != "",
+			"write_metadata":     app.ExifTool != "",
+			"geocoding":          app.Geocoder != nil,
+		},
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 5000
+)
+
+type mediaChange struct {
+	Seq     int64  `db:"seq"`
+	MediaID int    `db:"media_id"`
+	Op      string `db:"op"`
+}
+
+// getMediaChanges returns the items created, updated and deleted since the
+// given cursor. Clients start without a cursor, store the one returned and
+// keep polling with it; has_more means another page is available right away.
+func (app *App) getMediaChanges(w http.ResponseWriter, r *http.Request) {
+	var since int64
+	if v := r.URL.Query().Get("since"); v != "" {
+		var err error
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+
+	limit := defaultChangesLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < maxChangesLimit {
+			limit = n
+		} else {
+			limit = maxChangesLimit
+		}
+	}
+
+	var changes []mediaChange
+	err := app.DB.Select(&changes,
+		"SELECT seq, media_id, op FROM media_changes WHERE seq > ? ORDER BY seq LIMIT ?",
+		since, limit,
+	)
+	if err != nil {
+		log.Error("Failed to fetch media changes:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Collapse the log to one entry per item: whether the client has seen it
+	// before (its first change in this window wasn't the creation) and the
+	// last thing that happened to it.
+	cursor := since
+	isNew := make(map[int]bool)
+	last := make(map[int]string)
+	var order []int
+	for _, c := range changes {
+		cursor = c.Seq
+		if _, seen := last[c.MediaID]; !seen {
+			order = append(order, c.MediaID)
+			isNew[c.MediaID] = c.Op == "created"
+		}
+		last[c.MediaID] = c.Op
+	}
+
+	deleted := []int{}
+	var live []int
+	for _, id := range order {
+		if last[id] != "deleted" {
+			live = append(live, id)
+		} else if !isNew[id] {
+			deleted = append(deleted, id)
+		}
+	}
+
+	created := []MediaDetail{}
+	updated := []MediaDetail{}
+	if len(live) > 0 {
+		var items []MediaItem
+		query, args, err := sqlx.In("SELECT * FROM media WHERE id IN (?)", live)
+		if err == nil {
+			err = app.DB.Select(&items, app.DB.Rebind(query), args...)
+		}
+		if err != nil {
+			log.Error("Failed to fetch changed media items:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		details, err := app.mediaDetails(items, mediaRelations)
+		if err != nil {
+			log.Error("Failed to fetch media details:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		byID := make(map[int]MediaDetail, len(details))
+		for _, d := range details {
+			byID[d.ID] = d
+		}
+
+		// Items missing here were deleted after this window; a later page
+		// reports them
+		for _, id := range live {
+			d, ok := byID[id]
+			if !ok {
+				continue
+			}
+			if isNew[id] {
+				created = append(created, d)
+			} else {
+				updated = append(updated, d)
+			}
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"created":  created,
+		"updated":  updated,
+		"deleted":  deleted,
+		"cursor":   strconv.FormatInt(cursor, 10),
+		"has_more": len(changes) == limit,
+	})
+}
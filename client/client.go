@@ -0,0 +1,284 @@
+// Package client is a Go client for the Media Organizer REST API.
+//
+//	c := client.New("http://nas.local:9999")
+//	videos, err := c.ListMedia(ctx, &client.ListOptions{Type: "video"})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Client talks to a Media Organizer server.
+type Client struct {
+	// BaseURL is the server's address, e.g. "http://localhost:9999".
+	BaseURL string
+	// HTTPClient is used for requests; nil means http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// New returns a client for the server at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/")}
+}
+
+// Error is returned for responses with a non-2xx status.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("media organizer: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// ListOptions filters and orders ListMedia results. The zero value lists
+// everything, newest first.
+type ListOptions struct {
+	Type    string
+	Query   string
+	MinSize int64
+	MaxSize int64
+	// Sort is "created_at", "date", "filename", "filename_natural", "size"
+	// or "duration".
+	Sort string
+}
+
+func (o *ListOptions) values() url.Values {
+	v := url.Values{}
+	if o == nil {
+		return v
+	}
+	if o.Type != "" {
+		v.Set("type", o.Type)
+	}
+	if o.Query != "" {
+		v.Set("q", o.Query)
+	}
+	if o.MinSize > 0 {
+		v.Set("min_size", strconv.FormatInt(o.MinSize, 10))
+	}
+	if o.MaxSize > 0 {
+		v.Set("max_size", strconv.FormatInt(o.MaxSize, 10))
+	}
+	if o.Sort != "" {
+		v.Set("sort", o.Sort)
+	}
+	return v
+}
+
+// ListMedia returns the media items matching opts.
+func (c *Client) ListMedia(ctx context.Context, opts *ListOptions) ([]Media, error) {
+	var items []Media
+	err := c.do(ctx, http.MethodGet, "/api/media?"+opts.values().Encode(), nil, &items)
+	return items, err
+}
+
+// ListMediaPage returns up to limit of the media items matching opts,
+// skipping the first offset, with the total number of matching items. The
+// server caps limit at 1000.
+func (c *Client) ListMediaPage(ctx context.Context, opts *ListOptions, offset, limit int) (*MediaPage, error) {
+	v := opts.values()
+	v.Set("limit", strconv.Itoa(limit))
+	v.Set("offset", strconv.Itoa(offset))
+	var page MediaPage
+	if err := c.do(ctx, http.MethodGet, "/api/media?"+v.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// ListMediaAfter returns up to limit of the media items matching opts,
+// newest first, following the page whose NextCursor is cursor; an empty
+// cursor starts at the newest item. Unlike offsets, cursors stay fast deep
+// into large libraries, so walk the whole library with them:
+//
+//	for cursor := ""; ; {
+//		page, err := c.ListMediaAfter(ctx, nil, cursor, 1000)
+//		...
+//		if !page.HasMore {
+//			break
+//		}
+//		cursor = page.NextCursor
+//	}
+//
+// opts can't set another Sort.
+func (c *Client) ListMediaAfter(ctx context.Context, opts *ListOptions, cursor string, limit int) (*MediaPage, error) {
+	v := opts.values()
+	v.Set("cursor", cursor)
+	v.Set("limit", strconv.Itoa(limit))
+	var page MediaPage
+	if err := c.do(ctx, http.MethodGet, "/api/media?"+v.Encode(), nil, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// GetMedia returns a media item with its aliases.
+func (c *Client) GetMedia(ctx context.Context, id int) (*Media, error) {
+	var item Media
+	if err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/media/%d", id), nil, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// ImportFile adds the file at path, which must be absolute on the server, to
+// the library. Importing a path that is already in the library returns the
+// existing item.
+func (c *Client) ImportFile(ctx context.Context, path string) (*Media, error) {
+	var item Media
+	body := map[string]string{"path": path}
+	if err := c.do(ctx, http.MethodPost, "/api/media/import", body, &item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Scan scans a directory on the server and waits for it to finish.
+func (c *Client) Scan(ctx context.Context, req ScanRequest) (*ScanResult, error) {
+	var result ScanResult
+	if err := c.do(ctx, http.MethodPost, "/api/scan", req, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// Scans returns the scan history, newest first.
+func (c *Client) Scans(ctx context.Context) ([]Scan, error) {
+	var scans []Scan
+	err := c.do(ctx, http.MethodGet, "/api/scans", nil, &scans)
+	return scans, err
+}
+
+// ScanErrors returns the paths a scan couldn't handle.
+func (c *Client) ScanErrors(ctx context.Context, id int) ([]ScanError, error) {
+	var scanErrors []ScanError
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/scans/%d/errors", id), nil, &scanErrors)
+	return scanErrors, err
+}
+
+// Stats returns the library statistics.
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	if err := c.do(ctx, http.MethodGet, "/api/stats", nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// CompareStats returns the library statistics with a comparison of the
+// current period with the previous one; period is "day", "week", "month"
+// or "year".
+func (c *Client) CompareStats(ctx context.Context, period string) (*Stats, error) {
+	var stats Stats
+	path := "/api/stats?compare=" + url.QueryEscape(period)
+	if err := c.do(ctx, http.MethodGet, path, nil, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// VideoDuplicates returns the pairs of fingerprinted videos whose frames
+// have at least minSimilarity, from 0 to 1, of their bits in common; zero
+// uses the server's default.
+func (c *Client) VideoDuplicates(ctx context.Context, minSimilarity float64) ([]VideoDuplicate, error) {
+	path := "/api/media/duplicates"
+	if minSimilarity > 0 {
+		path += "?min_similarity=" + strconv.FormatFloat(minSimilarity, 'f', -1, 64)
+	}
+	var duplicates []VideoDuplicate
+	err := c.do(ctx, http.MethodGet, path, nil, &duplicates)
+	return duplicates, err
+}
+
+// Tag tags a media item by tag name or alias, creating the tag if the name
+// is new, and returns the item's tags.
+func (c *Client) Tag(ctx context.Context, id int, name string) ([]string, error) {
+	var tags []string
+	err := c.do(ctx, http.MethodPut, fmt.Sprintf("/api/media/%d/tags/%s", id, url.PathEscape(name)), nil, &tags)
+	return tags, err
+}
+
+// Untag removes a tag, by name or alias, from a media item and returns the
+// item's tags.
+func (c *Client) Untag(ctx context.Context, id int, name string) ([]string, error) {
+	var tags []string
+	err := c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/media/%d/tags/%s", id, url.PathEscape(name)), nil, &tags)
+	return tags, err
+}
+
+// DeleteMedia moves media items to the trash, previewing the delete and
+// confirming it with the preview's token. Locked items are kept, and files
+// on disk are left alone. It returns how many items were removed.
+func (c *Client) DeleteMedia(ctx context.Context, ids []int) (int, error) {
+	var preview struct {
+		Count int    `json:"count"`
+		Token string `json:"token"`
+	}
+	body := map[string][]int{"ids": ids}
+	if err := c.do(ctx, http.MethodPost, "/api/media/delete/preview", body, &preview); err != nil {
+		return 0, err
+	}
+	if preview.Count == 0 {
+		return 0, nil
+	}
+
+	var result struct {
+		Deleted int `json:"deleted"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/media/delete", map[string]string{"token": preview.Token}, &result)
+	return result.Deleted, err
+}
+
+// do sends a request with body encoded as JSON and decodes the response
+// into out.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	// The types in this package use the default field names and times,
+	// whatever the server is configured to send
+	req.Header.Set("Accept-Profile", "snake, rfc3339")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,247 @@
+package client
+
+import "time"
+
+// Media is a media item in the library.
+type Media struct {
+	ID       int    `json:"id"`
+	Path     string `json:"path"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Type     string `json:"type"`
+	// MimeType is sniffed from the file's content.
+	MimeType   string    `json:"mime_type"`
+	CreatedAt  time.Time `json:"created_at"`
+	Checksum   string    `json:"checksum"`
+	Oshash     string    `json:"oshash"`
+	ArtworkURL string    `json:"artwork_url"`
+	Locked     bool      `json:"locked"`
+	// Organized items have been reviewed, and leave the review queue.
+	Organized bool `json:"organized"`
+	// FileModTime and FileBirthTime are the file's own times, if known.
+	FileModTime   *time.Time `json:"file_mod_time"`
+	FileBirthTime *time.Time `json:"file_birth_time"`
+	// VerifiedAt is when an item of an immutable library last matched its
+	// checksum.
+	VerifiedAt *time.Time `json:"verified_at"`
+	// Video metadata, if the server has ffprobe.
+	Duration   float64 `json:"duration"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	VideoCodec string  `json:"video_codec"`
+	AudioCodec string  `json:"audio_codec"`
+	Bitrate    int64   `json:"bitrate"`
+	FrameRate  float64 `json:"frame_rate"`
+	Container  string  `json:"container"`
+	Projection string  `json:"projection"`
+	HDR        string  `json:"hdr"`
+	StereoMode string  `json:"stereo_mode"`
+	// Color description, e.g. "bt2020" primaries, and bits per component.
+	ColorPrimaries string `json:"color_primaries"`
+	ColorTransfer  string `json:"color_transfer"`
+	ColorSpace     string `json:"color_space"`
+	BitDepth       int    `json:"bit_depth"`
+	// IsAnimated is set for images with more than one frame.
+	IsAnimated bool `json:"is_animated"`
+	Frames     int  `json:"frames"`
+	// Orientation is the EXIF orientation of an image, 0 if it has none.
+	Orientation int `json:"orientation"`
+	// Audio tracks; AudioLanguages is comma separated.
+	AudioTracks    int    `json:"audio_tracks"`
+	AudioChannels  int    `json:"audio_channels"`
+	ChannelLayout  string `json:"channel_layout"`
+	SampleRate     int    `json:"sample_rate"`
+	AudioLanguages string `json:"audio_languages"`
+	// Extra is "sample" or "trailer" for videos belonging to ParentID.
+	Extra    string `json:"extra"`
+	ParentID *int   `json:"parent_id"`
+	// GPS position and place of a photo, if known.
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Country   string   `json:"country"`
+	City      string   `json:"city"`
+	// TakenAt comes from Google Takeout sidecars, Title and Year from the
+	// NFO files of videos, Description from either. Title, Artist and
+	// Album of audio files come from their tags.
+	TakenAt     *time.Time `json:"taken_at"`
+	Description string     `json:"description"`
+	Title       string     `json:"title"`
+	Year        int        `json:"year"`
+	Artist      string     `json:"artist"`
+	Album       string     `json:"album"`
+	// Pages is the page count of a document or comic.
+	Pages int `json:"pages"`
+	// ContentRating comes from the NFO files of videos, e.g. "PG-13",
+	// and RatingAge is its minimum age, nil if unknown.
+	ContentRating string `json:"content_rating"`
+	RatingAge     *int   `json:"rating_age"`
+	// Sharpness is the sharpness score of an image, nil until analyzed.
+	Sharpness *float64 `json:"sharpness"`
+	// PHash is the perceptual hash of an image that near-duplicates are
+	// found by.
+	PHash string `json:"phash"`
+	// Aliases, Flags, People, Genres and Tags are only filled in by
+	// GetMedia.
+	Aliases []Alias  `json:"aliases,omitempty"`
+	Flags   []Flag   `json:"flags,omitempty"`
+	People  []string `json:"people,omitempty"`
+	Genres  []string `json:"genres,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+	// Attributes are custom key-value fields, also only filled in by
+	// GetMedia.
+	Attributes map[string]string `json:"attributes,omitempty"`
+	// Attachments are the auxiliary files attached to the item, also only
+	// filled in by GetMedia.
+	Attachments []Attachment `json:"attachments,omitempty"`
+}
+
+// MediaPage is a page of media items, as returned by ListMediaPage and
+// ListMediaAfter.
+type MediaPage struct {
+	Items []Media `json:"items"`
+	// Total is the number of items matching the options, across all
+	// pages. Cursor pages aren't counted, and leave it and Offset zero.
+	Total   int  `json:"total"`
+	Limit   int  `json:"limit"`
+	Offset  int  `json:"offset"`
+	HasMore bool `json:"has_more"`
+	// NextCursor is where the page after a cursor page starts, empty
+	// after the last one.
+	NextCursor string `json:"next_cursor"`
+}
+
+// Alias is another filename or path a media item has been known by.
+type Alias struct {
+	ID        int       `json:"id"`
+	MediaID   int       `json:"media_id"`
+	Filename  string    `json:"filename"`
+	Path      string    `json:"path"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Attachment is an auxiliary file attached to a media item, such as a
+// receipt or an alternate edit.
+type Attachment struct {
+	ID          int       `json:"id"`
+	MediaID     int       `json:"media_id"`
+	Filename    string    `json:"filename"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Flag is a flag set on a media item, e.g. "corrupt" or "needs_review".
+type Flag struct {
+	MediaID   int       `json:"media_id"`
+	Flag      string    `json:"flag"`
+	Source    string    `json:"source"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ScanRequest starts a scan. Nil fields use the server's defaults.
+type ScanRequest struct {
+	Path              string   `json:"path"`
+	MinSize           *int64   `json:"min_size,omitempty"`
+	MaxSize           *int64   `json:"max_size,omitempty"`
+	SkipHidden        *bool    `json:"skip_hidden,omitempty"`
+	MaxFilesPerSecond *float64 `json:"max_files_per_second,omitempty"`
+	IdlePriority      *bool    `json:"idle_priority,omitempty"`
+}
+
+// ScanResult is the outcome of a finished scan. Moved counts the items
+// whose file was found at a new path and followed there.
+type ScanResult struct {
+	ScanID      int              `json:"scan_id"`
+	Added       int              `json:"count"`
+	Moved       int              `json:"moved"`
+	Skipped     int              `json:"skipped"`
+	Errors      int              `json:"errors"`
+	Directories []ScanDirSummary `json:"directories"`
+	Message     string           `json:"message"`
+}
+
+// ScanDirSummary counts what a scan did in one top-level directory.
+type ScanDirSummary struct {
+	Directory string `json:"directory"`
+	Added     int    `json:"added"`
+	Moved     int    `json:"moved"`
+	Skipped   int    `json:"skipped"`
+	Errors    int    `json:"errors"`
+}
+
+// Scan is an entry of the scan history.
+type Scan struct {
+	ID         int        `json:"id"`
+	Path       string     `json:"path"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	Added      int        `json:"added"`
+	Moved      int        `json:"moved"`
+	Skipped    int        `json:"skipped"`
+	Errors     int        `json:"errors"`
+	Error      string     `json:"error"`
+	Checkpoint string     `json:"checkpoint"`
+}
+
+// ScanError is a path a scan couldn't handle.
+type ScanError struct {
+	ID        int       `json:"id"`
+	ScanID    int       `json:"scan_id"`
+	Path      string    `json:"path"`
+	Error     string    `json:"error"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Stats are the library statistics.
+type Stats struct {
+	Total     int          `json:"total"`
+	Videos    int          `json:"videos"`
+	Images    int          `json:"images"`
+	Documents int          `json:"documents"`
+	RAWs      int          `json:"raws"`
+	Audio     int          `json:"audio"`
+	Comics    int          `json:"comics"`
+	Quotas    []QuotaUsage `json:"quotas"`
+	// Comparison is only filled in by CompareStats.
+	Comparison *StatsComparison `json:"comparison,omitempty"`
+}
+
+// StatsComparison compares the current day, week, month or year so far with
+// the whole previous one. Change is current minus previous.
+type StatsComparison struct {
+	Period   string       `json:"period"`
+	Current  PeriodStats  `json:"current"`
+	Previous PeriodStats  `json:"previous"`
+	Change   PeriodTotals `json:"change"`
+}
+
+// PeriodStats are the totals of a period, from Start up to End.
+type PeriodStats struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	PeriodTotals
+}
+
+// PeriodTotals count the items added to and deleted from the library, and
+// their sizes.
+type PeriodTotals struct {
+	Added        int   `json:"added"`
+	BytesAdded   int64 `json:"bytes_added"`
+	Deleted      int   `json:"deleted"`
+	BytesDeleted int64 `json:"bytes_deleted"`
+}
+
+// QuotaUsage is the space used by a library with a quota.
+type QuotaUsage struct {
+	Library string `json:"library"`
+	Used    int64  `json:"used"`
+	Quota   int64  `json:"quota"`
+}
+
+// VideoDuplicate is a pair of videos whose frames look alike, with the
+// share of their frame hash bits in common.
+type VideoDuplicate struct {
+	Similarity float64 `json:"similarity"`
+	Items      []Media `json:"items"`
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Collection is a named group of media items.
+type Collection struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Virtual collections are defined by a filter rather than membership.
+	Virtual bool `json:"virtual"`
+	// CoverID is the item shown for a stored collection, if one was picked.
+	CoverID *int `json:"cover_id,omitempty"`
+	Count   int  `json:"count"`
+}
+
+// slugify turns a collection name into a URL friendly ID, e.g.
+// "All 4K Videos" becomes "all-4k-videos".
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// virtualCollection returns the configured collection with the given ID, or
+// nil.
+func (app *App) virtualCollection(id string) *CollectionConfig {
+	for i := range app.Config.Collections {
+		if slugify(app.Config.Collections[i].Name) == id {
+			return &app.Config.Collections[i]
+		}
+	}
+	return nil
+}
+
+func (app *App) getCollections(w http.ResponseWriter, r *http.Request) {
+	collections := []Collection{}
+
+	for _, c := range app.Config.Collections {
+		filter := c.Filter
+		filter.profile = profileOf(r)
+		where, args := filter.where()
+
+		var count int
+		if err := app.DB.Get(&count, "SELECT COUNT(*) FROM media"+where, args...); err != nil {
+			log.Errorf("Failed to count collection %s: %v", c.Name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		collections = append(collections, Collection{
+			ID:          slugify(c.Name),
+			Name:        c.Name,
+			Description: c.Description,
+			Virtual:     true,
+			Count:       count,
+		})
+	}
+
+	var stored []storedCollection
+	if err := app.DB.Select(&stored, "SELECT * FROM collections ORDER BY name COLLATE NOCASE, id"); err != nil {
+		log.Error("Failed to fetch collections:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range stored {
+		c, err := app.presentCollection(r, &stored[i])
+		if err != nil {
+			log.Errorf("Failed to count collection %s: %v", stored[i].Name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		collections = append(collections, *c)
+	}
+
+	var smart []storedSmartCollection
+	if err := app.DB.Select(&smart, "SELECT * FROM smart_collections ORDER BY name COLLATE NOCASE, id"); err != nil {
+		log.Error("Failed to fetch smart collections:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range smart {
+		c, err := app.presentSmartCollection(r, &smart[i])
+		if err != nil {
+			log.Errorf("Failed to count smart collection %s: %v", smart[i].Name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		collections = append(collections, Collection{
+			ID:          c.ID,
+			Name:        c.Name,
+			Description: c.Description,
+			Virtual:     true,
+			Count:       c.Count,
+		})
+	}
+
+	app.writeJSON(w, r, http.StatusOK, collections)
+}
+
+// getCollectionMedia lists the items of a collection: those matching a
+// virtual or smart collection's filter, or a stored collection's members,
+// in their order unless ?sort is given.
+func (app *App) getCollectionMedia(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	c := app.virtualCollection(id)
+	if c == nil {
+		var err error
+		if c, err = app.smartCollection(id); err != nil {
+			log.Error("Failed to fetch smart collection:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	var stored int
+	if c == nil {
+		if err := app.DB.Get(&stored, "SELECT COUNT(*) FROM collections WHERE id = ?", id); err != nil {
+			log.Error("Failed to fetch collection:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if stored == 0 {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	sort := r.URL.Query().Get("sort")
+	order, err := orderBy(sort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	view, err := parseMediaView(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	view.profile = profileOf(r)
+	var query string
+	var args []interface{}
+	if c != nil {
+		filter := c.Filter
+		filter.profile = view.profile
+		var where string
+		where, args = filter.where()
+		query = "SELECT * FROM media" + where + order
+	} else {
+		query, args = "SELECT media.* FROM media JOIN collection_items ci ON ci.media_id = media.id WHERE ci.collection_id = ?", []interface{}{id}
+		if view.profile != nil {
+			cond, condArgs := view.profile.where()
+			query += " AND " + cond
+			args = append(args, condArgs...)
+		}
+		if sort == "" {
+			order = " ORDER BY ci.position, ci.media_id"
+		}
+		query += order
+	}
+
+	items := []MediaItem{}
+	err = app.DB.Select(&items, query, args...)
+	if err != nil {
+		log.Error("Failed to fetch collection media:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sortMedia(items, sort)
+
+	out, err := app.presentMedia(items, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, out)
+}
+
+// errVirtualCollection is the error for changes to virtual collections.
+const errVirtualCollection = "Virtual collections are defined in config.json"
+
+// storedCollection is a collection created through the API. Items are
+// added to it by hand and kept in the order they were added or rearranged
+// into, independent of where their files are.
+type storedCollection struct {
+	ID          string    `db:"id"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	CoverID     *int      `db:"cover_id"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// storedCollectionFromURL loads the stored collection identified by the {id}
+// URL parameter, writing an error response and returning nil if it can't.
+func (app *App) storedCollectionFromURL(w http.ResponseWriter, r *http.Request) *storedCollection {
+	id := chi.URLParam(r, "id")
+	var c storedCollection
+	err := app.DB.Get(&c, "SELECT * FROM collections WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		if app.virtualCollection(id) != nil {
+			http.Error(w, errVirtualCollection, http.StatusConflict)
+		} else if smart, _ := app.smartCollection(id); smart != nil {
+			http.Error(w, errSmartCollection, http.StatusConflict)
+		} else {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+		}
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return &c
+}
+
+// presentCollection returns a stored collection as listed, counting the members the
+// profile of the request can see.
+func (app *App) presentCollection(r *http.Request, c *storedCollection) (*Collection, error) {
+	query, args := "SELECT COUNT(*) FROM collection_items WHERE collection_id = ?", []interface{}{c.ID}
+	if res := profileOf(r); res != nil {
+		cond, condArgs := res.where()
+		query += " AND media_id IN (SELECT id FROM media WHERE " + cond + ")"
+		args = append(args, condArgs...)
+	}
+
+	out := &Collection{ID: c.ID, Name: c.Name, Description: c.Description, CoverID: c.CoverID}
+	if err := app.DB.Get(&out.Count, query, args...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// checkMediaIDs returns an error naming the first of ids that isn't an item.
+func (app *App) checkMediaIDs(ids []int) error {
+	for _, id := range ids {
+		var n int
+		if err := app.DB.Get(&n, "SELECT COUNT(*) FROM media WHERE id = ?", id); err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("media item %d not found", id)
+		}
+	}
+	return nil
+}
+
+// createCollection creates a collection. Its ID is derived from its name
+// like those of virtual collections, and stays the same if it is renamed.
+func (app *App) createCollection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		CoverID     *int   `json:"cover_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := storedCollection{
+		ID:          slugify(req.Name),
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		CoverID:     req.CoverID,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if c.ID == "" {
+		http.Error(w, "Name must contain letters or digits", http.StatusBadRequest)
+		return
+	}
+	taken, err := app.collectionIDTaken(c.ID)
+	if err != nil {
+		log.Error("Failed to create collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "A collection with this ID already exists", http.StatusConflict)
+		return
+	}
+	if c.CoverID != nil {
+		if err := app.checkMediaIDs([]int{*c.CoverID}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := app.DB.NamedExec(
+		`INSERT OR IGNORE INTO collections (id, name, description, cover_id, created_at)
+			VALUES (:id, :name, :description, :cover_id, :created_at)`,
+		c,
+	)
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err != nil {
+		log.Error("Failed to create collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "A collection with this ID already exists", http.StatusConflict)
+		return
+	}
+
+	log.Infof("Created collection %s", c.ID)
+	app.writeJSON(w, r, http.StatusCreated, &Collection{ID: c.ID, Name: c.Name, Description: c.Description, CoverID: c.CoverID})
+}
+
+// updateCollection renames a collection, or changes its description or
+// cover. A cover_id of 0 removes the cover.
+func (app *App) updateCollection(w http.ResponseWriter, r *http.Request) {
+	c := app.storedCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+
+	var req struct {
+		Name        *string `json:"name"`
+		Description *string `json:"description"`
+		CoverID     *int    `json:"cover_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		if slugify(*req.Name) == "" {
+			http.Error(w, "Name must contain letters or digits", http.StatusBadRequest)
+			return
+		}
+		c.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Description != nil {
+		c.Description = *req.Description
+	}
+	if req.CoverID != nil {
+		c.CoverID = nil
+		if *req.CoverID != 0 {
+			if err := app.checkMediaIDs([]int{*req.CoverID}); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			c.CoverID = req.CoverID
+		}
+	}
+
+	_, err := app.DB.NamedExec(
+		"UPDATE collections SET name = :name, description = :description, cover_id = :cover_id WHERE id = :id", c)
+	if err != nil {
+		log.Error("Failed to update collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := app.presentCollection(r, c)
+	if err != nil {
+		log.Error("Failed to count collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, out)
+}
+
+// deleteCollection deletes a collection. Its items stay in the library.
+func (app *App) deleteCollection(w http.ResponseWriter, r *http.Request) {
+	c := app.storedCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM collections WHERE id = ?", c.ID); err != nil {
+		log.Error("Failed to delete collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// addCollectionItems appends items to a collection, in the order given.
+// Items already in it keep their place.
+func (app *App) addCollectionItems(w http.ResponseWriter, r *http.Request) {
+	c := app.storedCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "ids are required", http.StatusBadRequest)
+		return
+	}
+	if err := app.checkMediaIDs(req.IDs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to add to collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var next int
+	err = tx.Get(&next, "SELECT COALESCE(MAX(position) + 1, 0) FROM collection_items WHERE collection_id = ?", c.ID)
+	added := 0
+	for _, id := range req.IDs {
+		if err != nil {
+			break
+		}
+		var res sql.Result
+		res, err = tx.Exec(
+			"INSERT OR IGNORE INTO collection_items (collection_id, media_id, position) VALUES (?, ?, ?)",
+			c.ID, id, next,
+		)
+		var n int64
+		if err == nil {
+			n, err = res.RowsAffected()
+		}
+		added += int(n)
+		next += int(n)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Error("Failed to add to collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"added":   added,
+	})
+}
+
+// removeCollectionItem takes an item out of a collection.
+func (app *App) removeCollectionItem(w http.ResponseWriter, r *http.Request) {
+	c := app.storedCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+	id, err := strconv.Atoi(chi.URLParam(r, "mediaID"))
+	if err != nil {
+		http.Error(w, "Invalid media ID", http.StatusBadRequest)
+		return
+	}
+
+	res, err := app.DB.Exec("DELETE FROM collection_items WHERE collection_id = ? AND media_id = ?", c.ID, id)
+	var n int64
+	if err == nil {
+		n, err = res.RowsAffected()
+	}
+	if err != nil {
+		log.Error("Failed to remove from collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n == 0 {
+		http.Error(w, "Media item is not in the collection", http.StatusNotFound)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// orderCollection rearranges the items of a collection: those listed come
+// first, in the order given, followed by the others in their current
+// order. It returns the IDs of the items in their new order.
+func (app *App) orderCollection(w http.ResponseWriter, r *http.Request) {
+	c := app.storedCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to order collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var members []int
+	if err := tx.Select(&members, "SELECT media_id FROM collection_items WHERE collection_id = ? ORDER BY position, media_id", c.ID); err != nil {
+		log.Error("Failed to order collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rest := map[int]bool{}
+	for _, id := range members {
+		rest[id] = true
+	}
+
+	order := make([]int, 0, len(members))
+	for _, id := range req.IDs {
+		if !rest[id] {
+			http.Error(w, fmt.Sprintf("Media item %d is not in the collection or listed twice", id), http.StatusBadRequest)
+			return
+		}
+		delete(rest, id)
+		order = append(order, id)
+	}
+	for _, id := range members {
+		if rest[id] {
+			order = append(order, id)
+		}
+	}
+
+	for position, id := range order {
+		if _, err := tx.Exec(
+			"UPDATE collection_items SET position = ? WHERE collection_id = ? AND media_id = ?",
+			position, c.ID, id,
+		); err != nil {
+			log.Error("Failed to order collection:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Failed to order collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"ids": order,
+	})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxComicPage caps the size of a page read from a comic archive.
+const maxComicPage = 64 << 20
+
+// comicPageTypes are the content types of the images that count as the
+// pages of a comic archive, by extension.
+var comicPageTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+}
+
+// comicPages lists the pages of a comic archive in reading order, the
+// natural order of their names. CBZ files are ZIP archives; CBR files are
+// RAR archives read with unrar, though many are ZIP archives renamed, which
+// need no tool.
+func (app *App) comicPages(archive string) ([]string, error) {
+	var names []string
+	if isZip(archive) {
+		zr, err := zip.OpenReader(archive)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			if !f.FileInfo().IsDir() {
+				names = append(names, f.Name)
+			}
+		}
+	} else {
+		if app.Unrar == "" {
+			return nil, errProbeUnavailable
+		}
+		out, err := runTool(app.Unrar, "lb", "-p-", archive)
+		if err != nil {
+			return nil, err
+		}
+		names = strings.Split(strings.TrimSpace(string(out)), "\n")
+	}
+
+	var pages []string
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		base := path.Base(strings.ReplaceAll(name, `\`, "/"))
+		// Skip macOS resource forks and hidden files
+		if strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(base, ".") {
+			continue
+		}
+		if _, ok := comicPageTypes[strings.ToLower(path.Ext(base))]; ok {
+			pages = append(pages, name)
+		}
+	}
+	sort.Slice(pages, func(i, j int) bool { return naturalLess(pages[i], pages[j]) })
+	return pages, nil
+}
+
+// comicPage reads the page with the given name from a comic archive.
+func (app *App) comicPage(archive, name string) ([]byte, error) {
+	if !isZip(archive) {
+		if app.Unrar == "" {
+			return nil, errProbeUnavailable
+		}
+		return runTool(app.Unrar, "p", "-inul", "-p-", archive, name)
+	}
+
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		if f.Name != name {
+			continue
+		}
+		if f.UncompressedSize64 > maxComicPage {
+			return nil, fmt.Errorf("%s exceeds %d bytes", name, maxComicPage)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(io.LimitReader(rc, maxComicPage))
+	}
+	return nil, os.ErrNotExist
+}
+
+// isZip reports whether the file at path starts like a ZIP archive.
+func isZip(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	var magic [4]byte
+	_, err = io.ReadFull(f, magic[:])
+	return err == nil && string(magic[:]) == "PK\x03\x04"
+}
+
+// probeComic stores the page count of a comic and renders its first page as
+// the thumbnail. A cover that doesn't decode, such as a WebP image, leaves
+// the comic without a thumbnail.
+func (app *App) probeComic(item *MediaItem) error {
+	pages, err := app.comicPages(item.Path)
+	if err != nil {
+		return err
+	}
+
+	var thumbnail string
+	if len(pages) > 0 {
+		cover, err := app.comicPage(item.Path, pages[0])
+		if err == nil {
+			var img image.Image
+			if img, _, err = image.Decode(bytes.NewReader(cover)); err == nil {
+				thumbnail, err = writeThumbnail(item, img)
+			}
+		}
+		if err != nil {
+			log.Warnf("Failed to render cover of %s: %v", item.Path, err)
+		}
+	}
+
+	_, err = app.DB.Exec(
+		"UPDATE media SET pages = ?, thumbnail = ?, probed = 1 WHERE id = ?",
+		len(pages), thumbnail, item.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	item.Pages = len(pages)
+	item.Thumbnail = thumbnail
+	item.Probed = true
+	return nil
+}
+
+// getComicPage serves a page of a comic, counting from 1, for reading it
+// page by page.
+func (app *App) getComicPage(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+	if item.Type != "comic" {
+		http.Error(w, "Media item is not a comic", http.StatusBadRequest)
+		return
+	}
+
+	page, err := strconv.Atoi(chi.URLParam(r, "page"))
+	if err != nil || page < 1 {
+		http.Error(w, "Invalid page number", http.StatusBadRequest)
+		return
+	}
+
+	pages, err := app.comicPages(item.Path)
+	if err == errProbeUnavailable {
+		http.Error(w, "unrar is needed to read CBR archives", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to list comic pages:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if page > len(pages) {
+		http.Error(w, "Page not found", http.StatusNotFound)
+		return
+	}
+
+	name := pages[page-1]
+	data, err := app.comicPage(item.Path, name)
+	if err != nil {
+		log.Error("Failed to read comic page:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", comicPageTypes[strings.ToLower(path.Ext(name))])
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// configFile is read from the working directory at startup. It is optional;
+// a missing file leaves every setting at its default.
+const configFile = "config.json"
+
+type Config struct {
+	// DataDir holds the database and the files the application generates.
+	DataDir   string          `json:"data_dir"`
+	Server    ServerConfig    `json:"server"`
+	Scan      ScanConfig      `json:"scan"`
+	Libraries []LibraryConfig `json:"libraries"`
+	API       APIConfig       `json:"api"`
+	// Collections are virtual collections whose contents are computed from
+	// a filter every time they are read.
+	Collections []CollectionConfig `json:"collections"`
+	Hooks       HooksConfig        `json:"hooks"`
+	Profiles    ProfilesConfig     `json:"profiles"`
+	Processing  ProcessingConfig   `json:"processing"`
+	Thumbnails  ThumbnailsConfig   `json:"thumbnails"`
+	// Sinks publish library events to message brokers and webhooks.
+	Sinks     []SinkConfig    `json:"sinks"`
+	Metadata  MetadataConfig  `json:"metadata"`
+	Dashboard DashboardConfig `json:"dashboard"`
+	OnThisDay OnThisDayConfig `json:"on_this_day"`
+	Trash     TrashConfig     `json:"trash"`
+	Geocoding GeocodingConfig `json:"geocoding"`
+	// Providers override the limits of the clients of external services,
+	// by provider name.
+	Providers map[string]ProviderConfig `json:"providers"`
+	// Flags are custom flags that can be set on items in addition to the
+	// built-in ones.
+	Flags []string `json:"flags"`
+	// FilenameParsers read titles and capture dates from filenames, tried
+	// in order until one matches.
+	FilenameParsers []FilenameParserConfig `json:"filename_parsers"`
+}
+
+// ServerConfig controls how the server listens and announces itself.
+type ServerConfig struct {
+	Port int `json:"port"`
+	// PortFallback moves on to the next free port if Port is taken.
+	PortFallback bool `json:"port_fallback"`
+	// MDNS advertises the server on the local network under Name, so
+	// clients can discover it without knowing its address.
+	MDNS bool   `json:"mdns"`
+	Name string `json:"name"`
+}
+
+// ScanConfig holds the defaults applied to every scan. Individual scan
+// requests may override them.
+type ScanConfig struct {
+	// MinFileSize and MaxFileSize are in bytes. Zero disables the limit.
+	MinFileSize int64 `json:"min_file_size"`
+	MaxFileSize int64 `json:"max_file_size"`
+	// SkipHidden excludes dotfiles and everything below dot-directories.
+	SkipHidden bool `json:"skip_hidden"`
+	// NoMediaMarker is the name of a file that excludes the directory
+	// containing it, Android style. Empty disables the check.
+	NoMediaMarker string `json:"nomedia_marker"`
+	// MaxFilesPerSecond limits how fast scans walk the disk. Zero means
+	// no limit.
+	MaxFilesPerSecond float64 `json:"max_files_per_second"`
+	// IdlePriority runs scans at idle CPU and IO priority (Linux only).
+	IdlePriority bool `json:"idle_priority"`
+}
+
+// options returns the scan options these defaults describe.
+func (c ScanConfig) options() ScanOptions {
+	return ScanOptions{
+		MinSize:           c.MinFileSize,
+		MaxSize:           c.MaxFileSize,
+		SkipHidden:        c.SkipHidden,
+		NoMediaMarker:     c.NoMediaMarker,
+		MaxFilesPerSecond: c.MaxFilesPerSecond,
+		IdlePriority:      c.IdlePriority,
+	}
+}
+
+// APIConfig controls the shape of JSON responses. Clients can override both
+// settings per request with an Accept-Profile header.
+type APIConfig struct {
+	// FieldCase is "snake" (created_at) or "camel" (createdAt).
+	FieldCase string `json:"field_case"`
+	// TimeFormat is "rfc3339" or "unix" (seconds since the epoch).
+	TimeFormat string `json:"time_format"`
+}
+
+// MetadataConfig controls metadata extraction.
+type MetadataConfig struct {
+	// FFprobePath is the ffprobe binary used for video metadata, looked up
+	// in PATH unless it contains a slash. Empty disables extraction.
+	FFprobePath string `json:"ffprobe_path"`
+	// FFmpegPath is the ffmpeg binary used to extract the frames that
+	// videos are fingerprinted by and their thumbnails, looked up like
+	// FFprobePath.
+	FFmpegPath string `json:"ffmpeg_path"`
+	// The Poppler tools used for the page count, text and first page
+	// thumbnail of PDFs, looked up like FFprobePath.
+	PDFInfoPath   string `json:"pdfinfo_path"`
+	PDFToTextPath string `json:"pdftotext_path"`
+	PDFToPPMPath  string `json:"pdftoppm_path"`
+	// UnrarPath is the unrar binary used for the pages of CBR comics,
+	// looked up like FFprobePath.
+	UnrarPath string `json:"unrar_path"`
+	// ExifToolPath is the exiftool binary used to write metadata to the
+	// files of libraries with WriteMetadata, looked up like FFprobePath.
+	ExifToolPath string `json:"exiftool_path"`
+}
+
+// DashboardConfig controls what /api/dashboard returns by default.
+type DashboardConfig struct {
+	// Sections lists the sections to include; empty means all of them.
+	Sections []string `json:"sections"`
+	// RecentItems is the number of recently added items to include.
+	RecentItems int `json:"recent_items"`
+	// QuotaWarning is the fraction of a library's quota above which an
+	// alert is raised.
+	QuotaWarning float64 `json:"quota_warning"`
+}
+
+// OnThisDayConfig controls the daily On This Day digest.
+type OnThisDayConfig struct {
+	// DigestTime is the local time, as "HH:MM", at which the digest is
+	// published to /api/events. Empty disables it.
+	DigestTime string `json:"digest_time"`
+}
+
+// TrashConfig controls how long deleted items can be restored, and whether
+// files can be deleted from disk for good.
+type TrashConfig struct {
+	// RetentionDays is how long items stay in the trash before they are
+	// purged for good. Zero keeps them until the trash is emptied.
+	RetentionDays int `json:"retention_days"`
+	// AllowFileDeletion lets DELETE /api/media/{id}?deleteFile=true
+	// remove files from disk without going through the trash.
+	AllowFileDeletion bool `json:"allow_file_deletion"`
+}
+
+// GeocodingConfig controls reverse geocoding of photo GPS positions. It is
+// disabled unless one of the fields is set.
+type GeocodingConfig struct {
+	// Dataset is a GeoNames cities file used for offline lookups.
+	Dataset string `json:"dataset"`
+	// URL is a Nominatim-compatible reverse geocoding endpoint, used if
+	// there is no dataset.
+	URL string `json:"url"`
+}
+
+// ProviderConfig overrides the default limits of an external service's
+// client. Unset fields keep the provider's default.
+type ProviderConfig struct {
+	// RequestsPerSecond caps the request rate; zero means no limit.
+	RequestsPerSecond *float64 `json:"requests_per_second"`
+	// Retries is how many times a failed request is retried.
+	Retries *int `json:"retries"`
+	// CacheHours is how long successful responses are cached; zero
+	// disables the cache.
+	CacheHours *float64 `json:"cache_hours"`
+	// AllowPrivate allows requests to loopback, link-local and private
+	// addresses.
+	AllowPrivate *bool `json:"allow_private"`
+}
+
+// ProcessingConfig limits when heavy background work runs: probing new
+// items, which renders thumbnails and runs ffprobe and the PDF tools, and
+// dedup analyses.
+type ProcessingConfig struct {
+	// Windows are the daily spans of local time the work runs in, e.g.
+	// "01:00-07:00". Empty means any time.
+	Windows []string `json:"windows"`
+	// PauseWhileStreaming also holds the work back while clients are
+	// reading thumbnails, artwork or pages.
+	PauseWhileStreaming bool `json:"pause_while_streaming"`
+}
+
+// ThumbnailsConfig hands rendering the thumbnails of images and videos to
+// external workers, so the decoding runs on another machine than the
+// database and API.
+type ThumbnailsConfig struct {
+	// Workers are the URLs of thumbnail workers, started with
+	// "media-organizer thumbnailer". Items are spread across them. Empty
+	// renders thumbnails locally.
+	Workers []string `json:"workers"`
+	// LocalFallback renders a thumbnail locally if every worker fails,
+	// rather than leaving the item without one.
+	LocalFallback bool `json:"local_fallback"`
+	// Token is sent to the workers in an X-Worker-Token header, for those
+	// started with one.
+	Token string `json:"token"`
+}
+
+// ProfilesConfig sets up restricted profiles for shared deployments, such as
+// a family's, which only see part of the library.
+type ProfilesConfig struct {
+	// PIN is needed to leave a restricted profile.
+	PIN string `json:"pin"`
+	// Default is the profile of clients that haven't switched to one;
+	// empty means they are unrestricted.
+	Default    string          `json:"default"`
+	Restricted []ProfileConfig `json:"restricted"`
+}
+
+// ProfileConfig describes what a restricted profile can see.
+type ProfileConfig struct {
+	Name string `json:"name"`
+	// Libraries and Tags grant access to the items in any of the
+	// libraries or with any of the tags, or a tag below them. Without
+	// either the profile sees the whole library.
+	Libraries []string `json:"libraries"`
+	Tags      []string `json:"tags"`
+	// MaxRating is the highest content rating the profile sees, e.g.
+	// "PG" or "FSK 12"; items rated higher are hidden.
+	MaxRating string `json:"max_rating"`
+	// BlockUnrated also hides videos without a rating.
+	BlockUnrated bool `json:"block_unrated"`
+}
+
+// SinkConfig describes where a sink publishes events.
+type SinkConfig struct {
+	Name string `json:"name"`
+	// Type is "webhook", "mqtt", "nats" or "kafka".
+	Type string `json:"type"`
+	// URL is the webhook URL, the broker address as mqtt://, mqtts:// or
+	// nats:// with optional credentials, or the Kafka REST Proxy URL.
+	URL string `json:"url"`
+	// Topic is the prefix of MQTT topics and NATS subjects, or the Kafka
+	// topic. It defaults to "media-organizer".
+	Topic string `json:"topic"`
+	// Events lists the event types to publish; empty means all but the
+	// progress events.
+	Events []string `json:"events"`
+	// MaxOutbox caps the events kept for the sink while it is down, the
+	// oldest being dropped past it. Zero keeps every event until it is
+	// delivered.
+	MaxOutbox int `json:"max_outbox"`
+}
+
+// HooksConfig secures the endpoints external tools call.
+type HooksConfig struct {
+	// Token, if set, must be sent in an X-Hook-Token header or a token
+	// query parameter.
+	Token string `json:"token"`
+}
+
+// LibraryConfig describes a named directory that uploads can be stored in.
+type LibraryConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	// Quota is the maximum number of bytes of media the library may hold,
+	// across all of its volumes. Zero means unlimited.
+	Quota int64 `json:"quota"`
+	// Volumes are further directories, usually on other disks, that new
+	// files can be stored in besides Path.
+	Volumes []string `json:"volumes"`
+	// Placement chooses the volume of a new file: "most_free" (the
+	// default) or "round_robin". Pinned maps media types, e.g. "video",
+	// to the volume their files are always stored on.
+	Placement string            `json:"placement"`
+	Pinned    map[string]string `json:"pinned"`
+	// WriteMetadata writes titles, descriptions, people and tags into the
+	// library's files as XMP, so they survive outside the application.
+	// Content ratings are not written.
+	WriteMetadata bool `json:"write_metadata"`
+	// Immutable treats the library as a write-once archive: its files are
+	// never changed by the application, and changes found by scans or
+	// verification raise alerts instead of being accepted.
+	Immutable bool `json:"immutable"`
+	// Exclude are gitignore-style patterns relative to each of the
+	// library's volumes, which scans skip. The .mediaignore files in the
+	// library are applied after them, so they can re-include files.
+	Exclude []string `json:"exclude"`
+}
+
+// FilenameParserConfig reads the title, capture date and year of items
+// from their filenames, without the extension. Pattern is made of the
+// tokens {date}, {year}, {title} and {*} and literal text, e.g.
+// "{date}_{title}"; Regex is a regular expression with title, date and
+// year groups instead. DateLayout is the Go time layout of dates, which
+// are otherwise read by their digits. Types limits the parser to items of
+// those types.
+type FilenameParserConfig struct {
+	Pattern    string   `json:"pattern"`
+	Regex      string   `json:"regex"`
+	DateLayout string   `json:"date_layout"`
+	Types      []string `json:"types"`
+}
+
+type CollectionConfig struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Filter      MediaFilter `json:"filter"`
+}
+
+// library returns the configured library with the given name, or nil.
+func (c *Config) library(name string) *LibraryConfig {
+	for i := range c.Libraries {
+		if c.Libraries[i].Name == name {
+			return &c.Libraries[i]
+		}
+	}
+	return nil
+}
+
+// libraryOf returns the library whose volumes hold path, or nil.
+func (c *Config) libraryOf(path string) *LibraryConfig {
+	for i := range c.Libraries {
+		for _, v := range c.Libraries[i].volumes() {
+			if strings.HasPrefix(path, v+string(os.PathSeparator)) {
+				return &c.Libraries[i]
+			}
+		}
+	}
+	return nil
+}
+
+// volumeOf returns the library and the volume that path is or lies in, or
+// nil if it isn't in a library.
+func (c *Config) volumeOf(path string) (*LibraryConfig, string) {
+	for i := range c.Libraries {
+		for _, v := range c.Libraries[i].volumes() {
+			if withinDir(v, path) {
+				return &c.Libraries[i], v
+			}
+		}
+	}
+	return nil, ""
+}
+
+func loadConfig(path string) (*Config, error) {
+	config := &Config{
+		DataDir: legacyDataDir,
+		Server: ServerConfig{
+			Port: 9999,
+			Name: "Media Organizer",
+		},
+		Scan: ScanConfig{
+			SkipHidden:    true,
+			NoMediaMarker: ".nomedia",
+		},
+		API: APIConfig{
+			FieldCase:  caseSnake,
+			TimeFormat: timeRFC3339,
+		},
+		Metadata: MetadataConfig{
+			FFprobePath:   "ffprobe",
+			FFmpegPath:    "ffmpeg",
+			PDFInfoPath:   "pdfinfo",
+			PDFToTextPath: "pdftotext",
+			PDFToPPMPath:  "pdftoppm",
+			UnrarPath:     "unrar",
+			ExifToolPath:  "exiftool",
+		},
+		Dashboard: DashboardConfig{
+			RecentItems:  12,
+			QuotaWarning: 0.9,
+		},
+		OnThisDay: OnThisDayConfig{
+			DigestTime: "09:00",
+		},
+		Trash: TrashConfig{
+			RetentionDays: 30,
+		},
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
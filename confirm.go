@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// confirmationTTL is how long a confirmation token stays valid.
+const confirmationTTL = 5 * time.Minute
+
+// errInvalidConfirmation is returned for unknown, expired and already used
+// confirmation tokens.
+var errInvalidConfirmation = errors.New("invalid or expired confirmation token")
+
+// issueConfirmation stores the payload of a previewed destructive action and
+// returns a single-use token that executes it.
+func (app *App) issueConfirmation(action string, payload interface{}) (string, time.Time, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(b)
+	expires := time.Now().UTC().Add(confirmationTTL)
+
+	// Drop tokens nobody came back for
+	if _, err := app.DB.Exec("DELETE FROM confirmations WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return "", time.Time{}, err
+	}
+
+	_, err = app.DB.Exec(
+		"INSERT INTO confirmations (token, action, payload, expires_at) VALUES (?, ?, ?, ?)",
+		token, action, string(data), expires,
+	)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return token, expires, nil
+}
+
+// redeemConfirmation consumes a token issued for action and decodes the
+// payload stored with it.
+func (app *App) redeemConfirmation(token, action string, payload interface{}) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var row struct {
+		Payload   string    `db:"payload"`
+		ExpiresAt time.Time `db:"expires_at"`
+	}
+	err = tx.Get(&row, "SELECT payload, expires_at FROM confirmations WHERE token = ? AND action = ?", token, action)
+	if err == sql.ErrNoRows {
+		return errInvalidConfirmation
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM confirmations WHERE token = ?", token); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if time.Now().After(row.ExpiresAt) {
+		return errInvalidConfirmation
+	}
+	return json.Unmarshal([]byte(row.Payload), payload)
+}
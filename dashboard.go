@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDashboardRecent caps the number of recent items a dashboard request
+// can ask for.
+const maxDashboardRecent = 100
+
+// dashboardSections are the sections /api/dashboard can return, in the
+// order they are computed.
+var dashboardSections = []string{"stats", "trends", "recent", "jobs", "alerts"}
+
+// Alert levels, from least to most severe.
+const (
+	alertInfo    = "info"
+	alertWarning = "warning"
+	alertError   = "error"
+)
+
+// Alert is something on the dashboard that needs the user's attention.
+type Alert struct {
+	Level   string `json:"level"`
+	Type    string `json:"type"`
+	Message string `json:"message"`
+	ScanID  int    `json:"scan_id,omitempty"`
+	Library string `json:"library,omitempty"`
+}
+
+// parseDashboardSections returns the requested sections, defaulting to the
+// configured ones and then to all of them.
+func (app *App) parseDashboardSections(v string) (map[string]bool, error) {
+	names := app.Config.Dashboard.Sections
+	if v != "" {
+		names = strings.Split(v, ",")
+	}
+	if len(names) == 0 {
+		names = dashboardSections
+	}
+
+	known := map[string]bool{}
+	for _, name := range dashboardSections {
+		known[name] = true
+	}
+
+	sections := map[string]bool{}
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if !known[name] {
+			return nil, fmt.Errorf("unknown dashboard section: %s", name)
+		}
+		sections[name] = true
+	}
+	return sections, nil
+}
+
+// getDashboard returns everything the home screen shows in one response, so
+// it and third-party dashboards don't have to poll several endpoints.
+func (app *App) getDashboard(w http.ResponseWriter, r *http.Request) {
+	sections, err := app.parseDashboardSections(r.URL.Query().Get("sections"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := app.Config.Dashboard.RecentItems
+	if v := r.URL.Query().Get("recent"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			http.Error(w, fmt.Sprintf("invalid recent: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+	if limit > maxDashboardRecent {
+		limit = maxDashboardRecent
+	}
+
+	view, err := parseMediaView(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dashboard := map[string]interface{}{}
+
+	if sections["stats"] {
+		dashboard["stats"] = app.stats()
+	}
+
+	if sections["trends"] {
+		trends, err := app.compareStats("month", time.Now())
+		if err != nil {
+			log.Error("Failed to compare periods:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dashboard["trends"] = trends
+	}
+
+	if sections["recent"] {
+		var items []MediaItem
+		err := app.DB.Select(&items, "SELECT * FROM media ORDER BY created_at DESC, id DESC LIMIT ?", limit)
+		if err != nil {
+			log.Error("Failed to fetch recent media items:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		out, err := app.presentMedia(items, view)
+		if err != nil {
+			log.Error("Failed to fetch media details:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dashboard["recent"] = out
+	}
+
+	if sections["jobs"] {
+		jobs := []ScanRecord{}
+		if err := app.DB.Select(&jobs, "SELECT * FROM scans WHERE status = ? ORDER BY id", scanRunning); err != nil {
+			log.Error("Failed to fetch running scans:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dashboard["jobs"] = jobs
+	}
+
+	if sections["alerts"] {
+		alerts, err := app.alerts()
+		if err != nil {
+			log.Error("Failed to compute alerts:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dashboard["alerts"] = alerts
+	}
+
+	app.writeJSON(w, r, http.StatusOK, dashboard)
+}
+
+// alerts collects the problems worth showing on the dashboard: libraries
+// close to their quota, scans that failed, were interrupted or hit errors
+// the last time their directory was scanned, modified files of immutable
+// libraries, and videos waiting for ffprobe.
+func (app *App) alerts() ([]Alert, error) {
+	alerts := []Alert{}
+
+	for i := range app.Config.Libraries {
+		lib := &app.Config.Libraries[i]
+		if lib.Quota <= 0 {
+			continue
+		}
+
+		used, err := app.libraryUsage(lib)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case used >= lib.Quota:
+			alerts = append(alerts, Alert{
+				Level:   alertError,
+				Type:    "quota",
+				Message: fmt.Sprintf("Library %q is full (%d of %d bytes used)", lib.Name, used, lib.Quota),
+				Library: lib.Name,
+			})
+		case float64(used) >= float64(lib.Quota)*app.Config.Dashboard.QuotaWarning:
+			alerts = append(alerts, Alert{
+				Level:   alertWarning,
+				Type:    "quota",
+				Message: fmt.Sprintf("Library %q is almost full (%d of %d bytes used)", lib.Name, used, lib.Quota),
+				Library: lib.Name,
+			})
+		}
+	}
+
+	// Only the latest scan of each directory matters; an old failure that
+	// a later scan got past is no longer news
+	var scans []ScanRecord
+	err := app.DB.Select(&scans,
+		`SELECT * FROM scans WHERE id IN (SELECT MAX(id) FROM scans GROUP BY path)
+			AND (status IN (?, ?) OR (status = ? AND errors > 0)) ORDER BY id`,
+		scanFailed, scanInterrupted, scanCompleted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, scan := range scans {
+		alert := Alert{ScanID: scan.ID}
+		switch scan.Status {
+		case scanFailed:
+			alert.Level, alert.Type = alertError, "scan_failed"
+			alert.Message = fmt.Sprintf("Scan of %s failed: %s", scan.Path, scan.Error)
+		case scanInterrupted:
+			alert.Level, alert.Type = alertWarning, "scan_interrupted"
+			alert.Message = fmt.Sprintf("Scan of %s was interrupted and can be resumed", scan.Path)
+		default:
+			alert.Level, alert.Type = alertInfo, "scan_errors"
+			alert.Message = fmt.Sprintf("Scan of %s couldn't read %d paths", scan.Path, scan.Errors)
+		}
+		alerts = append(alerts, alert)
+	}
+
+	var modified int
+	if err := app.DB.Get(&modified, "SELECT COUNT(*) FROM media_flags WHERE flag = ?", flagModified); err != nil {
+		return nil, err
+	}
+	if modified > 0 {
+		alerts = append(alerts, Alert{
+			Level:   alertError,
+			Type:    "integrity",
+			Message: fmt.Sprintf("%d files of immutable libraries were modified", modified),
+		})
+	}
+
+	if app.FFprobe == "" {
+		var unprobed int
+		if err := app.DB.Get(&unprobed, "SELECT COUNT(*) FROM media WHERE type = 'video' AND NOT probed"); err != nil {
+			return nil, err
+		}
+		if unprobed > 0 {
+			alerts = append(alerts, Alert{
+				Level:   alertWarning,
+				Type:    "ffprobe_missing",
+				Message: fmt.Sprintf("ffprobe is not available; %d videos have no metadata", unprobed),
+			})
+		}
+	}
+
+	return alerts, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// legacyDataDir is where versions before the data directory layout kept
+// the database, directly inside the directory, next to the folders of
+// generated files.
+const legacyDataDir = "./data"
+
+// The data directory holds the database and everything the application
+// generates, each in a folder of its own. They are set by setDataDir at
+// startup.
+var (
+	dataDir      string
+	databaseDir  string
+	thumbnailDir string
+	artworkDir   string
+	stagingDir   string
+	backupDir    string
+	// attachmentDir holds the files attached to items, which unlike the
+	// other folders can't be generated again.
+	attachmentDir string
+	// trashDir holds the files of trashed items, until they are purged.
+	trashDir string
+)
+
+// dataFolders are the folders of generated files, by name, which the
+// legacy layout had in the same places.
+var dataFolders = map[string]*string{
+	"thumbnails": &thumbnailDir,
+	"artwork":    &artworkDir,
+	"staging":    &stagingDir,
+}
+
+func init() {
+	setDataDir(legacyDataDir)
+}
+
+// setDataDir lays out the data directory under dir.
+func setDataDir(dir string) {
+	dataDir = dir
+	databaseDir = filepath.Join(dir, "db")
+	backupDir = filepath.Join(dir, "backups")
+	attachmentDir = filepath.Join(dir, "attachments")
+	trashDir = filepath.Join(dir, "trash")
+	for name, folder := range dataFolders {
+		*folder = filepath.Join(dir, name)
+	}
+}
+
+// databasePath is the path of the SQLite database.
+func databasePath() string {
+	return filepath.Join(databaseDir, "media.db")
+}
+
+// migrateLegacyDataDir moves a database left in the legacy layout, and the
+// generated files that go with it, into the data directory, so upgrading
+// keeps the library rather than starting an empty one. The original
+// database is copied to the backup folder first. Nothing happens if the
+// data directory already has a database.
+func migrateLegacyDataDir() error {
+	legacy := filepath.Join(legacyDataDir, "media.db")
+	if _, err := os.Stat(databasePath()); !os.IsNotExist(err) {
+		return err
+	}
+	if _, err := os.Stat(legacy); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	log.Infof("Migrating legacy data directory %s to %s", legacyDataDir, dataDir)
+
+	for _, dir := range []string{databaseDir, backupDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	backup := filepath.Join(backupDir, "media-legacy-"+time.Now().Format("20060102-150405")+".db")
+	if err := copyFile(legacy, backup); err != nil {
+		return fmt.Errorf("backing up %s: %w", legacy, err)
+	}
+	log.Infof("Backed up the legacy database to %s", backup)
+
+	// A journal left by a crash must stay with its database to be rolled
+	// back
+	for _, suffix := range []string{"", "-journal", "-wal", "-shm"} {
+		if _, err := os.Stat(legacy + suffix); os.IsNotExist(err) {
+			continue
+		}
+		err := moveFile(legacy+suffix, databasePath()+suffix)
+		if err != nil {
+			return fmt.Errorf("moving %s: %w", legacy+suffix, err)
+		}
+	}
+
+	for name, folder := range dataFolders {
+		src := filepath.Join(legacyDataDir, name)
+		if sameFile(src, *folder) {
+			continue
+		}
+		if _, err := os.Stat(*folder); err == nil {
+			log.Warnf("Not moving %s: %s already exists", src, *folder)
+			continue
+		}
+		if err := moveDir(src, *folder); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("moving %s: %w", src, err)
+		}
+	}
+
+	log.Info("Legacy data directory migrated")
+	return nil
+}
+
+// moveDir moves a directory, copying it if it can't be renamed, as across
+// file systems.
+func moveDir(src, dst string) error {
+	if _, err := os.Stat(src); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm())
+		}
+		return copyFile(path, target)
+	})
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyFile copies the file at src to dst, replacing it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// sameFile reports whether a and b are the same path once made absolute.
+func sameFile(a, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA == absB
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// migrations are applied in order after the base schema has been created.
+// The number of applied migrations is stored in SQLite's user_version pragma,
+// so existing entries must never be edited or reordered - only appended to.
+var migrations = []string{
+	// 1: content checksum used for deduplication
+	`ALTER TABLE media ADD COLUMN checksum TEXT NOT NULL DEFAULT '';
+	CREATE INDEX IF NOT EXISTS idx_checksum ON media(checksum);`,
+
+	// 2: other filenames and paths an item has been known by
+	`CREATE TABLE media_aliases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		path TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE(media_id, filename, path)
+	);
+	CREATE INDEX idx_alias_filename ON media_aliases(filename);`,
+
+	// 3: change log for incremental sync, maintained by triggers so that
+	// every write path is covered
+	`CREATE TABLE media_changes (
+		seq INTEGER PRIMARY KEY AUTOINCREMENT,
+		media_id INTEGER NOT NULL,
+		op TEXT NOT NULL,
+		changed_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	INSERT INTO media_changes (media_id, op) SELECT id, 'created' FROM media ORDER BY id;
+	CREATE TRIGGER media_changes_insert AFTER INSERT ON media BEGIN
+		INSERT INTO media_changes (media_id, op) VALUES (NEW.id, 'created');
+	END;
+	CREATE TRIGGER media_changes_update AFTER UPDATE ON media BEGIN
+		INSERT INTO media_changes (media_id, op) VALUES (NEW.id, 'updated');
+	END;
+	CREATE TRIGGER media_changes_delete AFTER DELETE ON media BEGIN
+		INSERT INTO media_changes (media_id, op) VALUES (OLD.id, 'deleted');
+	END;
+	CREATE TRIGGER media_changes_alias AFTER INSERT ON media_aliases BEGIN
+		INSERT INTO media_changes (media_id, op) VALUES (NEW.media_id, 'updated');
+	END;`,
+
+	// 4: scan history
+	`CREATE TABLE scans (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL,
+		status TEXT NOT NULL,
+		started_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME,
+		added INTEGER NOT NULL DEFAULT 0,
+		skipped INTEGER NOT NULL DEFAULT 0,
+		errors INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT ''
+	);`,
+
+	// 5: locally cached artwork
+	`ALTER TABLE media ADD COLUMN artwork_url TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN artwork TEXT NOT NULL DEFAULT '';`,
+
+	// 6: resumable scans
+	`ALTER TABLE scans ADD COLUMN options TEXT NOT NULL DEFAULT '{}';
+	ALTER TABLE scans ADD COLUMN checkpoint TEXT NOT NULL DEFAULT '';`,
+
+	// 7: per-directory scan counts
+	`ALTER TABLE scans ADD COLUMN directories TEXT NOT NULL DEFAULT '[]';`,
+
+	// 8: confirmation tokens for destructive operations
+	`CREATE TABLE confirmations (
+		token TEXT PRIMARY KEY,
+		action TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		expires_at DATETIME NOT NULL
+	);`,
+
+	// 9: per-file scan errors
+	`CREATE TABLE scan_errors (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		scan_id INTEGER NOT NULL REFERENCES scans(id) ON DELETE CASCADE,
+		path TEXT NOT NULL,
+		error TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_scan_errors_scan ON scan_errors(scan_id);`,
+
+	// 10: locked items can't be deleted, moved or renamed
+	`ALTER TABLE media ADD COLUMN locked INTEGER NOT NULL DEFAULT 0;
+	CREATE TRIGGER media_locked_delete BEFORE DELETE ON media WHEN OLD.locked BEGIN
+		SELECT RAISE(ABORT, 'media item is locked');
+	END;
+	CREATE TRIGGER media_locked_move BEFORE UPDATE OF path, filename ON media
+		WHEN OLD.locked AND NEW.locked BEGIN
+		SELECT RAISE(ABORT, 'media item is locked');
+	END;`,
+
+	// 11: video metadata from ffprobe
+	`ALTER TABLE media ADD COLUMN duration REAL NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN width INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN height INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN video_codec TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN audio_codec TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN bitrate INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN frame_rate REAL NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN container TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN probed INTEGER NOT NULL DEFAULT 0;`,
+
+	// 12: document page counts, text and thumbnails
+	`ALTER TABLE media ADD COLUMN pages INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN content TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN thumbnail TEXT NOT NULL DEFAULT '';`,
+
+	// 13: file times, as opposed to when the row was created
+	`ALTER TABLE media ADD COLUMN file_mod_time DATETIME;
+	ALTER TABLE media ADD COLUMN file_birth_time DATETIME;
+	CREATE INDEX idx_file_mod_time ON media(file_mod_time);`,
+
+	// 14: 360 degree, HDR and 3D video flags. Videos are marked unprobed
+	// so POST /api/media/probe fills them in.
+	`ALTER TABLE media ADD COLUMN projection TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN hdr TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN stereo_mode TEXT NOT NULL DEFAULT '';
+	UPDATE media SET probed = 0 WHERE type = 'video';`,
+
+	// 15: samples and trailers, linked to their main video
+	`ALTER TABLE media ADD COLUMN extra TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN parent_id INTEGER REFERENCES media(id) ON DELETE SET NULL;
+	CREATE INDEX idx_parent_id ON media(parent_id);`,
+
+	// 16: cheap partial hash, filled in by scans
+	`ALTER TABLE media ADD COLUMN oshash TEXT NOT NULL DEFAULT '';
+	CREATE INDEX idx_oshash ON media(oshash);`,
+
+	// 17: uploads staged for review before they are committed to a library
+	`CREATE TABLE staging_sessions (
+		id TEXT PRIMARY KEY,
+		library TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		expires_at DATETIME NOT NULL
+	);
+	CREATE TABLE staged_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_id TEXT NOT NULL REFERENCES staging_sessions(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL DEFAULT 0,
+		type TEXT NOT NULL,
+		checksum TEXT NOT NULL DEFAULT '',
+		library TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_staged_files_session ON staged_files(session_id);`,
+
+	// 18: audio tracks of videos, filled in by POST /api/media/probe
+	`ALTER TABLE media ADD COLUMN audio_tracks INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN audio_channels INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN channel_layout TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN sample_rate INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN audio_languages TEXT NOT NULL DEFAULT '';
+	UPDATE media SET probed = 0 WHERE type = 'video';`,
+
+	// 19: flags set by pipeline stages, users and external tools
+	`CREATE TABLE media_flags (
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		flag TEXT NOT NULL,
+		source TEXT NOT NULL DEFAULT '',
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (media_id, flag)
+	);
+	CREATE INDEX idx_media_flags_flag ON media_flags(flag);`,
+
+	// 20: GPS positions and places of photos. Images are marked unprobed
+	// so POST /api/media/probe reads their EXIF data.
+	`ALTER TABLE media ADD COLUMN latitude REAL;
+	ALTER TABLE media ADD COLUMN longitude REAL;
+	ALTER TABLE media ADD COLUMN country TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN city TEXT NOT NULL DEFAULT '';
+	CREATE INDEX idx_place ON media(country, city);
+	UPDATE media SET probed = 0 WHERE type = 'image';`,
+
+	// 21: metadata from Google Takeout sidecars
+	`ALTER TABLE media ADD COLUMN taken_at DATETIME;
+	ALTER TABLE media ADD COLUMN description TEXT NOT NULL DEFAULT '';
+	CREATE INDEX idx_taken_at ON media(taken_at);
+	CREATE TABLE media_people (
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		PRIMARY KEY (media_id, name)
+	);
+	CREATE INDEX idx_media_people_name ON media_people(name COLLATE NOCASE);`,
+
+	// 22: journal of batch moves
+	`CREATE TABLE move_batches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		status TEXT NOT NULL,
+		error TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME
+	);
+	CREATE TABLE move_ops (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		batch_id INTEGER NOT NULL REFERENCES move_batches(id) ON DELETE CASCADE,
+		media_id INTEGER NOT NULL,
+		src TEXT NOT NULL,
+		dst TEXT NOT NULL,
+		status TEXT NOT NULL
+	);
+	CREATE INDEX idx_move_ops_batch ON move_ops(batch_id);`,
+
+	// 23: metadata from Kodi/Jellyfin NFO files
+	`ALTER TABLE media ADD COLUMN title TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN year INTEGER NOT NULL DEFAULT 0;
+	CREATE TABLE media_genres (
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		name TEXT NOT NULL,
+		PRIMARY KEY (media_id, name)
+	);
+	CREATE INDEX idx_media_genres_name ON media_genres(name COLLATE NOCASE);
+	UPDATE media SET probed = 0 WHERE type = 'video';`,
+
+	// 24: dedup analyses
+	`CREATE TABLE dedup_analyses (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		status TEXT NOT NULL,
+		filter TEXT NOT NULL DEFAULT '',
+		chunk_size INTEGER NOT NULL,
+		files INTEGER NOT NULL DEFAULT 0,
+		errors INTEGER NOT NULL DEFAULT 0,
+		total_bytes INTEGER NOT NULL DEFAULT 0,
+		unique_bytes INTEGER NOT NULL DEFAULT 0,
+		whole_file_bytes INTEGER NOT NULL DEFAULT 0,
+		chunks INTEGER NOT NULL DEFAULT 0,
+		unique_chunks INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		started_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		finished_at DATETIME
+	);
+	CREATE TABLE dedup_files (
+		analysis_id INTEGER NOT NULL REFERENCES dedup_analyses(id) ON DELETE CASCADE,
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		redundant_bytes INTEGER NOT NULL,
+		shares_with INTEGER,
+		PRIMARY KEY (analysis_id, media_id)
+	);`,
+
+	// 25: custom attributes
+	`CREATE TABLE media_attributes (
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (media_id, key)
+	);
+	CREATE INDEX idx_media_attributes_key ON media_attributes(key, value);`,
+
+	// 26: verification of immutable libraries
+	`ALTER TABLE media ADD COLUMN verified_at DATETIME;`,
+
+	// 27: content type sniffed from the files
+	`ALTER TABLE media ADD COLUMN mime_type TEXT NOT NULL DEFAULT '';`,
+
+	// 28: tags and their aliases
+	`CREATE TABLE tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE tag_aliases (
+		name TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+		tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE
+	);
+	CREATE INDEX idx_tag_aliases_tag ON tag_aliases(tag_id);
+	CREATE TABLE media_tags (
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		tag_id INTEGER NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		PRIMARY KEY (media_id, tag_id)
+	);
+	CREATE INDEX idx_media_tags_tag ON media_tags(tag_id);`,
+
+	// 29: animated images, which are probed again to count their frames
+	`ALTER TABLE media ADD COLUMN animated BOOLEAN NOT NULL DEFAULT 0;
+	ALTER TABLE media ADD COLUMN frames INTEGER NOT NULL DEFAULT 0;
+	UPDATE media SET probed = 0 WHERE type = 'image';`,
+
+	// 30: tag hierarchy
+	`ALTER TABLE tags ADD COLUMN parent_id INTEGER REFERENCES tags(id);
+	CREATE INDEX idx_tags_parent ON tags(parent_id);`,
+
+	// 31: color description of videos, which are probed again to read it
+	`ALTER TABLE media ADD COLUMN color_primaries TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN color_transfer TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN color_space TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN bit_depth INTEGER NOT NULL DEFAULT 0;
+	UPDATE media SET probed = 0 WHERE type = 'video';`,
+
+	// 32: EXIF orientation of images, which are probed again to read it
+	// and render their thumbnails
+	`ALTER TABLE media ADD COLUMN orientation INTEGER NOT NULL DEFAULT 0;
+	UPDATE media SET probed = 0 WHERE type = 'image';`,
+
+	// 33: mapping profiles for metadata imports
+	`CREATE TABLE import_profiles (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		format TEXT NOT NULL,
+		match_column TEXT NOT NULL,
+		match_by TEXT NOT NULL,
+		fields TEXT NOT NULL,
+		default_tags TEXT NOT NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`,
+
+	// 34: responses of external services
+	`CREATE TABLE api_cache (
+		provider TEXT NOT NULL,
+		url TEXT NOT NULL,
+		content_type TEXT NOT NULL,
+		body BLOB NOT NULL,
+		fetched_at DATETIME NOT NULL,
+		PRIMARY KEY (provider, url)
+	);`,
+
+	// 35: tags of audio files
+	`ALTER TABLE media ADD COLUMN artist TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN album TEXT NOT NULL DEFAULT '';`,
+
+	// 36: events waiting to be delivered to sinks
+	`CREATE TABLE event_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sink TEXT NOT NULL,
+		type TEXT NOT NULL,
+		data TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_event_outbox_sink ON event_outbox(sink, id);`,
+
+	// 37: sharpness scores of images, NULL until analyzed
+	`ALTER TABLE media ADD COLUMN sharpness REAL;`,
+
+	// 38: content ratings and the sessions of restricted profiles
+	`ALTER TABLE media ADD COLUMN content_rating TEXT NOT NULL DEFAULT '';
+	ALTER TABLE media ADD COLUMN rating_age INTEGER;
+	CREATE TABLE profile_sessions (
+		token TEXT PRIMARY KEY,
+		profile TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// 39: frame hashes of videos, for finding re-encoded duplicates
+	`CREATE TABLE video_fingerprints (
+		media_id INTEGER PRIMARY KEY REFERENCES media(id) ON DELETE CASCADE,
+		frames TEXT NOT NULL
+	);`,
+
+	// 40: perceptual hashes of images, for finding near-duplicates
+	`ALTER TABLE media ADD COLUMN phash TEXT NOT NULL DEFAULT '';`,
+
+	// 41: auxiliary files attached to items
+	`CREATE TABLE media_attachments (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		content_type TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_media_attachments_media ON media_attachments(media_id);`,
+
+	// 42: sizes in the change log, for the bytes added and deleted per
+	// period
+	`ALTER TABLE media_changes ADD COLUMN size INTEGER NOT NULL DEFAULT 0;
+	UPDATE media_changes SET size = COALESCE((SELECT size FROM media WHERE media.id = media_changes.media_id), 0)
+		WHERE op = 'created';
+	DROP TRIGGER media_changes_insert;
+	CREATE TRIGGER media_changes_insert AFTER INSERT ON media BEGIN
+		INSERT INTO media_changes (media_id, op, size) VALUES (NEW.id, 'created', NEW.size);
+	END;
+	DROP TRIGGER media_changes_delete;
+	CREATE TRIGGER media_changes_delete AFTER DELETE ON media BEGIN
+		INSERT INTO media_changes (media_id, op, size) VALUES (OLD.id, 'deleted', OLD.size);
+	END;
+	CREATE INDEX idx_media_changes_op ON media_changes(op, changed_at);`,
+
+	// 43: collections created through the API and their items
+	`CREATE TABLE collections (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		cover_id INTEGER REFERENCES media(id) ON DELETE SET NULL,
+		created_at DATETIME NOT NULL
+	);
+	CREATE TABLE collection_items (
+		collection_id TEXT NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		position INTEGER NOT NULL,
+		PRIMARY KEY (collection_id, media_id)
+	);
+	CREATE INDEX idx_collection_items_media ON collection_items(media_id);`,
+
+	// 44: galleries, the directories images were added to
+	`CREATE TABLE galleries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL UNIQUE,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// 45: trash of deleted items, with a snapshot of their rows to restore
+	`CREATE TABLE trash (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		media_id INTEGER NOT NULL,
+		path TEXT NOT NULL,
+		filename TEXT NOT NULL,
+		type TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		file TEXT NOT NULL DEFAULT '',
+		snapshot TEXT NOT NULL,
+		trashed_at DATETIME NOT NULL
+	);
+	CREATE INDEX idx_trash_trashed_at ON trash(trashed_at);`,
+
+	// 46: smart collections, saved filters created through the API
+	`CREATE TABLE smart_collections (
+		id TEXT PRIMARY KEY,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		filter TEXT NOT NULL,
+		created_at DATETIME NOT NULL
+	);`,
+
+	// 47: people as records of their own, with aliases and an image. Items
+	// are linked to them instead of naming them.
+	`CREATE TABLE people (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE COLLATE NOCASE,
+		image_url TEXT NOT NULL DEFAULT '',
+		image TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE TABLE person_aliases (
+		name TEXT NOT NULL PRIMARY KEY COLLATE NOCASE,
+		person_id INTEGER NOT NULL REFERENCES people(id) ON DELETE CASCADE
+	);
+	CREATE INDEX idx_person_aliases_person ON person_aliases(person_id);
+	INSERT OR IGNORE INTO people (name) SELECT name FROM media_people ORDER BY name;
+	ALTER TABLE media_people RENAME TO media_people_names;
+	CREATE TABLE media_people (
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		person_id INTEGER NOT NULL REFERENCES people(id) ON DELETE CASCADE,
+		PRIMARY KEY (media_id, person_id)
+	);
+	CREATE INDEX idx_media_people_person ON media_people(person_id);
+	INSERT OR IGNORE INTO media_people (media_id, person_id)
+		SELECT n.media_id, p.id FROM media_people_names n JOIN people p ON p.name = n.name;
+	DROP TABLE media_people_names;`,
+
+	// 48: markers of moments in videos
+	`CREATE TABLE media_markers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		seconds REAL NOT NULL,
+		title TEXT NOT NULL,
+		tag_id INTEGER REFERENCES tags(id) ON DELETE SET NULL,
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_media_markers_media ON media_markers(media_id, seconds);`,
+
+	// 49: items scans found at a new path
+	`ALTER TABLE scans ADD COLUMN moved INTEGER NOT NULL DEFAULT 0;`,
+
+	// 50: items a user has reviewed
+	`ALTER TABLE media ADD COLUMN organized INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX idx_media_organized ON media(organized, created_at);`,
+
+	// 51: re-probe photos to read when they were taken
+	`UPDATE media SET probed = 0 WHERE type IN ('image', 'raw') AND taken_at IS NULL;`,
+
+	// 52: the order media listings are paged through by cursor
+	`CREATE INDEX idx_media_created ON media(created_at, id);`,
+
+	// 53: tags given to staged files' items on commit, as a JSON list
+	`ALTER TABLE staged_files ADD COLUMN tags TEXT NOT NULL DEFAULT '[]';`,
+
+	// 54: the files of items besides their primary file. Versions linked
+	// as extras become files of their item, which takes over their tags,
+	// people, genres, attributes and albums; those with attachments are
+	// listed on their own again, so no attachment is lost.
+	`CREATE TABLE media_files (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		media_id INTEGER NOT NULL REFERENCES media(id) ON DELETE CASCADE,
+		path TEXT NOT NULL UNIQUE,
+		filename TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		mime_type TEXT NOT NULL DEFAULT '',
+		checksum TEXT NOT NULL DEFAULT '',
+		oshash TEXT NOT NULL DEFAULT '',
+		file_mod_time DATETIME,
+		file_birth_time DATETIME,
+		width INTEGER NOT NULL DEFAULT 0,
+		height INTEGER NOT NULL DEFAULT 0,
+		duration REAL NOT NULL DEFAULT 0,
+		video_codec TEXT NOT NULL DEFAULT '',
+		audio_codec TEXT NOT NULL DEFAULT '',
+		bitrate INTEGER NOT NULL DEFAULT 0,
+		container TEXT NOT NULL DEFAULT '',
+		created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX idx_media_files_media ON media_files(media_id);
+	UPDATE media SET extra = '', parent_id = NULL
+		WHERE extra = 'version' AND id IN (SELECT media_id FROM media_attachments);
+	INSERT INTO media_files (media_id, path, filename, size, type, mime_type, checksum, oshash,
+			file_mod_time, file_birth_time, width, height, duration, video_codec, audio_codec,
+			bitrate, container, created_at)
+		SELECT parent_id, path, filename, size, type, mime_type, checksum, oshash,
+			file_mod_time, file_birth_time, width, height, duration, video_codec, audio_codec,
+			bitrate, container, created_at
+		FROM media WHERE extra = 'version' AND parent_id IS NOT NULL;
+	INSERT OR IGNORE INTO media_tags (media_id, tag_id)
+		SELECT m.parent_id, t.tag_id FROM media_tags t JOIN media m ON m.id = t.media_id
+		WHERE m.extra = 'version' AND m.parent_id IS NOT NULL;
+	INSERT OR IGNORE INTO media_people (media_id, person_id)
+		SELECT m.parent_id, p.person_id FROM media_people p JOIN media m ON m.id = p.media_id
+		WHERE m.extra = 'version' AND m.parent_id IS NOT NULL;
+	INSERT OR IGNORE INTO media_genres (media_id, name)
+		SELECT m.parent_id, g.name FROM media_genres g JOIN media m ON m.id = g.media_id
+		WHERE m.extra = 'version' AND m.parent_id IS NOT NULL;
+	INSERT OR IGNORE INTO media_attributes (media_id, key, value)
+		SELECT m.parent_id, a.key, a.value FROM media_attributes a JOIN media m ON m.id = a.media_id
+		WHERE m.extra = 'version' AND m.parent_id IS NOT NULL;
+	INSERT OR IGNORE INTO collection_items (collection_id, media_id, position)
+		SELECT c.collection_id, m.parent_id, c.position FROM collection_items c JOIN media m ON m.id = c.media_id
+		WHERE m.extra = 'version' AND m.parent_id IS NOT NULL;
+	UPDATE collections SET cover_id = (SELECT parent_id FROM media WHERE id = cover_id)
+		WHERE cover_id IN (SELECT id FROM media WHERE extra = 'version' AND parent_id IS NOT NULL);
+	DELETE FROM media WHERE extra = 'version' AND parent_id IS NOT NULL;
+	UPDATE media SET extra = '' WHERE extra = 'version';`,
+}
+
+func migrateDB(db *sqlx.DB) error {
+	var version int
+	if err := db.Get(&version, "PRAGMA user_version"); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Beginx()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		log.Infof("Applied database migration %d", i+1)
+	}
+
+	return nil
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Dedup analysis states.
+const (
+	analysisRunning     = "running"
+	analysisCompleted   = "completed"
+	analysisFailed      = "failed"
+	analysisInterrupted = "interrupted"
+)
+
+// Events published while a dedup analysis runs.
+const (
+	eventDedupProgress = "dedup_progress"
+	eventDedupFinished = "dedup_finished"
+)
+
+// Limits of the average chunk size an analysis can ask for. Smaller chunks
+// find more redundancy but need more memory, about 50 bytes per chunk.
+const (
+	defaultChunkSize = 64 << 10
+	minChunkSize     = 4 << 10
+	maxChunkSize     = 4 << 20
+)
+
+// maxDedupFiles is the number of files listed in an analysis report.
+const maxDedupFiles = 100
+
+// errAnalysisRunning is returned when starting an analysis while another
+// one is running.
+var errAnalysisRunning = errors.New("a dedup analysis is already running")
+
+// gearTable holds the random values the rolling hash adds for each byte.
+// They are generated from a fixed seed so chunk boundaries, and with them
+// the results, are the same from run to run.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x6d656469614f7267)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker splits a stream into content-defined chunks: boundaries are where
+// a rolling hash of the last bytes matches a mask, so inserting or removing
+// data only moves the boundaries near the change. Chunks are between a
+// quarter and four times the average size.
+type chunker struct {
+	r   io.Reader
+	buf []byte
+	// n is the number of bytes in buf, of which the first last belong to
+	// the chunk returned last.
+	n    int
+	last int
+	eof  bool
+	min  int
+	mask uint64
+}
+
+func newChunker(r io.Reader, avg int) *chunker {
+	// The mask covers the top bits, which depend on the most bytes
+	maskBits := bits.TrailingZeros(uint(avg))
+	return &chunker{
+		r:    r,
+		buf:  make([]byte, avg*4),
+		min:  avg / 4,
+		mask: (uint64(1)<<maskBits - 1) << (64 - maskBits),
+	}
+}
+
+// next returns the next chunk, which is only valid until the following
+// call, or io.EOF at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	// Move the rest of the previous read to the front and fill up
+	c.n = copy(c.buf, c.buf[c.last:c.n])
+	if !c.eof && c.n < len(c.buf) {
+		read, err := io.ReadFull(c.r, c.buf[c.n:])
+		c.n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.n == 0 {
+		return nil, io.EOF
+	}
+
+	cut := c.n
+	if c.n > c.min {
+		var h uint64
+		for i := c.min; i < c.n; i++ {
+			h = h<<1 + gearTable[c.buf[i]]
+			if h&c.mask == 0 {
+				cut = i + 1
+				break
+			}
+		}
+	}
+
+	c.last = cut
+	return c.buf[:cut], nil
+}
+
+// DedupAnalysis is a run of the dedup analysis. Redundancy is measured in
+// chunks: UniqueBytes is the size of the distinct chunks, so the library
+// would shrink by Savings with block-level deduplication. WholeFileBytes is
+// the part of that coming from files that are complete copies of others,
+// which deleting or hard-linking them would already save.
+type DedupAnalysis struct {
+	ID     int    `db:"id" json:"id"`
+	Status string `db:"status" json:"status"`
+	// Filter is the query string of media filters the analysis was
+	// started with.
+	Filter         string     `db:"filter" json:"filter"`
+	ChunkSize      int        `db:"chunk_size" json:"chunk_size"`
+	Files          int        `db:"files" json:"files"`
+	Errors         int        `db:"errors" json:"errors"`
+	TotalBytes     int64      `db:"total_bytes" json:"total_bytes"`
+	UniqueBytes    int64      `db:"unique_bytes" json:"unique_bytes"`
+	WholeFileBytes int64      `db:"whole_file_bytes" json:"whole_file_bytes"`
+	Chunks         int64      `db:"chunks" json:"chunks"`
+	UniqueChunks   int64      `db:"unique_chunks" json:"unique_chunks"`
+	Savings        int64      `db:"-" json:"savings"`
+	Error          string     `db:"error" json:"error"`
+	StartedAt      time.Time  `db:"started_at" json:"started_at"`
+	FinishedAt     *time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// DedupFile is a file that shares data with other files, or repeats data
+// within itself.
+type DedupFile struct {
+	AnalysisID int    `db:"analysis_id" json:"-"`
+	MediaID    int    `db:"media_id" json:"media_id"`
+	Path       string `db:"path" json:"path"`
+	Size       int64  `db:"size" json:"size"`
+	// RedundantBytes are the bytes of the file found earlier in the
+	// analysis, in this or another file.
+	RedundantBytes int64 `db:"redundant_bytes" json:"redundant_bytes"`
+	// SharesWith is the other item the file has the most data in common
+	// with, nil if the repeats are all within the file.
+	SharesWith *int `db:"shares_with" json:"shares_with"`
+}
+
+// interruptAnalyses marks the analyses a previous run of the server left
+// running as interrupted. Analyses can't be resumed; they keep what they
+// had counted.
+func (app *App) interruptAnalyses() error {
+	_, err := app.DB.Exec(
+		"UPDATE dedup_analyses SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE status = ?",
+		analysisInterrupted, analysisRunning,
+	)
+	return err
+}
+
+// dedupRun is the state of a running analysis.
+type dedupRun struct {
+	app      *App
+	analysis *DedupAnalysis
+	// owners maps the hash of every chunk seen to the item it was first
+	// seen in.
+	owners map[[16]byte]int
+}
+
+// chunkFile chunks one file, adding its chunks to the run's totals and
+// recording it if any of them were seen before.
+func (d *dedupRun) chunkFile(item *MediaItem) error {
+	f, err := os.Open(item.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var size, redundant int64
+	shared := map[int]int64{}
+	c := newChunker(f, d.analysis.ChunkSize)
+	for {
+		chunk, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(chunk)
+		var key [16]byte
+		copy(key[:], sum[:])
+
+		// Totals are counted as chunks are read, so they stay consistent
+		// if reading fails halfway
+		size += int64(len(chunk))
+		d.analysis.TotalBytes += int64(len(chunk))
+		d.analysis.Chunks++
+		if owner, ok := d.owners[key]; ok {
+			redundant += int64(len(chunk))
+			shared[owner] += int64(len(chunk))
+			continue
+		}
+		d.owners[key] = item.ID
+		d.analysis.UniqueChunks++
+		d.analysis.UniqueBytes += int64(len(chunk))
+	}
+
+	d.analysis.Files++
+	if redundant == 0 {
+		return nil
+	}
+	if redundant == size {
+		d.analysis.WholeFileBytes += size
+	}
+
+	var sharesWith *int
+	for owner, n := range shared {
+		if owner != item.ID && (sharesWith == nil || n > shared[*sharesWith]) {
+			owner := owner
+			sharesWith = &owner
+		}
+	}
+	_, err = d.app.DB.Exec(
+		"INSERT INTO dedup_files (analysis_id, media_id, redundant_bytes, shares_with) VALUES (?, ?, ?, ?)",
+		d.analysis.ID, item.ID, redundant, sharesWith,
+	)
+	return err
+}
+
+// saveAnalysis writes the counters of an analysis to its record.
+func (app *App) saveAnalysis(a *DedupAnalysis) error {
+	_, err := app.DB.NamedExec(
+		`UPDATE dedup_analyses SET status = :status, files = :files, errors = :errors,
+			total_bytes = :total_bytes, unique_bytes = :unique_bytes, whole_file_bytes = :whole_file_bytes,
+			chunks = :chunks, unique_chunks = :unique_chunks, error = :error, finished_at = :finished_at
+			WHERE id = :id`,
+		a,
+	)
+	return err
+}
+
+// runAnalysis chunks the items in order, saving the totals after every
+// file so a report can be read while the analysis runs. Files are only
+// read.
+func (app *App) runAnalysis(a *DedupAnalysis, items []MediaItem) {
+	log.Infof("Starting dedup analysis %d of %d files", a.ID, len(items))
+	d := &dedupRun{app: app, analysis: a, owners: map[[16]byte]int{}}
+
+	var failure error
+	for i := range items {
+		app.Processing.wait()
+		if err := d.chunkFile(&items[i]); err != nil {
+			log.Warnf("Dedup analysis %d: failed to read %s: %v", a.ID, items[i].Path, err)
+			a.Errors++
+		}
+		if err := app.saveAnalysis(a); err != nil {
+			failure = err
+			break
+		}
+		app.Events.publish(eventDedupProgress, a.withSavings())
+	}
+
+	now := time.Now().UTC()
+	a.Status, a.FinishedAt = analysisCompleted, &now
+	if failure != nil {
+		a.Status, a.Error = analysisFailed, failure.Error()
+	}
+	if err := app.saveAnalysis(a); err != nil {
+		log.Errorf("Failed to record dedup analysis %d: %v", a.ID, err)
+	}
+
+	log.Infof("Dedup analysis %d finished: %d of %d bytes unique", a.ID, a.UniqueBytes, a.TotalBytes)
+	app.Events.publish(eventDedupFinished, a.withSavings())
+}
+
+// withSavings returns a copy of the analysis with Savings filled in.
+func (a DedupAnalysis) withSavings() DedupAnalysis {
+	a.Savings = a.TotalBytes - a.UniqueBytes
+	return a
+}
+
+// startAnalysis analyzes the items matching the media filters in the query
+// string in the background. Only one analysis runs at a time. The response
+// is the new analysis, whose report fills in as it runs.
+func (app *App) startAnalysis(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chunkSize := defaultChunkSize
+	if v := query.Get("chunk_size"); v != "" {
+		size, err := strconv.Atoi(v)
+		if err != nil || size < minChunkSize || size > maxChunkSize || size&(size-1) != 0 {
+			http.Error(w, fmt.Sprintf("chunk_size must be a power of two from %d to %d", minChunkSize, maxChunkSize), http.StatusBadRequest)
+			return
+		}
+		chunkSize = size
+	}
+	query.Del("chunk_size")
+
+	filter, err := parseMediaFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items []MediaItem
+	where, args := filter.where()
+	if err := app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY id", args...); err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	res, err := app.DB.Exec(
+		`INSERT INTO dedup_analyses (status, filter, chunk_size) SELECT ?, ?, ?
+			WHERE NOT EXISTS (SELECT 1 FROM dedup_analyses WHERE status = ?)`,
+		analysisRunning, query.Encode(), chunkSize, analysisRunning,
+	)
+	var id int64
+	if err == nil {
+		if id, err = res.LastInsertId(); err == nil {
+			var n int64
+			if n, err = res.RowsAffected(); err == nil && n == 0 {
+				err = errAnalysisRunning
+			}
+		}
+	}
+	if err == errAnalysisRunning {
+		http.Error(w, "A dedup analysis is already running", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to record dedup analysis:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var analysis DedupAnalysis
+	if err := app.DB.Get(&analysis, "SELECT * FROM dedup_analyses WHERE id = ?", id); err != nil {
+		log.Error("Failed to fetch dedup analysis:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	started := analysis.withSavings()
+	go app.runAnalysis(&analysis, items)
+
+	app.writeJSON(w, r, http.StatusAccepted, started)
+}
+
+func (app *App) getAnalyses(w http.ResponseWriter, r *http.Request) {
+	analyses := []DedupAnalysis{}
+	if err := app.DB.Select(&analyses, "SELECT * FROM dedup_analyses ORDER BY id DESC"); err != nil {
+		log.Error("Failed to fetch dedup analyses:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range analyses {
+		analyses[i] = analyses[i].withSavings()
+	}
+	app.writeJSON(w, r, http.StatusOK, analyses)
+}
+
+// getAnalysis returns an analysis with the files holding the most
+// redundant data.
+func (app *App) getAnalysis(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid analysis ID", http.StatusBadRequest)
+		return
+	}
+
+	var analysis DedupAnalysis
+	err = app.DB.Get(&analysis, "SELECT * FROM dedup_analyses WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Dedup analysis not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to fetch dedup analysis:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	files := []DedupFile{}
+	err = app.DB.Select(&files,
+		`SELECT f.*, m.path, m.size FROM dedup_files f JOIN media m ON m.id = f.media_id
+			WHERE f.analysis_id = ? ORDER BY f.redundant_bytes DESC, f.media_id LIMIT ?`,
+		id, maxDedupFiles,
+	)
+	if err != nil {
+		log.Error("Failed to fetch dedup files:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"analysis": analysis.withSavings(),
+		"files":    files,
+	})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// deleteSampleSize is the number of items listed in a delete preview.
+const deleteSampleSize = 10
+
+const actionDeleteMedia = "delete_media"
+
+const actionDeleteFile = "delete_file"
+
+// deletePlan is what a delete confirmation token executes: the previewed
+// items, and whether their files go to the trash with them.
+type deletePlan struct {
+	IDs   []int `json:"ids"`
+	Files bool  `json:"files"`
+}
+
+// previewDelete selects the media items a bulk delete would move to the
+// trash and returns a summary with the token needed to actually delete
+// them. Nothing is deleted by this request.
+func (app *App) previewDelete(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs    []int        `json:"ids"`
+		Filter *MediaFilter `json:"filter"`
+		Files  bool         `json:"files"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// An empty filter matches everything, so it has to be given explicitly
+	if len(req.IDs) == 0 && req.Filter == nil {
+		http.Error(w, "ids or filter is required", http.StatusBadRequest)
+		return
+	}
+
+	items, err := app.selectMedia(req.IDs, req.Filter)
+	if err != nil {
+		log.Error("Failed to select media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Locked items are never deleted in bulk, only reported
+	var ids []int
+	var size int64
+	var unlocked []MediaItem
+	locked := 0
+	for _, item := range items {
+		if item.Locked {
+			locked++
+			continue
+		}
+		ids = append(ids, item.ID)
+		size += item.Size
+		unlocked = append(unlocked, item)
+	}
+
+	sample := unlocked
+	if len(sample) > deleteSampleSize {
+		sample = sample[:deleteSampleSize]
+	}
+
+	preview := map[string]interface{}{
+		"count":  len(ids),
+		"size":   size,
+		"locked": locked,
+		"files":  req.Files,
+		"sample": append([]MediaItem{}, sample...),
+	}
+
+	// The token is bound to the previewed IDs, so items matching the
+	// filter by the time it is used are not deleted unseen
+	if len(ids) > 0 {
+		token, expires, err := app.issueConfirmation(actionDeleteMedia, deletePlan{ids, req.Files})
+		if err != nil {
+			log.Error("Failed to issue confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		preview["token"] = token
+		preview["expires_at"] = expires
+	}
+
+	app.writeJSON(w, r, http.StatusOK, preview)
+}
+
+// deleteMedia moves the media items of a previewed delete to the trash,
+// along with their files if the preview asked for it. Otherwise files on
+// disk are left alone.
+func (app *App) deleteMedia(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "token is required; request a preview first", http.StatusBadRequest)
+		return
+	}
+
+	var plan deletePlan
+	err := app.redeemConfirmation(req.Token, actionDeleteMedia, &plan)
+	if err == errInvalidConfirmation {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to redeem confirmation token:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	deleted, err := app.trashMediaItems(plan.IDs, plan.Files)
+	if err != nil {
+		log.Error("Failed to delete media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Moved %d media items to the trash", deleted)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"deleted": deleted,
+	})
+}
+
+// selectMedia returns the items matching a filter, limited to the given IDs
+// if there are any, for bulk operations.
+func (app *App) selectMedia(ids []int, filter *MediaFilter) ([]MediaItem, error) {
+	var where string
+	var args []interface{}
+	if filter != nil {
+		where, args = filter.where()
+	}
+	if len(ids) > 0 {
+		if where == "" {
+			where = " WHERE id IN (?)"
+		} else {
+			where += " AND id IN (?)"
+		}
+		args = append(args, ids)
+	}
+
+	var items []MediaItem
+	query, args, err := sqlx.In("SELECT * FROM media"+where+" ORDER BY id", args...)
+	if err != nil {
+		return nil, err
+	}
+	return items, app.DB.Select(&items, app.DB.Rebind(query), args...)
+}
+
+// deleteMediaItem deletes one item. By default it goes to the trash like a
+// bulk delete, leaving its file alone. With ?deleteFile=true its files,
+// including those of its versions, are removed from disk for good, along
+// with the item and its thumbnail and attachments, if the configuration
+// allows it. That takes two requests:
+// the first returns the item with a token and deletes nothing, and the
+// second, with ?token=, deletes it.
+func (app *App) deleteMediaItem(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+	if item.Locked {
+		http.Error(w, "Media item is locked", http.StatusConflict)
+		return
+	}
+
+	// A misspelt parameter would quietly trash the item instead
+	query := r.URL.Query()
+	for name := range query {
+		if name != "deleteFile" && name != "token" {
+			http.Error(w, fmt.Sprintf("Unknown parameter: %s", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if query.Get("deleteFile") != "true" {
+		deleted, err := app.trashMediaItems([]int{item.ID}, false)
+		if err != nil {
+			log.Error("Failed to delete media item:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Moved media item %d to the trash", item.ID)
+		app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"deleted": deleted,
+		})
+		return
+	}
+
+	if !app.Config.Trash.AllowFileDeletion {
+		http.Error(w, "Deleting files is disabled; set trash.allow_file_deletion", http.StatusForbidden)
+		return
+	}
+	if app.immutable(item) {
+		http.Error(w, "Media item is in an immutable library", http.StatusConflict)
+		return
+	}
+
+	token := query.Get("token")
+	if token == "" {
+		token, expires, err := app.issueConfirmation(actionDeleteFile, item.ID)
+		if err != nil {
+			log.Error("Failed to issue confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"item":       item,
+			"token":      token,
+			"expires_at": expires,
+		})
+		return
+	}
+
+	var id int
+	err := app.redeemConfirmation(token, actionDeleteFile, &id)
+	if err == nil && id != item.ID {
+		err = errInvalidConfirmation
+	}
+	if err == errInvalidConfirmation {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to redeem confirmation token:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	versions, err := app.itemVersions(item.ID)
+	if err != nil {
+		log.Error("Failed to fetch versions:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The files go first, so a failure leaves the item pointing at them
+	paths := []string{item.Path}
+	for _, version := range versions {
+		paths = append(paths, version.Path)
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Error("Failed to delete file:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err := app.DB.Exec("DELETE FROM media WHERE id = ?", item.ID); err != nil {
+		log.Error("Failed to delete media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := removeGeneratedFiles(item.ID, item.Thumbnail); err != nil {
+		log.Warn("Failed to remove generated files of deleted media item:", err)
+	}
+	log.Infof("Deleted media item %d and its file %s", item.ID, item.Path)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"deleted":      1,
+		"file_deleted": true,
+	})
+}
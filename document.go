@@ -0,0 +1,370 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxDocumentText caps the text stored per document, so a huge book
+// doesn't bloat the database. Search only finds text before the cut.
+const maxDocumentText = 1 << 20
+
+// epubCharsPerPage is used to estimate the page count of EPUBs, which
+// reflow and have no pages of their own.
+const epubCharsPerPage = 1500
+
+// thumbnailSize is the longest side in pixels of rendered thumbnails.
+const thumbnailSize = 320
+
+// pdfTools are the paths of the Poppler tools, each empty if not found.
+type pdfTools struct {
+	Info   string
+	Text   string
+	Render string
+}
+
+// documentInfo is what is extracted from a document.
+type documentInfo struct {
+	Pages     int
+	Content   string
+	Thumbnail string
+}
+
+// probeDocument stores the page count, text and thumbnail of a document
+// item.
+func (app *App) probeDocument(item *MediaItem) error {
+	var info *documentInfo
+	var err error
+	switch strings.ToLower(filepath.Ext(item.Path)) {
+	case ".pdf":
+		info, err = app.probePDF(item)
+	case ".epub":
+		info, err = probeEPUB(item)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = app.DB.Exec(
+		"UPDATE media SET pages = ?, content = ?, thumbnail = ?, probed = 1 WHERE id = ?",
+		info.Pages, info.Content, info.Thumbnail, item.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	item.Pages = info.Pages
+	item.Content = info.Content
+	item.Thumbnail = info.Thumbnail
+	item.Probed = true
+	return nil
+}
+
+// probePDF reads a PDF's page count with pdfinfo, its text with pdftotext
+// and renders its first page with pdftoppm. Only pdfinfo is required; the
+// text and thumbnail are left empty without the other tools.
+func (app *App) probePDF(item *MediaItem) (*documentInfo, error) {
+	if app.PDF.Info == "" {
+		return nil, errProbeUnavailable
+	}
+
+	out, err := runTool(app.PDF.Info, item.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &documentInfo{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if v := strings.TrimPrefix(line, "Pages:"); v != line {
+			info.Pages, _ = strconv.Atoi(strings.TrimSpace(v))
+			break
+		}
+	}
+
+	// A document whose text or thumbnail fails is still worth its page
+	// count
+	if app.PDF.Text != "" {
+		text, err := runTool(app.PDF.Text, "-q", "-enc", "UTF-8", item.Path, "-")
+		if err != nil {
+			log.Warnf("Failed to extract text of %s: %v", item.Path, err)
+		}
+		info.Content = normalizeText(string(text))
+	}
+
+	if app.PDF.Render != "" {
+		if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
+			return nil, err
+		}
+
+		// pdftoppm adds the extension to the output name itself
+		name := strconv.Itoa(item.ID)
+		_, err := runTool(app.PDF.Render,
+			"-q", "-png", "-f", "1", "-l", "1", "-singlefile",
+			"-scale-to", strconv.Itoa(thumbnailSize),
+			item.Path, filepath.Join(thumbnailDir, name),
+		)
+		if err != nil {
+			log.Warnf("Failed to render thumbnail of %s: %v", item.Path, err)
+		} else {
+			info.Thumbnail = name + ".png"
+		}
+	}
+
+	return info, nil
+}
+
+// normalizeText collapses runs of whitespace, so searches match across
+// line breaks, and truncates the text to maxDocumentText.
+func normalizeText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > maxDocumentText {
+		s = strings.ToValidUTF8(s[:maxDocumentText], "")
+	}
+	return s
+}
+
+// epubPackage is the part of an EPUB's OPF package document needed to find
+// its text and cover.
+type epubPackage struct {
+	Meta []struct {
+		Name    string `xml:"name,attr"`
+		Content string `xml:"content,attr"`
+	} `xml:"metadata>meta"`
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine []struct {
+		IDRef string `xml:"idref,attr"`
+	} `xml:"spine>itemref"`
+}
+
+// probeEPUB reads the text of an EPUB in reading order and copies its cover
+// image as the thumbnail.
+func probeEPUB(item *MediaItem) (*documentInfo, error) {
+	zr, err := zip.OpenReader(item.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := decodeZipXML(files["META-INF/container.xml"], &container); err != nil {
+		return nil, fmt.Errorf("reading container.xml: %v", err)
+	}
+	if len(container.Rootfiles) == 0 {
+		return nil, fmt.Errorf("container.xml names no package document")
+	}
+
+	opfPath := container.Rootfiles[0].FullPath
+	var pkg epubPackage
+	if err := decodeZipXML(files[opfPath], &pkg); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", opfPath, err)
+	}
+
+	// Manifest hrefs are URLs relative to the package document
+	resolve := func(href string) string {
+		if unescaped, err := url.PathUnescape(href); err == nil {
+			href = unescaped
+		}
+		return path.Join(path.Dir(opfPath), href)
+	}
+
+	hrefs := map[string]string{}
+	coverID := ""
+	for _, m := range pkg.Manifest {
+		hrefs[m.ID] = resolve(m.Href)
+		if coverID == "" && strings.Contains(" "+m.Properties+" ", " cover-image ") {
+			coverID = m.ID
+		}
+	}
+	if coverID == "" {
+		// EPUB 2 names the cover in a meta element instead
+		for _, meta := range pkg.Meta {
+			if meta.Name == "cover" {
+				coverID = meta.Content
+			}
+		}
+	}
+
+	var text strings.Builder
+	chars := 0
+	for _, ref := range pkg.Spine {
+		f := files[hrefs[ref.IDRef]]
+		if f == nil {
+			continue
+		}
+		s, err := htmlText(f)
+		if err != nil {
+			log.Warnf("Failed to extract text of %s in %s: %v", f.Name, item.Path, err)
+			continue
+		}
+		s = strings.Join(strings.Fields(s), " ")
+		if s == "" {
+			continue
+		}
+
+		chars += utf8.RuneCountInString(s)
+		if text.Len() < maxDocumentText {
+			if text.Len() > 0 {
+				text.WriteByte(' ')
+			}
+			text.WriteString(s)
+		}
+	}
+
+	info := &documentInfo{
+		Pages:   (chars + epubCharsPerPage - 1) / epubCharsPerPage,
+		Content: normalizeText(text.String()),
+	}
+
+	if f := files[hrefs[coverID]]; f != nil {
+		name := strconv.Itoa(item.ID) + strings.ToLower(path.Ext(f.Name))
+		if err := copyZipFile(f, filepath.Join(thumbnailDir, name)); err != nil {
+			log.Warnf("Failed to extract cover of %s: %v", item.Path, err)
+		} else {
+			info.Thumbnail = name
+		}
+	}
+
+	return info, nil
+}
+
+func decodeZipXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return os.ErrNotExist
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
+
+// htmlBlocks are the elements that separate words, unlike inline elements
+// such as <em>.
+var htmlBlocks = map[string]bool{
+	"address": true, "blockquote": true, "br": true, "dd": true, "div": true,
+	"dt": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "li": true, "p": true, "pre": true, "section": true,
+	"td": true, "th": true, "tr": true,
+}
+
+// htmlText returns the text of an XHTML document, leaving out its head and
+// scripts.
+func htmlText(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	// Books in the wild aren't always well-formed XML
+	d := xml.NewDecoder(rc)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	var text strings.Builder
+	skip := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return text.String(), nil
+		}
+		if err != nil {
+			return text.String(), err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch name := strings.ToLower(t.Name.Local); {
+			case name == "head" || name == "script" || name == "style":
+				skip++
+			case htmlBlocks[name]:
+				text.WriteByte(' ')
+			}
+		case xml.EndElement:
+			switch name := strings.ToLower(t.Name.Local); {
+			case name == "head" || name == "script" || name == "style":
+				skip--
+			case htmlBlocks[name]:
+				text.WriteByte(' ')
+			}
+		case xml.CharData:
+			if skip == 0 {
+				text.Write(t)
+			}
+		}
+	}
+}
+
+// copyZipFile extracts f to dst, up to maxArtworkSize bytes.
+func copyZipFile(f *zip.File, dst string) error {
+	if f.UncompressedSize64 > maxArtworkSize {
+		return fmt.Errorf("%s exceeds %d bytes", f.Name, maxArtworkSize)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.LimitReader(rc, maxArtworkSize))
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func (app *App) getThumbnail(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if item.Thumbnail == "" {
+		http.Error(w, "Media item has no thumbnail", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, filepath.Join(thumbnailDir, item.Thumbnail))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// eventBuffer is the number of events queued per subscriber. Events for a
+// subscriber that falls this far behind are dropped rather than blocking
+// the publisher.
+const eventBuffer = 64
+
+// eventKeepAlive is the interval of the comments sent to keep idle event
+// streams from being closed by proxies.
+const eventKeepAlive = 30 * time.Second
+
+// event is a message pushed to /api/events subscribers.
+type event struct {
+	Type string
+	Data interface{}
+}
+
+// eventHub fans events out to the connected subscribers.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+	// sinks, if set, also get every event, delivered reliably rather
+	// than dropped.
+	sinks *eventSinks
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan event]struct{})}
+}
+
+func (h *eventHub) subscribe() chan event {
+	ch := make(chan event, eventBuffer)
+
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// publish sends an event to every subscriber without waiting for any of
+// them.
+func (h *eventHub) publish(typ string, data interface{}) {
+	if h.sinks != nil {
+		h.sinks.enqueue(typ, data)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subs {
+		select {
+		case ch <- event{Type: typ, Data: data}:
+		default:
+		}
+	}
+}
+
+// streamEvents sends events to the client as Server-Sent Events until it
+// disconnects.
+func (app *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	profile := app.responseProfile(r)
+
+	ch := app.Events.subscribe()
+	defer app.Events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+
+		case e := <-ch:
+			data := e.Data
+			if profile.Case == caseCamel || profile.Time == timeUnix {
+				data = profile.shape(reflect.ValueOf(data))
+			}
+			encoded, err := json.Marshal(data)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, encoded)
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// errNoEXIF is returned for files without EXIF data.
+var errNoEXIF = errors.New("no EXIF data")
+
+// EXIF tags used by readEXIF.
+const (
+	tagMake         = 0x010f
+	tagModel        = 0x0110
+	tagOrientation  = 0x0112
+	tagExifIFD      = 0x8769
+	tagGPSIFD       = 0x8825
+	tagDateOriginal = 0x9003
+	tagTimeOffset   = 0x9011
+	tagGPSLatRef    = 0x0001
+	tagGPSLatitude  = 0x0002
+	tagGPSLonRef    = 0x0003
+	tagGPSLongitude = 0x0004
+)
+
+// exifData is the EXIF metadata of an image that the application uses.
+type exifData struct {
+	// Latitude and Longitude are in decimal degrees, nil if the image has
+	// no GPS position.
+	Latitude  *float64
+	Longitude *float64
+	// Orientation is how the image is stored relative to how it is
+	// viewed, 1 to 8, or 0 if the image doesn't say; see orientImage.
+	Orientation int
+	// Camera is the make and model of the camera that took the image,
+	// empty if it doesn't say.
+	Camera string
+	// TakenAt is when the image was taken, nil if it doesn't say.
+	TakenAt *time.Time
+}
+
+// exifTime reads an EXIF date, e.g. "2019:07:04 21:30:00", in the zone of
+// its offset, e.g. "+02:00". Dates without one are the camera's clock, and
+// taken as local time so photos land on the day they were taken. Cameras
+// without a clock write zeros or blanks, which aren't dates.
+func exifTime(date, offset string) (time.Time, bool) {
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", date, time.Local)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		if zoned, err := time.Parse("2006:01:02 15:04:05-07:00", date+offset); err == nil {
+			t = zoned
+		}
+	}
+	return t.UTC(), true
+}
+
+// readEXIF reads the EXIF metadata of a JPEG file.
+func readEXIF(path string) (*exifData, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tiff, err := jpegEXIF(bufio.NewReader(f))
+	if err != nil {
+		return nil, err
+	}
+	return parseEXIF(tiff)
+}
+
+// jpegEXIF returns the TIFF structure inside a JPEG's Exif APP1 segment. It
+// stops at the image data, as EXIF comes before it.
+func jpegEXIF(r io.Reader) ([]byte, error) {
+	var marker [2]byte
+	if _, err := io.ReadFull(r, marker[:]); err != nil || marker != [2]byte{0xff, 0xd8} {
+		return nil, errNoEXIF
+	}
+
+	for {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, errNoEXIF
+		}
+		if header[0] != 0xff {
+			return nil, errNoEXIF
+		}
+		// Start of scan: the image data follows
+		if header[1] == 0xda {
+			return nil, errNoEXIF
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:])) - 2
+		if length < 0 {
+			return nil, errNoEXIF
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, errNoEXIF
+		}
+
+		if header[1] == 0xe1 && len(data) > 6 && string(data[:6]) == "Exif\x00\x00" {
+			return data[6:], nil
+		}
+	}
+}
+
+// ifdEntry is a field of a TIFF image file directory, with its value
+// resolved whether it is stored inline or at an offset.
+type ifdEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// tiffTypeSizes are the sizes in bytes of the TIFF field types.
+var tiffTypeSizes = map[uint16]uint32{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4,
+}
+
+type tiffReader struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// ifd reads the directory at offset.
+func (t *tiffReader) ifd(offset uint32) (map[uint16]ifdEntry, error) {
+	if uint64(offset)+2 > uint64(len(t.b)) {
+		return nil, errNoEXIF
+	}
+	n := uint32(t.order.Uint16(t.b[offset:]))
+	if uint64(offset)+2+uint64(n)*12 > uint64(len(t.b)) {
+		return nil, errNoEXIF
+	}
+
+	entries := make(map[uint16]ifdEntry, n)
+	for i := uint32(0); i < n; i++ {
+		e := t.b[offset+2+i*12:]
+		entry := ifdEntry{typ: t.order.Uint16(e[2:]), count: t.order.Uint32(e[4:])}
+
+		size, ok := tiffTypeSizes[entry.typ]
+		if !ok {
+			continue
+		}
+		total := uint64(size) * uint64(entry.count)
+		if total <= 4 {
+			entry.value = e[8 : 8+total]
+		} else {
+			start := uint64(t.order.Uint32(e[8:]))
+			if start+total > uint64(len(t.b)) {
+				continue
+			}
+			entry.value = t.b[start : start+total]
+		}
+		entries[t.order.Uint16(e)] = entry
+	}
+	return entries, nil
+}
+
+// long returns the entry's first SHORT or LONG value.
+func (t *tiffReader) long(e ifdEntry) (uint32, bool) {
+	switch {
+	case e.typ == 3 && len(e.value) >= 2:
+		return uint32(t.order.Uint16(e.value)), true
+	case e.typ == 4 && len(e.value) >= 4:
+		return t.order.Uint32(e.value), true
+	}
+	return 0, false
+}
+
+// ascii returns the entry's ASCII value without its terminating NULs.
+func (t *tiffReader) ascii(e ifdEntry) string {
+	if e.typ != 2 {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(string(e.value), "\x00"))
+}
+
+// degrees converts a GPS coordinate, stored as three RATIONALs of degrees,
+// minutes and seconds, to decimal degrees.
+func (t *tiffReader) degrees(e ifdEntry) (float64, bool) {
+	if e.typ != 5 || e.count < 3 {
+		return 0, false
+	}
+
+	var v float64
+	for i, unit := range []float64{1, 60, 3600} {
+		num := t.order.Uint32(e.value[i*8:])
+		den := t.order.Uint32(e.value[i*8+4:])
+		if den == 0 {
+			return 0, false
+		}
+		v += float64(num) / float64(den) / unit
+	}
+	return v, true
+}
+
+// parseEXIF reads the fields the application uses from a TIFF structure.
+func parseEXIF(b []byte) (*exifData, error) {
+	if len(b) < 8 {
+		return nil, errNoEXIF
+	}
+
+	t := &tiffReader{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return nil, errNoEXIF
+	}
+
+	ifd0, err := t.ifd(t.order.Uint32(b[4:]))
+	if err != nil {
+		return nil, err
+	}
+
+	data := &exifData{}
+	if orientation, ok := t.long(ifd0[tagOrientation]); ok && orientation >= 1 && orientation <= 8 {
+		data.Orientation = int(orientation)
+	}
+	maker, model := t.ascii(ifd0[tagMake]), t.ascii(ifd0[tagModel])
+	// Models usually repeat the make, as in "Canon" "Canon EOS R5"
+	if !strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		model = strings.TrimSpace(maker + " " + model)
+	}
+	data.Camera = model
+
+	// Only the original date is when the shutter fired; IFD0's DateTime is
+	// when the file was last changed, so it isn't a capture time
+	if offset, ok := t.long(ifd0[tagExifIFD]); ok {
+		if sub, err := t.ifd(offset); err == nil {
+			if taken, ok := exifTime(t.ascii(sub[tagDateOriginal]), t.ascii(sub[tagTimeOffset])); ok {
+				data.TakenAt = &taken
+			}
+		}
+	}
+
+	if offset, ok := t.long(ifd0[tagGPSIFD]); ok {
+		gps, err := t.ifd(offset)
+		if err != nil {
+			return data, nil
+		}
+
+		lat, okLat := t.degrees(gps[tagGPSLatitude])
+		lon, okLon := t.degrees(gps[tagGPSLongitude])
+		// Cameras without a fix sometimes write zeros
+		if okLat && okLon && (lat != 0 || lon != 0) {
+			if ref := gps[tagGPSLatRef].value; len(ref) > 0 && ref[0] == 'S' {
+				lat = -lat
+			}
+			if ref := gps[tagGPSLonRef].value; len(ref) > 0 && ref[0] == 'W' {
+				lon = -lon
+			}
+			data.Latitude, data.Longitude = &lat, &lon
+		}
+	}
+
+	return data, nil
+}
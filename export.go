@@ -0,0 +1,126 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exportChunkSize is the number of items an export reads at a time, along
+// with their related records.
+const exportChunkSize = 500
+
+// exportEmbed are the related records each line of an export carries.
+var exportEmbed = map[string]bool{
+	"tags":        true,
+	"people":      true,
+	"genres":      true,
+	"attributes":  true,
+	"attachments": true,
+}
+
+// exportRow is a line of an export.
+type exportRow struct {
+	MediaItem
+	Tags        []string          `json:"tags"`
+	People      []string          `json:"people"`
+	Genres      []string          `json:"genres"`
+	Attributes  map[string]string `json:"attributes"`
+	Attachments []Attachment      `json:"attachments,omitempty"`
+}
+
+// exportMedia streams the library as newline-delimited JSON, one media item
+// per line, for loading into tools like DuckDB or pandas. Items are read
+// and written a chunk at a time, so exports of large libraries don't have
+// to fit in memory. Each item lists its tags, people, genres, attributes
+// and attachments, if it has any; the attachments' files are downloaded
+// separately. ?compress=gzip compresses the stream.
+func (app *App) exportMedia(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	compress := r.URL.Query().Get("compress")
+	if compress != "" && compress != "gzip" {
+		http.Error(w, "invalid compress: "+compress, http.StatusBadRequest)
+		return
+	}
+
+	where, args := filter.where()
+	if where == "" {
+		where = " WHERE id > ?"
+	} else {
+		where += " AND id > ?"
+	}
+	chunk, err := app.exportChunk(where, args, 0)
+	if err != nil {
+		log.Error("Failed to export media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var out io.Writer = w
+	if compress == "gzip" {
+		w.Header().Set("Content-Type", "application/gzip")
+		w.Header().Set("Content-Disposition", `attachment; filename="media.ndjson.gz"`)
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		out = gz
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="media.ndjson"`)
+	}
+
+	profile := app.responseProfile(r)
+	reshape := profile.Case == caseCamel || profile.Time == timeUnix
+	enc := json.NewEncoder(out)
+
+	// The status is sent with the first row, so errors from here on can
+	// only end the stream early
+	for len(chunk) > 0 {
+		for _, d := range chunk {
+			row := exportRow{
+				MediaItem:   d.MediaItem,
+				Tags:        d.Tags,
+				People:      d.People,
+				Genres:      d.Genres,
+				Attributes:  d.Attributes,
+				Attachments: d.Attachments,
+			}
+
+			var v interface{} = row
+			if reshape {
+				v = profile.shape(reflect.ValueOf(row))
+			}
+			if err := enc.Encode(v); err != nil {
+				log.Warn("Export aborted:", err)
+				return
+			}
+		}
+
+		if len(chunk) < exportChunkSize {
+			break
+		}
+		if chunk, err = app.exportChunk(where, args, chunk[len(chunk)-1].ID); err != nil {
+			log.Error("Failed to export media items:", err)
+			return
+		}
+	}
+}
+
+// exportChunk reads the next chunk of an export, the items matching where
+// after the one with ID after, with their related records.
+func (app *App) exportChunk(where string, args []interface{}, after int) ([]MediaDetail, error) {
+	var items []MediaItem
+	args = append(append([]interface{}{}, args...), after, exportChunkSize)
+	if err := app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY id LIMIT ?", args...); err != nil {
+		return nil, err
+	}
+	return app.mediaDetails(items, exportEmbed)
+}
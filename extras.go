@@ -0,0 +1,244 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Kinds of extras, the videos that belong to a main video rather than
+// standing on their own.
+const (
+	extraSample  = "sample"
+	extraTrailer = "trailer"
+)
+
+// extraPattern matches filenames (without extension) marked as a sample or
+// trailer: "sample", "movie-sample", "Movie (2019) Trailer" or the scene
+// style "sample-group-movie". A name merely starting with the word, like
+// "Trailer Park Boys S01E01", doesn't match.
+var extraPattern = regexp.MustCompile(`(?i)(?:^|[^a-z0-9])(sample|trailer)s?$|^(sample|trailer)-`)
+
+// extraDirs are directory names whose videos are extras of the videos in
+// the parent directory.
+var extraDirs = map[string]string{
+	"sample":   extraSample,
+	"samples":  extraSample,
+	"trailer":  extraTrailer,
+	"trailers": extraTrailer,
+}
+
+// A video without a telling name is a sample if it is this short, both in
+// absolute terms and relative to the main video of its directory.
+const (
+	sampleMaxDuration = 5 * 60
+	sampleMaxFraction = 0.1
+)
+
+// extraKind returns the kind of extra the filename or directory name of
+// path marks it as, or an empty string.
+func extraKind(path string) string {
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if m := extraPattern.FindStringSubmatch(name); m != nil {
+		return strings.ToLower(m[1] + m[2])
+	}
+	return extraDirs[strings.ToLower(filepath.Base(filepath.Dir(path)))]
+}
+
+// classifyExtras marks the samples and trailers among the videos in dirs
+// and links them to the main video they belong to. Locked items and items
+// that are already classified are left alone.
+func (app *App) classifyExtras(dirs map[string]bool) error {
+	for dir := range dirs {
+		// Extras in a Samples or Trailers directory belong to the videos
+		// next to it
+		if extraDirs[strings.ToLower(filepath.Base(dir))] != "" {
+			if err := app.classifyDir(filepath.Dir(dir), dir); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := app.classifyDir(dir, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// classifyDir classifies the videos in dir, whose main video is in
+// mainDir.
+func (app *App) classifyDir(mainDir, dir string) error {
+	mains, err := app.videosIn(mainDir)
+	if err != nil {
+		return err
+	}
+	candidates := mains
+	if dir != mainDir {
+		if candidates, err = app.videosIn(dir); err != nil {
+			return err
+		}
+	}
+
+	// The main video is the longest one that isn't an extra itself,
+	// going by size if ffprobe hasn't measured them
+	var main *MediaItem
+	for i := range mains {
+		m := &mains[i]
+		if m.Extra != "" || extraKind(m.Path) != "" {
+			continue
+		}
+		if main == nil || m.Duration > main.Duration ||
+			(m.Duration == main.Duration && m.Size > main.Size) {
+			main = m
+		}
+	}
+	if main == nil {
+		return nil
+	}
+
+	for _, item := range candidates {
+		if item.ID == main.ID || item.Extra != "" || item.Locked {
+			continue
+		}
+
+		kind := extraKind(item.Path)
+		if kind == "" && item.Duration > 0 && item.Duration <= sampleMaxDuration &&
+			item.Duration <= main.Duration*sampleMaxFraction {
+			kind = extraSample
+		}
+		if kind == "" {
+			continue
+		}
+
+		log.Infof("Classified %s as a %s of %s", item.Path, kind, main.Path)
+		_, err := app.DB.Exec("UPDATE media SET extra = ?, parent_id = ? WHERE id = ?", kind, main.ID, item.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// classifyNew classifies the directory of a newly added video, or pairs
+// the RAW files next to a new photo and makes a gallery of its directory,
+// and reloads the item in case it turned out to be an extra.
+func (app *App) classifyNew(item *MediaItem) {
+	dirs := map[string]bool{filepath.Dir(item.Path): true}
+	var err error
+	switch item.Type {
+	case "video":
+		err = app.classifyExtras(dirs)
+	case "image", "raw":
+		if err = app.pairRAWs(dirs); err == nil {
+			err = app.addGalleries(dirs)
+		}
+	default:
+		return
+	}
+	if err != nil {
+		log.Warnf("Failed to classify extras next to %s: %v", item.Path, err)
+		return
+	}
+	if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err != nil {
+		log.Warnf("Failed to reload media item %d: %v", item.ID, err)
+	}
+}
+
+// videosIn returns the videos directly inside dir.
+func (app *App) videosIn(dir string) ([]MediaItem, error) {
+	prefix := filepath.Clean(dir) + string(os.PathSeparator)
+
+	var items []MediaItem
+	err := app.DB.Select(&items,
+		"SELECT * FROM media WHERE type = 'video' AND substr(path, 1, length(?)) = ? ORDER BY id",
+		prefix, prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	direct := items[:0]
+	for _, item := range items {
+		if filepath.Dir(item.Path) == filepath.Clean(dir) {
+			direct = append(direct, item)
+		}
+	}
+	return direct, nil
+}
+
+// classifyLibrary classifies the extras and galleries in every directory of
+// the library, e.g. after upgrading from a version that didn't.
+func (app *App) classifyLibrary(w http.ResponseWriter, r *http.Request) {
+	var items []MediaItem
+	if err := app.DB.Select(&items, "SELECT path, type FROM media WHERE type IN ('video', 'raw', 'image')"); err != nil {
+		log.Error("Failed to fetch videos, RAW files and images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	videoDirs, rawDirs, imageDirs := map[string]bool{}, map[string]bool{}, map[string]bool{}
+	for _, item := range items {
+		switch item.Type {
+		case "video":
+			videoDirs[filepath.Dir(item.Path)] = true
+		case "raw":
+			rawDirs[filepath.Dir(item.Path)] = true
+		default:
+			imageDirs[filepath.Dir(item.Path)] = true
+		}
+	}
+
+	err := app.classifyExtras(videoDirs)
+	if err == nil {
+		err = app.pairRAWs(rawDirs)
+	}
+	if err == nil {
+		err = app.addGalleries(imageDirs)
+	}
+	if err != nil {
+		log.Error("Failed to classify extras:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	screenshots, err := app.classifyScreenshots()
+	if err != nil {
+		log.Error("Failed to classify screenshots:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hashed, err := app.hashImages()
+	if err != nil {
+		log.Error("Failed to hash images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var extras int
+	if err := app.DB.Get(&extras, "SELECT COUNT(*) FROM media WHERE extra != ''"); err != nil {
+		log.Error("Failed to count extras:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var galleries int
+	if err := app.DB.Get(&galleries, "SELECT COUNT(*) FROM galleries"); err != nil {
+		log.Error("Failed to count galleries:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"extras":      extras,
+		"screenshots": screenshots,
+		"hashed":      hashed,
+		"galleries":   galleries,
+	})
+}
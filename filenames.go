@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// filenameTokens are the tokens of filename patterns, and the expressions
+// they match. Dates are a year, month and day, optionally followed by a
+// time, in digits with or without separators: 2019-07-04, 20190704 or
+// 20190704_213000. {*} matches anything and captures nothing.
+var filenameTokens = map[string]string{
+	"date":  `(?P<date>\d{4}[-_.]?\d{2}[-_.]?\d{2}(?:[-_. T]?\d{2}[-_.:]?\d{2}[-_.:]?\d{2})?)`,
+	"year":  `(?P<year>\d{4})`,
+	"title": `(?P<title>.+?)`,
+	"*":     `.*?`,
+}
+
+// filenameToken matches the tokens of filename patterns.
+var filenameToken = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// filenameSeparators are the characters filenames put between words, which
+// titles get spaces for.
+var filenameSeparators = strings.NewReplacer("_", " ", ".", " ")
+
+// filenameParser reads the title and capture date of items from their
+// filenames, by a regular expression with title, date and year groups.
+type filenameParser struct {
+	re     *regexp.Regexp
+	layout string
+	types  map[string]bool
+}
+
+// newFilenameParsers compiles the configured filename parsers, in the order
+// they are tried.
+func newFilenameParsers(configs []FilenameParserConfig) ([]*filenameParser, error) {
+	var parsers []*filenameParser
+	for i, c := range configs {
+		p, err := newFilenameParser(c)
+		if err != nil {
+			return nil, fmt.Errorf("filename parser %d: %w", i+1, err)
+		}
+		parsers = append(parsers, p)
+	}
+	return parsers, nil
+}
+
+func newFilenameParser(c FilenameParserConfig) (*filenameParser, error) {
+	var expr string
+	switch {
+	case c.Pattern != "" && c.Regex != "":
+		return nil, fmt.Errorf("give either a pattern or a regex, not both")
+	case c.Pattern != "":
+		var err error
+		if expr, err = filenamePattern(c.Pattern); err != nil {
+			return nil, err
+		}
+	case c.Regex != "":
+		expr = c.Regex
+	default:
+		return nil, fmt.Errorf("pattern or regex is required")
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	captures := false
+	for _, name := range re.SubexpNames() {
+		switch name {
+		case "title", "date", "year":
+			captures = true
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown group %q: use title, date or year", name)
+		}
+	}
+	if !captures {
+		return nil, fmt.Errorf("%q captures no title, date or year", expr)
+	}
+
+	p := &filenameParser{re: re, layout: c.DateLayout}
+	if len(c.Types) > 0 {
+		p.types = map[string]bool{}
+		for _, t := range c.Types {
+			p.types[t] = true
+		}
+	}
+	return p, nil
+}
+
+// filenamePattern turns a pattern such as "{date}_{title}" into a regular
+// expression matching whole filenames, without their extension.
+func filenamePattern(pattern string) (string, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	last := 0
+	for _, m := range filenameToken.FindAllStringSubmatchIndex(pattern, -1) {
+		token := pattern[m[2]:m[3]]
+		expr, ok := filenameTokens[token]
+		if !ok {
+			return "", fmt.Errorf("unknown token {%s}: use {date}, {year}, {title} or {*}", token)
+		}
+		b.WriteString(regexp.QuoteMeta(pattern[last:m[0]]))
+		b.WriteString(expr)
+		last = m[1]
+	}
+	b.WriteString(regexp.QuoteMeta(pattern[last:]))
+	b.WriteString("$")
+	return b.String(), nil
+}
+
+// parse reads the title, capture date and year from a filename. ok is false
+// if the filename doesn't match or its date isn't one.
+func (p *filenameParser) parse(filename string) (title string, date *time.Time, year int, ok bool) {
+	stem := strings.TrimSuffix(filename, filepath.Ext(filename))
+	m := p.re.FindStringSubmatch(stem)
+	if m == nil {
+		return "", nil, 0, false
+	}
+
+	for i, name := range p.re.SubexpNames() {
+		switch name {
+		case "title":
+			title = strings.Join(strings.Fields(filenameSeparators.Replace(m[i])), " ")
+		case "date":
+			if m[i] == "" {
+				continue
+			}
+			t, err := p.date(m[i])
+			if err != nil {
+				return "", nil, 0, false
+			}
+			date = &t
+		case "year":
+			if m[i] == "" {
+				continue
+			}
+			if year, _ = strconv.Atoi(m[i]); year < 1800 || year > 2999 {
+				return "", nil, 0, false
+			}
+		}
+	}
+	return title, date, year, true
+}
+
+// date reads a captured date in the parser's layout or, without one, by its
+// digits. Dates without a zone are taken as local time, like EXIF capture
+// times, so they are organized under the day the filename names.
+func (p *filenameParser) date(v string) (time.Time, error) {
+	if p.layout != "" {
+		return time.ParseInLocation(p.layout, v, time.Local)
+	}
+
+	digits := strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, v)
+	switch len(digits) {
+	case 8:
+		return time.ParseInLocation("20060102", digits, time.Local)
+	case 14:
+		return time.ParseInLocation("20060102150405", digits, time.Local)
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", v)
+}
+
+// applyFilename sets the title, capture date and year of an item from its
+// filename, by the first configured parser that matches it. Only values the
+// item doesn't have yet are set, so sidecars, NFO files and edits win over
+// the filename. Locked items are left alone.
+func (app *App) applyFilename(item *MediaItem) error {
+	if item.Locked {
+		return nil
+	}
+
+	for _, p := range app.FilenameParsers {
+		if p.types != nil && !p.types[item.Type] {
+			continue
+		}
+		title, date, year, ok := p.parse(item.Filename)
+		if !ok {
+			continue
+		}
+
+		if item.Title == "" {
+			item.Title = title
+		}
+		if item.TakenAt == nil {
+			item.TakenAt = date
+		}
+		if item.Year == 0 {
+			item.Year = year
+		}
+		_, err := app.DB.Exec(
+			"UPDATE media SET title = ?, taken_at = ?, year = ? WHERE id = ?",
+			item.Title, item.TakenAt, item.Year, item.ID,
+		)
+		return err
+	}
+	return nil
+}
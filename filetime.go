@@ -0,0 +1,12 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// fileTimes returns the modification time of a file and, where the
+// platform records it, its creation time.
+func fileTimes(info os.FileInfo) (mod time.Time, birth *time.Time) {
+	return info.ModTime().UTC(), birthTime(info)
+}
@@ -0,0 +1,19 @@
+//go:build darwin || freebsd || netbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time recorded in the file's stat data.
+func birthTime(info os.FileInfo) *time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	t := time.Unix(st.Birthtimespec.Unix()).UTC()
+	return &t
+}
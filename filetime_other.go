@@ -0,0 +1,14 @@
+//go:build !darwin && !freebsd && !netbsd && !windows
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime is not available here. Linux only exposes it through statx,
+// which the syscall package doesn't wrap.
+func birthTime(info os.FileInfo) *time.Time {
+	return nil
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the file's creation time.
+func birthTime(info os.FileInfo) *time.Time {
+	data, ok := info.Sys().(*syscall.Win32FileAttributeData)
+	if !ok {
+		return nil
+	}
+	t := time.Unix(0, data.CreationTime.Nanoseconds()).UTC()
+	return &t
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// MediaFilter selects media items. It is parsed from the /api/media query
+// string and stored in virtual collection definitions, so every field must
+// work in both places. The zero value matches everything.
+type MediaFilter struct {
+	Type    string `json:"type"`
+	Query   string `json:"q"`
+	MinSize int64  `json:"min_size"`
+	MaxSize int64  `json:"max_size"`
+	Locked  *bool  `json:"locked"`
+	// Untagged matches items without (true) or with (false) tags,
+	// Organized those that have (true) or haven't (false) been reviewed.
+	Untagged  *bool `json:"untagged"`
+	Organized *bool `json:"organized"`
+
+	// Video metadata; durations are in seconds.
+	MinDuration float64 `json:"min_duration"`
+	MaxDuration float64 `json:"max_duration"`
+	MinWidth    int     `json:"min_width"`
+	MinHeight   int     `json:"min_height"`
+	VideoCodec  string  `json:"video_codec"`
+	AudioCodec  string  `json:"audio_codec"`
+	Container   string  `json:"container"`
+	// AudioLanguage matches videos with a track in the language,
+	// NoAudioLanguage those without one. MaxAudioChannels matches videos
+	// whose default track has at most that many channels, e.g. 1 for mono.
+	AudioLanguage    string `json:"audio_language"`
+	NoAudioLanguage  string `json:"no_audio_language"`
+	MaxAudioChannels int    `json:"max_audio_channels"`
+	// Spherical, HDR and Stereo match videos with (true) or without
+	// (false) the flag.
+	Spherical *bool `json:"spherical"`
+	HDR       *bool `json:"hdr"`
+	Stereo    *bool `json:"stereo"`
+	// HDRFormat and ColorPrimaries match videos with any of the
+	// comma-separated HDR formats, e.g. "dolby_vision", or color
+	// primaries, e.g. "bt2020".
+	HDRFormat      string `json:"hdr_format"`
+	ColorPrimaries string `json:"color_primaries"`
+	// Animated matches animated (true) or still (false) images.
+	Animated *bool `json:"animated"`
+	// MinSharpness and MaxSharpness match images by their sharpness
+	// score; images not analyzed yet match neither.
+	MinSharpness float64 `json:"min_sharpness"`
+	MaxSharpness float64 `json:"max_sharpness"`
+	// Extra matches samples, trailers and RAW files paired with a JPEG
+	// (true) or everything else (false).
+	Extra *bool `json:"extra"`
+	// Flag matches items with all of the comma-separated flags, NoFlag
+	// items with none of them.
+	Flag   string `json:"flag"`
+	NoFlag string `json:"no_flag"`
+	// Location matches photos taken in a city, by name, or a country, by
+	// code. Geotagged matches photos with (true) or without
+	// (false) a GPS position.
+	Location  string `json:"location"`
+	Geotagged *bool  `json:"geotagged"`
+	// Person matches items showing the person, named or by alias. Tag
+	// matches items with all of the comma-separated tags, named or by
+	// alias, and with TagDescendants also items with a tag below one of
+	// them.
+	Person         string `json:"person"`
+	Tag            string `json:"tag"`
+	TagDescendants bool   `json:"tag_descendants"`
+	// Genre matches videos of the genre, Year those released in the year.
+	Genre string `json:"genre"`
+	Year  int    `json:"year"`
+	// Attributes match items with all of the custom attributes, each
+	// given as "key=value", or just "key" for any value.
+	Attributes []string `json:"attr"`
+
+	// profile limits the filter to what a restricted profile can see.
+	profile *restriction
+}
+
+func parseMediaFilter(values url.Values) (MediaFilter, error) {
+	filter := MediaFilter{
+		Type:       values.Get("type"),
+		Query:      values.Get("q"),
+		VideoCodec: values.Get("video_codec"),
+		AudioCodec: values.Get("audio_codec"),
+		Container:  values.Get("container"),
+
+		HDRFormat:      values.Get("hdr_format"),
+		ColorPrimaries: values.Get("color_primaries"),
+
+		AudioLanguage:   strings.ToLower(values.Get("audio_language")),
+		NoAudioLanguage: strings.ToLower(values.Get("no_audio_language")),
+
+		Flag:     values.Get("flag"),
+		NoFlag:   values.Get("no_flag"),
+		Location: values.Get("location"),
+		Person:   values.Get("person"),
+		Tag:      values.Get("tag"),
+		Genre:    values.Get("genre"),
+
+		Attributes: values["attr"],
+	}
+
+	var err error
+	if v := values.Get("min_size"); v != "" {
+		if filter.MinSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid min_size: %s", v)
+		}
+	}
+	if v := values.Get("max_size"); v != "" {
+		if filter.MaxSize, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid max_size: %s", v)
+		}
+	}
+
+	if v := values.Get("min_duration"); v != "" {
+		if filter.MinDuration, err = strconv.ParseFloat(v, 64); err != nil {
+			return filter, fmt.Errorf("invalid min_duration: %s", v)
+		}
+	}
+	if v := values.Get("max_duration"); v != "" {
+		if filter.MaxDuration, err = strconv.ParseFloat(v, 64); err != nil {
+			return filter, fmt.Errorf("invalid max_duration: %s", v)
+		}
+	}
+	if v := values.Get("min_width"); v != "" {
+		if filter.MinWidth, err = strconv.Atoi(v); err != nil {
+			return filter, fmt.Errorf("invalid min_width: %s", v)
+		}
+	}
+	if v := values.Get("min_height"); v != "" {
+		if filter.MinHeight, err = strconv.Atoi(v); err != nil {
+			return filter, fmt.Errorf("invalid min_height: %s", v)
+		}
+	}
+	if v := values.Get("max_audio_channels"); v != "" {
+		if filter.MaxAudioChannels, err = strconv.Atoi(v); err != nil {
+			return filter, fmt.Errorf("invalid max_audio_channels: %s", v)
+		}
+	}
+	if v := values.Get("min_sharpness"); v != "" {
+		if filter.MinSharpness, err = strconv.ParseFloat(v, 64); err != nil {
+			return filter, fmt.Errorf("invalid min_sharpness: %s", v)
+		}
+	}
+	if v := values.Get("max_sharpness"); v != "" {
+		if filter.MaxSharpness, err = strconv.ParseFloat(v, 64); err != nil {
+			return filter, fmt.Errorf("invalid max_sharpness: %s", v)
+		}
+	}
+	if v := values.Get("year"); v != "" {
+		if filter.Year, err = strconv.Atoi(v); err != nil {
+			return filter, fmt.Errorf("invalid year: %s", v)
+		}
+	}
+	if v := values.Get("locked"); v != "" {
+		locked, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid locked: %s", v)
+		}
+		filter.Locked = &locked
+	}
+	if v := values.Get("untagged"); v != "" {
+		untagged, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid untagged: %s", v)
+		}
+		filter.Untagged = &untagged
+	}
+	if v := values.Get("organized"); v != "" {
+		organized, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid organized: %s", v)
+		}
+		filter.Organized = &organized
+	}
+	if v := values.Get("spherical"); v != "" {
+		spherical, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid spherical: %s", v)
+		}
+		filter.Spherical = &spherical
+	}
+	if v := values.Get("hdr"); v != "" {
+		hdr, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid hdr: %s", v)
+		}
+		filter.HDR = &hdr
+	}
+	if v := values.Get("stereo"); v != "" {
+		stereo, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid stereo: %s", v)
+		}
+		filter.Stereo = &stereo
+	}
+	if v := values.Get("animated"); v != "" {
+		animated, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid animated: %s", v)
+		}
+		filter.Animated = &animated
+	}
+	if v := values.Get("geotagged"); v != "" {
+		geotagged, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid geotagged: %s", v)
+		}
+		filter.Geotagged = &geotagged
+	}
+	if v := values.Get("tag_descendants"); v != "" {
+		descendants, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid tag_descendants: %s", v)
+		}
+		filter.TagDescendants = descendants
+	}
+	if v := values.Get("extra"); v != "" {
+		extra, err := strconv.ParseBool(v)
+		if err != nil {
+			return filter, fmt.Errorf("invalid extra: %s", v)
+		}
+		filter.Extra = &extra
+	}
+
+	return filter, nil
+}
+
+// escapeLike escapes the LIKE wildcards in s, for patterns with ESCAPE '\'.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// where returns the SQL WHERE clause (including the keyword) matching the
+// filter against the media table, or an empty string if it matches
+// everything.
+func (f MediaFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+
+	if f.Type != "" {
+		conds = append(conds, "type = ?")
+		args = append(args, f.Type)
+	}
+
+	// Search matches the current filename and path as well as any alias,
+	// and the name of a tag, so searching for a tag's alias finds the items
+	// with the tag
+	if f.Query != "" {
+		like := "%" + escapeLike(f.Query) + "%"
+		conds = append(conds, `(filename LIKE ? ESCAPE '\' OR path LIKE ? ESCAPE '\' OR content LIKE ? ESCAPE '\'
+			OR description LIKE ? ESCAPE '\' OR title LIKE ? ESCAPE '\' OR artist LIKE ? ESCAPE '\' OR album LIKE ? ESCAPE '\' OR id IN (
+			SELECT media_id FROM media_aliases WHERE filename LIKE ? ESCAPE '\' OR path LIKE ? ESCAPE '\') OR id IN (
+			SELECT media_id FROM media_tags WHERE tag_id IN (
+				SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ?)))`)
+		args = append(args, like, like, like, like, like, like, like, like, like, f.Query, f.Query)
+	}
+
+	if f.MinSize > 0 {
+		conds = append(conds, "size >= ?")
+		args = append(args, f.MinSize)
+	}
+	if f.MaxSize > 0 {
+		conds = append(conds, "size <= ?")
+		args = append(args, f.MaxSize)
+	}
+
+	if f.MinDuration > 0 {
+		conds = append(conds, "duration >= ?")
+		args = append(args, f.MinDuration)
+	}
+	if f.MaxDuration > 0 {
+		conds = append(conds, "duration <= ?")
+		args = append(args, f.MaxDuration)
+	}
+	if f.MinWidth > 0 {
+		conds = append(conds, "width >= ?")
+		args = append(args, f.MinWidth)
+	}
+	if f.MinHeight > 0 {
+		conds = append(conds, "height >= ?")
+		args = append(args, f.MinHeight)
+	}
+	if f.VideoCodec != "" {
+		conds = append(conds, "video_codec = ?")
+		args = append(args, f.VideoCodec)
+	}
+	if f.AudioCodec != "" {
+		conds = append(conds, "audio_codec = ?")
+		args = append(args, f.AudioCodec)
+	}
+
+	// The container column lists every name of the format, e.g.
+	// "mov,mp4,m4a", so match any one of them
+	if f.Container != "" {
+		conds = append(conds, "',' || container || ',' LIKE ? ESCAPE '\\'")
+		args = append(args, "%,"+escapeLike(f.Container)+",%")
+	}
+
+	if f.AudioLanguage != "" {
+		conds = append(conds, "',' || audio_languages || ',' LIKE ? ESCAPE '\\'")
+		args = append(args, "%,"+escapeLike(f.AudioLanguage)+",%")
+	}
+	// The languages of videos that haven't been probed are unknown rather
+	// than missing
+	if f.NoAudioLanguage != "" {
+		conds = append(conds, "type = 'video' AND probed AND ',' || audio_languages || ',' NOT LIKE ? ESCAPE '\\'")
+		args = append(args, "%,"+escapeLike(f.NoAudioLanguage)+",%")
+	}
+	if f.MaxAudioChannels > 0 {
+		conds = append(conds, "audio_channels BETWEEN 1 AND ?")
+		args = append(args, f.MaxAudioChannels)
+	}
+
+	if f.Spherical != nil {
+		conds = append(conds, "(projection != '') = ?")
+		args = append(args, *f.Spherical)
+	}
+	if f.HDR != nil {
+		conds = append(conds, "(hdr != '') = ?")
+		args = append(args, *f.HDR)
+	}
+	if f.Stereo != nil {
+		conds = append(conds, "(stereo_mode != '') = ?")
+		args = append(args, *f.Stereo)
+	}
+	if formats := splitList(f.HDRFormat); len(formats) > 0 {
+		conds = append(conds, "hdr IN (?"+strings.Repeat(", ?", len(formats)-1)+")")
+		for _, format := range formats {
+			args = append(args, format)
+		}
+	}
+	if primaries := splitList(f.ColorPrimaries); len(primaries) > 0 {
+		conds = append(conds, "color_primaries IN (?"+strings.Repeat(", ?", len(primaries)-1)+")")
+		for _, p := range primaries {
+			args = append(args, p)
+		}
+	}
+	if f.Animated != nil {
+		conds = append(conds, "type = 'image' AND animated = ?")
+		args = append(args, *f.Animated)
+	}
+	if f.MinSharpness > 0 {
+		conds = append(conds, "sharpness >= ?")
+		args = append(args, f.MinSharpness)
+	}
+	if f.MaxSharpness > 0 {
+		conds = append(conds, "sharpness <= ?")
+		args = append(args, f.MaxSharpness)
+	}
+	if f.Extra != nil {
+		conds = append(conds, "(extra != '') = ?")
+		args = append(args, *f.Extra)
+	}
+
+	if f.Location != "" {
+		conds = append(conds, "(city = ? COLLATE NOCASE OR country = ? COLLATE NOCASE)")
+		args = append(args, f.Location, f.Location)
+	}
+	if f.Geotagged != nil {
+		conds = append(conds, "(latitude IS NOT NULL) = ?")
+		args = append(args, *f.Geotagged)
+	}
+
+	if f.Person != "" {
+		conds = append(conds, `id IN (SELECT media_id FROM media_people WHERE person_id IN (
+			SELECT id FROM people WHERE name = ? UNION SELECT person_id FROM person_aliases WHERE name = ?))`)
+		args = append(args, f.Person, f.Person)
+	}
+
+	for _, tag := range splitList(f.Tag) {
+		if f.TagDescendants {
+			conds = append(conds, `id IN (SELECT media_id FROM media_tags WHERE tag_id IN (
+				WITH RECURSIVE below(id) AS (
+					SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ?
+					UNION SELECT t.id FROM tags t JOIN below ON t.parent_id = below.id
+				) SELECT id FROM below))`)
+		} else {
+			conds = append(conds, `id IN (SELECT media_id FROM media_tags WHERE tag_id IN (
+				SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ?))`)
+		}
+		args = append(args, tag, tag)
+	}
+
+	if f.Genre != "" {
+		conds = append(conds, "id IN (SELECT media_id FROM media_genres WHERE name = ? COLLATE NOCASE)")
+		args = append(args, f.Genre)
+	}
+	if f.Year > 0 {
+		conds = append(conds, "year = ?")
+		args = append(args, f.Year)
+	}
+
+	for _, attr := range f.Attributes {
+		key, value := attributeFilter(attr)
+		if value == nil {
+			conds = append(conds, "id IN (SELECT media_id FROM media_attributes WHERE key = ?)")
+			args = append(args, key)
+		} else {
+			conds = append(conds, "id IN (SELECT media_id FROM media_attributes WHERE key = ? AND value = ?)")
+			args = append(args, key, *value)
+		}
+	}
+
+	for _, flag := range splitList(f.Flag) {
+		conds = append(conds, "id IN (SELECT media_id FROM media_flags WHERE flag = ?)")
+		args = append(args, flag)
+	}
+	if flags := splitList(f.NoFlag); len(flags) > 0 {
+		conds = append(conds, "id NOT IN (SELECT media_id FROM media_flags WHERE flag IN (?"+
+			strings.Repeat(", ?", len(flags)-1)+"))")
+		for _, flag := range flags {
+			args = append(args, flag)
+		}
+	}
+
+	if f.Locked != nil {
+		conds = append(conds, "locked = ?")
+		args = append(args, *f.Locked)
+	}
+	if f.Untagged != nil {
+		conds = append(conds, "(id NOT IN (SELECT media_id FROM media_tags)) = ?")
+		args = append(args, *f.Untagged)
+	}
+	if f.Organized != nil {
+		conds = append(conds, "organized = ?")
+		args = append(args, *f.Organized)
+	}
+
+	if f.profile != nil {
+		cond, profileArgs := f.profile.where()
+		conds = append(conds, cond)
+		args = append(args, profileArgs...)
+	}
+
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// splitList splits a comma-separated parameter, ignoring empty entries.
+func splitList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
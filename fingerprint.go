@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fingerprintFrames is the number of frames hashed per video, spread
+// evenly between 10% and 90% of its duration so intros, credits and fades
+// to black are left out.
+const fingerprintFrames = 5
+
+// Videos are probable duplicates if the average similarity of their frames
+// is at least defaultMinSimilarity, unless asked otherwise, and their
+// durations differ by at most maxDurationDrift, since re-encodes and
+// remuxes keep the length but may add or drop a few frames.
+const (
+	defaultMinSimilarity = 0.9
+	maxDurationDrift     = 0.02
+)
+
+// frameHash computes the difference hash of a frame: the frame is scaled
+// to 9x8 gray pixels and each bit tells whether a pixel is brighter than
+// the one to its right. Re-encoding, scaling and small color changes keep
+// nearly all bits.
+func frameHash(gray []byte) uint64 {
+	var hash uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if gray[y*9+x] > gray[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// videoFingerprint hashes fingerprintFrames frames of a video with ffmpeg.
+func (app *App) videoFingerprint(item *MediaItem) ([]uint64, error) {
+	hashes := make([]uint64, 0, fingerprintFrames)
+	for i := 0; i < fingerprintFrames; i++ {
+		at := item.Duration * (0.1 + 0.8*float64(i)/float64(fingerprintFrames-1))
+		out, err := runTool(app.FFmpeg,
+			"-v", "error", "-ss", strconv.FormatFloat(at, 'f', 3, 64), "-i", item.Path,
+			"-frames:v", "1", "-vf", "scale=9:8,format=gray", "-f", "rawvideo", "-",
+		)
+		if err != nil {
+			return nil, err
+		}
+		if len(out) != 9*8 {
+			return nil, fmt.Errorf("no frame at %.1fs", at)
+		}
+		hashes = append(hashes, frameHash(out))
+	}
+	return hashes, nil
+}
+
+// encodeFingerprint and decodeFingerprint store frame hashes as hex,
+// separated by spaces.
+func encodeFingerprint(hashes []uint64) string {
+	parts := make([]string, len(hashes))
+	for i, h := range hashes {
+		parts[i] = fmt.Sprintf("%016x", h)
+	}
+	return strings.Join(parts, " ")
+}
+
+func decodeFingerprint(s string) ([]uint64, error) {
+	var hashes []uint64
+	for _, part := range strings.Fields(s) {
+		h, err := strconv.ParseUint(part, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, nil
+}
+
+// fingerprintSimilarity is the share of bits that the frames of two
+// videos have in common, from 0 to 1.
+func fingerprintSimilarity(a, b []uint64) float64 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	differing := 0
+	for i := range a {
+		differing += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return 1 - float64(differing)/float64(64*len(a))
+}
+
+// fingerprintVideos hashes frames of the videos matching the media filters
+// in the query string. Videos already fingerprinted are skipped, as are
+// those without a duration, which need probing first; force=true
+// fingerprints videos again.
+func (app *App) fingerprintVideos(w http.ResponseWriter, r *http.Request) {
+	if app.FFmpeg == "" {
+		http.Error(w, "ffmpeg is not available", http.StatusServiceUnavailable)
+		return
+	}
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	force := false
+	if v := r.URL.Query().Get("force"); v != "" {
+		if force, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid force: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var items []MediaItem
+	where, args := filter.where()
+	if err := app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY id", args...); err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var done []int
+	if err := app.DB.Select(&done, "SELECT media_id FROM video_fingerprints"); err != nil {
+		log.Error("Failed to fetch video fingerprints:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fingerprinted := map[int]bool{}
+	for _, id := range done {
+		fingerprinted[id] = true
+	}
+
+	analyzed, skipped, failed := 0, 0, 0
+	for i := range items {
+		item := &items[i]
+		if item.Type != "video" || item.Duration <= 0 || (fingerprinted[item.ID] && !force) {
+			skipped++
+			continue
+		}
+
+		hashes, err := app.videoFingerprint(item)
+		if err == nil {
+			_, err = app.DB.Exec(
+				"INSERT OR REPLACE INTO video_fingerprints (media_id, frames) VALUES (?, ?)",
+				item.ID, encodeFingerprint(hashes),
+			)
+		}
+		if err != nil {
+			log.Warnf("Failed to fingerprint %s: %v", item.Path, err)
+			failed++
+			continue
+		}
+		analyzed++
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"analyzed": analyzed,
+		"skipped":  skipped,
+		"failed":   failed,
+	})
+}
+
+// VideoDuplicate is a pair of videos whose frames look alike.
+type VideoDuplicate struct {
+	Similarity float64     `json:"similarity"`
+	Items      []MediaItem `json:"items"`
+}
+
+// getVideoDuplicates lists the pairs of fingerprinted videos that are
+// probably the same video, most similar first. ?min_similarity sets how
+// alike their frames must be, from 0 to 1.
+func (app *App) getVideoDuplicates(w http.ResponseWriter, r *http.Request) {
+	minSimilarity := defaultMinSimilarity
+	if v := r.URL.Query().Get("min_similarity"); v != "" {
+		var err error
+		minSimilarity, err = strconv.ParseFloat(v, 64)
+		if err != nil || minSimilarity < 0 || minSimilarity > 1 {
+			http.Error(w, "invalid min_similarity: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var rows []struct {
+		MediaItem
+		Frames string `db:"frames"`
+	}
+	err := app.DB.Select(&rows,
+		`SELECT media.*, f.frames FROM media JOIN video_fingerprints f ON f.media_id = media.id
+			WHERE media.duration > 0 ORDER BY media.duration, media.id`)
+	if err != nil {
+		log.Error("Failed to fetch video fingerprints:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hashes := make([][]uint64, len(rows))
+	for i := range rows {
+		if hashes[i], err = decodeFingerprint(rows[i].Frames); err != nil {
+			log.Warnf("Invalid fingerprint of media item %d: %v", rows[i].ID, err)
+		}
+	}
+
+	// Sorted by duration, each video only needs comparing with the longer
+	// ones that follow it until they are too long
+	duplicates := []VideoDuplicate{}
+	for i := range rows {
+		a := &rows[i].MediaItem
+		for j := i + 1; j < len(rows); j++ {
+			b := &rows[j].MediaItem
+			if b.Duration-a.Duration > b.Duration*maxDurationDrift {
+				break
+			}
+			if similarity := fingerprintSimilarity(hashes[i], hashes[j]); similarity >= minSimilarity {
+				duplicates = append(duplicates, VideoDuplicate{
+					Similarity: similarity,
+					Items:      []MediaItem{*a, *b},
+				})
+			}
+		}
+	}
+	sort.SliceStable(duplicates, func(i, j int) bool {
+		return duplicates[i].Similarity > duplicates[j].Similarity
+	})
+
+	app.writeJSON(w, r, http.StatusOK, duplicates)
+}
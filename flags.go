@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Built-in flags. The pipeline sets and clears missing, corrupt, duplicate,
+// type_mismatch and screenshot as files are scanned and probed, and
+// modified as the files of immutable libraries are checked; the others are
+// set through the API, by users or external tools.
+const (
+	flagMissing     = "missing"
+	flagCorrupt     = "corrupt"
+	flagDuplicate   = "duplicate"
+	flagModified    = "modified"
+	flagMismatch    = "type_mismatch"
+	flagScreenshot  = "screenshot"
+	flagNSFW        = "nsfw"
+	flagArchived    = "archived"
+	flagNeedsReview = "needs_review"
+	flagRejected    = "rejected"
+)
+
+var builtinFlags = []string{
+	flagMissing, flagCorrupt, flagDuplicate, flagModified, flagMismatch, flagScreenshot,
+	flagNSFW, flagArchived, flagNeedsReview, flagRejected,
+}
+
+// Flag sources for the pipeline stages. Flags set through the API have the
+// source the client gives, "user" by default.
+const (
+	sourceScan   = "scan"
+	sourceProbe  = "probe"
+	sourceVerify = "verify"
+	sourceUser   = "user"
+)
+
+// MediaFlag is a flag set on a media item.
+type MediaFlag struct {
+	MediaID int    `db:"media_id" json:"media_id"`
+	Flag    string `db:"flag" json:"flag"`
+	// Source is the pipeline stage or client that set the flag.
+	Source    string    `db:"source" json:"source"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// FlagSummary describes a flag and how many items have it.
+type FlagSummary struct {
+	Name    string `json:"name"`
+	Builtin bool   `json:"builtin"`
+	Count   int    `json:"count"`
+}
+
+// knownFlag reports whether name is a built-in or configured flag.
+func (app *App) knownFlag(name string) bool {
+	for _, flag := range builtinFlags {
+		if flag == name {
+			return true
+		}
+	}
+	for _, flag := range app.Config.Flags {
+		if flag == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setFlag flags a media item. Setting a flag the item already has keeps the
+// original source and time.
+func (app *App) setFlag(mediaID int, flag, source string) error {
+	_, err := app.DB.Exec(
+		"INSERT OR IGNORE INTO media_flags (media_id, flag, source) VALUES (?, ?, ?)",
+		mediaID, flag, source,
+	)
+	return err
+}
+
+func (app *App) clearFlag(mediaID int, flag string) error {
+	_, err := app.DB.Exec("DELETE FROM media_flags WHERE media_id = ? AND flag = ?", mediaID, flag)
+	return err
+}
+
+// flagDuplicates flags every item whose content matches another item's, by
+// checksum or by size and oshash, and clears the flag of items that no
+// longer have a duplicate.
+func (app *App) flagDuplicates() error {
+	const duplicates = `SELECT m.id FROM media m WHERE EXISTS (
+		SELECT 1 FROM media o WHERE o.id != m.id AND o.size = m.size
+			AND ((m.oshash != '' AND o.oshash = m.oshash) OR (m.checksum != '' AND o.checksum = m.checksum)))`
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM media_flags WHERE flag = ? AND media_id NOT IN ("+duplicates+")", flagDuplicate)
+	if err == nil {
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO media_flags (media_id, flag, source) SELECT id, ?, ? FROM ("+duplicates+")",
+			flagDuplicate, sourceScan,
+		)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// flagDuplicatesOf flags a newly added item and the items its content
+// matches, without the full pass of flagDuplicates. A new item can only
+// give others a duplicate, so no flag needs clearing.
+func (app *App) flagDuplicatesOf(item *MediaItem) error {
+	var ids []int
+	err := app.DB.Select(&ids,
+		`SELECT id FROM media WHERE id != ? AND size = ?
+			AND ((? != '' AND oshash = ?) OR (? != '' AND checksum = ?))`,
+		item.ID, item.Size, item.Oshash, item.Oshash, item.Checksum, item.Checksum,
+	)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+
+	for _, id := range append(ids, item.ID) {
+		if err := app.setFlag(id, flagDuplicate, sourceScan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flagMissing flags the items below root whose file is gone, and clears the
+// flag of those whose file is back.
+func (app *App) flagMissing(root string) error {
+	prefix := filepath.Clean(root) + string(os.PathSeparator)
+
+	var items []MediaItem
+	err := app.DB.Select(&items, "SELECT * FROM media WHERE substr(path, 1, length(?)) = ?", prefix, prefix)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		_, err := os.Lstat(item.Path)
+		switch {
+		case os.IsNotExist(err):
+			err = app.setFlag(item.ID, flagMissing, sourceScan)
+		case err == nil:
+			err = app.clearFlag(item.ID, flagMissing)
+		default:
+			// Unreadable isn't the same as gone
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFlags lists the built-in and configured flags with the number of items
+// having each.
+func (app *App) getFlags(w http.ResponseWriter, r *http.Request) {
+	var counts []struct {
+		Flag  string `db:"flag"`
+		Count int    `db:"count"`
+	}
+	if err := app.DB.Select(&counts, "SELECT flag, COUNT(*) AS count FROM media_flags GROUP BY flag"); err != nil {
+		log.Error("Failed to count flags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	byFlag := map[string]int{}
+	for _, c := range counts {
+		byFlag[c.Flag] = c.Count
+	}
+
+	flags := []FlagSummary{}
+	for _, name := range builtinFlags {
+		flags = append(flags, FlagSummary{Name: name, Builtin: true, Count: byFlag[name]})
+	}
+	for _, name := range app.Config.Flags {
+		flags = append(flags, FlagSummary{Name: name, Count: byFlag[name]})
+	}
+
+	app.writeJSON(w, r, http.StatusOK, flags)
+}
+
+// itemFlags returns the flags of a media item, writing an error response
+// and returning nil if it can't.
+func (app *App) itemFlags(w http.ResponseWriter, item *MediaItem) []MediaFlag {
+	flags := []MediaFlag{}
+	err := app.DB.Select(&flags, "SELECT * FROM media_flags WHERE media_id = ? ORDER BY created_at, flag", item.ID)
+	if err != nil {
+		log.Error("Failed to fetch flags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return flags
+}
+
+func (app *App) getMediaFlags(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if flags := app.itemFlags(w, item); flags != nil {
+		app.writeJSON(w, r, http.StatusOK, flags)
+	}
+}
+
+// setMediaFlag flags an item. The optional body names the source, e.g. the
+// tool that classified the item.
+func (app *App) setMediaFlag(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	flag := chi.URLParam(r, "flag")
+	if !app.knownFlag(flag) {
+		http.Error(w, fmt.Sprintf("Unknown flag %q", flag), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Source string `json:"source"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Source == "" {
+		req.Source = sourceUser
+	}
+
+	if err := app.setFlag(item.ID, flag, req.Source); err != nil {
+		log.Error("Failed to set flag:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if flags := app.itemFlags(w, item); flags != nil {
+		app.writeJSON(w, r, http.StatusOK, flags)
+	}
+}
+
+func (app *App) clearMediaFlag(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if err := app.clearFlag(item.ID, chi.URLParam(r, "flag")); err != nil {
+		log.Error("Failed to clear flag:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if flags := app.itemFlags(w, item); flags != nil {
+		app.writeJSON(w, r, http.StatusOK, flags)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Gallery is a directory of images, picked up as images are added to it.
+// Its images are those directly inside it, in filename order.
+type Gallery struct {
+	ID   int    `db:"id" json:"id"`
+	Path string `db:"path" json:"path"`
+	// Name is the name of the directory.
+	Name  string `db:"-" json:"name"`
+	Count int    `db:"-" json:"count"`
+	// CoverID is the first image, whose thumbnail stands for the gallery.
+	CoverID   int       `db:"-" json:"cover_id"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// addGalleries makes galleries of the directories among dirs that have
+// images directly inside them. Directories that already are galleries are
+// left alone.
+func (app *App) addGalleries(dirs map[string]bool) error {
+	for dir := range dirs {
+		images, err := app.galleryImages(dir)
+		if err != nil {
+			return err
+		}
+		if len(images) == 0 {
+			continue
+		}
+		res, err := app.DB.Exec("INSERT OR IGNORE INTO galleries (path, created_at) VALUES (?, ?)",
+			filepath.Clean(dir), time.Now().UTC())
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			log.Infof("Added gallery %s", dir)
+		}
+	}
+	return nil
+}
+
+// galleryImages returns the images directly inside dir, in filename order.
+func (app *App) galleryImages(dir string) ([]MediaItem, error) {
+	prefix := filepath.Clean(dir) + string(os.PathSeparator)
+
+	var items []MediaItem
+	err := app.DB.Select(&items,
+		"SELECT * FROM media WHERE type = 'image' AND substr(path, 1, length(?)) = ? ORDER BY id",
+		prefix, prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	images := []MediaItem{}
+	for _, item := range items {
+		if filepath.Dir(item.Path) == filepath.Clean(dir) {
+			images = append(images, item)
+		}
+	}
+	sort.SliceStable(images, func(i, j int) bool {
+		return naturalLess(images[i].Filename, images[j].Filename)
+	})
+	return images, nil
+}
+
+// getGalleries lists the galleries that still have images, by path.
+func (app *App) getGalleries(w http.ResponseWriter, r *http.Request) {
+	var galleries []Gallery
+	if err := app.DB.Select(&galleries, "SELECT * FROM galleries ORDER BY path"); err != nil {
+		log.Error("Failed to fetch galleries:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The images of all galleries are counted in one pass over the
+	// library's images
+	var images []MediaItem
+	if err := app.DB.Select(&images, "SELECT id, path, filename FROM media WHERE type = 'image'"); err != nil {
+		log.Error("Failed to fetch images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	byDir := map[string][]*MediaItem{}
+	for i := range images {
+		dir := filepath.Dir(images[i].Path)
+		byDir[dir] = append(byDir[dir], &images[i])
+	}
+
+	out := []Gallery{}
+	for _, g := range galleries {
+		inside := byDir[g.Path]
+		if len(inside) == 0 {
+			continue
+		}
+		cover := inside[0]
+		for _, item := range inside[1:] {
+			if naturalLess(item.Filename, cover.Filename) {
+				cover = item
+			}
+		}
+		g.Name = filepath.Base(g.Path)
+		g.Count = len(inside)
+		g.CoverID = cover.ID
+		out = append(out, g)
+	}
+
+	app.writeJSON(w, r, http.StatusOK, out)
+}
+
+// galleryFromURL loads the gallery identified by the {id} URL parameter
+// with its images, writing an error response and returning nil if it
+// can't.
+func (app *App) galleryFromURL(w http.ResponseWriter, r *http.Request) (*Gallery, []MediaItem) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid gallery ID", http.StatusBadRequest)
+		return nil, nil
+	}
+
+	var g Gallery
+	err = app.DB.Get(&g, "SELECT * FROM galleries WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Gallery not found", http.StatusNotFound)
+		return nil, nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch gallery:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil
+	}
+
+	images, err := app.galleryImages(g.Path)
+	if err != nil {
+		log.Error("Failed to fetch gallery images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, nil
+	}
+	g.Name = filepath.Base(g.Path)
+	g.Count = len(images)
+	if len(images) > 0 {
+		g.CoverID = images[0].ID
+	}
+	return &g, images
+}
+
+func (app *App) getGallery(w http.ResponseWriter, r *http.Request) {
+	if g, _ := app.galleryFromURL(w, r); g != nil {
+		app.writeJSON(w, r, http.StatusOK, g)
+	}
+}
+
+// getGalleryMedia lists the images of a gallery in filename order.
+func (app *App) getGalleryMedia(w http.ResponseWriter, r *http.Request) {
+	view, err := parseMediaView(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	g, images := app.galleryFromURL(w, r)
+	if g == nil {
+		return
+	}
+
+	out, err := app.presentMedia(images, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, out)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPlaceDistance is how far in kilometres a photo may be from the nearest
+// city of the offline dataset to be placed in it.
+const maxPlaceDistance = 100
+
+// maxGeocodeResponse caps the size of a geocoding service's response.
+const maxGeocodeResponse = 1 << 20
+
+// earthRadius is the mean radius of the Earth in kilometres.
+const earthRadius = 6371
+
+// place is where a photo was taken. Country is an ISO 3166-1 alpha-2 code,
+// e.g. "PT".
+type place struct {
+	Country string
+	City    string
+}
+
+// geocoder turns coordinates into a place. It returns nil if the
+// coordinates are in no known place, e.g. at sea.
+type geocoder interface {
+	reverse(lat, lon float64) (*place, error)
+}
+
+// newGeocoder returns the geocoder the configuration asks for, or nil if
+// reverse geocoding is disabled. An offline dataset takes precedence over a
+// service, which is called through api.
+func newGeocoder(config GeocodingConfig, api *apiClient) (geocoder, error) {
+	switch {
+	case config.Dataset != "":
+		// A nil *cityGeocoder would make a non-nil geocoder
+		g, err := loadCities(config.Dataset)
+		if err != nil {
+			return nil, err
+		}
+		return g, nil
+	case config.URL != "":
+		return &serviceGeocoder{url: config.URL, api: api}, nil
+	}
+	return nil, nil
+}
+
+// city is an entry of the offline dataset.
+type city struct {
+	name     string
+	country  string
+	lat, lon float64
+}
+
+// cityGeocoder finds the nearest city in a GeoNames dataset. Cities are
+// bucketed by whole degrees, so a lookup only looks at the cells around
+// the coordinates.
+type cityGeocoder struct {
+	cells map[[2]int][]city
+}
+
+func cell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), int(math.Floor(lon))}
+}
+
+// loadCities reads a GeoNames cities file, e.g. cities1000.txt from
+// https://download.geonames.org/export/dump/.
+func loadCities(path string) (*cityGeocoder, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	g := &cityGeocoder{cells: map[[2]int][]city{}}
+	n := 0
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64<<10), 1<<20)
+	for sc.Scan() {
+		// geonameid, name, asciiname, alternatenames, latitude,
+		// longitude, feature class, feature code, country code, ...
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) < 9 {
+			continue
+		}
+		lat, err1 := strconv.ParseFloat(fields[4], 64)
+		lon, err2 := strconv.ParseFloat(fields[5], 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		c := city{name: fields[1], country: fields[8], lat: lat, lon: lon}
+		key := cell(lat, lon)
+		g.cells[key] = append(g.cells[key], c)
+		n++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("%s has no cities", path)
+	}
+
+	log.Infof("Loaded %d cities for reverse geocoding", n)
+	return g, nil
+}
+
+func (g *cityGeocoder) reverse(lat, lon float64) (*place, error) {
+	// Degrees of longitude shrink towards the poles, so more cells are
+	// needed to cover the same distance
+	latCells := int(math.Ceil(maxPlaceDistance / (earthRadius * math.Pi / 180)))
+	lonCells := 180
+	if cos := math.Cos(lat * math.Pi / 180); cos > 0.01 {
+		lonCells = int(math.Min(180, math.Ceil(float64(latCells)/cos)))
+	}
+
+	var nearest *city
+	best := float64(maxPlaceDistance)
+	center := cell(lat, lon)
+	for dLat := -latCells; dLat <= latCells; dLat++ {
+		for dLon := -lonCells; dLon <= lonCells; dLon++ {
+			// Wrap around the antimeridian
+			lonCell := (center[1]+dLon+180+360)%360 - 180
+			cities := g.cells[[2]int{center[0] + dLat, lonCell}]
+			for i := range cities {
+				if d := distance(lat, lon, cities[i].lat, cities[i].lon); d <= best {
+					best, nearest = d, &cities[i]
+				}
+			}
+		}
+	}
+
+	if nearest == nil {
+		return nil, nil
+	}
+	return &place{Country: nearest.country, City: nearest.name}, nil
+}
+
+// distance returns the great-circle distance in kilometres between two
+// points.
+func distance(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// serviceGeocoder asks a Nominatim-compatible reverse geocoding service.
+type serviceGeocoder struct {
+	url string
+	api *apiClient
+}
+
+func (g *serviceGeocoder) reverse(lat, lon float64) (*place, error) {
+	// Three decimals are about 100 m, plenty for a city, and let photos
+	// taken around the same spot share a cached response
+	q := url.Values{}
+	q.Set("format", "jsonv2")
+	q.Set("lat", strconv.FormatFloat(lat, 'f', 3, 64))
+	q.Set("lon", strconv.FormatFloat(lon, 'f', 3, 64))
+	// City level is all that's stored
+	q.Set("zoom", "10")
+
+	sep := "?"
+	if strings.Contains(g.url, "?") {
+		sep = "&"
+	}
+	resp, err := g.api.get(g.url+sep+q.Encode(), maxGeocodeResponse)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Status != http.StatusOK {
+		return nil, fmt.Errorf("geocoding service returned %d %s", resp.Status, http.StatusText(resp.Status))
+	}
+
+	var result struct {
+		Error   string `json:"error"`
+		Address struct {
+			City        string `json:"city"`
+			Town        string `json:"town"`
+			Village     string `json:"village"`
+			CountryCode string `json:"country_code"`
+		} `json:"address"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, err
+	}
+
+	// Nominatim reports coordinates in no place as an error
+	if result.Error != "" || result.Address.CountryCode == "" {
+		return nil, nil
+	}
+
+	p := &place{Country: strings.ToUpper(result.Address.CountryCode), City: result.Address.City}
+	if p.City == "" {
+		p.City = result.Address.Town
+	}
+	if p.City == "" {
+		p.City = result.Address.Village
+	}
+	return p, nil
+}
+
+// geocode stores the place an item with coordinates was taken in. Items
+// are left as they are if reverse geocoding is disabled.
+func (app *App) geocode(item *MediaItem) error {
+	if app.Geocoder == nil || item.Latitude == nil || item.Longitude == nil {
+		return nil
+	}
+
+	p, err := app.Geocoder.reverse(*item.Latitude, *item.Longitude)
+	if err != nil {
+		return err
+	}
+	if p == nil {
+		p = &place{}
+	}
+
+	if _, err := app.DB.Exec("UPDATE media SET country = ?, city = ? WHERE id = ?", p.Country, p.City, item.ID); err != nil {
+		return err
+	}
+	item.Country, item.City = p.Country, p.City
+	return nil
+}
+
+// geocodeMissing looks up the place of every item that has coordinates but
+// no place, e.g. because it was added before reverse geocoding was set up.
+func (app *App) geocodeMissing(w http.ResponseWriter, r *http.Request) {
+	if app.Geocoder == nil {
+		http.Error(w, "Reverse geocoding is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var items []MediaItem
+	err := app.DB.Select(&items, "SELECT * FROM media WHERE latitude IS NOT NULL AND country = '' ORDER BY id")
+	if err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	geocoded, failed := 0, 0
+	for i := range items {
+		if err := app.geocode(&items[i]); err != nil {
+			log.Warnf("Failed to geocode %s: %v", items[i].Path, err)
+			failed++
+			continue
+		}
+		if items[i].Country != "" {
+			geocoded++
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"geocoded": geocoded,
+		"failed":   failed,
+	})
+}
+
+// Location is a place photos were taken in.
+type Location struct {
+	Country string `db:"country" json:"country"`
+	City    string `db:"city" json:"city"`
+	Count   int    `db:"count" json:"count"`
+}
+
+// getLocations lists the places items were taken in, most photographed
+// first, for browsing by location.
+func (app *App) getLocations(w http.ResponseWriter, r *http.Request) {
+	locations := []Location{}
+	err := app.DB.Select(&locations,
+		`SELECT country, city, COUNT(*) AS count FROM media WHERE country != ''
+			GROUP BY country, city ORDER BY count DESC, country, city`,
+	)
+	if err != nil {
+		log.Error("Failed to fetch locations:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, locations)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// fileChecksum returns the hex encoded MD5 of the file's contents.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// oshashChunkSize is the number of bytes read from each end of a file for
+// its oshash.
+const oshashChunkSize = 64 * 1024
+
+// fileOshash returns the OpenSubtitles style hash of a file: its size plus
+// the sum of the little-endian 64 bit words in its first and last 64 KB, as
+// 16 hex digits. It reads at most 128 KB, however large the file, so unlike
+// the checksum it is cheap to compute during a scan. The result matches
+// Stash's oshash, so the two can be cross-referenced.
+func fileOshash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size == 0 {
+		return "", errors.New("cannot hash an empty file")
+	}
+
+	chunk := int64(oshashChunkSize)
+	if size < chunk {
+		chunk = size
+	}
+
+	// Files smaller than two chunks overlap; as in Stash, such bytes are
+	// counted twice
+	buf := make([]byte, 2*chunk)
+	if _, err := f.ReadAt(buf[:chunk], 0); err != nil {
+		return "", err
+	}
+	if _, err := f.ReadAt(buf[chunk:], size-chunk); err != nil {
+		return "", err
+	}
+
+	sum := uint64(size)
+	for i := 0; i+8 <= len(buf); i += 8 {
+		sum += binary.LittleEndian.Uint64(buf[i:])
+	}
+	return fmt.Sprintf("%016x", sum), nil
+}
+
+// findByContent returns the media item whose content matches checksum, or nil
+// if there is none. Items of the same size that have not been hashed yet are
+// hashed on demand and their checksum is stored for next time.
+func (app *App) findByContent(checksum string, size int64) (*MediaItem, error) {
+	var candidates []MediaItem
+	err := app.DB.Select(&candidates,
+		"SELECT * FROM media WHERE size = ? AND checksum IN (?, '') ORDER BY id",
+		size, checksum,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range candidates {
+		item := &candidates[i]
+
+		if item.Checksum == "" {
+			sum, err := fileChecksum(item.Path)
+			if err != nil {
+				log.Warnf("Failed to hash %s: %v", item.Path, err)
+				continue
+			}
+
+			item.Checksum = sum
+			if _, err := app.DB.Exec("UPDATE media SET checksum = ? WHERE id = ?", sum, item.ID); err != nil {
+				return nil, err
+			}
+		}
+
+		if item.Checksum == checksum {
+			return item, nil
+		}
+	}
+
+	return nil, nil
+}
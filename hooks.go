@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ingestRequest is the body of an ingest hook. Besides the generic path and
+// paths fields it understands the file fields of Sonarr and Radarr webhook
+// payloads, so those can call the hook directly.
+type ingestRequest struct {
+	Path  string   `json:"path"`
+	Paths []string `json:"paths"`
+
+	EventType   string    `json:"eventType"`
+	EpisodeFile *hookFile `json:"episodeFile"`
+	MovieFile   *hookFile `json:"movieFile"`
+}
+
+type hookFile struct {
+	Path string `json:"path"`
+}
+
+// paths returns the paths the request asks to ingest.
+func (req *ingestRequest) paths() []string {
+	var paths []string
+	if req.Path != "" {
+		paths = append(paths, req.Path)
+	}
+	paths = append(paths, req.Paths...)
+
+	// Sonarr and Radarr also send the series or movie folder, but the
+	// imported file is all that changed
+	if req.EpisodeFile != nil && req.EpisodeFile.Path != "" {
+		paths = append(paths, req.EpisodeFile.Path)
+	} else if req.MovieFile != nil && req.MovieFile.Path != "" {
+		paths = append(paths, req.MovieFile.Path)
+	}
+
+	return paths
+}
+
+// ingestResult is the outcome of ingesting one path.
+type ingestResult struct {
+	Path    string      `json:"path"`
+	Item    *MediaItem  `json:"item,omitempty"`
+	Scan    *ScanRecord `json:"scan,omitempty"`
+	Created bool        `json:"created"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// ingestHook imports the files and scans the directories external tools
+// report as just completed.
+func (app *App) ingestHook(w http.ResponseWriter, r *http.Request) {
+	if token := app.Config.Hooks.Token; token != "" {
+		given := r.Header.Get("X-Hook-Token")
+		if given == "" {
+			given = r.URL.Query().Get("token")
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "Invalid hook token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	var req ingestRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	paths := req.paths()
+
+	// Sonarr and Radarr send a test event when the webhook is set up
+	if req.EventType == "Test" && len(paths) == 0 {
+		app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+			"success": true,
+			"results": []ingestResult{},
+		})
+		return
+	}
+
+	if len(paths) == 0 {
+		http.Error(w, "No path to ingest", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]ingestResult, 0, len(paths))
+	success := true
+	for _, path := range paths {
+		result := app.ingest(path)
+		if result.Error != "" {
+			success = false
+		}
+		results = append(results, result)
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": success,
+		"results": results,
+	})
+}
+
+// ingest imports path if it is a file, or scans it with the configured
+// defaults if it is a directory.
+func (app *App) ingest(path string) ingestResult {
+	result := ingestResult{Path: path}
+
+	if !filepath.IsAbs(path) {
+		result.Error = "Path must be absolute"
+		return result
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	if info.IsDir() {
+		log.Infof("Ingest hook: scanning %s", path)
+		record, err := app.scan(path, app.Config.Scan.options())
+		result.Scan = record
+		if err != nil {
+			result.Error = err.Error()
+		}
+		return result
+	}
+
+	log.Infof("Ingest hook: importing %s", path)
+	item, created, err := app.importFile(path)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Item = item
+	result.Created = created
+	return result
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// mediaIgnoreFile is read from every directory a scan visits, and from the
+// directories between the scan root and the root of its library. It uses
+// gitignore syntax to exclude files and directories below the directory
+// holding it.
+const mediaIgnoreFile = ".mediaignore"
+
+type ignoreRule struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules is an ordered list of gitignore-style patterns. As in git, the
+// last rule matching a path decides whether it is ignored.
+type ignoreRules []ignoreRule
+
+// loadIgnoreFile parses the ignore file at path. A missing file yields no
+// rules.
+func loadIgnoreFile(path string) (ignoreRules, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	rules, err := parseIgnoreRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// parseExcludes parses the configured exclusions of a library, one pattern
+// per entry.
+func parseExcludes(patterns []string) (ignoreRules, error) {
+	return parseIgnoreRules(strings.NewReader(strings.Join(patterns, "\n")))
+}
+
+func parseIgnoreRules(r io.Reader) (ignoreRules, error) {
+	var rules ignoreRules
+
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		pattern := strings.TrimRight(sc.Text(), " \t")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		var rule ignoreRule
+		if strings.HasPrefix(pattern, "!") {
+			rule.negate = true
+			pattern = pattern[1:]
+		} else if strings.HasPrefix(pattern, `\`) {
+			// \# and \! escape a literal leading character
+			pattern = pattern[1:]
+		}
+
+		if strings.HasSuffix(pattern, "/") {
+			rule.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		if pattern == "" {
+			continue
+		}
+
+		// A slash anywhere but the end anchors the pattern to the root;
+		// otherwise it matches a name at any depth
+		anchored := strings.Contains(pattern, "/")
+		pattern = strings.TrimPrefix(pattern, "/")
+
+		expr := globToRegexp(pattern)
+		if anchored {
+			expr = "^" + expr + "$"
+		} else {
+			expr = "(^|/)" + expr + "$"
+		}
+
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid pattern %q", line, sc.Text())
+		}
+		rule.re = re
+
+		rules = append(rules, rule)
+	}
+
+	return rules, sc.Err()
+}
+
+// globToRegexp translates a gitignore glob into a regular expression body.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			b.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return b.String()
+}
+
+// match reports whether any rule matches rel, a slash separated path
+// relative to the directory holding the rules, and if so whether the last
+// one to match excludes it.
+func (rules ignoreRules) match(rel string, isDir bool) (matched, ignored bool) {
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(rel) {
+			matched, ignored = true, !rule.negate
+		}
+	}
+	return matched, ignored
+}
+
+// ignoreScope is a set of rules and the directory its paths are relative
+// to.
+type ignoreScope struct {
+	dir   string
+	rules ignoreRules
+}
+
+// ignoreStack holds the rules in effect during a walk, outermost first: the
+// library's configured exclusions, then the ignore file of every directory
+// from the library's root down. As in git, a deeper file overrides the ones
+// above it.
+type ignoreStack []ignoreScope
+
+// ignored reports whether path is excluded by the scopes it lies in.
+func (stack ignoreStack) ignored(path string, isDir bool) bool {
+	ignored := false
+	for _, scope := range stack {
+		if !withinDir(scope.dir, path) || path == scope.dir {
+			continue
+		}
+		rel, err := filepath.Rel(scope.dir, path)
+		if err != nil {
+			continue
+		}
+		if matched, excluded := scope.rules.match(filepath.ToSlash(rel), isDir); matched {
+			ignored = excluded
+		}
+	}
+	return ignored
+}
+
+// excludedDir returns dir, or the directory above it, that the stack
+// excludes, or an empty string if none of them is.
+func (stack ignoreStack) excludedDir(dir string) string {
+	for dir = filepath.Clean(dir); ; dir = filepath.Dir(dir) {
+		if stack.ignored(dir, true) {
+			return dir
+		}
+		if filepath.Dir(dir) == dir {
+			return ""
+		}
+	}
+}
+
+// enter drops the scopes of the directories the walk has left, keeping
+// those dir lies in.
+func (stack ignoreStack) enter(dir string) ignoreStack {
+	for len(stack) > 0 && !withinDir(stack[len(stack)-1].dir, dir) {
+		stack = stack[:len(stack)-1]
+	}
+	return stack
+}
+
+// withinDir reports whether path is dir or lies below it.
+func withinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// scanIgnores returns the rules that apply to a scan of root before its
+// walk starts: the exclusions of the library root lies in, and the ignore
+// files from the library's volume down to root. Outside a library only
+// root's own ignore file applies.
+func (app *App) scanIgnores(root string) (ignoreStack, error) {
+	root = filepath.Clean(root)
+	base := root
+
+	var stack ignoreStack
+	if lib, volume := app.Config.volumeOf(root); lib != nil {
+		rules, err := parseExcludes(lib.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("library %q: %w", lib.Name, err)
+		}
+		stack = append(stack, ignoreScope{dir: volume, rules: rules})
+		base = volume
+	}
+
+	// The directories from the volume down to root, outermost first
+	dirs := []string{root}
+	for dir := root; dir != base; {
+		dir = filepath.Dir(dir)
+		dirs = append([]string{dir}, dirs...)
+	}
+	for _, dir := range dirs {
+		rules, err := loadIgnoreFile(filepath.Join(dir, mediaIgnoreFile))
+		if err != nil {
+			return nil, err
+		}
+		if rules != nil {
+			stack = append(stack, ignoreScope{dir: dir, rules: rules})
+		}
+	}
+	return stack, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errUnknownImageFormat is returned for images whose header can't be read.
+var errUnknownImageFormat = errors.New("unknown image format")
+
+// imageSize reads the dimensions of an image from its header, without
+// decoding the pixels.
+func imageSize(path string) (int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	// The standard library has no WebP decoder
+	if strings.ToLower(filepath.Ext(path)) == ".webp" {
+		return webpSize(f)
+	}
+
+	config, _, err := image.DecodeConfig(f)
+	if err == image.ErrFormat {
+		return 0, 0, errUnknownImageFormat
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// webpSize reads the canvas size from the first chunk of a WebP file, which
+// is VP8 (lossy), VP8L (lossless) or VP8X (extended).
+func webpSize(r io.Reader) (int, int, error) {
+	var header [30]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, 0, errUnknownImageFormat
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return 0, 0, errUnknownImageFormat
+	}
+
+	data := header[20:]
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// A 3 byte frame tag and the start code precede the 14 bit
+		// dimensions
+		if !bytes.Equal(data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, errUnknownImageFormat
+		}
+		width := binary.LittleEndian.Uint16(data[6:8]) & 0x3fff
+		height := binary.LittleEndian.Uint16(data[8:10]) & 0x3fff
+		return int(width), int(height), nil
+
+	case "VP8L":
+		if data[0] != 0x2f {
+			return 0, 0, errUnknownImageFormat
+		}
+		bits := binary.LittleEndian.Uint32(data[1:5])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+
+	case "VP8X":
+		// 4 bytes of flags, then 24 bit dimensions minus one
+		width := uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16
+		height := uint32(data[7]) | uint32(data[8])<<8 | uint32(data[9])<<16
+		return int(width) + 1, int(height) + 1, nil
+	}
+
+	return 0, 0, errUnknownImageFormat
+}
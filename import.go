@@ -0,0 +1,168 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventMediaAdded is published with the new item when a scan, an import or
+// an upload adds a file to the library.
+const eventMediaAdded = "media_added"
+
+// importError is a reason a path can't be imported that lies with the
+// caller rather than the server.
+type importError string
+
+func (e importError) Error() string {
+	return string(e)
+}
+
+// importFile adds the media file at path to the library without walking
+// any directory. If the path is already in the library, as an item or a
+// version of one, the item is returned and created is false.
+func (app *App) importFile(path string) (item *MediaItem, created bool, err error) {
+	if !filepath.IsAbs(path) {
+		return nil, false, importError(fmt.Sprintf("Path must be absolute: %s", path))
+	}
+	path = filepath.Clean(path)
+
+	// A version's path belongs to its item
+	var existing MediaItem
+	err = app.DB.Get(&existing,
+		"SELECT * FROM media WHERE path = ? OR id = (SELECT media_id FROM media_files WHERE path = ?)",
+		path, path,
+	)
+	if err == nil {
+		return &existing, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, false, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, importError(fmt.Sprintf("Not a regular file: %s", path))
+	}
+
+	// Files a scan would leave out aren't imported either
+	dir := filepath.Dir(path)
+	ignores, err := app.scanIgnores(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	if ignores.excludedDir(dir) != "" || ignores.ignored(path, false) {
+		return nil, false, importError(fmt.Sprintf("Path is excluded from the library: %s", path))
+	}
+
+	// Files without a supported extension are typed by their content, as
+	// long as it's unambiguous
+	mediaType, ok := supportedExtensions[strings.ToLower(filepath.Ext(path))]
+	if !ok {
+		if mimeType, err := sniffMIME(path); err == nil && mimeType != "application/zip" {
+			mediaType, ok = sniffedTypes[mimeType]
+		}
+	}
+	if !ok {
+		return nil, false, importError(fmt.Sprintf("Unsupported file type: %s", info.Name()))
+	}
+
+	// Hashing reads the whole file, so outside the processing windows the
+	// item is added without a checksum, as scans add them
+	var checksum string
+	if app.Processing.open() {
+		if checksum, err = fileChecksum(path); err != nil {
+			return nil, false, err
+		}
+	}
+	oshash, err := fileOshash(path)
+	if err != nil && info.Size() > 0 {
+		return nil, false, err
+	}
+
+	media := MediaItem{
+		Path:     path,
+		Filename: info.Name(),
+		Size:     info.Size(),
+		Type:     mediaType,
+		Checksum: checksum,
+		Oshash:   oshash,
+	}
+	modTime, birthTime := fileTimes(info)
+	media.FileModTime, media.FileBirthTime = &modTime, birthTime
+
+	res, err := app.DB.NamedExec(
+		`INSERT INTO media (path, filename, size, type, checksum, oshash, file_mod_time, file_birth_time)
+			VALUES (:path, :filename, :size, :type, :checksum, :oshash, :file_mod_time, :file_birth_time)`,
+		media,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := app.DB.Get(&media, "SELECT * FROM media WHERE id = ?", id); err != nil {
+		return nil, false, err
+	}
+
+	app.probeOrDefer(&media)
+	app.baselineOrDefer(&media)
+	app.classifyNew(&media)
+	if err := app.flagDuplicatesOf(&media); err != nil {
+		log.Warnf("Failed to flag duplicates of %s: %v", path, err)
+	}
+	app.Events.publish(eventMediaAdded, media)
+
+	return &media, true, nil
+}
+
+func (app *App) importMedia(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path string `json:"path"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Path == "" {
+		http.Error(w, "Path is required", http.StatusBadRequest)
+		return
+	}
+
+	item, created, err := app.importFile(req.Path)
+	if _, ok := err.(importError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if os.IsNotExist(err) {
+		http.Error(w, fmt.Sprintf("File not found: %s", req.Path), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to import media file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !created {
+		app.writeJSON(w, r, http.StatusOK, item)
+		return
+	}
+
+	log.Infof("Imported %s", item.Path)
+
+	app.writeJSON(w, r, http.StatusCreated, item)
+}
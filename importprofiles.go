@@ -0,0 +1,676 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxImportFileSize caps the files run through an import profile.
+const maxImportFileSize = 64 << 20
+
+// importMatchColumns are the item columns rows can be matched on.
+var importMatchColumns = map[string]bool{
+	"path":     true,
+	"filename": true,
+	"checksum": true,
+	"oshash":   true,
+}
+
+// importListFields are the fields that take several values, split on
+// commas unless a split transform says otherwise. Values are added to the
+// item's, never replacing them.
+var importListFields = map[string]bool{
+	"tags":   true,
+	"people": true,
+	"genres": true,
+}
+
+// importDateLayouts are the formats taken_at values are read in without a
+// date transform.
+var importDateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+var errImportProfileExists = fmt.Errorf("an import profile with this name already exists")
+
+// FieldMapping maps a source column to an item field: title, description,
+// year, taken_at, tags, people, genres or attr:<key> for a custom
+// attribute. Transforms are applied to the value in order:
+//
+//	trim, lower, upper   whitespace and case
+//	replace:<old>=<new>  every occurrence of old
+//	split:<sep>          into several values, for tags, people and genres
+//	date:<layout>        the Go time layout of a taken_at value
+type FieldMapping struct {
+	Column     string   `json:"column"`
+	Field      string   `json:"field"`
+	Transforms []string `json:"transforms"`
+}
+
+// ImportProfile is a reusable mapping of the rows of a CSV or JSON file,
+// e.g. an export of another application, to item metadata. Rows are
+// matched to items by comparing MatchColumn with the item's MatchBy
+// column, and DefaultTags are added to every item matched.
+type ImportProfile struct {
+	ID          int            `db:"id" json:"id"`
+	Name        string         `db:"name" json:"name"`
+	Format      string         `db:"format" json:"format"`
+	MatchColumn string         `db:"match_column" json:"match_column"`
+	MatchBy     string         `db:"match_by" json:"match_by"`
+	Fields      []FieldMapping `db:"-" json:"fields"`
+	DefaultTags []string       `db:"-" json:"default_tags"`
+	CreatedAt   time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time      `db:"updated_at" json:"updated_at"`
+
+	// The fields and tags as stored, in JSON
+	FieldsJSON      string `db:"fields" json:"-"`
+	DefaultTagsJSON string `db:"default_tags" json:"-"`
+}
+
+// ImportError is a row that couldn't be imported. Row counts the data rows
+// from 1, not counting a CSV header.
+type ImportError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// importChanges are the changes one row makes to an item.
+type importChanges struct {
+	columns    map[string]interface{}
+	lists      map[string][]string
+	attributes map[string]string
+}
+
+// validate checks the profile, cleaning up its tag names.
+func (p *ImportProfile) validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if p.Format != "csv" && p.Format != "json" {
+		return fmt.Errorf("unknown format %q: use csv or json", p.Format)
+	}
+	if p.MatchColumn == "" {
+		return fmt.Errorf("match_column is required")
+	}
+	if !importMatchColumns[p.MatchBy] {
+		return fmt.Errorf("unknown match_by %q: use path, filename, checksum or oshash", p.MatchBy)
+	}
+	if p.Fields == nil {
+		p.Fields = []FieldMapping{}
+	}
+	if p.DefaultTags == nil {
+		p.DefaultTags = []string{}
+	}
+
+	for i := range p.Fields {
+		mapping := &p.Fields[i]
+		if mapping.Transforms == nil {
+			mapping.Transforms = []string{}
+		}
+		if mapping.Column == "" {
+			return fmt.Errorf("every field needs a column")
+		}
+		switch {
+		case mapping.Field == "title", mapping.Field == "description", mapping.Field == "year", mapping.Field == "taken_at":
+		case importListFields[mapping.Field]:
+		case strings.HasPrefix(mapping.Field, "attr:"):
+			if key := strings.TrimPrefix(mapping.Field, "attr:"); !attributeKeyPattern.MatchString(key) {
+				return fmt.Errorf("invalid attribute key %q: use up to 64 letters, digits, '_', '.' or '-'", key)
+			}
+		default:
+			return fmt.Errorf("unknown field %q: use title, description, year, taken_at, tags, people, genres or attr:<key>", mapping.Field)
+		}
+
+		for _, transform := range mapping.Transforms {
+			name, arg, _ := strings.Cut(transform, ":")
+			switch {
+			case (name == "trim" || name == "lower" || name == "upper") && arg == "":
+			case name == "replace" && strings.Contains(arg, "="):
+			case name == "split" && arg != "":
+				if !importListFields[mapping.Field] {
+					return fmt.Errorf("split only applies to tags, people and genres, not %s", mapping.Field)
+				}
+			case name == "date" && arg != "":
+				if mapping.Field != "taken_at" {
+					return fmt.Errorf("date only applies to taken_at, not %s", mapping.Field)
+				}
+			default:
+				return fmt.Errorf("invalid transform %q", transform)
+			}
+		}
+	}
+
+	for i, tag := range p.DefaultTags {
+		name, err := tagName(tag)
+		if err != nil {
+			return err
+		}
+		p.DefaultTags[i] = name
+	}
+	return nil
+}
+
+// values transforms a source value into the values of the mapped field,
+// dropping empty ones.
+func (mapping *FieldMapping) values(v string) []string {
+	values := []string{v}
+	split := importListFields[mapping.Field]
+	for _, transform := range mapping.Transforms {
+		name, arg, _ := strings.Cut(transform, ":")
+		if name == "split" {
+			var parts []string
+			for _, v := range values {
+				parts = append(parts, strings.Split(v, arg)...)
+			}
+			values, split = parts, false
+			continue
+		}
+		for i, v := range values {
+			switch name {
+			case "trim":
+				values[i] = strings.TrimSpace(v)
+			case "lower":
+				values[i] = strings.ToLower(v)
+			case "upper":
+				values[i] = strings.ToUpper(v)
+			case "replace":
+				old, replacement, _ := strings.Cut(arg, "=")
+				values[i] = strings.ReplaceAll(v, old, replacement)
+			}
+		}
+	}
+	if split {
+		values = strings.Split(values[0], ",")
+	}
+
+	kept := values[:0]
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// changes works out what a row changes, or why it can't be imported.
+func (p *ImportProfile) changes(row map[string]string) (*importChanges, error) {
+	changes := &importChanges{
+		columns:    map[string]interface{}{},
+		lists:      map[string][]string{"tags": append([]string{}, p.DefaultTags...)},
+		attributes: map[string]string{},
+	}
+
+	for _, mapping := range p.Fields {
+		values := mapping.values(row[mapping.Column])
+		if len(values) == 0 {
+			continue
+		}
+		v := values[0]
+
+		switch {
+		case mapping.Field == "title", mapping.Field == "description":
+			changes.columns[mapping.Field] = v
+		case mapping.Field == "year":
+			year, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil || year < 1 {
+				return nil, fmt.Errorf("%s: invalid year %q", mapping.Column, v)
+			}
+			changes.columns["year"] = year
+		case mapping.Field == "taken_at":
+			t, err := importDate(&mapping, strings.TrimSpace(v))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", mapping.Column, err)
+			}
+			changes.columns["taken_at"] = t
+		case importListFields[mapping.Field]:
+			for _, v := range values {
+				v = strings.TrimSpace(v)
+				if mapping.Field == "tags" {
+					name, err := tagName(v)
+					if err != nil {
+						return nil, fmt.Errorf("%s: %v", mapping.Column, err)
+					}
+					v = name
+				}
+				changes.lists[mapping.Field] = append(changes.lists[mapping.Field], v)
+			}
+		default:
+			changes.attributes[strings.TrimPrefix(mapping.Field, "attr:")] = v
+		}
+	}
+	return changes, nil
+}
+
+// importDate reads a taken_at value in the layout of the mapping's date
+// transform, or else in one of importDateLayouts. Times without a zone are
+// taken as UTC.
+func importDate(mapping *FieldMapping, v string) (time.Time, error) {
+	layouts := importDateLayouts
+	for _, transform := range mapping.Transforms {
+		if layout := strings.TrimPrefix(transform, "date:"); layout != transform {
+			layouts = []string{layout}
+		}
+	}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", v)
+}
+
+// apply makes the changes of a row to an item.
+func (c *importChanges) apply(tx *sqlx.Tx, mediaID int) error {
+	for column, v := range c.columns {
+		if _, err := tx.Exec("UPDATE media SET "+column+" = ? WHERE id = ?", v, mediaID); err != nil {
+			return err
+		}
+	}
+	for field, values := range c.lists {
+		for _, v := range values {
+			var err error
+			switch field {
+			case "tags":
+				err = tagMedia(tx, mediaID, v)
+			case "people":
+				err = linkPerson(tx, mediaID, v)
+			case "genres":
+				_, err = tx.Exec("INSERT OR IGNORE INTO media_genres (media_id, name) VALUES (?, ?)", mediaID, v)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for key, v := range c.attributes {
+		_, err := tx.Exec(
+			`INSERT INTO media_attributes (media_id, key, value) VALUES (?, ?, ?)
+				ON CONFLICT (media_id, key) DO UPDATE SET value = excluded.value`,
+			mediaID, key, v,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readImportRows reads the rows of a CSV file, whose first row names the
+// columns, or of a JSON array of objects. JSON numbers and booleans are
+// read as text and arrays are joined with commas.
+func readImportRows(format string, r io.Reader) ([]map[string]string, error) {
+	rows := []map[string]string{}
+
+	if format == "csv" {
+		reader := csv.NewReader(r)
+		reader.FieldsPerRecord = -1
+		header, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Spreadsheet applications start their CSV files with a BOM
+		if len(header) > 0 {
+			header[0] = strings.TrimPrefix(header[0], "\ufeff")
+		}
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				return rows, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			row := make(map[string]string, len(header))
+			for i, column := range header {
+				if i < len(record) {
+					row[column] = record[i]
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	var objects []map[string]interface{}
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		row := make(map[string]string, len(object))
+		for column, v := range object {
+			row[column] = importText(v)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// importText converts a JSON value to the text it's mapped as.
+func importText(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, part := range v {
+			parts[i] = importText(part)
+		}
+		return strings.Join(parts, ",")
+	case map[string]interface{}:
+		data, _ := json.Marshal(v)
+		return string(data)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// loadImportProfiles returns the profiles matching the condition.
+func (app *App) loadImportProfiles(where string, args ...interface{}) ([]ImportProfile, error) {
+	profiles := []ImportProfile{}
+	if err := app.DB.Select(&profiles, "SELECT * FROM import_profiles"+where+" ORDER BY name", args...); err != nil {
+		return nil, err
+	}
+	for i := range profiles {
+		p := &profiles[i]
+		if err := json.Unmarshal([]byte(p.FieldsJSON), &p.Fields); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(p.DefaultTagsJSON), &p.DefaultTags); err != nil {
+			return nil, err
+		}
+	}
+	return profiles, nil
+}
+
+// importProfileFromURL fetches the profile named by the id URL parameter,
+// writing an error response and returning nil if it can't.
+func (app *App) importProfileFromURL(w http.ResponseWriter, r *http.Request) *ImportProfile {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid import profile ID", http.StatusBadRequest)
+		return nil
+	}
+	return app.loadImportProfile(w, id)
+}
+
+// loadImportProfile fetches a profile, writing an error response and
+// returning nil if it doesn't exist or can't be loaded.
+func (app *App) loadImportProfile(w http.ResponseWriter, id int) *ImportProfile {
+	profiles, err := app.loadImportProfiles(" WHERE id = ?", id)
+	if err != nil {
+		log.Error("Failed to fetch import profile:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if len(profiles) == 0 {
+		http.Error(w, "Import profile not found", http.StatusNotFound)
+		return nil
+	}
+	return &profiles[0]
+}
+
+// saveImportProfile inserts a new profile or updates an existing one,
+// returning its ID.
+func (app *App) saveImportProfile(p *ImportProfile) (int, error) {
+	var taken int
+	err := app.DB.Get(&taken, "SELECT COUNT(*) FROM import_profiles WHERE name = ? AND id != ?", p.Name, p.ID)
+	if err != nil {
+		return 0, err
+	}
+	if taken > 0 {
+		return 0, errImportProfileExists
+	}
+
+	fields, err := json.Marshal(p.Fields)
+	if err != nil {
+		return 0, err
+	}
+	tags, err := json.Marshal(p.DefaultTags)
+	if err != nil {
+		return 0, err
+	}
+
+	if p.ID != 0 {
+		_, err := app.DB.Exec(
+			`UPDATE import_profiles SET name = ?, format = ?, match_column = ?, match_by = ?, fields = ?,
+				default_tags = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+			p.Name, p.Format, p.MatchColumn, p.MatchBy, string(fields), string(tags), p.ID,
+		)
+		return p.ID, err
+	}
+
+	res, err := app.DB.Exec(
+		"INSERT INTO import_profiles (name, format, match_column, match_by, fields, default_tags) VALUES (?, ?, ?, ?, ?, ?)",
+		p.Name, p.Format, p.MatchColumn, p.MatchBy, string(fields), string(tags),
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	return int(id), err
+}
+
+// writeImportProfile saves a profile and writes it, or the error, as the
+// response.
+func (app *App) writeImportProfile(w http.ResponseWriter, r *http.Request, p *ImportProfile, status int) {
+	p.Name = strings.TrimSpace(p.Name)
+	if err := p.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id, err := app.saveImportProfile(p)
+	if err == errImportProfileExists {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to save import profile:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if saved := app.loadImportProfile(w, id); saved != nil {
+		app.writeJSON(w, r, status, saved)
+	}
+}
+
+func (app *App) getImportProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := app.loadImportProfiles("")
+	if err != nil {
+		log.Error("Failed to fetch import profiles:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, profiles)
+}
+
+func (app *App) getImportProfile(w http.ResponseWriter, r *http.Request) {
+	if p := app.importProfileFromURL(w, r); p != nil {
+		app.writeJSON(w, r, http.StatusOK, p)
+	}
+}
+
+func (app *App) createImportProfile(w http.ResponseWriter, r *http.Request) {
+	var p ImportProfile
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.ID = 0
+
+	app.writeImportProfile(w, r, &p, http.StatusCreated)
+}
+
+// updateImportProfile changes the given settings of a profile. fields and
+// default_tags are replaced as a whole.
+func (app *App) updateImportProfile(w http.ResponseWriter, r *http.Request) {
+	p := app.importProfileFromURL(w, r)
+	if p == nil {
+		return
+	}
+
+	var req struct {
+		Name        *string         `json:"name"`
+		Format      *string         `json:"format"`
+		MatchColumn *string         `json:"match_column"`
+		MatchBy     *string         `json:"match_by"`
+		Fields      *[]FieldMapping `json:"fields"`
+		DefaultTags *[]string       `json:"default_tags"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		p.Name = *req.Name
+	}
+	if req.Format != nil {
+		p.Format = *req.Format
+	}
+	if req.MatchColumn != nil {
+		p.MatchColumn = *req.MatchColumn
+	}
+	if req.MatchBy != nil {
+		p.MatchBy = *req.MatchBy
+	}
+	if req.Fields != nil {
+		p.Fields = *req.Fields
+	}
+	if req.DefaultTags != nil {
+		p.DefaultTags = *req.DefaultTags
+	}
+
+	app.writeImportProfile(w, r, p, http.StatusOK)
+}
+
+func (app *App) deleteImportProfile(w http.ResponseWriter, r *http.Request) {
+	p := app.importProfileFromURL(w, r)
+	if p == nil {
+		return
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM import_profiles WHERE id = ?", p.ID); err != nil {
+		log.Error("Failed to delete import profile:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runImportProfile imports the CSV or JSON file in the request body with a
+// profile. Rows that match no item or several, locked items and rows with
+// invalid values are skipped and counted; the rest are imported in one
+// transaction, and the items are written back to their files if their
+// library asks for it.
+func (app *App) runImportProfile(w http.ResponseWriter, r *http.Request) {
+	p := app.importProfileFromURL(w, r)
+	if p == nil {
+		return
+	}
+
+	rows, err := readImportRows(p.Format, http.MaxBytesReader(w, r.Body, maxImportFileSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid %s file: %v", p.Format, err), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to import metadata:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	unmatched, ambiguous, locked := 0, 0, 0
+	errors := []ImportError{}
+	updated := 0
+	changed := map[int]bool{}
+	for i, row := range rows {
+		key := strings.TrimSpace(row[p.MatchColumn])
+		if key == "" {
+			unmatched++
+			continue
+		}
+
+		var items []MediaItem
+		if err := tx.Select(&items, "SELECT * FROM media WHERE "+p.MatchBy+" = ? LIMIT 2", key); err != nil {
+			log.Error("Failed to import metadata:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case len(items) == 0:
+			unmatched++
+			continue
+		case len(items) > 1:
+			ambiguous++
+			continue
+		case items[0].Locked:
+			locked++
+			continue
+		}
+
+		changes, err := p.changes(row)
+		if err != nil {
+			errors = append(errors, ImportError{Row: i + 1, Error: err.Error()})
+			continue
+		}
+		if err := changes.apply(tx, items[0].ID); err != nil {
+			log.Error("Failed to import metadata:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		updated++
+		changed[items[0].ID] = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Error("Failed to import metadata:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for id := range changed {
+		var item MediaItem
+		if err := app.DB.Get(&item, "SELECT * FROM media WHERE id = ?", id); err == nil {
+			app.writeBack(&item)
+		}
+	}
+
+	log.Infof("Imported metadata of %d media items with profile %q", len(changed), p.Name)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":   true,
+		"rows":      len(rows),
+		"updated":   updated,
+		"unmatched": unmatched,
+		"ambiguous": ambiguous,
+		"locked":    locked,
+		"errors":    errors,
+	})
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxSidecarSize caps the JSON metadata files read by an ingest.
+const maxSidecarSize = 1 << 20
+
+// sidecarRecord is the schema of an ingest's JSON metadata files: an item
+// as /api/media/export writes it, with its tags, people, genres and custom
+// attributes. Of the item's fields only title, description, year,
+// taken_at, artist, album and locked are imported; the others describe the
+// file and are read again from it. Unknown fields are errors, so typos
+// don't go unnoticed.
+type sidecarRecord struct {
+	MediaItem
+	Tags       []string          `json:"tags"`
+	People     []string          `json:"people"`
+	Genres     []string          `json:"genres"`
+	Attributes map[string]string `json:"attributes"`
+	// Attachments are listed by exports, but not imported.
+	Attachments json.RawMessage `json:"attachments"`
+}
+
+// SidecarError is a file an ingest couldn't import.
+type SidecarError struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+// findJSONSidecar returns the metadata file of a media file, named after
+// the whole filename ("IMG_0001.jpg.json") or its stem ("IMG_0001.json"),
+// or an empty string if it has none.
+func findJSONSidecar(path string, files map[string]bool) string {
+	for _, candidate := range []string{path + ".json", strings.TrimSuffix(path, filepath.Ext(path)) + ".json"} {
+		if files[candidate] {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readSidecarRecord reads and validates a metadata file, returning the
+// changes it makes to its item.
+func readSidecarRecord(path string) (*importChanges, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSidecarSize {
+		return nil, fmt.Errorf("larger than %d bytes", maxSidecarSize)
+	}
+
+	var record sidecarRecord
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&record); err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("more than one JSON value")
+	}
+
+	changes := &importChanges{
+		columns:    map[string]interface{}{},
+		lists:      map[string][]string{},
+		attributes: map[string]string{},
+	}
+	// Empty values don't clear what the item already has
+	for column, v := range map[string]string{
+		"title":       record.Title,
+		"description": record.Description,
+		"artist":      record.Artist,
+		"album":       record.Album,
+	} {
+		if v != "" {
+			changes.columns[column] = v
+		}
+	}
+	switch {
+	case record.Year < 0:
+		return nil, fmt.Errorf("invalid year %d", record.Year)
+	case record.Year > 0:
+		changes.columns["year"] = record.Year
+	}
+	if record.TakenAt != nil {
+		changes.columns["taken_at"] = record.TakenAt.UTC()
+	}
+	if record.Locked {
+		changes.columns["locked"] = true
+	}
+
+	for _, tag := range record.Tags {
+		name, err := tagName(tag)
+		if err != nil {
+			return nil, err
+		}
+		changes.lists["tags"] = append(changes.lists["tags"], name)
+	}
+	for field, values := range map[string][]string{"people": record.People, "genres": record.Genres} {
+		for _, v := range values {
+			if v = strings.TrimSpace(v); v == "" {
+				return nil, fmt.Errorf("empty name in %s", field)
+			}
+			changes.lists[field] = append(changes.lists[field], v)
+		}
+	}
+	for key, v := range record.Attributes {
+		if !attributeKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("invalid attribute key %q", key)
+		}
+		changes.attributes[key] = v
+	}
+	return changes, nil
+}
+
+// ingestSidecars imports a directory of media files, each with a JSON
+// metadata file next to it, in one pass: every file is imported with its
+// metadata, unless the metadata is invalid, in which case neither is.
+// Files without metadata are imported as they are, and metadata without a
+// file is reported. dry_run only validates the metadata. Locked items keep
+// theirs.
+func (app *App) ingestSidecars(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Path   string `json:"path"`
+		DryRun bool   `json:"dry_run"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsAbs(req.Path) {
+		http.Error(w, "Path must be absolute", http.StatusBadRequest)
+		return
+	}
+	root := filepath.Clean(req.Path)
+
+	// Files a scan would skip are left out the same way
+	options := app.Config.Scan.options()
+	ignores, err := app.scanIgnores(root)
+	if err != nil {
+		log.Error("Failed to load ignore rules:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if dir := ignores.excludedDir(root); dir != "" {
+		http.Error(w, dir+" is excluded from the library", http.StatusBadRequest)
+		return
+	}
+
+	var media []string
+	files := map[string]bool{}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			log.Warnf("Ingest: skipping %s: %v", path, err)
+			return nil
+		}
+		excluded, err := options.excluded(&ignores, root, path, info)
+		if err != nil {
+			log.Warnf("Ingest: %s: %v", filepath.Join(path, mediaIgnoreFile), err)
+		}
+		if excluded && info.IsDir() {
+			return filepath.SkipDir
+		}
+		if excluded || !info.Mode().IsRegular() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if ext == ".json" {
+			files[path] = true
+		} else if _, ok := supportedExtensions[ext]; ok {
+			media = append(media, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		http.Error(w, "Directory not found: "+root, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to walk ingest directory:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	imported, updated, withoutSidecar, locked := 0, 0, 0, 0
+	failed := []SidecarError{}
+	used := map[string]bool{}
+	for _, path := range media {
+		var changes *importChanges
+		if sidecar := findJSONSidecar(path, files); sidecar != "" {
+			used[sidecar] = true
+			if changes, err = readSidecarRecord(sidecar); err != nil {
+				failed = append(failed, SidecarError{Path: sidecar, Error: err.Error()})
+				continue
+			}
+		} else {
+			withoutSidecar++
+		}
+		if req.DryRun {
+			continue
+		}
+
+		item, created, err := app.importFile(path)
+		if err != nil {
+			failed = append(failed, SidecarError{Path: path, Error: err.Error()})
+			continue
+		}
+		if created {
+			imported++
+		}
+		if changes == nil {
+			continue
+		}
+		if item.Locked {
+			locked++
+			continue
+		}
+
+		tx, err := app.DB.Beginx()
+		if err == nil {
+			if err = changes.apply(tx, item.ID); err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			log.Error("Failed to import metadata:", err)
+			failed = append(failed, SidecarError{Path: path, Error: err.Error()})
+			continue
+		}
+		if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err == nil {
+			app.writeBack(item)
+		}
+		updated++
+	}
+
+	var orphans []string
+	for path := range files {
+		if !used[path] {
+			orphans = append(orphans, path)
+		}
+	}
+	sort.Strings(orphans)
+	for _, path := range orphans {
+		failed = append(failed, SidecarError{Path: path, Error: "no media file for this metadata"})
+	}
+
+	log.Infof("Ingested %s: %d files imported, %d with metadata", root, imported, updated)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":         true,
+		"dry_run":         req.DryRun,
+		"files":           len(media),
+		"imported":        imported,
+		"updated":         updated,
+		"without_sidecar": withoutSidecar,
+		"locked":          locked,
+		"errors":          failed,
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Locked items are protected from automated changes. The database refuses
+// to delete, move or rename them (see migration 10), and automated
+// processes skip them instead of adding to them.
+
+func (app *App) setLocked(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		Locked *bool `json:"locked"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Locked == nil {
+		http.Error(w, "locked is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := app.DB.Exec("UPDATE media SET locked = ? WHERE id = ?", *req.Locked, item.ID); err != nil {
+		log.Error("Failed to update lock:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	item.Locked = *req.Locked
+
+	app.writeJSON(w, r, http.StatusOK, item)
+}
@@ -3,12 +3,10 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
-	"strings"
 	"time"
 
 	"github.com/go-chi/chi"
@@ -18,16 +16,156 @@ import (
 )
 
 type MediaItem struct {
-	ID          int       `db:"id" json:"id"`
-	Path        string    `db:"path" json:"path"`
-	Filename    string    `db:"filename" json:"filename"`
-	Size        int64     `db:"size" json:"size"`
-	Type        string    `db:"type" json:"type"`
-	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	ID       int    `db:"id" json:"id"`
+	Path     string `db:"path" json:"path"`
+	Filename string `db:"filename" json:"filename"`
+	Size     int64  `db:"size" json:"size"`
+	Type     string `db:"type" json:"type"`
+	// MimeType is sniffed from the file's content when it's probed, while
+	// Type follows its extension. It's empty until then.
+	MimeType   string    `db:"mime_type" json:"mime_type"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	Checksum   string    `db:"checksum" json:"checksum"`
+	Oshash     string    `db:"oshash" json:"oshash"`
+	ArtworkURL string    `db:"artwork_url" json:"artwork_url"`
+	Artwork    string    `db:"artwork" json:"-"`
+	// Locked items are protected from automated changes.
+	Locked bool `db:"locked" json:"locked"`
+	// Organized items have been reviewed, and leave the review queue.
+	Organized bool `db:"organized" json:"organized"`
+	// FileModTime is the file's modification time, unlike CreatedAt which
+	// is when it was added. FileBirthTime is its creation time, on
+	// platforms that record one. Both are nil for items added before they
+	// were tracked, until the next scan of their directory.
+	FileModTime   *time.Time `db:"file_mod_time" json:"file_mod_time"`
+	FileBirthTime *time.Time `db:"file_birth_time" json:"file_birth_time"`
+	// VerifiedAt is when the file of an item of an immutable library last
+	// matched its checksum.
+	VerifiedAt *time.Time `db:"verified_at" json:"verified_at"`
+
+	// Technical metadata. Width and Height are set for images and videos,
+	// as displayed, so they are swapped for images stored on their side;
+	// the rest comes from ffprobe for videos. Audio files have their
+	// Duration, AudioCodec, SampleRate and AudioChannels read from their
+	// headers. Duration is in seconds and Bitrate in bits per second.
+	// Container is ffprobe's format name, which lists every name the
+	// format goes by, e.g. "mov,mp4,m4a".
+	Duration   float64 `db:"duration" json:"duration"`
+	Width      int     `db:"width" json:"width"`
+	Height     int     `db:"height" json:"height"`
+	VideoCodec string  `db:"video_codec" json:"video_codec"`
+	AudioCodec string  `db:"audio_codec" json:"audio_codec"`
+	Bitrate    int64   `db:"bitrate" json:"bitrate"`
+	FrameRate  float64 `db:"frame_rate" json:"frame_rate"`
+	Container  string  `db:"container" json:"container"`
+	// Projection, HDR and StereoMode flag 360 degree, HDR and 3D video;
+	// see videoInfo for their values.
+	Projection string `db:"projection" json:"projection"`
+	HDR        string `db:"hdr" json:"hdr"`
+	StereoMode string `db:"stereo_mode" json:"stereo_mode"`
+	// Color description of a video in ffprobe's names, e.g. "bt2020"
+	// primaries with the "smpte2084" (PQ) transfer for HDR10, and the bits
+	// per color component.
+	ColorPrimaries string `db:"color_primaries" json:"color_primaries"`
+	ColorTransfer  string `db:"color_transfer" json:"color_transfer"`
+	ColorSpace     string `db:"color_space" json:"color_space"`
+	BitDepth       int    `db:"bit_depth" json:"bit_depth"`
+	Probed         bool   `db:"probed" json:"-"`
+	// Frames is the number of frames of an image, more than one for
+	// animated GIF, PNG (APNG) and WebP images.
+	Animated bool `db:"animated" json:"is_animated"`
+	Frames   int  `db:"frames" json:"frames"`
+	// Orientation is the EXIF orientation of an image, 1 to 8, or 0 if it
+	// has none. Thumbnails are rendered upright.
+	Orientation int `db:"orientation" json:"orientation"`
+	// Audio tracks of a video; see videoInfo. AudioLanguages is comma
+	// separated, e.g. "eng,jpn".
+	AudioTracks    int    `db:"audio_tracks" json:"audio_tracks"`
+	AudioChannels  int    `db:"audio_channels" json:"audio_channels"`
+	ChannelLayout  string `db:"channel_layout" json:"channel_layout"`
+	SampleRate     int    `db:"sample_rate" json:"sample_rate"`
+	AudioLanguages string `db:"audio_languages" json:"audio_languages"`
+
+	// Latitude and Longitude are the GPS position of a photo, if its EXIF
+	// data has one. Country (an ISO 3166-1 alpha-2 code) and City are
+	// filled in from them if reverse geocoding is configured.
+	Latitude  *float64 `db:"latitude" json:"latitude"`
+	Longitude *float64 `db:"longitude" json:"longitude"`
+	Country   string   `db:"country" json:"country"`
+	City      string   `db:"city" json:"city"`
+	// TakenAt comes from Google Takeout sidecars and is nil if the capture
+	// time is unknown. Title and Year come from the NFO files of videos,
+	// and Description from either. Title, Artist and Album of audio files
+	// come from their tags.
+	TakenAt     *time.Time `db:"taken_at" json:"taken_at"`
+	Description string     `db:"description" json:"description"`
+	Title       string     `db:"title" json:"title"`
+	Year        int        `db:"year" json:"year"`
+	Artist      string     `db:"artist" json:"artist"`
+	Album       string     `db:"album" json:"album"`
+
+	// Extra is "sample" or "trailer" for videos that belong to the main
+	// video ParentID rather than standing on their own, and "raw" for RAW
+	// files paired with a JPEG.
+	Extra    string `db:"extra" json:"extra"`
+	ParentID *int   `db:"parent_id" json:"parent_id"`
+
+	// Document metadata, of which comics have the page count and
+	// thumbnail. Content is the extracted text, which is searched but too
+	// large to include in responses. Thumbnail is the name of the first
+	// page or cover image in the thumbnail directory, or of the scaled
+	// down copy of an image.
+	Pages     int    `db:"pages" json:"pages"`
+	Content   string `db:"content" json:"-"`
+	Thumbnail string `db:"thumbnail" json:"-"`
+
+	// ContentRating is the rating of a video from its NFO file, e.g.
+	// "PG-13", and RatingAge its minimum age, nil if unknown.
+	ContentRating string `db:"content_rating" json:"content_rating"`
+	RatingAge     *int   `db:"rating_age" json:"rating_age"`
+
+	// Sharpness is the variance of the Laplacian of an image, nil until
+	// it is analyzed; lower is blurrier.
+	Sharpness *float64 `db:"sharpness" json:"sharpness"`
+	// PHash is the perceptual hash of an image, in hex, that near-duplicates
+	// are found by. It is empty for images without a thumbnail.
+	PHash string `db:"phash" json:"phash"`
 }
 
 type App struct {
-	DB *sqlx.DB
+	DB     *sqlx.DB
+	Config *Config
+	Events *eventHub
+	// FFprobe is the path of the ffprobe binary, or empty if there is none.
+	FFprobe string
+	// FFmpeg is the path of the ffmpeg binary used to fingerprint videos,
+	// or empty if there is none.
+	FFmpeg string
+	// PDF are the Poppler tools used for PDF documents.
+	PDF pdfTools
+	// Unrar is the path of unrar, used for CBR comics, or empty if there
+	// is none.
+	Unrar string
+	// Geocoder places photos by their GPS position, nil if disabled.
+	Geocoder geocoder
+	// Thumbnailer renders the thumbnails of images and videos, locally or
+	// on thumbnail workers.
+	Thumbnailer thumbnailer
+	// Placer chooses the volume new files of a library are stored on.
+	Placer *volumePlacer
+	// ExifTool is the path of exiftool, or empty if metadata isn't
+	// written to files.
+	ExifTool string
+	// Providers are the clients of external services, by provider name.
+	Providers map[string]*apiClient
+	// Restrictions are the restricted profiles, by name.
+	Restrictions map[string]*restriction
+	PINAttempts  pinAttempts
+	// Processing holds heavy background work back outside the processing
+	// windows.
+	Processing *processingGate
+	// FilenameParsers read titles and capture dates from filenames.
+	FilenameParsers []*filenameParser
 }
 
 var supportedExtensions = map[string]string{
@@ -43,9 +181,36 @@ var supportedExtensions = map[string]string{
 	".png":  "image",
 	".gif":  "image",
 	".webp": "image",
+	".cr2":  "raw",
+	".cr3":  "raw",
+	".nef":  "raw",
+	".arw":  "raw",
+	".dng":  "raw",
+	".raf":  "raw",
+	".pdf":  "document",
+	".epub": "document",
+	".mp3":  "audio",
+	".flac": "audio",
+	".m4a":  "audio",
+	".ogg":  "audio",
+	".cbz":  "comic",
+	".cbr":  "comic",
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "tui" {
+		if err := runTUI(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "thumbnailer" {
+		if err := runThumbnailWorker(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	log.SetFormatter(&log.TextFormatter{
 		FullTimestamp: true,
 	})
@@ -53,6 +218,19 @@ func main() {
 
 	log.Info("Starting Media Organizer MVP...")
 
+	config, err := loadConfig(configFile)
+	if err != nil {
+		log.Fatal("Failed to load configuration:", err)
+	}
+	if err := checkLibraries(config.Libraries); err != nil {
+		log.Fatal("Invalid library configuration:", err)
+	}
+
+	setDataDir(config.DataDir)
+	if err := migrateLegacyDataDir(); err != nil {
+		log.Fatal("Failed to migrate the legacy data directory:", err)
+	}
+
 	// Initialize database
 	db, err := initDB()
 	if err != nil {
@@ -60,30 +238,255 @@ func main() {
 	}
 	defer db.Close()
 
-	app := &App{DB: db}
+	app := &App{
+		DB:       db,
+		Config:   config,
+		Events:   newEventHub(),
+		Placer:   newVolumePlacer(),
+		ExifTool: findExifTool(config),
+		FFprobe:  findTool(config.Metadata.FFprobePath, "video metadata"),
+		FFmpeg:   findTool(config.Metadata.FFmpegPath, "video fingerprints and thumbnails"),
+		PDF: pdfTools{
+			Info:   findTool(config.Metadata.PDFInfoPath, "PDF page counts"),
+			Text:   findTool(config.Metadata.PDFToTextPath, "PDF text"),
+			Render: findTool(config.Metadata.PDFToPPMPath, "PDF thumbnails"),
+		},
+		Unrar: findTool(config.Metadata.UnrarPath, "CBR comic pages"),
+	}
+
+	if app.Providers, err = newAPIClients(db, config.Providers); err != nil {
+		log.Fatal("Invalid provider settings:", err)
+	}
+
+	if app.Processing, err = newProcessingGate(config.Processing); err != nil {
+		log.Fatal("Invalid processing configuration:", err)
+	}
+	go app.runDeferred()
+
+	if app.Restrictions, err = newRestrictions(config); err != nil {
+		log.Fatal("Invalid profile configuration:", err)
+	}
+
+	if app.FilenameParsers, err = newFilenameParsers(config.FilenameParsers); err != nil {
+		log.Fatal("Invalid filename parser configuration:", err)
+	}
+
+	if app.Events.sinks, err = newEventSinks(db, config.Sinks); err != nil {
+		log.Fatal("Invalid sink configuration:", err)
+	}
+
+	if app.Thumbnailer, err = newThumbnailer(config.Thumbnails, app.FFmpeg); err != nil {
+		log.Fatal("Invalid thumbnail configuration:", err)
+	}
+
+	if app.Geocoder, err = newGeocoder(config.Geocoding, app.Providers[providerGeocoding]); err != nil {
+		log.Warn("Failed to set up reverse geocoding; photo places will not be looked up:", err)
+	}
+
+	if err := app.interruptScans(); err != nil {
+		log.Fatal("Failed to update scan history:", err)
+	}
+
+	if err := app.interruptMoves(); err != nil {
+		log.Fatal("Failed to update move journal:", err)
+	}
+
+	if err := app.interruptAnalyses(); err != nil {
+		log.Fatal("Failed to update dedup analysis history:", err)
+	}
+
+	if err := app.expireStaging(); err != nil {
+		log.Warn("Failed to discard expired staging sessions:", err)
+	}
+
+	if err := app.scheduleOnThisDay(config.OnThisDay.DigestTime); err != nil {
+		log.Fatal("Failed to schedule the On This Day digest:", err)
+	}
+
+	app.scheduleTrashPurge()
 
 	// Setup router
 	r := chi.NewRouter()
+	r.Use(app.restrict)
 
 	// API routes
 	r.Get("/api/media", app.getMediaItems)
+	r.Post("/api/media/lookup", app.lookupMedia)
+	r.Post("/api/media/import", app.importMedia)
+	r.Post("/api/media/import/sidecars", app.ingestSidecars)
+	r.Post("/api/media/probe", app.probeMissing)
+	r.Post("/api/media/classify", app.classifyLibrary)
+	r.Post("/api/media/geocode", app.geocodeMissing)
+	r.Post("/api/media/writeback", app.writeBackMedia)
+	r.Post("/api/media/verify", app.verifyMedia)
+	r.Post("/api/media/sharpness", app.analyzeSharpness)
+	r.Post("/api/media/fingerprint", app.fingerprintVideos)
+	r.Get("/api/media/duplicates", app.getVideoDuplicates)
+	r.Get("/api/media/similar", app.getImageClusters)
+	r.Post("/api/media/delete/preview", app.previewDelete)
+	r.Post("/api/media/delete", app.deleteMedia)
+	r.Post("/api/media/bulk", app.bulkMedia)
+	r.Delete("/api/media/{id}", app.deleteMediaItem)
+	r.Get("/api/trash", app.getTrash)
+	r.Post("/api/trash/{id}/restore", app.restoreTrash)
+	r.Delete("/api/trash", app.emptyTrash)
+	r.Post("/api/media/replace/preview", app.previewReplace)
+	r.Post("/api/media/relink/preview", app.previewRelink)
+	r.Post("/api/media/relink", app.relinkMedia)
+	r.Post("/api/media/replace", app.replaceMetadata)
+	r.Post("/api/media/organize/preview", app.previewOrganize)
+	r.Post("/api/media/organize", app.organizeMedia)
+	r.Post("/api/media/rename/preview", app.previewRename)
+	r.Post("/api/media/rename", app.renameMedia)
+	r.Get("/api/media/changes", app.getMediaChanges)
+	r.Get("/api/media/export", app.exportMedia)
+	r.Get("/api/media/onthisday", app.getOnThisDay)
+	r.Get("/api/media/review", app.getReviewQueue)
+	r.Get("/api/media/{id}", app.getMediaItem)
+	r.Patch("/api/media/{id}", app.updateMediaItem)
+	r.Get("/api/media/{id}/artwork", app.served(app.getArtwork))
+	r.Get("/api/media/{id}/thumbnail", app.served(app.getThumbnail))
+	r.Get("/api/media/{id}/pages/{page}", app.served(app.getComicPage))
+	r.Get("/api/media/{id}/attachments", app.getAttachments)
+	r.Post("/api/media/{id}/attachments", app.addAttachment)
+	r.Get("/api/media/{id}/attachments/{attachmentID}", app.getAttachment)
+	r.Delete("/api/media/{id}/attachments/{attachmentID}", app.deleteAttachment)
+	r.Get("/api/media/{id}/versions", app.getVersions)
+	r.Post("/api/media/{id}/versions", app.addVersions)
+	r.Delete("/api/media/{id}/versions/{versionID}", app.removeVersion)
+	r.Put("/api/media/{id}/primary", app.setPrimary)
+	r.Get("/api/media/{id}/markers", app.getMarkers)
+	r.Post("/api/media/{id}/markers", app.addMarker)
+	r.Patch("/api/media/{id}/markers/{markerID}", app.updateMarker)
+	r.Delete("/api/media/{id}/markers/{markerID}", app.deleteMarker)
+	r.Get("/api/media/{id}/similar", app.getSimilarImages)
+	r.Post("/api/media/{id}/keep", app.keepShot)
+	r.Put("/api/media/{id}/artwork", app.setArtwork)
+	r.Get("/api/media/{id}/aliases", app.getAliases)
+	r.Post("/api/media/{id}/aliases", app.createAlias)
+	r.Put("/api/media/{id}/lock", app.setLocked)
+	r.Put("/api/media/{id}/organized", app.setOrganized)
+	r.Get("/api/media/{id}/flags", app.getMediaFlags)
+	r.Put("/api/media/{id}/flags/{flag}", app.setMediaFlag)
+	r.Delete("/api/media/{id}/flags/{flag}", app.clearMediaFlag)
+	r.Get("/api/media/{id}/attributes", app.getMediaAttributes)
+	r.Put("/api/media/{id}/attributes/{key}", app.setMediaAttribute)
+	r.Delete("/api/media/{id}/attributes/{key}", app.deleteMediaAttribute)
+	r.Get("/api/media/{id}/tags", app.getMediaTags)
+	r.Put("/api/media/{id}/tags/{name}", app.addMediaTag)
+	r.Delete("/api/media/{id}/tags/{name}", app.removeMediaTag)
+	r.Get("/api/media/{id}/people", app.getMediaPeople)
+	r.Put("/api/media/{id}/people/{name}", app.addMediaPerson)
+	r.Delete("/api/media/{id}/people/{name}", app.removeMediaPerson)
+	r.Get("/api/flags", app.getFlags)
+	r.Get("/api/attributes", app.getAttributes)
+	r.Get("/api/tags", app.getTags)
+	r.Post("/api/tags", app.createTag)
+	r.Get("/api/tags/tree", app.getTagTree)
+	r.Get("/api/tags/{id}", app.getTag)
+	r.Patch("/api/tags/{id}", app.updateTag)
+	r.Delete("/api/tags/{id}", app.deleteTag)
+	r.Post("/api/tags/{id}/aliases", app.addTagAlias)
+	r.Delete("/api/tags/{id}/aliases/{name}", app.deleteTagAlias)
+	r.Post("/api/tags/{id}/merge", app.mergeTags)
+	r.Get("/api/people", app.getPeople)
+	r.Post("/api/people", app.createPerson)
+	r.Get("/api/people/{id}", app.getPerson)
+	r.Patch("/api/people/{id}", app.updatePerson)
+	r.Delete("/api/people/{id}", app.deletePerson)
+	r.Post("/api/people/{id}/aliases", app.addPersonAlias)
+	r.Delete("/api/people/{id}/aliases/{name}", app.deletePersonAlias)
+	r.Put("/api/people/{id}/image", app.setPersonImage)
+	r.Get("/api/people/{id}/image", app.getPersonImage)
+	r.Get("/api/import-profiles", app.getImportProfiles)
+	r.Post("/api/import-profiles", app.createImportProfile)
+	r.Get("/api/import-profiles/{id}", app.getImportProfile)
+	r.Patch("/api/import-profiles/{id}", app.updateImportProfile)
+	r.Delete("/api/import-profiles/{id}", app.deleteImportProfile)
+	r.Post("/api/import-profiles/{id}/run", app.runImportProfile)
+	r.Get("/api/locations", app.getLocations)
+	r.Get("/api/providers", app.getProviders)
+	r.Get("/api/sinks", app.getSinks)
+	r.Get("/api/processing", app.getProcessing)
+	r.Get("/api/capabilities", app.getCapabilities)
+	r.Get("/api/profile", app.getProfile)
+	r.Post("/api/profile", app.switchProfile)
+	r.Delete("/api/providers/{name}/cache", app.clearProviderCache)
 	r.Post("/api/scan", app.scanDirectory)
+	r.Get("/api/scans", app.getScans)
+	r.Get("/api/scans/{id}/errors", app.getScanErrors)
+	r.Get("/api/scan/{id}/errors", app.getScanErrors)
+	r.Post("/api/scans/{id}/resume", app.resumeScan)
+	r.Post("/api/upload", app.uploadMedia)
+	r.Post("/api/staging", app.createStaging)
+	r.Get("/api/staging/{id}", app.getStaging)
+	r.Delete("/api/staging/{id}", app.discardStaging)
+	r.Post("/api/staging/{id}/files", app.stageFile)
+	r.Get("/api/staging/{id}/files/{fileID}", app.getStagedFile)
+	r.Patch("/api/staging/{id}/files/{fileID}", app.updateStagedFile)
+	r.Delete("/api/staging/{id}/files/{fileID}", app.discardStagedFile)
+	r.Post("/api/staging/{id}/commit", app.commitStaging)
+	r.Post("/api/media/{id}/move", app.moveMediaItem)
+	r.Post("/api/moves", app.moveMedia)
+	r.Get("/api/moves", app.getMoveBatches)
+	r.Get("/api/moves/{id}", app.getMoveBatch)
+	r.Post("/api/moves/{id}/resume", app.resumeMoves)
+	r.Post("/api/moves/{id}/rollback", app.rollbackMoves)
 	r.Get("/api/stats", app.getStats)
+	r.Get("/api/dashboard", app.getDashboard)
+	r.Get("/api/volumes", app.getVolumes)
+	r.Post("/api/dedup", app.startAnalysis)
+	r.Get("/api/dedup", app.getAnalyses)
+	r.Get("/api/dedup/{id}", app.getAnalysis)
+	r.Get("/api/galleries", app.getGalleries)
+	r.Get("/api/galleries/{id}", app.getGallery)
+	r.Get("/api/galleries/{id}/media", app.getGalleryMedia)
+	r.Get("/api/collections", app.getCollections)
+	r.Post("/api/collections", app.createCollection)
+	r.Patch("/api/collections/{id}", app.updateCollection)
+	r.Delete("/api/collections/{id}", app.deleteCollection)
+	r.Get("/api/collections/{id}/media", app.getCollectionMedia)
+	r.Post("/api/collections/{id}/items", app.addCollectionItems)
+	r.Delete("/api/collections/{id}/items/{mediaID}", app.removeCollectionItem)
+	r.Put("/api/collections/{id}/order", app.orderCollection)
+	r.Get("/api/smart-collections", app.getSmartCollections)
+	r.Post("/api/smart-collections", app.createSmartCollection)
+	r.Get("/api/smart-collections/{id}", app.getSmartCollection)
+	r.Patch("/api/smart-collections/{id}", app.updateSmartCollection)
+	r.Delete("/api/smart-collections/{id}", app.deleteSmartCollection)
+	r.Get("/api/smart-collections/{id}/media", app.getCollectionMedia)
+	r.Get("/api/events", app.streamEvents)
+	r.Post("/api/hooks/ingest", app.ingestHook)
 
 	// Serve static files
 	r.Get("/", serveIndex)
 	r.Get("/static/*", http.NotFound)
 
-	log.Info("Server starting on http://localhost:9999")
-	log.Info("Open your browser and navigate to http://localhost:9999")
-	http.ListenAndServe(":9999", r)
+	ln, err := listen(config.Server.Port, config.Server.PortFallback)
+	if err != nil {
+		log.Fatal("Failed to listen:", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if port != config.Server.Port {
+		log.Warnf("Port %d is in use, using %d instead", config.Server.Port, port)
+	}
+
+	if config.Server.MDNS {
+		if err := advertise(config.Server.Name, port); err != nil {
+			log.Warn("Failed to start mDNS advertisement:", err)
+		}
+	}
+
+	log.Infof("Server starting on http://localhost:%d", port)
+	log.Infof("Open your browser and navigate to http://localhost:%d", port)
+	log.Fatal(http.Serve(ln, r))
 }
 
 func initDB() (*sqlx.DB, error) {
-	// Create data directory if it doesn't exist
-	os.MkdirAll("./data", 0755)
+	// Create the database directory if it doesn't exist
+	os.MkdirAll(databaseDir, 0755)
 
-	db, err := sqlx.Connect("sqlite3", "./data/media.db")
+	db, err := sqlx.Connect("sqlite3", databasePath()+"?_foreign_keys=on")
 	if err != nil {
 		return nil, err
 	}
@@ -106,35 +509,121 @@ func initDB() (*sqlx.DB, error) {
 		return nil, err
 	}
 
+	if err := migrateDB(db); err != nil {
+		return nil, err
+	}
+
 	log.Info("Database initialized successfully")
 	return db, nil
 }
 
+// getMediaItems lists the items matching the filter. With a limit it
+// returns one page of them, with the total number of items and where the
+// page is; with a cursor, the page after the cursor and the cursor of the
+// next; without either it returns every item.
 func (app *App) getMediaItems(w http.ResponseWriter, r *http.Request) {
-	mediaType := r.URL.Query().Get("type")
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	var items []MediaItem
-	var err error
+	sort := r.URL.Query().Get("sort")
+	order, err := orderBy(sort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	if mediaType != "" {
-		err = app.DB.Select(&items, "SELECT * FROM media WHERE type = ? ORDER BY created_at DESC", mediaType)
-	} else {
-		err = app.DB.Select(&items, "SELECT * FROM media ORDER BY created_at DESC")
+	view, err := parseMediaView(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := parseMediaPage(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if page != nil && page.keyset && sort != "" && sort != "created_at" {
+		http.Error(w, "cursors only page the created_at sort", http.StatusBadRequest)
+		return
 	}
 
+	filter.profile = profileOf(r)
+	view.profile = filter.profile
+	where, args := filter.where()
+
+	// Natural filename order is sorted in Go, so those pages are cut from
+	// the whole listing. Keyset pages aren't counted, as counting takes as
+	// long as the offsets they avoid.
+	var total int
+	if page != nil && page.keyset {
+		where, args = page.keysetWhere(where, args)
+		order += page.sql()
+	} else if page != nil && sort != sortNatural {
+		if err := app.DB.Get(&total, "SELECT COUNT(*) FROM media"+where, args...); err != nil {
+			log.Error("Failed to count media items:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		order += page.sql()
+	}
+
+	var items []MediaItem
+	err = app.DB.Select(&items, "SELECT * FROM media"+where+order, args...)
 	if err != nil {
 		log.Error("Failed to fetch media items:", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	sortMedia(items, sort)
+	if page != nil && sort == sortNatural {
+		total = len(items)
+		items = page.slice(items)
+	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(items)
+	var next string
+	if page != nil && page.keyset && len(items) > page.limit {
+		items = items[:page.limit]
+		last := items[len(items)-1]
+		cursor := mediaCursor{ID: last.ID}
+		if err := app.DB.Get(&cursor.CreatedAt, "SELECT CAST(created_at AS TEXT) FROM media WHERE id = ?", last.ID); err != nil {
+			log.Error("Failed to fetch media cursor:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		next = cursor.encode()
+	}
+
+	out, err := app.presentMedia(items, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case page != nil && page.keyset:
+		app.writeJSON(w, r, http.StatusOK, page.keysetResult(out, next))
+		return
+	case page != nil:
+		app.writeJSON(w, r, http.StatusOK, page.result(out, len(items), total))
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, out)
 }
 
 func (app *App) scanDirectory(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		Path string `json:"path"`
+		Path       string `json:"path"`
+		MinSize    *int64 `json:"min_size"`
+		MaxSize    *int64 `json:"max_size"`
+		SkipHidden *bool  `json:"skip_hidden"`
+
+		MaxFilesPerSecond *float64 `json:"max_files_per_second"`
+		IdlePriority      *bool    `json:"idle_priority"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -147,73 +636,67 @@ func (app *App) scanDirectory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Infof("Starting scan of directory: %s", req.Path)
-
-	count := 0
-	err := filepath.Walk(req.Path, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-
-		if info.IsDir() {
-			return nil
-		}
-
-		ext := strings.ToLower(filepath.Ext(path))
-		mediaType, ok := supportedExtensions[ext]
-		if !ok {
-			return nil
-		}
-
-		// Check if file already exists
-		var existing int
-		err = app.DB.Get(&existing, "SELECT COUNT(*) FROM media WHERE path = ?", path)
-		if err == nil && existing > 0 {
-			return nil
-		}
-
-		media := MediaItem{
-			Path:     path,
-			Filename: info.Name(),
-			Size:     info.Size(),
-			Type:     mediaType,
-		}
-
-		_, err = app.DB.NamedExec(
-			"INSERT INTO media (path, filename, size, type) VALUES (:path, :filename, :size, :type)",
-			media,
-		)
-		if err != nil {
-			log.Warnf("Failed to insert media item %s: %v", path, err)
-		} else {
-			count++
-		}
+	options := app.Config.Scan.options()
+	if req.MinSize != nil {
+		options.MinSize = *req.MinSize
+	}
+	if req.MaxSize != nil {
+		options.MaxSize = *req.MaxSize
+	}
+	if req.SkipHidden != nil {
+		options.SkipHidden = *req.SkipHidden
+	}
+	if req.MaxFilesPerSecond != nil {
+		options.MaxFilesPerSecond = *req.MaxFilesPerSecond
+	}
+	if req.IdlePriority != nil {
+		options.IdlePriority = *req.IdlePriority
+	}
 
-		return nil
-	})
+	log.Infof("Starting scan of directory: %s", req.Path)
 
+	record, err := app.scan(req.Path, options)
 	if err != nil {
 		log.Error("Failed to scan directory:", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	log.Infof("Scan complete. Added %d new items", count)
+	log.Infof("Scan complete. Added %d new items", record.Added)
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"success": true,
-		"count":   count,
-		"message": fmt.Sprintf("Successfully scanned and added %d items", count),
-	})
+	app.writeScanResult(w, r, record)
 }
 
-func (app *App) getStats(w http.ResponseWriter, r *http.Request) {
-	var stats struct {
-		Total  int `db:"total"`
-		Videos int `db:"videos"`
-		Images int `db:"images"`
-	}
+// Stats are the library totals reported by /api/stats and the dashboard.
+type Stats struct {
+	Total  int `json:"total"`
+	Videos int `json:"videos"`
+	Images int `json:"images"`
+	// Documents are PDFs and EPUBs.
+	Documents int `json:"documents"`
+	// RAWs are RAW photos, including those paired with a JPEG.
+	RAWs int `json:"raws"`
+	// Audio are MP3, FLAC, M4A and Ogg files.
+	Audio int `json:"audio"`
+	// Comics are CBZ and CBR archives.
+	Comics int          `json:"comics"`
+	Quotas []QuotaUsage `json:"quotas"`
+	// Comparison compares the current period with the previous one, if
+	// asked for with ?compare.
+	Comparison *StatsComparison `json:"comparison,omitempty"`
+}
+
+// QuotaUsage is the space used by a library with a quota.
+type QuotaUsage struct {
+	Library string `json:"library"`
+	Used    int64  `json:"used"`
+	Quota   int64  `json:"quota"`
+}
+
+// stats computes the library totals. Failed counts are logged and left at
+// zero rather than failing the whole response.
+func (app *App) stats() Stats {
+	var stats Stats
 
 	err := app.DB.Get(&stats.Total, "SELECT COUNT(*) FROM media")
 	if err != nil && err != sql.ErrNoRows {
@@ -230,8 +713,60 @@ func (app *App) getStats(w http.ResponseWriter, r *http.Request) {
 		log.Error("Failed to get image count:", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	err = app.DB.Get(&stats.Documents, "SELECT COUNT(*) FROM media WHERE type = 'document'")
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed to get document count:", err)
+	}
+
+	err = app.DB.Get(&stats.RAWs, "SELECT COUNT(*) FROM media WHERE type = 'raw'")
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed to get RAW count:", err)
+	}
+
+	err = app.DB.Get(&stats.Audio, "SELECT COUNT(*) FROM media WHERE type = 'audio'")
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed to get audio count:", err)
+	}
+
+	err = app.DB.Get(&stats.Comics, "SELECT COUNT(*) FROM media WHERE type = 'comic'")
+	if err != nil && err != sql.ErrNoRows {
+		log.Error("Failed to get comic count:", err)
+	}
+
+	stats.Quotas = []QuotaUsage{}
+	for i := range app.Config.Libraries {
+		lib := &app.Config.Libraries[i]
+		used, err := app.libraryUsage(lib)
+		if err != nil {
+			log.Errorf("Failed to get usage of library %s: %v", lib.Name, err)
+			continue
+		}
+		stats.Quotas = append(stats.Quotas, QuotaUsage{Library: lib.Name, Used: used, Quota: lib.Quota})
+	}
+
+	return stats
+}
+
+// getStats returns the library totals. ?compare=day, week, month or year
+// adds what happened in the current period compared with the previous one.
+func (app *App) getStats(w http.ResponseWriter, r *http.Request) {
+	var comparison *StatsComparison
+	if period := r.URL.Query().Get("compare"); period != "" {
+		if !statsPeriods[period] {
+			http.Error(w, "invalid compare: "+period, http.StatusBadRequest)
+			return
+		}
+		var err error
+		if comparison, err = app.compareStats(period, time.Now()); err != nil {
+			log.Error("Failed to compare periods:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	stats := app.stats()
+	stats.Comparison = comparison
+	app.writeJSON(w, r, http.StatusOK, stats)
 }
 
 func serveIndex(w http.ResponseWriter, r *http.Request) {
@@ -434,6 +969,22 @@ const indexHTML = `<!DOCTYPE html>
             background: #48bb78;
         }
 
+        .media-type.document {
+            background: #ed8936;
+        }
+
+        .media-type.raw {
+            background: #9f7aea;
+        }
+
+        .media-type.audio {
+            background: #38b2ac;
+        }
+
+        .media-type.comic {
+            background: #e53e3e;
+        }
+
         .media-filename {
             font-weight: 600;
             color: #333;
@@ -453,6 +1004,16 @@ const indexHTML = `<!DOCTYPE html>
             color: #999;
         }
 
+        .media-thumbnail {
+            display: block;
+            width: 100%;
+            height: 160px;
+            object-fit: contain;
+            background: #eee;
+            border-radius: 4px;
+            margin-bottom: 10px;
+        }
+
         .message {
             padding: 15px;
             border-radius: 5px;
@@ -489,6 +1050,16 @@ const indexHTML = `<!DOCTYPE html>
             opacity: 0.3;
         }
 
+        .load-more {
+            display: none;
+            text-align: center;
+            margin-top: 20px;
+        }
+
+        .load-more.show {
+            display: block;
+        }
+
         .loading {
             text-align: center;
             padding: 40px;
@@ -516,6 +1087,22 @@ const indexHTML = `<!DOCTYPE html>
                 <div class="stat-number" id="imageCount">0</div>
                 <div class="stat-label">Images</div>
             </div>
+            <div class="stat-card">
+                <div class="stat-number" id="documentCount">0</div>
+                <div class="stat-label">Documents</div>
+            </div>
+            <div class="stat-card">
+                <div class="stat-number" id="rawCount">0</div>
+                <div class="stat-label">RAW</div>
+            </div>
+            <div class="stat-card">
+                <div class="stat-number" id="audioCount">0</div>
+                <div class="stat-label">Audio</div>
+            </div>
+            <div class="stat-card">
+                <div class="stat-number" id="comicCount">0</div>
+                <div class="stat-label">Comics</div>
+            </div>
         </div>
 
         <div class="controls">
@@ -529,6 +1116,10 @@ const indexHTML = `<!DOCTYPE html>
                 <button class="filter-btn active" onclick="filterMedia('')">All</button>
                 <button class="filter-btn" onclick="filterMedia('video')">Videos</button>
                 <button class="filter-btn" onclick="filterMedia('image')">Images</button>
+                <button class="filter-btn" onclick="filterMedia('document')">Documents</button>
+                <button class="filter-btn" onclick="filterMedia('raw')">RAW</button>
+                <button class="filter-btn" onclick="filterMedia('audio')">Audio</button>
+                <button class="filter-btn" onclick="filterMedia('comic')">Comics</button>
             </div>
         </div>
 
@@ -537,11 +1128,21 @@ const indexHTML = `<!DOCTYPE html>
             <div id="mediaList" class="media-list">
                 <div class="loading">Loading...</div>
             </div>
+            <div id="loadMore" class="load-more">
+                <button onclick="loadMedia(currentFilter, true)">Load more</button>
+            </div>
         </div>
     </div>
 
     <script>
         let currentFilter = '';
+        // Items are loaded a page at a time, so large libraries don't
+        // lock up the browser
+        const pageSize = 200;
+        let loadedMedia = [];
+        // Types whose items can have a thumbnail; those without one hide
+        // the image when it fails to load
+        const thumbnailTypes = ['image', 'raw', 'document', 'comic'];
 
         async function loadStats() {
             try {
@@ -550,17 +1151,29 @@ const indexHTML = `<!DOCTYPE html>
                 document.getElementById('totalCount').textContent = stats.total || 0;
                 document.getElementById('videoCount').textContent = stats.videos || 0;
                 document.getElementById('imageCount').textContent = stats.images || 0;
+                document.getElementById('documentCount').textContent = stats.documents || 0;
+                document.getElementById('rawCount').textContent = stats.raws || 0;
+                document.getElementById('audioCount').textContent = stats.audio || 0;
+                document.getElementById('comicCount').textContent = stats.comics || 0;
             } catch (error) {
                 console.error('Failed to load stats:', error);
             }
         }
 
-        async function loadMedia(type = '') {
+        async function loadMedia(type = '', more = false) {
             try {
-                const url = type ? `/api/media?type=${type}` : '/api/media';
+                const offset = more ? loadedMedia.length : 0;
+                let url = ` + "`" + `/api/media?limit=${pageSize}&offset=${offset}` + "`" + `;
+                if (type) url += ` + "`" + `&type=${type}` + "`" + `;
                 const response = await fetch(url);
-                const media = await response.json();
-                displayMedia(media);
+                const page = await response.json();
+                loadedMedia = more ? loadedMedia.concat(page.items) : page.items;
+                displayMedia(loadedMedia);
+
+                const loadMore = document.getElementById('loadMore');
+                loadMore.classList.toggle('show', page.has_more);
+                loadMore.querySelector('button').textContent =
+                    ` + "`" + `Load more (${loadedMedia.length} of ${page.total})` + "`" + `;
             } catch (error) {
                 console.error('Failed to load media:', error);
                 document.getElementById('mediaList').innerHTML = '<div class="empty-state">Failed to load media</div>';
@@ -571,7 +1184,7 @@ const indexHTML = `<!DOCTYPE html>
             const mediaList = document.getElementById('mediaList');
             
             if (!media || media.length === 0) {
-                mediaList.innerHTML = `
+                mediaList.innerHTML = ` + "`" + `
                     <div class="empty-state">
                         <svg fill="currentColor" viewBox="0 0 20 20">
                             <path fill-rule="evenodd" d="M4 3a2 2 0 00-2 2v10a2 2 0 002 2h12a2 2 0 002-2V5a2 2 0 00-2-2H4zm12 12H4l4-8 3 6 2-4 3 6z" clip-rule="evenodd"></path>
@@ -579,18 +1192,19 @@ const indexHTML = `<!DOCTYPE html>
                         <h3>No media items found</h3>
                         <p>Scan a directory to add media to your library</p>
                     </div>
-                `;
+                ` + "`" + `;
                 return;
             }
 
-            mediaList.innerHTML = media.map(item => `
+            mediaList.innerHTML = media.map(item => ` + "`" + `
                 <div class="media-item">
+                    ${thumbnailTypes.includes(item.type) ? ` + "`" + `<img class="media-thumbnail" src="/api/media/${item.id}/thumbnail" loading="lazy" alt="" onerror="this.remove()">` + "`" + ` : ''}
                     <span class="media-type ${item.type}">${item.type}</span>
                     <div class="media-filename">${item.filename}</div>
                     <div class="media-path">${item.path}</div>
-                    <div class="media-size">${formatSize(item.size)}</div>
+                    <div class="media-size">${formatSize(item.size)}${item.pages ? ` + "`" + ` · ${item.pages} pages` + "`" + ` : ''}</div>
                 </div>
-            `).join('');
+            ` + "`" + `).join('');
         }
 
         function formatSize(bytes) {
@@ -612,6 +1226,16 @@ const indexHTML = `<!DOCTYPE html>
             btn.disabled = true;
             btn.textContent = '⏳ Scanning...';
 
+            // Show live progress of this scan while the request runs
+            const events = new EventSource('/api/events');
+            events.addEventListener('scan_progress', (e) => {
+                const progress = JSON.parse(e.data);
+                if (progress.root !== path) {
+                    return;
+                }
+                btn.textContent = ` + "`" + `⏳ Scanning... ${progress.visited} files, ${progress.added} new` + "`" + `;
+            });
+
             try {
                 const response = await fetch('/api/scan', {
                     method: 'POST',
@@ -631,6 +1255,7 @@ const indexHTML = `<!DOCTYPE html>
             } catch (error) {
                 showMessage('Failed to scan directory: ' + error.message, 'error');
             } finally {
+                events.close();
                 btn.disabled = false;
                 btn.textContent = '🔍 Scan';
             }
@@ -648,7 +1273,7 @@ const indexHTML = `<!DOCTYPE html>
         function showMessage(text, type) {
             const messageDiv = document.getElementById('message');
             messageDiv.textContent = text;
-            messageDiv.className = `message ${type} show`;
+            messageDiv.className = ` + "`" + `message ${type} show` + "`" + `;
             setTimeout(() => {
                 messageDiv.classList.remove('show');
             }, 5000);
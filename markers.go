@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxMarkerTitle is the maximum length of marker titles.
+const maxMarkerTitle = 200
+
+// Marker is a moment in a video, such as a chapter or a scene to come back
+// to, at Seconds from its start. Tag optionally names a tag saying what
+// happens there.
+type Marker struct {
+	ID        int       `db:"id" json:"id"`
+	MediaID   int       `db:"media_id" json:"media_id"`
+	Seconds   float64   `db:"seconds" json:"seconds"`
+	Title     string    `db:"title" json:"title"`
+	Tag       string    `db:"tag" json:"tag"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// markerRequest creates or changes a marker. Fields left out of a change
+// are kept; an empty tag removes it.
+type markerRequest struct {
+	Seconds *float64 `json:"seconds"`
+	Title   *string  `json:"title"`
+	Tag     *string  `json:"tag"`
+}
+
+// validate checks the request against the video, cleaning up the title and
+// tag name.
+func (req *markerRequest) validate(item *MediaItem) error {
+	if req.Seconds != nil {
+		s := *req.Seconds
+		if s < 0 || math.IsNaN(s) || math.IsInf(s, 0) {
+			return fmt.Errorf("seconds must be a time from the start of the video")
+		}
+		// The duration is only known once the video is probed
+		if item.Duration > 0 && s > item.Duration {
+			return fmt.Errorf("seconds is past the end of the video (%.3f)", item.Duration)
+		}
+	}
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || len(title) > maxMarkerTitle {
+			return fmt.Errorf("title must be 1 to %d characters", maxMarkerTitle)
+		}
+		req.Title = &title
+	}
+	if req.Tag != nil && *req.Tag != "" {
+		name, err := tagName(*req.Tag)
+		if err != nil {
+			return err
+		}
+		req.Tag = &name
+	}
+	return nil
+}
+
+// apply writes the request to the marker, creating the tag if it is new.
+func (req *markerRequest) apply(tx *sqlx.Tx, id int) error {
+	if req.Seconds != nil {
+		if _, err := tx.Exec("UPDATE media_markers SET seconds = ? WHERE id = ?", *req.Seconds, id); err != nil {
+			return err
+		}
+	}
+	if req.Title != nil {
+		if _, err := tx.Exec("UPDATE media_markers SET title = ? WHERE id = ?", *req.Title, id); err != nil {
+			return err
+		}
+	}
+	if req.Tag != nil {
+		var tagID interface{}
+		if *req.Tag != "" {
+			resolved, err := resolveTag(tx, *req.Tag)
+			if err != nil {
+				return err
+			}
+			tagID = resolved
+		}
+		if _, err := tx.Exec("UPDATE media_markers SET tag_id = ? WHERE id = ?", tagID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markerColumns selects a marker with the name of its tag.
+const markerColumns = `SELECT m.id, m.media_id, m.seconds, m.title, COALESCE(t.name, '') AS tag, m.created_at
+	FROM media_markers m LEFT JOIN tags t ON t.id = m.tag_id`
+
+// videoFromURL loads the media item identified by the {id} URL parameter,
+// writing an error response and returning nil if it can't or it isn't a
+// video.
+func (app *App) videoFromURL(w http.ResponseWriter, r *http.Request) *MediaItem {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return nil
+	}
+	if item.Type != "video" {
+		http.Error(w, "Markers are for videos", http.StatusBadRequest)
+		return nil
+	}
+	return item
+}
+
+// markerFromURL loads the marker identified by the {markerID} URL
+// parameter of the item, writing an error response and returning nil if it
+// can't.
+func (app *App) markerFromURL(w http.ResponseWriter, r *http.Request, item *MediaItem) *Marker {
+	id, err := strconv.Atoi(chi.URLParam(r, "markerID"))
+	if err != nil {
+		http.Error(w, "Invalid marker ID", http.StatusBadRequest)
+		return nil
+	}
+	return app.loadMarker(w, item, id)
+}
+
+// loadMarker fetches a marker of the item, writing an error response and
+// returning nil if it doesn't exist or can't be loaded.
+func (app *App) loadMarker(w http.ResponseWriter, item *MediaItem, id int) *Marker {
+	var m Marker
+	err := app.DB.Get(&m, markerColumns+" WHERE m.id = ? AND m.media_id = ?", id, item.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Marker not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch marker:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return &m
+}
+
+// getMarkers lists the markers of a video in the order they appear.
+func (app *App) getMarkers(w http.ResponseWriter, r *http.Request) {
+	item := app.videoFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	markers := []Marker{}
+	if err := app.DB.Select(&markers, markerColumns+" WHERE m.media_id = ? ORDER BY m.seconds, m.id", item.ID); err != nil {
+		log.Error("Failed to fetch markers:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, markers)
+}
+
+// addMarker marks a moment of a video. Tagging it with a name that isn't in
+// use creates the tag. Locked items can still be given markers, since they
+// don't change the item.
+func (app *App) addMarker(w http.ResponseWriter, r *http.Request) {
+	item := app.videoFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req markerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Seconds == nil || req.Title == nil {
+		http.Error(w, "seconds and title are required", http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to add marker:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var id int64
+	res, err := tx.Exec("INSERT INTO media_markers (media_id, seconds, title) VALUES (?, ?, ?)", item.ID, *req.Seconds, *req.Title)
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err == nil {
+		err = req.apply(tx, int(id))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Error("Failed to add marker:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if m := app.loadMarker(w, item, int(id)); m != nil {
+		app.writeJSON(w, r, http.StatusCreated, m)
+	}
+}
+
+// updateMarker moves, renames or retags a marker.
+func (app *App) updateMarker(w http.ResponseWriter, r *http.Request) {
+	item := app.videoFromURL(w, r)
+	if item == nil {
+		return
+	}
+	m := app.markerFromURL(w, r, item)
+	if m == nil {
+		return
+	}
+
+	var req markerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(item); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to update marker:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = req.apply(tx, m.ID)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Error("Failed to update marker:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if m := app.loadMarker(w, item, m.ID); m != nil {
+		app.writeJSON(w, r, http.StatusOK, m)
+	}
+}
+
+func (app *App) deleteMarker(w http.ResponseWriter, r *http.Request) {
+	item := app.videoFromURL(w, r)
+	if item == nil {
+		return
+	}
+	m := app.markerFromURL(w, r, item)
+	if m == nil {
+		return
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM media_markers WHERE id = ?", m.ID); err != nil {
+		log.Error("Failed to delete marker:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
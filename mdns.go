@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The instance is advertised over multicast DNS (RFC 6762) as a DNS-SD
+// service (RFC 6763), so clients on the LAN can browse for
+// _media-organizer._tcp.local instead of hardcoding an address.
+const (
+	mdnsService = "_media-organizer._tcp"
+	mdnsTTL     = 120
+)
+
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+
+	dnsClassIN = 1
+	// dnsCacheFlush marks records this host is the only owner of.
+	dnsCacheFlush = 0x8000
+)
+
+// mdnsResponder answers queries for the service, its instance and the host.
+type mdnsResponder struct {
+	instance string
+	host     string
+	port     int
+	conn     *net.UDPConn
+}
+
+// advertise announces the server on the LAN and answers queries for it in
+// the background.
+func advertise(name string, port int) error {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return err
+	}
+
+	m := &mdnsResponder{
+		// Dots would split the instance name into several labels
+		instance: strings.ReplaceAll(name, ".", "-"),
+		host:     hostname,
+		port:     port,
+		conn:     conn,
+	}
+
+	go m.serve()
+
+	// Announce twice, a second apart, as the RFC recommends
+	go func() {
+		for i := 0; i < 2; i++ {
+			m.respond()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	log.Infof("Advertising %s.%s.local on port %d", m.instance, mdnsService, port)
+	return nil
+}
+
+func (m *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := m.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Warn("mDNS responder stopped:", err)
+			return
+		}
+		if m.wanted(buf[:n]) {
+			m.respond()
+		}
+	}
+}
+
+// wanted reports whether msg is a query asking about anything this
+// responder owns.
+func (m *mdnsResponder) wanted(msg []byte) bool {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return false
+	}
+
+	names := map[string]bool{
+		"_services._dns-sd._udp.local":                             true,
+		mdnsService + ".local":                                     true,
+		strings.ToLower(m.instance + "." + mdnsService + ".local"): true,
+		strings.ToLower(m.host + ".local"):                         true,
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return false
+		}
+		if names[strings.ToLower(name)] {
+			return true
+		}
+		off = next + 4
+	}
+	return false
+}
+
+// respond multicasts every record of the service.
+func (m *mdnsResponder) respond() {
+	service := append(strings.Split(mdnsService, "."), "local")
+	instance := append([]string{m.instance}, service...)
+	host := []string{m.host, "local"}
+
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[2:], 0x8400) // response, authoritative
+
+	var answers uint16
+	add := func(name []string, typ, class uint16, rdata []byte) {
+		msg = appendName(msg, name)
+		msg = binary.BigEndian.AppendUint16(msg, typ)
+		msg = binary.BigEndian.AppendUint16(msg, class)
+		msg = binary.BigEndian.AppendUint32(msg, mdnsTTL)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(rdata)))
+		msg = append(msg, rdata...)
+		answers++
+	}
+
+	add([]string{"_services", "_dns-sd", "_udp", "local"}, dnsTypePTR, dnsClassIN, appendName(nil, service))
+	add(service, dnsTypePTR, dnsClassIN, appendName(nil, instance))
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(m.port))
+	add(instance, dnsTypeSRV, dnsClassIN|dnsCacheFlush, appendName(srv, host))
+
+	var txt []byte
+	for _, s := range []string{"path=/api"} {
+		txt = append(append(txt, byte(len(s))), s...)
+	}
+	add(instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, txt)
+
+	for _, ip := range localIPv4s() {
+		add(host, dnsTypeA, dnsClassIN|dnsCacheFlush, ip)
+	}
+
+	binary.BigEndian.PutUint16(msg[6:], answers)
+
+	if _, err := m.conn.WriteToUDP(msg, mdnsAddr); err != nil {
+		log.Warn("Failed to send mDNS response:", err)
+	}
+}
+
+// localIPv4s returns the host's non-loopback IPv4 addresses.
+func localIPv4s() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	var ips []net.IP
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		if ip := ipnet.IP.To4(); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// appendName appends a DNS name made of labels, without compression.
+func appendName(b []byte, labels []string) []byte {
+	for _, label := range labels {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// readName decodes the possibly compressed DNS name at off in msg, returning
+// it in dotted form along with the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name out of bounds")
+		}
+		n := int(msg[off])
+
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, "."), next, nil
+
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 10 {
+				return "", 0, errors.New("invalid name pointer")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errors.New("label out of bounds")
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLookup is the maximum number of IDs plus checksums accepted by a single
+// lookup request.
+const maxLookup = 500
+
+// MediaDetail is a media item together with its related records.
+type MediaDetail struct {
+	MediaItem
+	Aliases []MediaAlias `json:"aliases"`
+	// Extras are the samples and trailers of the item, or its RAW file.
+	Extras []MediaItem `json:"extras"`
+	// Versions are the files of the item besides its primary file.
+	Versions []MediaFile `json:"versions"`
+	Flags    []MediaFlag `json:"flags"`
+	// People are the names of the people in the item.
+	People []string `json:"people"`
+	Genres []string `json:"genres"`
+	Tags   []string `json:"tags"`
+	// Attributes are the custom attributes of the item.
+	Attributes map[string]string `json:"attributes"`
+	// Attachments are the auxiliary files attached to the item.
+	Attachments []Attachment `json:"attachments"`
+}
+
+// mediaRelations are the MediaDetail fields holding related records, which
+// clients can ask for with ?embed=.
+var mediaRelations = map[string]bool{
+	"aliases":     true,
+	"extras":      true,
+	"versions":    true,
+	"flags":       true,
+	"people":      true,
+	"genres":      true,
+	"tags":        true,
+	"attributes":  true,
+	"attachments": true,
+}
+
+// mediaView controls which parts of media items a response contains.
+type mediaView struct {
+	// fields are the MediaItem fields to include; nil means all.
+	fields map[string]bool
+	// embed are the related records to include.
+	embed map[string]bool
+	// profile hides the extras a restricted profile can't see.
+	profile *restriction
+}
+
+// parseMediaView reads the fields and embed query parameters, e.g.
+// ?fields=id,filename&embed=aliases. Without an embed parameter the view
+// embeds everything if embedAll is set, and nothing otherwise.
+func parseMediaView(values url.Values, embedAll bool) (mediaView, error) {
+	view := mediaView{embed: map[string]bool{}}
+	if embedAll {
+		view.embed = mediaRelations
+	}
+
+	if v := values.Get("fields"); v != "" {
+		// Accept the camelCase spelling too, for clients using that profile
+		known := map[string]string{}
+		camel := jsonProfile{Case: caseCamel}
+		jsonFields(reflect.ValueOf(MediaItem{}), func(name string, _ reflect.Value) {
+			known[name] = name
+			known[camel.key(name)] = name
+		})
+
+		view.fields = map[string]bool{}
+		for _, name := range strings.Split(v, ",") {
+			field, ok := known[strings.TrimSpace(name)]
+			if !ok {
+				return view, fmt.Errorf("unknown field: %s", name)
+			}
+			view.fields[field] = true
+		}
+	}
+
+	if _, ok := values["embed"]; ok {
+		view.embed = map[string]bool{}
+		for _, name := range strings.Split(values.Get("embed"), ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !mediaRelations[name] {
+				return view, fmt.Errorf("unknown embed: %s", name)
+			}
+			view.embed[name] = true
+		}
+	}
+
+	return view, nil
+}
+
+// presentMedia loads the relations the view embeds and trims the items to
+// its fields.
+func (app *App) presentMedia(items []MediaItem, view mediaView) ([]interface{}, error) {
+	out := make([]interface{}, len(items))
+
+	if view.fields == nil && len(view.embed) == 0 {
+		for i := range items {
+			out[i] = items[i]
+		}
+		return out, nil
+	}
+
+	details, err := app.mediaDetails(items, view.embed)
+	if err != nil {
+		return nil, err
+	}
+	if view.profile != nil && view.embed["extras"] {
+		if err := app.hideExtras(details, view.profile); err != nil {
+			return nil, err
+		}
+	}
+
+	keep := func(name string) bool {
+		if mediaRelations[name] {
+			return view.embed[name]
+		}
+		return view.fields == nil || view.fields[name]
+	}
+	for i := range details {
+		out[i] = project(details[i], keep)
+	}
+
+	return out, nil
+}
+
+// mediaFromURL loads the media item identified by the {id} URL parameter,
+// writing an error response and returning nil if it can't.
+func (app *App) mediaFromURL(w http.ResponseWriter, r *http.Request) *MediaItem {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid media ID", http.StatusBadRequest)
+		return nil
+	}
+
+	// Items a restricted profile can't see don't exist for it
+	visible, err := app.visible(r, id)
+	if err != nil {
+		log.Error("Failed to check media item visibility:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if !visible {
+		http.Error(w, "Media item not found", http.StatusNotFound)
+		return nil
+	}
+
+	var item MediaItem
+	err = app.DB.Get(&item, "SELECT * FROM media WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Media item not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return &item
+}
+
+// mediaDetails loads the embedded related records for items in one query per
+// relation, rather than one per item.
+func (app *App) mediaDetails(items []MediaItem, embed map[string]bool) ([]MediaDetail, error) {
+	details := make([]MediaDetail, len(items))
+	if len(items) == 0 {
+		return details, nil
+	}
+
+	ids := make([]int, len(items))
+	index := make(map[int]*MediaDetail, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+		details[i] = MediaDetail{
+			MediaItem:   item,
+			Aliases:     []MediaAlias{},
+			Extras:      []MediaItem{},
+			Versions:    []MediaFile{},
+			Flags:       []MediaFlag{},
+			People:      []string{},
+			Genres:      []string{},
+			Tags:        []string{},
+			Attributes:  map[string]string{},
+			Attachments: []Attachment{},
+		}
+		index[item.ID] = &details[i]
+	}
+
+	if embed["aliases"] {
+		query, args, err := sqlx.In("SELECT * FROM media_aliases WHERE media_id IN (?) ORDER BY created_at, id", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var aliases []MediaAlias
+		if err := app.DB.Select(&aliases, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, alias := range aliases {
+			d := index[alias.MediaID]
+			d.Aliases = append(d.Aliases, alias)
+		}
+	}
+
+	if embed["extras"] {
+		query, args, err := sqlx.In("SELECT * FROM media WHERE parent_id IN (?) ORDER BY filename, id", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var extras []MediaItem
+		if err := app.DB.Select(&extras, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, extra := range extras {
+			d := index[*extra.ParentID]
+			d.Extras = append(d.Extras, extra)
+		}
+	}
+
+	if embed["versions"] {
+		query, args, err := sqlx.In("SELECT * FROM media_files WHERE media_id IN (?) ORDER BY id", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var versions []MediaFile
+		if err := app.DB.Select(&versions, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			d := index[version.MediaID]
+			d.Versions = append(d.Versions, version)
+		}
+	}
+
+	if embed["flags"] {
+		query, args, err := sqlx.In("SELECT * FROM media_flags WHERE media_id IN (?) ORDER BY created_at, flag", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var flags []MediaFlag
+		if err := app.DB.Select(&flags, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, flag := range flags {
+			d := index[flag.MediaID]
+			d.Flags = append(d.Flags, flag)
+		}
+	}
+
+	if embed["people"] {
+		query, args, err := sqlx.In(
+			"SELECT mp.media_id, p.name FROM media_people mp JOIN people p ON p.id = mp.person_id WHERE mp.media_id IN (?) ORDER BY p.name",
+			ids,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var people []struct {
+			MediaID int    `db:"media_id"`
+			Name    string `db:"name"`
+		}
+		if err := app.DB.Select(&people, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, person := range people {
+			d := index[person.MediaID]
+			d.People = append(d.People, person.Name)
+		}
+	}
+
+	if embed["genres"] {
+		query, args, err := sqlx.In("SELECT media_id, name FROM media_genres WHERE media_id IN (?) ORDER BY name", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var genres []struct {
+			MediaID int    `db:"media_id"`
+			Name    string `db:"name"`
+		}
+		if err := app.DB.Select(&genres, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, genre := range genres {
+			d := index[genre.MediaID]
+			d.Genres = append(d.Genres, genre.Name)
+		}
+	}
+
+	if embed["tags"] {
+		query, args, err := sqlx.In(
+			"SELECT mt.media_id, t.name FROM media_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.media_id IN (?) ORDER BY t.name",
+			ids,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		var tags []struct {
+			MediaID int    `db:"media_id"`
+			Name    string `db:"name"`
+		}
+		if err := app.DB.Select(&tags, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, tag := range tags {
+			d := index[tag.MediaID]
+			d.Tags = append(d.Tags, tag.Name)
+		}
+	}
+
+	if embed["attributes"] {
+		query, args, err := sqlx.In("SELECT media_id, key, value FROM media_attributes WHERE media_id IN (?)", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var attributes []struct {
+			MediaID int    `db:"media_id"`
+			Key     string `db:"key"`
+			Value   string `db:"value"`
+		}
+		if err := app.DB.Select(&attributes, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, attr := range attributes {
+			index[attr.MediaID].Attributes[attr.Key] = attr.Value
+		}
+	}
+
+	if embed["attachments"] {
+		query, args, err := sqlx.In("SELECT * FROM media_attachments WHERE media_id IN (?) ORDER BY id", ids)
+		if err != nil {
+			return nil, err
+		}
+
+		var attachments []Attachment
+		if err := app.DB.Select(&attachments, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, a := range attachments {
+			d := index[a.MediaID]
+			d.Attachments = append(d.Attachments, a)
+		}
+	}
+
+	return details, nil
+}
+
+func (app *App) getMediaItem(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	view, err := parseMediaView(r.URL.Query(), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	view.profile = profileOf(r)
+
+	out, err := app.presentMedia([]MediaItem{*item}, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, out[0])
+}
+
+// updateMediaItem edits the title and description of an item, the
+// free-text fields for what its file doesn't say. Fields left out are kept;
+// an empty string clears one. Unlike automated changes, edits are made to
+// locked items too.
+func (app *App) updateMediaItem(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		Title       *string `json:"title"`
+		Description *string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Title == nil && req.Description == nil {
+		http.Error(w, "title or description is required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Title != nil {
+		item.Title = strings.TrimSpace(*req.Title)
+	}
+	if req.Description != nil {
+		item.Description = strings.TrimSpace(*req.Description)
+	}
+	if _, err := app.DB.Exec("UPDATE media SET title = ?, description = ? WHERE id = ?", item.Title, item.Description, item.ID); err != nil {
+		log.Error("Failed to update media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeBack(item)
+
+	app.writeJSON(w, r, http.StatusOK, item)
+}
+
+func (app *App) lookupMedia(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		IDs       []int    `json:"ids"`
+		Checksums []string `json:"checksums"`
+		Oshashes  []string `json:"oshashes"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	view, err := parseMediaView(r.URL.Query(), true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if n := len(req.IDs) + len(req.Checksums) + len(req.Oshashes); n > maxLookup {
+		http.Error(w, fmt.Sprintf("Too many keys: %d (maximum %d)", n, maxLookup), http.StatusBadRequest)
+		return
+	}
+
+	var items []MediaItem
+	if len(req.IDs) > 0 || len(req.Checksums) > 0 || len(req.Oshashes) > 0 {
+		// sqlx.In rejects empty slices, so pad with values that never match
+		ids, checksums, oshashes := req.IDs, req.Checksums, req.Oshashes
+		if len(ids) == 0 {
+			ids = []int{0}
+		}
+		if len(checksums) == 0 {
+			checksums = []string{""}
+		}
+		if len(oshashes) == 0 {
+			oshashes = []string{""}
+		}
+
+		query, args, err := sqlx.In(
+			`SELECT * FROM media WHERE id IN (?) OR (checksum != '' AND checksum IN (?))
+				OR (oshash != '' AND oshash IN (?)) ORDER BY id`,
+			ids, checksums, oshashes,
+		)
+		if err == nil {
+			err = app.DB.Select(&items, app.DB.Rebind(query), args...)
+		}
+		if err != nil {
+			log.Error("Failed to look up media items:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	out, err := app.presentMedia(items, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Report the keys that didn't match anything so clients can drop them
+	foundIDs := make(map[int]bool, len(items))
+	foundChecksums := make(map[string]bool, len(items))
+	foundOshashes := make(map[string]bool, len(items))
+	for _, item := range items {
+		foundIDs[item.ID] = true
+		foundChecksums[item.Checksum] = true
+		foundOshashes[item.Oshash] = true
+	}
+
+	missingIDs := []int{}
+	for _, id := range req.IDs {
+		if !foundIDs[id] {
+			missingIDs = append(missingIDs, id)
+		}
+	}
+	missingChecksums := []string{}
+	for _, checksum := range req.Checksums {
+		if !foundChecksums[checksum] {
+			missingChecksums = append(missingChecksums, checksum)
+		}
+	}
+	missingOshashes := []string{}
+	for _, oshash := range req.Oshashes {
+		if !foundOshashes[oshash] {
+			missingOshashes = append(missingOshashes, oshash)
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"items": out,
+		"missing": map[string]interface{}{
+			"ids":       missingIDs,
+			"checksums": missingChecksums,
+			"oshashes":  missingOshashes,
+		},
+	})
+}
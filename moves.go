@@ -0,0 +1,611 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Move batch states. A batch is running until all of its moves are done,
+// or one fails and the finished ones are moved back. A batch left running
+// by a crash is interrupted, and can be resumed or rolled back.
+const (
+	moveRunning     = "running"
+	moveCompleted   = "completed"
+	moveRolledBack  = "rolled_back"
+	moveInterrupted = "interrupted"
+)
+
+// Move operation states. A move is journaled as pending, then moved once
+// its file is at the destination, then done once the database agrees.
+// Rolling back marks it reverted.
+const (
+	opPending  = "pending"
+	opMoved    = "moved"
+	opDone     = "done"
+	opReverted = "reverted"
+)
+
+// errMoveNotInterrupted is returned when resuming or rolling back a batch
+// that isn't interrupted.
+var errMoveNotInterrupted = errors.New("move batch is not interrupted")
+
+// moveError is a problem with a move request.
+type moveError string
+
+func (e moveError) Error() string {
+	return string(e)
+}
+
+// MoveBatch is the journal of a set of moves that succeed or fail together.
+type MoveBatch struct {
+	ID         int        `db:"id" json:"id"`
+	Status     string     `db:"status" json:"status"`
+	Error      string     `db:"error" json:"error"`
+	CreatedAt  time.Time  `db:"created_at" json:"created_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+	Ops        []MoveOp   `db:"-" json:"ops,omitempty"`
+}
+
+// MoveOp is the journal entry of moving one item's file.
+type MoveOp struct {
+	ID      int    `db:"id" json:"id"`
+	BatchID int    `db:"batch_id" json:"batch_id"`
+	MediaID int    `db:"media_id" json:"media_id"`
+	Src     string `db:"src" json:"src"`
+	Dst     string `db:"dst" json:"dst"`
+	Status  string `db:"status" json:"status"`
+}
+
+// moveRequest is one item to move and its new absolute path.
+type moveRequest struct {
+	ID   int    `json:"id"`
+	Path string `json:"path"`
+}
+
+// interruptMoves marks the move batches a previous run of the server left
+// running as interrupted, so they can be resumed or rolled back.
+func (app *App) interruptMoves() error {
+	res, err := app.DB.Exec("UPDATE move_batches SET status = ? WHERE status = ?", moveInterrupted, moveRunning)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Warnf("Marked %d unfinished move batch(es) as interrupted", n)
+	}
+	return nil
+}
+
+// planMoves checks a move request and journals it as a new batch. Every
+// item must exist and be unlocked, and every destination must be free.
+func (app *App) planMoves(moves []moveRequest) (*MoveBatch, error) {
+	if len(moves) == 0 {
+		return nil, moveError("moves is required")
+	}
+
+	ops := make([]MoveOp, 0, len(moves))
+	seen := map[string]bool{}
+	for _, m := range moves {
+		if !filepath.IsAbs(m.Path) {
+			return nil, moveError(fmt.Sprintf("Path must be absolute: %s", m.Path))
+		}
+		dst := filepath.Clean(m.Path)
+
+		var item MediaItem
+		err := app.DB.Get(&item, "SELECT * FROM media WHERE id = ?", m.ID)
+		if err == sql.ErrNoRows {
+			return nil, moveError(fmt.Sprintf("Media item %d not found", m.ID))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if item.Locked {
+			return nil, moveError(fmt.Sprintf("Media item %d is locked", m.ID))
+		}
+		if app.immutable(&item) {
+			return nil, moveError(fmt.Sprintf("Media item %d is in an immutable library", m.ID))
+		}
+		if dst == item.Path {
+			continue
+		}
+
+		if seen[dst] {
+			return nil, moveError(fmt.Sprintf("Two items would be moved to %s", dst))
+		}
+		seen[dst] = true
+		if _, err := os.Lstat(dst); err == nil {
+			return nil, moveError(fmt.Sprintf("File already exists: %s", dst))
+		}
+		var taken int
+		if err := app.DB.Get(&taken, "SELECT COUNT(*) FROM media WHERE path = ?", dst); err != nil {
+			return nil, err
+		}
+		if taken > 0 {
+			return nil, moveError(fmt.Sprintf("Path is already in the library: %s", dst))
+		}
+
+		ops = append(ops, MoveOp{MediaID: item.ID, Src: item.Path, Dst: dst, Status: opPending})
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	res, err := tx.Exec("INSERT INTO move_batches (status) VALUES (?)", moveRunning)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for i := range ops {
+		ops[i].BatchID = int(id)
+		res, err := tx.NamedExec(
+			`INSERT INTO move_ops (batch_id, media_id, src, dst, status)
+				VALUES (:batch_id, :media_id, :src, :dst, :status)`,
+			ops[i],
+		)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		opID, _ := res.LastInsertId()
+		ops[i].ID = int(opID)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &MoveBatch{ID: int(id), Status: moveRunning, Ops: ops}, nil
+}
+
+// loadBatch loads a batch and its operations.
+func (app *App) loadBatch(id int) (*MoveBatch, error) {
+	var batch MoveBatch
+	if err := app.DB.Get(&batch, "SELECT * FROM move_batches WHERE id = ?", id); err != nil {
+		return nil, err
+	}
+	batch.Ops = []MoveOp{}
+	if err := app.DB.Select(&batch.Ops, "SELECT * FROM move_ops WHERE batch_id = ? ORDER BY id", id); err != nil {
+		return nil, err
+	}
+	return &batch, nil
+}
+
+// setOpStatus records the progress of an operation.
+func (app *App) setOpStatus(op *MoveOp, status string) error {
+	if _, err := app.DB.Exec("UPDATE move_ops SET status = ? WHERE id = ?", status, op.ID); err != nil {
+		return err
+	}
+	op.Status = status
+	return nil
+}
+
+// movedOnDisk reports whether the file of a pending operation was moved
+// before its journal entry could be updated, i.e. before a crash. A move
+// that linked dst but failed to remove src counts as moved.
+func movedOnDisk(op *MoveOp) bool {
+	_, srcErr := os.Lstat(op.Src)
+	_, dstErr := os.Lstat(op.Dst)
+	return (os.IsNotExist(srcErr) && dstErr == nil) || linkedFiles(op.Src, op.Dst)
+}
+
+// runBatch performs the operations of a batch that aren't done yet. If one
+// fails, the batch is rolled back. It returns the finished batch; the
+// error is only for failures to update the journal itself.
+func (app *App) runBatch(batch *MoveBatch) (*MoveBatch, error) {
+	var failure error
+	for i := range batch.Ops {
+		if failure = app.runOp(&batch.Ops[i]); failure != nil {
+			log.Warnf("Move batch %d: moving %s failed: %v", batch.ID, batch.Ops[i].Src, failure)
+			break
+		}
+	}
+
+	if failure != nil {
+		if err := app.rollbackBatch(batch, failure.Error()); err != nil {
+			return nil, err
+		}
+		return app.loadBatch(batch.ID)
+	}
+
+	// The old paths are remembered only once the whole batch has stuck
+	for _, op := range batch.Ops {
+		if err := app.addAlias(op.MediaID, filepath.Base(op.Src), op.Src); err != nil {
+			log.Warnf("Failed to record alias %s: %v", op.Src, err)
+		}
+	}
+
+	_, err := app.DB.Exec(
+		"UPDATE move_batches SET status = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?",
+		moveCompleted, batch.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Move batch %d: moved %d files", batch.ID, len(batch.Ops))
+	return app.loadBatch(batch.ID)
+}
+
+// runOp moves one file and updates its item, journaling each step so an
+// interrupted batch can tell how far it got.
+func (app *App) runOp(op *MoveOp) error {
+	if op.Status == opPending {
+		moved := movedOnDisk(op)
+		if !moved {
+			if err := os.MkdirAll(filepath.Dir(op.Dst), 0755); err != nil {
+				return err
+			}
+		}
+		// moveFile finishes a move that left src linked to dst
+		if _, err := os.Lstat(op.Src); !moved || err == nil {
+			if err := moveFile(op.Src, op.Dst); err != nil {
+				return err
+			}
+		}
+		if err := app.setOpStatus(op, opMoved); err != nil {
+			return err
+		}
+	}
+
+	if op.Status == opMoved {
+		// The item and the journal change together, so the journal says
+		// done exactly when the database has the new path
+		tx, err := app.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE media SET path = ?, filename = ? WHERE id = ?", op.Dst, filepath.Base(op.Dst), op.MediaID)
+		if err == nil {
+			_, err = tx.Exec("UPDATE move_ops SET status = ? WHERE id = ?", opDone, op.ID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		op.Status = opDone
+	}
+
+	return nil
+}
+
+// rollbackBatch moves the files of a batch back, newest first, and restores
+// their items' paths. Operations that can't be reverted are logged and
+// leave the batch interrupted, so rolling back can be retried.
+func (app *App) rollbackBatch(batch *MoveBatch, reason string) error {
+	status := moveRolledBack
+	for i := len(batch.Ops) - 1; i >= 0; i-- {
+		op := &batch.Ops[i]
+		if err := app.revertOp(op); err != nil {
+			log.Warnf("Move batch %d: failed to move %s back: %v", batch.ID, op.Dst, err)
+			status = moveInterrupted
+			reason = fmt.Sprintf("%s; rollback failed: %v", reason, err)
+			break
+		}
+	}
+
+	_, err := app.DB.Exec(
+		"UPDATE move_batches SET status = ?, error = ?, finished_at = CURRENT_TIMESTAMP WHERE id = ?",
+		status, reason, batch.ID,
+	)
+	return err
+}
+
+func (app *App) revertOp(op *MoveOp) error {
+	if op.Status == opDone {
+		tx, err := app.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("UPDATE media SET path = ?, filename = ? WHERE id = ?", op.Src, filepath.Base(op.Src), op.MediaID)
+		if err == nil {
+			_, err = tx.Exec("UPDATE move_ops SET status = ? WHERE id = ?", opMoved, op.ID)
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		op.Status = opMoved
+	}
+
+	switch {
+	case op.Status == opMoved || (op.Status == opPending && movedOnDisk(op)):
+		if err := moveFile(op.Dst, op.Src); err != nil {
+			return err
+		}
+	case op.Status == opPending && copiedOnDisk(op.Dst):
+		// The source is intact; only the copy has to go
+		if err := os.Remove(op.Dst); err != nil {
+			return err
+		}
+		if err := os.Remove(op.Dst + ".partial"); err != nil {
+			return err
+		}
+	}
+	if op.Status != opReverted {
+		return app.setOpStatus(op, opReverted)
+	}
+	return nil
+}
+
+// batchFromURL loads the batch identified by the {id} URL parameter,
+// writing an error response and returning nil if it can't.
+func (app *App) batchFromURL(w http.ResponseWriter, r *http.Request) *MoveBatch {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid batch ID", http.StatusBadRequest)
+		return nil
+	}
+
+	batch, err := app.loadBatch(id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Move batch not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return batch
+}
+
+// claimBatch marks an interrupted batch as running again, so two requests
+// can't work on it at once.
+func (app *App) claimBatch(batch *MoveBatch) error {
+	res, err := app.DB.Exec(
+		"UPDATE move_batches SET status = ?, error = '', finished_at = NULL WHERE id = ? AND status = ?",
+		moveRunning, batch.ID, moveInterrupted,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errMoveNotInterrupted
+	}
+	batch.Status = moveRunning
+	return nil
+}
+
+// writeBatchResult writes the response to a finished batch.
+func (app *App) writeBatchResult(w http.ResponseWriter, r *http.Request, batch *MoveBatch) {
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": batch.Status == moveCompleted,
+		"batch":   batch,
+	})
+}
+
+// moveMedia moves the files of several items at once. Either all of them
+// end up at their new paths or, if one fails, none of them do.
+func (app *App) moveMedia(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Moves []moveRequest `json:"moves"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	batch, err := app.planMoves(req.Moves)
+	var moveErr moveError
+	if errors.As(err, &moveErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to plan moves:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	batch, err = app.runBatch(batch)
+	if err != nil {
+		log.Error("Failed to record move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeBatchResult(w, r, batch)
+}
+
+// moveMediaItem renames or relocates the file of one item, as a batch of
+// one move. The new location is either a path or, to rename the file in
+// its directory, a name. The destination directory must exist unless
+// create_dirs is set. A locked item, one in an immutable library and a
+// file or item already at the destination are conflicts.
+func (app *App) moveMediaItem(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+	if item.Locked {
+		http.Error(w, "Media item is locked", http.StatusConflict)
+		return
+	}
+	if app.immutable(item) {
+		http.Error(w, "Media item is in an immutable library", http.StatusConflict)
+		return
+	}
+
+	var req struct {
+		Path       string `json:"path"`
+		Name       string `json:"name"`
+		CreateDirs bool   `json:"create_dirs"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var dst string
+	switch {
+	case req.Path != "" && req.Name != "":
+		http.Error(w, "Give either path or name, not both", http.StatusBadRequest)
+		return
+	case req.Name != "":
+		if req.Name != filepath.Base(req.Name) || req.Name == "." || req.Name == ".." {
+			http.Error(w, "Name must be a filename without directories", http.StatusBadRequest)
+			return
+		}
+		dst = filepath.Join(filepath.Dir(item.Path), req.Name)
+	case req.Path != "":
+		if !filepath.IsAbs(req.Path) {
+			http.Error(w, "Path must be absolute", http.StatusBadRequest)
+			return
+		}
+		dst = filepath.Clean(req.Path)
+	default:
+		http.Error(w, "path or name is required", http.StatusBadRequest)
+		return
+	}
+
+	if dst != item.Path {
+		if _, err := os.Lstat(dst); err == nil {
+			http.Error(w, "File already exists: "+dst, http.StatusConflict)
+			return
+		}
+		var taken int
+		if err := app.DB.Get(&taken, "SELECT COUNT(*) FROM media WHERE path = ?", dst); err != nil {
+			log.Error("Failed to check destination:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if taken > 0 {
+			http.Error(w, "Path is already in the library: "+dst, http.StatusConflict)
+			return
+		}
+		if info, err := os.Stat(filepath.Dir(dst)); err == nil && !info.IsDir() {
+			http.Error(w, "Not a directory: "+filepath.Dir(dst), http.StatusBadRequest)
+			return
+		} else if os.IsNotExist(err) && !req.CreateDirs {
+			http.Error(w, "Directory does not exist: "+filepath.Dir(dst), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The request itself was checked above, so what planning rejects now
+	// changed since, like the item being locked
+	batch, err := app.planMoves([]moveRequest{{ID: item.ID, Path: dst}})
+	var moveErr moveError
+	if errors.As(err, &moveErr) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to plan move:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	batch, err = app.runBatch(batch)
+	if err == nil {
+		err = app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID)
+	}
+	if err != nil {
+		log.Error("Failed to record move:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": batch.Status == moveCompleted,
+		"item":    item,
+		"batch":   batch,
+	})
+}
+
+func (app *App) getMoveBatches(w http.ResponseWriter, r *http.Request) {
+	batches := []MoveBatch{}
+	if err := app.DB.Select(&batches, "SELECT * FROM move_batches ORDER BY id DESC"); err != nil {
+		log.Error("Failed to fetch move batches:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, batches)
+}
+
+func (app *App) getMoveBatch(w http.ResponseWriter, r *http.Request) {
+	if batch := app.batchFromURL(w, r); batch != nil {
+		app.writeJSON(w, r, http.StatusOK, batch)
+	}
+}
+
+// resumeMoves finishes an interrupted batch.
+func (app *App) resumeMoves(w http.ResponseWriter, r *http.Request) {
+	batch := app.batchFromURL(w, r)
+	if batch == nil {
+		return
+	}
+
+	if err := app.claimBatch(batch); err == errMoveNotInterrupted {
+		http.Error(w, "Only interrupted move batches can be resumed", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Error("Failed to resume move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Resuming move batch %d", batch.ID)
+	batch, err := app.runBatch(batch)
+	if err != nil {
+		log.Error("Failed to record move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeBatchResult(w, r, batch)
+}
+
+// rollbackMoves undoes an interrupted batch.
+func (app *App) rollbackMoves(w http.ResponseWriter, r *http.Request) {
+	batch := app.batchFromURL(w, r)
+	if batch == nil {
+		return
+	}
+
+	if err := app.claimBatch(batch); err == errMoveNotInterrupted {
+		http.Error(w, "Only interrupted move batches can be rolled back", http.StatusConflict)
+		return
+	} else if err != nil {
+		log.Error("Failed to roll back move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Rolling back move batch %d", batch.ID)
+	err := app.rollbackBatch(batch, "rolled back on request")
+	if err == nil {
+		batch, err = app.loadBatch(batch.ID)
+	}
+	if err != nil {
+		log.Error("Failed to record move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeBatchResult(w, r, batch)
+}
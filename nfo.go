@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// nfoRoots are the root elements of the NFO files Kodi and Jellyfin write
+// for videos.
+var nfoRoots = map[string]bool{
+	"movie":          true,
+	"episodedetails": true,
+	"musicvideo":     true,
+}
+
+// nfoFile is the part of a Kodi/Jellyfin NFO file that is imported.
+type nfoFile struct {
+	XMLName   xml.Name
+	Title     string   `xml:"title"`
+	Year      string   `xml:"year"`
+	Premiered string   `xml:"premiered"`
+	Aired     string   `xml:"aired"`
+	Plot      string   `xml:"plot"`
+	Outline   string   `xml:"outline"`
+	MPAA      string   `xml:"mpaa"`
+	Genres    []string `xml:"genre"`
+	Tags      []string `xml:"tag"`
+}
+
+// findNFO returns the path of the NFO file of a video, or an empty string
+// if it has none. Besides "Movie.nfo" next to "Movie.mkv", Kodi reads
+// "movie.nfo" in a folder holding a single movie.
+func findNFO(path string) string {
+	dir := filepath.Dir(path)
+	stem := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	for _, name := range []string{stem + ".nfo", "movie.nfo"} {
+		candidate := filepath.Join(dir, name)
+		if info, err := os.Stat(candidate); err == nil && info.Mode().IsRegular() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// readNFO parses an NFO file. It returns nil if the file holds no video
+// metadata, e.g. because it only has the URL of a scraper's page.
+func readNFO(path string) (*nfoFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Kodi allows a URL after the XML, which the decoder never reaches
+	var nfo nfoFile
+	if err := xml.NewDecoder(f).Decode(&nfo); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !nfoRoots[nfo.XMLName.Local] {
+		return nil, nil
+	}
+	return &nfo, nil
+}
+
+// nfoYear returns the release year of an NFO file, from its year or else
+// the date it premiered or aired, or 0 if it has none.
+func nfoYear(nfo *nfoFile) int {
+	for _, v := range []string{nfo.Year, nfo.Premiered, nfo.Aired} {
+		v = strings.TrimSpace(v)
+		if len(v) < 4 {
+			continue
+		}
+		if year, err := strconv.Atoi(v[:4]); err == nil && year > 0 {
+			return year
+		}
+	}
+	return 0
+}
+
+// applyNFO merges the NFO file of a video, if it has one: its title, year,
+// plot, content rating and genres. Fields the file leaves empty keep their
+// values, and locked items are left alone. Samples and trailers don't get
+// the metadata of the movie.nfo next to them.
+func (app *App) applyNFO(item *MediaItem) error {
+	if item.Type != "video" || item.Locked || extraKind(item.Path) != "" {
+		return nil
+	}
+	path := findNFO(item.Path)
+	if path == "" {
+		return nil
+	}
+
+	nfo, err := readNFO(path)
+	if err != nil || nfo == nil {
+		return err
+	}
+
+	if title := strings.TrimSpace(nfo.Title); title != "" {
+		item.Title = title
+	}
+	if year := nfoYear(nfo); year > 0 {
+		item.Year = year
+	}
+	// The outline is a one-line summary, for when there is no plot
+	for _, plot := range []string{nfo.Plot, nfo.Outline} {
+		if plot = strings.TrimSpace(plot); plot != "" {
+			item.Description = plot
+			break
+		}
+	}
+	if rating := strings.TrimSpace(nfo.MPAA); rating != "" {
+		item.ContentRating = rating
+		item.RatingAge = nil
+		if age, ok := ratingAge(rating); ok {
+			item.RatingAge = &age
+		}
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE media SET title = ?, year = ?, description = ?, content_rating = ?, rating_age = ? WHERE id = ?",
+		item.Title, item.Year, item.Description, item.ContentRating, item.RatingAge, item.ID,
+	)
+	for _, genre := range nfo.Genres {
+		// Older scrapers put every genre in one element: "Action / Comedy"
+		for _, name := range strings.Split(genre, "/") {
+			if err != nil {
+				break
+			}
+			if name = strings.TrimSpace(name); name != "" {
+				_, err = tx.Exec("INSERT OR IGNORE INTO media_genres (media_id, name) VALUES (?, ?)", item.ID, name)
+			}
+		}
+	}
+	// Tags go through their aliases, like tags added by users
+	for _, tag := range nfo.Tags {
+		if err != nil {
+			break
+		}
+		if name, nameErr := tagName(tag); nameErr == nil {
+			err = tagMedia(tx, item.ID, name)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
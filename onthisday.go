@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eventOnThisDay is published once a day when there are memories to show.
+const eventOnThisDay = "on_this_day"
+
+// OnThisDayYear holds the memories from one year.
+type OnThisDayYear struct {
+	Year     int           `json:"year"`
+	YearsAgo int           `json:"years_ago"`
+	Count    int           `json:"count"`
+	Items    []interface{} `json:"items,omitempty"`
+}
+
+// onThisDay returns the photos and videos captured on the month and day of
+// date in earlier years, newest first. Samples and trailers aren't
+// memories and are left out, as are items a restricted profile res, if not
+// nil, can't see.
+func (app *App) onThisDay(date time.Time, res *restriction) ([]MediaItem, error) {
+	days := []interface{}{date.Format("01-02")}
+	// Leap days are remembered on the 28th in other years
+	if date.Month() == time.February && date.Day() == 28 &&
+		time.Date(date.Year(), time.February, 29, 0, 0, 0, 0, time.UTC).Month() != time.February {
+		days = append(days, "02-29")
+	}
+
+	profileWhere, profileArgs := "1", []interface{}(nil)
+	if res != nil {
+		profileWhere, profileArgs = res.where()
+	}
+
+	query := fmt.Sprintf(
+		`SELECT * FROM media WHERE type IN ('image', 'video') AND extra = ''
+			AND strftime('%%m-%%d', %[1]s, 'localtime') IN (?%[2]s)
+			AND strftime('%%Y', %[1]s, 'localtime') < ?
+			AND %[3]s
+			ORDER BY %[1]s DESC, id DESC`,
+		captureDate, strings.Repeat(", ?", len(days)-1), profileWhere,
+	)
+
+	var items []MediaItem
+	args := append(days, fmt.Sprintf("%04d", date.Year()))
+	err := app.DB.Select(&items, query, append(args, profileArgs...)...)
+	return items, err
+}
+
+// groupByYear splits items, as returned by onThisDay, into years.
+func groupByYear(items []MediaItem, date time.Time) []OnThisDayYear {
+	years := []OnThisDayYear{}
+	for _, item := range items {
+		t := item.CreatedAt
+		if item.TakenAt != nil {
+			t = *item.TakenAt
+		} else if item.FileModTime != nil {
+			t = *item.FileModTime
+		}
+		year := t.Local().Year()
+
+		if len(years) == 0 || years[len(years)-1].Year != year {
+			years = append(years, OnThisDayYear{Year: year, YearsAgo: date.Year() - year})
+		}
+		years[len(years)-1].Count++
+	}
+	return years
+}
+
+// getOnThisDay returns the photos and videos captured on today's date, or
+// the date given as ?date=YYYY-MM-DD, in previous years.
+func (app *App) getOnThisDay(w http.ResponseWriter, r *http.Request) {
+	date := time.Now()
+	if v := r.URL.Query().Get("date"); v != "" {
+		var err error
+		if date, err = time.ParseInLocation("2006-01-02", v, time.Local); err != nil {
+			http.Error(w, fmt.Sprintf("invalid date: %s", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	view, err := parseMediaView(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	view.profile = profileOf(r)
+	items, err := app.onThisDay(date, view.profile)
+	if err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := app.presentMedia(items, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	years := groupByYear(items, date)
+	i := 0
+	for y := range years {
+		years[y].Items = out[i : i+years[y].Count]
+		i += years[y].Count
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"date":  date.Format("2006-01-02"),
+		"years": years,
+	})
+}
+
+// scheduleOnThisDay starts publishing the daily digest at the configured
+// local time, given as "HH:MM". An empty time disables it.
+func (app *App) scheduleOnThisDay(at string) error {
+	if at == "" {
+		return nil
+	}
+
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		return fmt.Errorf("invalid digest time %q, expected HH:MM", at)
+	}
+
+	go func() {
+		for {
+			now := time.Now()
+			next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+			if !next.After(now) {
+				next = time.Date(now.Year(), now.Month(), now.Day()+1, t.Hour(), t.Minute(), 0, 0, time.Local)
+			}
+			time.Sleep(time.Until(next))
+
+			if err := app.publishOnThisDay(next); err != nil {
+				log.Warn("Failed to compute the On This Day digest:", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// publishOnThisDay sends the number of memories per year for date to
+// /api/events subscribers, if there are any. Clients fetch the items
+// themselves.
+func (app *App) publishOnThisDay(date time.Time) error {
+	items, err := app.onThisDay(date, nil)
+	if err != nil || len(items) == 0 {
+		return err
+	}
+
+	app.Events.publish(eventOnThisDay, map[string]interface{}{
+		"date":  date.Format("2006-01-02"),
+		"count": len(items),
+		"years": groupByYear(items, date),
+	})
+	log.Infof("On This Day: %d memories", len(items))
+	return nil
+}
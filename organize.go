@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// organizeSampleSize is the number of moves listed in an organize preview.
+const organizeSampleSize = 50
+
+const actionOrganize = "organize"
+
+// organizePlaceholder matches the placeholders of an organize template.
+var organizePlaceholder = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// organizeFields are the placeholders of organize templates and the values
+// they stand for. {library} is the library volume the file is on: files
+// are organized within their volume, not placed anew by the library's
+// placement policy. The others are single path elements. Dates are
+// capture dates, the same ones items are sorted by.
+var organizeFields = map[string]func(item *MediaItem, tags []string) string{
+	"type":     func(item *MediaItem, _ []string) string { return item.Type },
+	"year":     func(item *MediaItem, _ []string) string { return captureTime(item).Local().Format("2006") },
+	"month":    func(item *MediaItem, _ []string) string { return captureTime(item).Local().Format("01") },
+	"day":      func(item *MediaItem, _ []string) string { return captureTime(item).Local().Format("02") },
+	"date":     func(item *MediaItem, _ []string) string { return captureTime(item).Local().Format("2006-01-02") },
+	"filename": func(item *MediaItem, _ []string) string { return filepath.Base(item.Path) },
+	"name": func(item *MediaItem, _ []string) string {
+		name := filepath.Base(item.Path)
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	},
+	"ext":      func(item *MediaItem, _ []string) string { return strings.TrimPrefix(filepath.Ext(item.Path), ".") },
+	"id":       func(item *MediaItem, _ []string) string { return strconv.Itoa(item.ID) },
+	"checksum": func(item *MediaItem, _ []string) string { return item.Checksum },
+	"title":    func(item *MediaItem, _ []string) string { return item.Title },
+	"artist":   func(item *MediaItem, _ []string) string { return item.Artist },
+	"album":    func(item *MediaItem, _ []string) string { return item.Album },
+	// The first tag by name, so items with several land in one place
+	"tag": func(_ *MediaItem, tags []string) string {
+		if len(tags) == 0 {
+			return ""
+		}
+		return tags[0]
+	},
+}
+
+// OrganizeMove is a file an organize would move, or why it can't.
+type OrganizeMove struct {
+	MediaID int    `json:"media_id"`
+	Src     string `json:"src"`
+	Dst     string `json:"dst,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// checkOrganizeTemplate validates a template: its placeholders must be
+// known, {library} can only start it, and the filename must keep the
+// file's extension through {filename} or {ext}.
+func checkOrganizeTemplate(template string) error {
+	if strings.TrimSpace(template) == "" {
+		return fmt.Errorf("template is required")
+	}
+	for _, m := range organizePlaceholder.FindAllStringSubmatch(template, -1) {
+		if _, ok := organizeFields[m[1]]; !ok && m[1] != "library" {
+			return fmt.Errorf("unknown placeholder {%s}", m[1])
+		}
+	}
+	if strings.Contains(strings.TrimPrefix(template, "{library}"), "{library}") {
+		return fmt.Errorf("{library} can only start the template")
+	}
+	if !strings.HasPrefix(template, "{library}") && !filepath.IsAbs(template) {
+		return fmt.Errorf("template must start with {library} or be an absolute path")
+	}
+	last := template[strings.LastIndex(template, "/")+1:]
+	if !strings.Contains(last, "{filename}") && !strings.Contains(last, "{ext}") {
+		return fmt.Errorf("the last element of the template must contain {filename} or {ext}")
+	}
+	return nil
+}
+
+// organizeElement makes a value safe as (part of) a path element.
+func organizeElement(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(v))
+	if v == "" || v == "." || v == ".." {
+		return "unknown"
+	}
+	return v
+}
+
+// organizePath expands a template for an item.
+func (app *App) organizePath(template string, item *MediaItem, tags []string) (string, error) {
+	var root string
+	if strings.HasPrefix(template, "{library}") {
+		lib, volume := app.Config.volumeOf(item.Path)
+		if lib == nil {
+			return "", fmt.Errorf("not in a library")
+		}
+		root, template = volume, strings.TrimPrefix(template, "{library}")
+	}
+
+	path := organizePlaceholder.ReplaceAllStringFunc(template, func(m string) string {
+		return organizeElement(organizeFields[m[1:len(m)-1]](item, tags))
+	})
+	return filepath.Clean(root + string(filepath.Separator) + path), nil
+}
+
+// itemTagNames returns the names of the items' tags, by item, in order.
+func (app *App) itemTagNames(items []MediaItem) (map[int][]string, error) {
+	tags := map[int][]string{}
+	if len(items) == 0 {
+		return tags, nil
+	}
+	ids := make([]int, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
+	}
+	query, args, err := sqlx.In(
+		"SELECT mt.media_id, t.name FROM media_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.media_id IN (?) ORDER BY t.name",
+		ids,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		MediaID int    `db:"media_id"`
+		Name    string `db:"name"`
+	}
+	if err := app.DB.Select(&rows, app.DB.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		tags[row.MediaID] = append(tags[row.MediaID], row.Name)
+	}
+	return tags, nil
+}
+
+// planOrganize works out where a template puts each of the items.
+func (app *App) planOrganize(template string, items []MediaItem) ([]OrganizeMove, error) {
+	tags := map[int][]string{}
+	if strings.Contains(template, "{tag}") {
+		var err error
+		if tags, err = app.itemTagNames(items); err != nil {
+			return nil, err
+		}
+	}
+	return app.planDestinations(items, func(item *MediaItem) (string, error) {
+		return app.organizePath(template, item, tags[item.ID])
+	})
+}
+
+// planDestinations works out the moves of the items to the paths dst gives
+// them. Items already in place are left out; those that can't be moved,
+// or would collide with another file, come with an error.
+func (app *App) planDestinations(items []MediaItem, dst func(item *MediaItem) (string, error)) ([]OrganizeMove, error) {
+	moves := []OrganizeMove{}
+	claimed := map[string][]int{}
+	for i := range items {
+		item := &items[i]
+		move := OrganizeMove{MediaID: item.ID, Src: item.Path}
+		path, err := dst(item)
+		switch {
+		case err != nil:
+			move.Error = err.Error()
+		case path == item.Path:
+			continue
+		case item.Locked:
+			move.Dst, move.Error = path, "locked"
+		case app.immutable(item):
+			move.Dst, move.Error = path, "in an immutable library"
+		default:
+			move.Dst = path
+			claimed[path] = append(claimed[path], len(moves))
+		}
+		moves = append(moves, move)
+	}
+
+	// Destinations are checked once all are known, since a file can move
+	// to where another is moving away from
+	leaving := map[string]bool{}
+	for _, move := range moves {
+		if move.Error == "" {
+			leaving[move.Src] = true
+		}
+	}
+	for dst, indexes := range claimed {
+		if len(indexes) > 1 {
+			for _, i := range indexes {
+				moves[i].Error = fmt.Sprintf("%d items would be moved here", len(indexes))
+			}
+			continue
+		}
+		move := &moves[indexes[0]]
+		if leaving[dst] {
+			move.Error = "another item is moving away from here; try again once it has"
+			continue
+		}
+		if _, err := os.Lstat(dst); err == nil {
+			move.Error = "file already exists"
+			continue
+		}
+		var taken int
+		if err := app.DB.Get(&taken, "SELECT COUNT(*) FROM media WHERE path = ?", dst); err != nil {
+			return nil, err
+		}
+		if taken > 0 {
+			move.Error = "path is already in the library"
+		}
+	}
+	return moves, nil
+}
+
+// previewOrganize works out where a template would move the selected
+// items' files and returns the planned moves with the token needed to make
+// them. Nothing is moved by this request.
+func (app *App) previewOrganize(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Template string       `json:"template"`
+		IDs      []int        `json:"ids"`
+		Filter   *MediaFilter `json:"filter"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// An empty filter matches everything, so it has to be given explicitly
+	if len(req.IDs) == 0 && req.Filter == nil {
+		http.Error(w, "ids or filter is required", http.StatusBadRequest)
+		return
+	}
+	if err := checkOrganizeTemplate(req.Template); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := app.selectMedia(req.IDs, req.Filter)
+	if err != nil {
+		log.Error("Failed to select media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	moves, err := app.planOrganize(req.Template, items)
+	if err != nil {
+		log.Error("Failed to plan organize:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeMovePreview(w, r, actionOrganize, len(items), moves)
+}
+
+// writeMovePreview writes the preview of planned moves: how many files
+// would move and how many are already in place, a sample of the moves,
+// those that can't be made, and the token of the action needed to make
+// them.
+func (app *App) writeMovePreview(w http.ResponseWriter, r *http.Request, action string, selected int, moves []OrganizeMove) {
+	var planned []moveRequest
+	skipped := []OrganizeMove{}
+	for _, move := range moves {
+		if move.Error != "" {
+			skipped = append(skipped, move)
+			continue
+		}
+		planned = append(planned, moveRequest{ID: move.MediaID, Path: move.Dst})
+	}
+	sample := []OrganizeMove{}
+	for _, move := range moves {
+		if move.Error == "" && len(sample) < organizeSampleSize {
+			sample = append(sample, move)
+		}
+	}
+	sort.Slice(sample, func(i, j int) bool { return sample[i].Dst < sample[j].Dst })
+
+	preview := map[string]interface{}{
+		"count":     len(planned),
+		"unchanged": selected - len(moves),
+		"sample":    sample,
+		"skipped":   skipped,
+	}
+
+	// The token is bound to the previewed moves, so nothing is moved
+	// anywhere that wasn't shown
+	if len(planned) > 0 {
+		token, expires, err := app.issueConfirmation(action, planned)
+		if err != nil {
+			log.Error("Failed to issue confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		preview["token"] = token
+		preview["expires_at"] = expires
+	}
+
+	app.writeJSON(w, r, http.StatusOK, preview)
+}
+
+// organizeMedia makes the moves of a previewed organize, as one move batch:
+// either every file ends up where the preview said or none are moved.
+func (app *App) organizeMedia(w http.ResponseWriter, r *http.Request) {
+	app.confirmMoves(w, r, actionOrganize)
+}
+
+// confirmMoves makes the moves previewed with the token of the request, as
+// one move batch.
+func (app *App) confirmMoves(w http.ResponseWriter, r *http.Request, action string) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "token is required; request a preview first", http.StatusBadRequest)
+		return
+	}
+
+	var planned []moveRequest
+	err := app.redeemConfirmation(req.Token, action, &planned)
+	if err == errInvalidConfirmation {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to redeem confirmation token:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Destinations taken or items locked since the preview fail the
+	// whole batch
+	batch, err := app.planMoves(planned)
+	var moveErr moveError
+	if errors.As(err, &moveErr) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to plan moves:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	batch, err = app.runBatch(batch)
+	if err != nil {
+		log.Error("Failed to record move batch:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeBatchResult(w, r, batch)
+}
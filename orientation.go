@@ -0,0 +1,148 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// thumbnailQuality is the JPEG quality of image thumbnails.
+const thumbnailQuality = 85
+
+// sideways reports whether an EXIF orientation stores the image rotated by
+// 90 degrees, so its width and height are swapped when viewed.
+func sideways(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orientImage turns an image stored with an EXIF orientation upright:
+//
+//	1: as stored          5: mirrored along the top-left diagonal
+//	2: mirrored           6: rotated 90 degrees clockwise
+//	3: rotated 180        7: mirrored along the top-right diagonal
+//	4: flipped            8: rotated 90 degrees counterclockwise
+//
+// Any other value leaves the image as stored.
+func orientImage(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if sideways(orientation) {
+		w, h = h, w
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			// The stored pixel shown at x, y
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, w-1-x
+			case 7:
+				sx, sy = h-1-y, w-1-x
+			case 8:
+				sx, sy = h-1-y, x
+			}
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return out
+}
+
+// scaleImage shrinks an image so its longest side is at most size pixels,
+// averaging the pixels each one covers. Smaller images are left as they
+// are.
+func scaleImage(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	dw, dh := size, h*size/w
+	if h > w {
+		dw, dh = w*size/h, size
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, (x+1)*w/dw
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			out.Set(x, y, color.RGBA64{
+				R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n),
+			})
+		}
+	}
+	return out
+}
+
+// decodeImage decodes an image file. Only the first frame of animated
+// images is used.
+func decodeImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err == image.ErrFormat {
+		return nil, errUnknownImageFormat
+	}
+	return img, err
+}
+
+// writeThumbnail writes an image of an item, scaled down and turned
+// upright, to the thumbnail directory as JPEG and returns its name.
+func writeThumbnail(item *MediaItem, img image.Image) (string, error) {
+	data, err := encodeThumbnail(item, img)
+	if err != nil {
+		return "", err
+	}
+	return saveThumbnail(item, data)
+}
+
+// saveThumbnail writes the JPEG thumbnail of an item to the thumbnail
+// directory and returns its name.
+func saveThumbnail(item *MediaItem, data []byte) (string, error) {
+	if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
+		return "", err
+	}
+	name := strconv.Itoa(item.ID) + ".jpg"
+	dst := filepath.Join(thumbnailDir, name)
+	if err := os.WriteFile(dst, data, 0644); err != nil {
+		os.Remove(dst)
+		return "", err
+	}
+	return name, nil
+}
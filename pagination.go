@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// maxPageLimit is the largest page of items a listing returns.
+const maxPageLimit = 1000
+
+// mediaPage is the part of a listing a client asked for with the limit and
+// offset or cursor query parameters. Listings without either return every
+// item.
+type mediaPage struct {
+	limit  int
+	offset int
+	// keyset pages are found by a cursor rather than an offset; after is
+	// the cursor, nil for the first page.
+	keyset bool
+	after  *mediaCursor
+}
+
+// mediaCursor is where a keyset page of the created_at listing starts: after
+// the item with ID, added at CreatedAt. The time is kept as SQLite stores
+// it, so it compares the way the listing is ordered.
+type mediaCursor struct {
+	CreatedAt string `json:"c"`
+	ID        int    `json:"i"`
+}
+
+// encode returns the cursor as the opaque string clients pass back.
+func (c mediaCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeMediaCursor(s string) (*mediaCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	var c mediaCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	if c.CreatedAt == "" || c.ID < 1 {
+		return nil, fmt.Errorf("incomplete cursor")
+	}
+	return &c, nil
+}
+
+// parseMediaPage reads the limit, offset and cursor query parameters.
+// Limits above maxPageLimit are lowered to it. A cursor parameter, empty for
+// the first page, asks for keyset pages, which default to the largest
+// limit.
+func parseMediaPage(values url.Values) (*mediaPage, error) {
+	page := &mediaPage{limit: maxPageLimit}
+	if values.Has("cursor") {
+		if values.Get("offset") != "" {
+			return nil, fmt.Errorf("offset can't be combined with a cursor")
+		}
+		page.keyset = true
+		if v := values.Get("cursor"); v != "" {
+			var err error
+			if page.after, err = decodeMediaCursor(v); err != nil {
+				return nil, fmt.Errorf("invalid cursor")
+			}
+		}
+	}
+
+	v := values.Get("limit")
+	if v == "" {
+		if values.Get("offset") != "" {
+			return nil, fmt.Errorf("offset needs a limit")
+		}
+		if page.keyset {
+			return page, nil
+		}
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid limit: %s", v)
+	}
+	if n < maxPageLimit {
+		page.limit = n
+	}
+	if v := values.Get("offset"); v != "" {
+		if page.offset, err = strconv.Atoi(v); err != nil || page.offset < 0 {
+			return nil, fmt.Errorf("invalid offset: %s", v)
+		}
+	}
+	return page, nil
+}
+
+// sql returns the LIMIT clause of the page. Keyset pages fetch one more
+// item than they return, to tell whether another page follows.
+func (p *mediaPage) sql() string {
+	if p.keyset {
+		return fmt.Sprintf(" LIMIT %d", p.limit+1)
+	}
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", p.limit, p.offset)
+}
+
+// keysetWhere adds the condition of a keyset page to a WHERE clause of the
+// created_at listing, which is ordered newest first.
+func (p *mediaPage) keysetWhere(where string, args []interface{}) (string, []interface{}) {
+	if p.after == nil {
+		return where, args
+	}
+	cond := "(created_at < ? OR (created_at = ? AND id < ?))"
+	if where == "" {
+		where = " WHERE " + cond
+	} else {
+		where += " AND " + cond
+	}
+	return where, append(args, p.after.CreatedAt, p.after.CreatedAt, p.after.ID)
+}
+
+// slice returns the page of items sorted in Go, which can't be paged in SQL.
+func (p *mediaPage) slice(items []MediaItem) []MediaItem {
+	if p.offset >= len(items) {
+		return items[:0]
+	}
+	end := p.offset + p.limit
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[p.offset:end]
+}
+
+// result wraps a page of a listing with where it is: the number of items
+// in the whole listing, the page's limit and offset, and whether more
+// follow it.
+func (p *mediaPage) result(items interface{}, count, total int) map[string]interface{} {
+	return map[string]interface{}{
+		"items":    items,
+		"total":    total,
+		"limit":    p.limit,
+		"offset":   p.offset,
+		"has_more": p.offset+count < total,
+	}
+}
+
+// keysetResult wraps a keyset page with the cursor of the next one, which
+// is empty after the last page.
+func (p *mediaPage) keysetResult(items interface{}, next string) map[string]interface{} {
+	return map[string]interface{}{
+		"items":       items,
+		"limit":       p.limit,
+		"next_cursor": next,
+		"has_more":    next != "",
+	}
+}
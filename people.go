@@ -0,0 +1,543 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxPersonName is the maximum length of people's names and aliases.
+const maxPersonName = 200
+
+// Person is someone who appears in items, such as a performer or a family
+// member. Like tag aliases, their aliases are other names that resolve to
+// them wherever a person is named, e.g. stage names or nicknames. ImageURL
+// is where their picture was downloaded from; Image is the cached copy.
+type Person struct {
+	ID        int       `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	Aliases   []string  `db:"-" json:"aliases"`
+	ImageURL  string    `db:"image_url" json:"image_url"`
+	Image     string    `db:"image" json:"-"`
+	Count     int       `db:"count" json:"count"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// personError is a reason a person can't be created or changed that lies
+// with the caller, because the name is invalid or already taken.
+type personError string
+
+func (e personError) Error() string {
+	return string(e)
+}
+
+// personName validates a person's name or alias, returning it without
+// surrounding spaces.
+func personName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxPersonName {
+		return "", personError(fmt.Sprintf("Invalid name %q: use up to %d characters", name, maxPersonName))
+	}
+	return name, nil
+}
+
+// findPerson returns the ID of the person with the name or alias, ignoring
+// case, or sql.ErrNoRows.
+func findPerson(tx *sqlx.Tx, name string) (int, error) {
+	var id int
+	err := tx.Get(&id, "SELECT id FROM people WHERE name = ? UNION SELECT person_id FROM person_aliases WHERE name = ? LIMIT 1", name, name)
+	return id, err
+}
+
+// checkPersonName returns a personError if the name is already a person's
+// name or alias.
+func checkPersonName(tx *sqlx.Tx, name string) error {
+	_, err := findPerson(tx, name)
+	switch err {
+	case nil:
+		return personError(fmt.Sprintf("Name already in use: %s", name))
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+// resolvePerson returns the ID of the person with the name or alias,
+// creating the person if there is none, so importers naming someone by a
+// known alias link the items to them.
+func resolvePerson(tx *sqlx.Tx, name string) (int, error) {
+	id, err := findPerson(tx, name)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	res, err := tx.Exec("INSERT INTO people (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+	lastID, err := res.LastInsertId()
+	return int(lastID), err
+}
+
+// linkPerson links an item to the person with the name or alias.
+func linkPerson(tx *sqlx.Tx, mediaID int, name string) error {
+	id, err := resolvePerson(tx, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO media_people (media_id, person_id) VALUES (?, ?)", mediaID, id)
+	return err
+}
+
+// loadPeople returns the people matching the condition, with their aliases
+// and item counts.
+func (app *App) loadPeople(where string, args ...interface{}) ([]Person, error) {
+	people := []Person{}
+	err := app.DB.Select(&people,
+		`SELECT p.id, p.name, p.image_url, p.image, p.created_at, (SELECT COUNT(*) FROM media_people mp WHERE mp.person_id = p.id) AS count
+			FROM people p`+where+` ORDER BY p.name`,
+		args...,
+	)
+	if err != nil || len(people) == 0 {
+		return people, err
+	}
+
+	var aliases []struct {
+		PersonID int    `db:"person_id"`
+		Name     string `db:"name"`
+	}
+	err = app.DB.Select(&aliases,
+		"SELECT person_id, name FROM person_aliases WHERE person_id IN (SELECT p.id FROM people p"+where+") ORDER BY name",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[int]*Person, len(people))
+	for i := range people {
+		people[i].Aliases = []string{}
+		index[people[i].ID] = &people[i]
+	}
+	for _, alias := range aliases {
+		if person := index[alias.PersonID]; person != nil {
+			person.Aliases = append(person.Aliases, alias.Name)
+		}
+	}
+	return people, nil
+}
+
+// personFromURL fetches the person identified by the id URL parameter,
+// writing an error response and returning nil if it can't.
+func (app *App) personFromURL(w http.ResponseWriter, r *http.Request) *Person {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid person ID", http.StatusBadRequest)
+		return nil
+	}
+	return app.loadPerson(w, id)
+}
+
+// loadPerson fetches a person, writing an error response and returning nil
+// if they don't exist or can't be loaded.
+func (app *App) loadPerson(w http.ResponseWriter, id int) *Person {
+	people, err := app.loadPeople(" WHERE p.id = ?", id)
+	if err != nil {
+		log.Error("Failed to fetch person:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if len(people) == 0 {
+		http.Error(w, "Person not found", http.StatusNotFound)
+		return nil
+	}
+	return &people[0]
+}
+
+// writePersonTxError rolls back a failed change to people and writes the
+// error response: 409 Conflict for names already in use.
+func writePersonTxError(w http.ResponseWriter, tx *sqlx.Tx, err error) {
+	tx.Rollback()
+	if _, ok := err.(personError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log.Error("Failed to update people:", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (app *App) getPeople(w http.ResponseWriter, r *http.Request) {
+	people, err := app.loadPeople("")
+	if err != nil {
+		log.Error("Failed to fetch people:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, people)
+}
+
+func (app *App) getPerson(w http.ResponseWriter, r *http.Request) {
+	if person := app.personFromURL(w, r); person != nil {
+		app.writeJSON(w, r, http.StatusOK, person)
+	}
+}
+
+// createPerson creates a person, optionally with aliases. Neither the name
+// nor the aliases may already be in use by another person.
+func (app *App) createPerson(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name    string   `json:"name"`
+		Aliases []string `json:"aliases"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names := append([]string{req.Name}, req.Aliases...)
+	for i, name := range names {
+		clean, err := personName(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names[i] = clean
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to create person:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var id int64
+	for i, name := range names {
+		if err = checkPersonName(tx, name); err != nil {
+			break
+		}
+		if i == 0 {
+			var res sql.Result
+			if res, err = tx.Exec("INSERT INTO people (name) VALUES (?)", name); err == nil {
+				id, err = res.LastInsertId()
+			}
+		} else {
+			_, err = tx.Exec("INSERT INTO person_aliases (name, person_id) VALUES (?, ?)", name, id)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writePersonTxError(w, tx, err)
+		return
+	}
+
+	if person := app.loadPerson(w, int(id)); person != nil {
+		app.writeJSON(w, r, http.StatusCreated, person)
+	}
+}
+
+// updatePerson renames a person. Their items follow, since they are linked
+// to the person rather than the name.
+func (app *App) updatePerson(w http.ResponseWriter, r *http.Request) {
+	person := app.personFromURL(w, r)
+	if person == nil {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, err := personName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to update person:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Changing the case of the person's own name doesn't clash with it
+	if !strings.EqualFold(name, person.Name) {
+		err = checkPersonName(tx, name)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE people SET name = ? WHERE id = ?", name, person.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writePersonTxError(w, tx, err)
+		return
+	}
+
+	if person := app.loadPerson(w, person.ID); person != nil {
+		app.writeJSON(w, r, http.StatusOK, person)
+	}
+}
+
+// deletePerson deletes a person and their aliases, unlinking their items.
+func (app *App) deletePerson(w http.ResponseWriter, r *http.Request) {
+	person := app.personFromURL(w, r)
+	if person == nil {
+		return
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM people WHERE id = ?", person.ID); err != nil {
+		log.Error("Failed to delete person:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// addPersonAlias adds another name for a person.
+func (app *App) addPersonAlias(w http.ResponseWriter, r *http.Request) {
+	person := app.personFromURL(w, r)
+	if person == nil {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, err := personName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to add person alias:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = checkPersonName(tx, name)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO person_aliases (name, person_id) VALUES (?, ?)", name, person.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writePersonTxError(w, tx, err)
+		return
+	}
+
+	if person := app.loadPerson(w, person.ID); person != nil {
+		app.writeJSON(w, r, http.StatusCreated, person)
+	}
+}
+
+func (app *App) deletePersonAlias(w http.ResponseWriter, r *http.Request) {
+	person := app.personFromURL(w, r)
+	if person == nil {
+		return
+	}
+
+	_, err := app.DB.Exec("DELETE FROM person_aliases WHERE person_id = ? AND name = ?", person.ID, chi.URLParam(r, "name"))
+	if err != nil {
+		log.Error("Failed to delete person alias:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if person := app.loadPerson(w, person.ID); person != nil {
+		app.writeJSON(w, r, http.StatusOK, person)
+	}
+}
+
+// setPersonImage downloads a picture of a person into the artwork cache.
+// An empty URL removes it.
+func (app *App) setPersonImage(w http.ResponseWriter, r *http.Request) {
+	person := app.personFromURL(w, r)
+	if person == nil {
+		return
+	}
+
+	var req struct {
+		URL string `json:"url"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var name string
+	if req.URL != "" {
+		u, err := url.Parse(req.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			http.Error(w, "A http or https URL is required", http.StatusBadRequest)
+			return
+		}
+
+		name, err = app.cacheArtwork(req.URL)
+		if err != nil {
+			log.Warnf("Failed to cache image %s: %v", req.URL, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	if _, err := app.DB.Exec("UPDATE people SET image_url = ?, image = ? WHERE id = ?", req.URL, name, person.ID); err != nil {
+		log.Error("Failed to update person image:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	person.ImageURL, person.Image = req.URL, name
+	app.writeJSON(w, r, http.StatusOK, person)
+}
+
+func (app *App) getPersonImage(w http.ResponseWriter, r *http.Request) {
+	person := app.personFromURL(w, r)
+	if person == nil {
+		return
+	}
+
+	if person.ImageURL == "" {
+		http.Error(w, "Person has no image", http.StatusNotFound)
+		return
+	}
+
+	// Re-fetch images that have been removed from the cache
+	path := filepath.Join(artworkDir, person.Image)
+	if _, err := os.Stat(path); person.Image == "" || err != nil {
+		name, err := app.cacheArtwork(person.ImageURL)
+		if err != nil {
+			log.Warnf("Failed to cache image %s: %v", person.ImageURL, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		if _, err := app.DB.Exec("UPDATE people SET image = ? WHERE id = ?", name, person.ID); err != nil {
+			log.Warnf("Failed to update image of person %d: %v", person.ID, err)
+		}
+		path = filepath.Join(artworkDir, name)
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	http.ServeFile(w, r, path)
+}
+
+// itemPeople returns the names of the people in a media item, writing an
+// error response and returning nil if it can't.
+func (app *App) itemPeople(w http.ResponseWriter, item *MediaItem) []string {
+	people := []string{}
+	err := app.DB.Select(&people,
+		"SELECT p.name FROM people p JOIN media_people mp ON mp.person_id = p.id WHERE mp.media_id = ? ORDER BY p.name",
+		item.ID,
+	)
+	if err != nil {
+		log.Error("Failed to fetch people:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return people
+}
+
+func (app *App) getMediaPeople(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if people := app.itemPeople(w, item); people != nil {
+		app.writeJSON(w, r, http.StatusOK, people)
+	}
+}
+
+// addMediaPerson links an item to a person by name or alias, creating the
+// person if the name is new.
+func (app *App) addMediaPerson(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	name, err := personName(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to link person:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = linkPerson(tx, item.ID, name)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writePersonTxError(w, tx, err)
+		return
+	}
+	app.writeBack(item)
+
+	if people := app.itemPeople(w, item); people != nil {
+		app.writeJSON(w, r, http.StatusOK, people)
+	}
+}
+
+// removeMediaPerson unlinks an item from a person, by name or alias.
+func (app *App) removeMediaPerson(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	_, err := app.DB.Exec(
+		`DELETE FROM media_people WHERE media_id = ? AND person_id IN (
+			SELECT id FROM people WHERE name = ? UNION SELECT person_id FROM person_aliases WHERE name = ?)`,
+		item.ID, name, name,
+	)
+	if err != nil {
+		log.Error("Failed to unlink person:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeBack(item)
+
+	if people := app.itemPeople(w, item); people != nil {
+		app.writeJSON(w, r, http.StatusOK, people)
+	}
+}
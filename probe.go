@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// probeTimeout bounds a single run of an external tool, so a file that
+// makes it hang can't stall a scan.
+const probeTimeout = 30 * time.Second
+
+// errProbeUnavailable is returned when the tool needed to read a file's
+// metadata, e.g. ffprobe for videos, wasn't found.
+var errProbeUnavailable = errors.New("metadata tool is not available")
+
+// videoInfo is the technical metadata ffprobe reports for a video file.
+type videoInfo struct {
+	Duration   float64
+	Width      int
+	Height     int
+	VideoCodec string
+	AudioCodec string
+	Bitrate    int64
+	FrameRate  float64
+	Container  string
+
+	// Projection is the spherical projection of 360 degree video, e.g.
+	// "equirectangular". HDR is "hdr10", "hlg" or "dolby_vision".
+	// StereoMode is the frame packing of 3D video, e.g. "top_bottom".
+	// All are empty for ordinary video.
+	Projection string
+	HDR        string
+	StereoMode string
+
+	// Color description of the video stream in ffprobe's names, e.g.
+	// "bt2020", "smpte2084" and "bt2020nc", empty where unspecified.
+	// BitDepth is the bits per color component, e.g. 10.
+	ColorPrimaries string
+	ColorTransfer  string
+	ColorSpace     string
+	BitDepth       int
+
+	// Audio tracks. The channels, layout and sample rate are those of the
+	// default track. AudioLanguages has the language tag of every track,
+	// "und" where there is none.
+	AudioTracks    int
+	AudioChannels  int
+	ChannelLayout  string
+	SampleRate     int
+	AudioLanguages []string
+}
+
+// sideData is an entry of a stream's side_data_list. Only the fields of
+// the types used for the video flags are decoded.
+type sideData struct {
+	Type       string `json:"side_data_type"`
+	Projection string `json:"projection"`
+	Stereo     string `json:"type"`
+}
+
+// findTool resolves a configured external tool, returning an empty string
+// if it is disabled or can't be found. purpose describes what is missing
+// without it.
+func findTool(path, purpose string) string {
+	if path == "" {
+		return ""
+	}
+
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		log.Warnf("%s not found (%v); %s will not be extracted", path, err, purpose)
+		return ""
+	}
+	return resolved
+}
+
+// runTool runs an external tool and returns its output. If it fails, the
+// error is what it printed to stderr.
+func runTool(name string, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+// probe runs ffprobe on a video file.
+func (app *App) probe(path string) (*videoInfo, error) {
+	if app.FFprobe == "" {
+		return nil, errProbeUnavailable
+	}
+
+	out, err := runTool(app.FFprobe,
+		"-v", "error", "-print_format", "json", "-show_format", "-show_streams", path,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType      string     `json:"codec_type"`
+			CodecName      string     `json:"codec_name"`
+			Width          int        `json:"width"`
+			Height         int        `json:"height"`
+			AvgFrameRate   string     `json:"avg_frame_rate"`
+			RFrameRate     string     `json:"r_frame_rate"`
+			PixFmt         string     `json:"pix_fmt"`
+			ColorPrimaries string     `json:"color_primaries"`
+			ColorTransfer  string     `json:"color_transfer"`
+			ColorSpace     string     `json:"color_space"`
+			SideData       []sideData `json:"side_data_list"`
+			Channels       int        `json:"channels"`
+			ChannelLayout  string     `json:"channel_layout"`
+			SampleRate     string     `json:"sample_rate"`
+			Tags           struct {
+				StereoMode string `json:"stereo_mode"`
+				Language   string `json:"language"`
+			} `json:"tags"`
+			Disposition struct {
+				Default     int `json:"default"`
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return nil, err
+	}
+
+	info := &videoInfo{Container: result.Format.FormatName}
+	info.Duration, _ = strconv.ParseFloat(result.Format.Duration, 64)
+	info.Bitrate, _ = strconv.ParseInt(result.Format.BitRate, 10, 64)
+
+	defaultAudio := false
+	for _, stream := range result.Streams {
+		switch stream.CodecType {
+		case "video":
+			// Cover art is stored as a single frame video stream
+			if info.VideoCodec != "" || stream.Disposition.AttachedPic == 1 {
+				continue
+			}
+			info.VideoCodec = stream.CodecName
+			info.Width = stream.Width
+			info.Height = stream.Height
+			info.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if info.FrameRate == 0 {
+				info.FrameRate = parseFrameRate(stream.RFrameRate)
+			}
+
+			info.ColorPrimaries = colorValue(stream.ColorPrimaries)
+			info.ColorTransfer = colorValue(stream.ColorTransfer)
+			info.ColorSpace = colorValue(stream.ColorSpace)
+			info.BitDepth = pixelDepth(stream.PixFmt)
+
+			switch stream.ColorTransfer {
+			case "smpte2084":
+				info.HDR = "hdr10"
+			case "arib-std-b67":
+				info.HDR = "hlg"
+			}
+
+			// Matroska signals 3D in a tag, MP4 in side data
+			if mode := stream.Tags.StereoMode; mode != "" && mode != "mono" {
+				info.StereoMode = mode
+			}
+			for _, sd := range stream.SideData {
+				switch sd.Type {
+				case "Spherical Mapping":
+					info.Projection = flagValue(sd.Projection)
+				case "Stereo 3D":
+					if sd.Stereo != "2D" {
+						info.StereoMode = flagValue(sd.Stereo)
+					}
+				case "DOVI configuration record":
+					info.HDR = "dolby_vision"
+				}
+			}
+		case "audio":
+			if info.AudioCodec == "" {
+				info.AudioCodec = stream.CodecName
+			}
+
+			info.AudioTracks++
+			lang := strings.ToLower(stream.Tags.Language)
+			if lang == "" {
+				lang = "und"
+			}
+			info.AudioLanguages = append(info.AudioLanguages, lang)
+
+			// Describe the track players pick, falling back to the first
+			if info.AudioTracks == 1 || (!defaultAudio && stream.Disposition.Default == 1) {
+				defaultAudio = stream.Disposition.Default == 1
+				info.AudioChannels = stream.Channels
+				info.ChannelLayout = stream.ChannelLayout
+				info.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+			}
+		}
+	}
+
+	return info, nil
+}
+
+// flagValue turns ffprobe's descriptions, e.g. "top and bottom", into
+// values that are easy to filter on, e.g. "top_and_bottom".
+func flagValue(s string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(s)), " ", "_")
+}
+
+// colorValue drops the "unknown" and "reserved" ffprobe reports for color
+// properties a stream doesn't specify.
+func colorValue(s string) string {
+	if s == "unknown" || s == "reserved" {
+		return ""
+	}
+	return s
+}
+
+// pixelDepth returns the bits per component of an ffmpeg pixel format, e.g.
+// 10 for "yuv420p10le". Formats without a depth in their name have 8 bits.
+func pixelDepth(pixFmt string) int {
+	if pixFmt == "" {
+		return 0
+	}
+	name := strings.TrimSuffix(strings.TrimSuffix(pixFmt, "le"), "be")
+	i := len(name)
+	for i > 0 && name[i-1] >= '0' && name[i-1] <= '9' {
+		i--
+	}
+	if i < len(name) && i > 0 && name[i-1] == 'p' {
+		if depth, err := strconv.Atoi(name[i:]); err == nil {
+			return depth
+		}
+	}
+	return 8
+}
+
+// parseFrameRate parses ffprobe's fractional frame rates, e.g. "30000/1001".
+func parseFrameRate(s string) float64 {
+	num, den, ok := strings.Cut(s, "/")
+	if !ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
+
+// probeMedia extracts and stores the technical metadata of an item: the
+// dimensions of an image, everything ffprobe reports for a video, or the
+// pages, text and thumbnail of a document. It returns errProbeUnavailable
+// if the tool the item needs is missing. Items whose metadata can't be
+// read are flagged as corrupt, and items whose content doesn't match their
+// extension as type_mismatch.
+func (app *App) probeMedia(item *MediaItem) error {
+	if err := app.sniffMedia(item); err != nil {
+		log.Warnf("Failed to detect the content type of %s: %v", item.Path, err)
+	}
+
+	err := app.readMetadata(item)
+
+	// Sidecars are applied after the EXIF data, whose position takes
+	// precedence. The filename only fills in what's missing, so it goes
+	// first and sidecars and NFO files override its guesses
+	if err := app.applyFilename(item); err != nil {
+		log.Warnf("Failed to parse the filename of %s: %v", item.Path, err)
+	}
+	if err := app.applySidecar(item); err != nil {
+		log.Warnf("Failed to import the sidecar of %s: %v", item.Path, err)
+	}
+	if err := app.applyNFO(item); err != nil {
+		log.Warnf("Failed to import the NFO file of %s: %v", item.Path, err)
+	}
+	app.writeBack(item)
+
+	var flagErr error
+	switch {
+	case err == errProbeUnavailable:
+	case err != nil:
+		flagErr = app.setFlag(item.ID, flagCorrupt, sourceProbe)
+	default:
+		flagErr = app.clearFlag(item.ID, flagCorrupt)
+	}
+	if flagErr != nil {
+		log.Warnf("Failed to update corrupt flag of %s: %v", item.Path, flagErr)
+	}
+
+	return err
+}
+
+func (app *App) readMetadata(item *MediaItem) error {
+	switch item.Type {
+	case "image":
+		return app.probeImage(item)
+	case "raw":
+		return app.probeRAW(item)
+	case "document":
+		return app.probeDocument(item)
+	case "audio":
+		return app.probeAudio(item)
+	case "comic":
+		return app.probeComic(item)
+	case "video":
+		if app.FFprobe == "" {
+			return errProbeUnavailable
+		}
+	default:
+		return nil
+	}
+
+	info, err := app.probe(item.Path)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.DB.Exec(
+		`UPDATE media SET duration = ?, width = ?, height = ?, video_codec = ?, audio_codec = ?,
+			bitrate = ?, frame_rate = ?, container = ?, projection = ?, hdr = ?, stereo_mode = ?,
+			color_primaries = ?, color_transfer = ?, color_space = ?, bit_depth = ?,
+			audio_tracks = ?, audio_channels = ?, channel_layout = ?, sample_rate = ?, audio_languages = ?,
+			probed = 1 WHERE id = ?`,
+		info.Duration, info.Width, info.Height, info.VideoCodec, info.AudioCodec,
+		info.Bitrate, info.FrameRate, info.Container, info.Projection, info.HDR, info.StereoMode,
+		info.ColorPrimaries, info.ColorTransfer, info.ColorSpace, info.BitDepth,
+		info.AudioTracks, info.AudioChannels, info.ChannelLayout, info.SampleRate, strings.Join(info.AudioLanguages, ","),
+		item.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	item.Duration = info.Duration
+	item.Width = info.Width
+	item.Height = info.Height
+	item.VideoCodec = info.VideoCodec
+	item.AudioCodec = info.AudioCodec
+	item.Bitrate = info.Bitrate
+	item.FrameRate = info.FrameRate
+	item.Container = info.Container
+	item.Projection = info.Projection
+	item.HDR = info.HDR
+	item.StereoMode = info.StereoMode
+	item.ColorPrimaries = info.ColorPrimaries
+	item.ColorTransfer = info.ColorTransfer
+	item.ColorSpace = info.ColorSpace
+	item.BitDepth = info.BitDepth
+	item.AudioTracks = info.AudioTracks
+	item.AudioChannels = info.AudioChannels
+	item.ChannelLayout = info.ChannelLayout
+	item.SampleRate = info.SampleRate
+	item.AudioLanguages = strings.Join(info.AudioLanguages, ",")
+	item.Probed = true
+
+	// The thumbnail is rendered after probing, which its frame's position
+	// depends on
+	thumbnail, err := app.renderThumbnail(item)
+	if err == nil {
+		_, err = app.DB.Exec("UPDATE media SET thumbnail = ? WHERE id = ?", thumbnail, item.ID)
+		item.Thumbnail = thumbnail
+	}
+	if err != nil && err != errNoThumbnail {
+		log.Warnf("Failed to render thumbnail of %s: %v", item.Path, err)
+	}
+	return nil
+}
+
+// probeImage stores the dimensions and frame count of an image item, and
+// the capture time, GPS position and place of a JPEG photo.
+func (app *App) probeImage(item *MediaItem) error {
+	width, height, err := imageSize(item.Path)
+	if err != nil {
+		return err
+	}
+
+	// Broken EXIF data doesn't make the image unusable
+	exif := &exifData{}
+	if ext := strings.ToLower(filepath.Ext(item.Path)); ext == ".jpg" || ext == ".jpeg" {
+		if exif, err = readEXIF(item.Path); err != nil {
+			if err != errNoEXIF {
+				log.Warnf("Failed to read EXIF data of %s: %v", item.Path, err)
+			}
+			exif = &exifData{}
+		}
+	}
+
+	frames, err := imageFrames(item.Path)
+	if err != nil {
+		return err
+	}
+
+	if sideways(exif.Orientation) {
+		width, height = height, width
+	}
+	item.Orientation = exif.Orientation
+
+	// An image without a thumbnail, e.g. a WebP image without a worker to
+	// decode it, is still shown in full
+	thumbnail, err := app.renderThumbnail(item)
+	if err != nil && err != errNoThumbnail {
+		log.Warnf("Failed to render thumbnail of %s: %v", item.Path, err)
+	}
+
+	_, err = app.DB.Exec(
+		`UPDATE media SET width = ?, height = ?, animated = ?, frames = ?, orientation = ?,
+			latitude = ?, longitude = ?, taken_at = COALESCE(taken_at, ?), thumbnail = ?, probed = 1 WHERE id = ?`,
+		width, height, frames > 1, frames, exif.Orientation,
+		exif.Latitude, exif.Longitude, exif.TakenAt, thumbnail, item.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if exif.TakenAt != nil {
+		item.TakenAt = exif.TakenAt
+	}
+
+	item.Width = width
+	item.Height = height
+	item.Animated = frames > 1
+	item.Frames = frames
+	item.Latitude = exif.Latitude
+	item.Longitude = exif.Longitude
+	item.Thumbnail = thumbnail
+	item.Probed = true
+
+	if err := app.hashImage(item); err != nil {
+		log.Warnf("Failed to hash %s: %v", item.Path, err)
+	}
+	if err := app.classifyScreenshot(item, exif, width, height); err != nil {
+		log.Warnf("Failed to classify %s as a screenshot: %v", item.Path, err)
+	}
+	if err := app.geocode(item); err != nil {
+		log.Warnf("Failed to geocode %s: %v", item.Path, err)
+	}
+	return nil
+}
+
+// probeMissing extracts the metadata of every item that doesn't have it
+// yet, e.g. because it was added before this version or before ffprobe was
+// installed. Items whose tool is unavailable are skipped.
+func (app *App) probeMissing(w http.ResponseWriter, r *http.Request) {
+	var items []MediaItem
+	err := app.DB.Select(&items, "SELECT * FROM media WHERE type IN ('image', 'raw', 'video', 'document', 'audio', 'comic') AND NOT probed ORDER BY id")
+	if err != nil {
+		log.Error("Failed to fetch unprobed media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	probed, skipped, failed := 0, 0, 0
+	for i := range items {
+		err := app.probeMedia(&items[i])
+		switch {
+		case err == errProbeUnavailable:
+			skipped++
+		case err != nil:
+			log.Warnf("Failed to probe %s: %v", items[i].Path, err)
+			failed++
+		default:
+			probed++
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"probed":  probed,
+		"skipped": skipped,
+		"failed":  failed,
+	})
+}
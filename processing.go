@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// processingPoll is how often paused background work checks whether it may
+// go on.
+const processingPoll = 30 * time.Second
+
+// streamIdle is how long after the last thumbnail, artwork or page was
+// served the server counts as idle again.
+const streamIdle = time.Minute
+
+// timeWindow is a daily span of local time, in minutes since midnight. A
+// window ending before it starts runs past midnight.
+type timeWindow struct {
+	start, end int
+}
+
+// parseTimeWindow parses a window like "01:00-07:00".
+func parseTimeWindow(s string) (timeWindow, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return timeWindow{}, fmt.Errorf("invalid window %q: use HH:MM-HH:MM", s)
+	}
+	var minutes [2]int
+	for i, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return timeWindow{}, fmt.Errorf("invalid window %q: use HH:MM-HH:MM", s)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	if minutes[0] == minutes[1] {
+		return timeWindow{}, fmt.Errorf("invalid window %q: it is empty", s)
+	}
+	return timeWindow{minutes[0], minutes[1]}, nil
+}
+
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// processingGate holds heavy background work back outside the configured
+// processing windows, and while clients are reading media if configured
+// to. Without either it is always open.
+type processingGate struct {
+	windows             []timeWindow
+	pauseWhileStreaming bool
+	// wake is signalled when work is deferred.
+	wake chan struct{}
+
+	mu         sync.Mutex
+	lastStream time.Time
+	paused     bool
+}
+
+func newProcessingGate(config ProcessingConfig) (*processingGate, error) {
+	g := &processingGate{pauseWhileStreaming: config.PauseWhileStreaming, wake: make(chan struct{}, 1)}
+	for _, s := range config.Windows {
+		w, err := parseTimeWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		g.windows = append(g.windows, w)
+	}
+	return g, nil
+}
+
+// inWindow reports whether t is in a processing window.
+func (g *processingGate) inWindow(t time.Time) bool {
+	if len(g.windows) == 0 {
+		return true
+	}
+	for _, w := range g.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// streaming reports whether media was served recently.
+func (g *processingGate) streaming() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pauseWhileStreaming && time.Since(g.lastStream) < streamIdle
+}
+
+// open reports whether heavy work may run now.
+func (g *processingGate) open() bool {
+	return g.inWindow(time.Now()) && !g.streaming()
+}
+
+// wait blocks until heavy work may run, logging when it pauses and
+// resumes.
+func (g *processingGate) wait() {
+	for !g.open() {
+		g.setPaused(true)
+		time.Sleep(processingPoll)
+	}
+	g.setPaused(false)
+}
+
+func (g *processingGate) setPaused(paused bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if paused != g.paused {
+		if paused {
+			log.Info("Pausing background processing outside the processing windows or while media is served")
+		} else {
+			log.Info("Resuming background processing")
+		}
+	}
+	g.paused = paused
+}
+
+// served records that a client read media, and wraps the handlers serving
+// it.
+func (app *App) served(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g := app.Processing
+		g.mu.Lock()
+		g.lastStream = time.Now()
+		g.mu.Unlock()
+		next(w, r)
+	}
+}
+
+// deferWork reports whether heavy work must wait, waking the deferred
+// worker to pick it up once the gate opens.
+func (g *processingGate) deferWork() bool {
+	if g.open() {
+		return false
+	}
+	select {
+	case g.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// probeOrDefer probes a new item, unless the gate is closed: then it stays
+// unprobed for the deferred worker, and is returned without its metadata.
+func (app *App) probeOrDefer(item *MediaItem) {
+	if app.Processing.deferWork() {
+		return
+	}
+	// A file whose metadata can't be read is still imported, just without
+	// it
+	if err := app.probeMedia(item); err != nil && err != errProbeUnavailable {
+		log.Warnf("Failed to probe %s: %v", item.Path, err)
+	}
+}
+
+// baselineOrDefer takes the baseline checksum of a new item of an
+// immutable library, unless the gate is closed: then the deferred worker
+// takes it.
+func (app *App) baselineOrDefer(item *MediaItem) {
+	if item.Checksum != "" || !app.immutable(item) || app.Processing.deferWork() {
+		return
+	}
+	if err := app.baseline(item); err != nil {
+		log.Warnf("Failed to checksum immutable file %s: %v", item.Path, err)
+	}
+}
+
+// runDeferred probes the items left unprobed while the gate was closed, as
+// soon as it opens, and classifies their extras, which may depend on their
+// duration; then it takes the baselines of immutable items that have none.
+// Each item is tried once per run, so items whose tool is missing aren't
+// probed over and over; the items unprobed at startup are tried once.
+func (app *App) runDeferred() {
+	lastID, lastBaselineID := 0, 0
+	for {
+		var items []MediaItem
+		err := app.DB.Select(&items,
+			`SELECT * FROM media WHERE type IN ('image', 'raw', 'video', 'document', 'audio', 'comic')
+				AND NOT probed AND id > ? ORDER BY id`, lastID)
+		if err != nil {
+			log.Error("Failed to fetch deferred media items:", err)
+		}
+
+		for i := range items {
+			app.Processing.wait()
+			item := &items[i]
+			if err := app.probeMedia(item); err != nil && err != errProbeUnavailable {
+				log.Warnf("Failed to probe %s: %v", item.Path, err)
+			}
+			app.classifyNew(item)
+			lastID = item.ID
+		}
+
+		items, err = app.unbaselined(lastBaselineID)
+		if err != nil {
+			log.Error("Failed to fetch immutable media items without a checksum:", err)
+		}
+		for i := range items {
+			app.Processing.wait()
+			if err := app.baseline(&items[i]); err != nil {
+				log.Warnf("Failed to checksum immutable file %s: %v", items[i].Path, err)
+			}
+			lastBaselineID = items[i].ID
+		}
+		<-app.Processing.wake
+	}
+}
+
+// getProcessing reports whether heavy background work may run now and how
+// many items wait to be probed.
+func (app *App) getProcessing(w http.ResponseWriter, r *http.Request) {
+	g := app.Processing
+	windows := app.Config.Processing.Windows
+	if windows == nil {
+		windows = []string{}
+	}
+
+	var deferred int
+	err := app.DB.Get(&deferred,
+		"SELECT COUNT(*) FROM media WHERE type IN ('image', 'raw', 'video', 'document', 'audio', 'comic') AND NOT probed")
+	if err != nil {
+		log.Error("Failed to count unprobed media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"open":      g.open(),
+		"in_window": g.inWindow(time.Now()),
+		"streaming": g.streaming(),
+		"windows":   windows,
+		"unprobed":  deferred,
+	})
+}
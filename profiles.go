@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Clients send the session of the profile they switched to in a cookie,
+// or in a header if they don't keep cookies.
+const (
+	profileCookie = "profile_session"
+	profileHeader = "X-Profile-Token"
+)
+
+// After maxPINFailures wrong PINs in a row, switching profiles is refused
+// for pinLockout, so a short PIN can't be guessed by trying them all.
+const (
+	maxPINFailures = 5
+	pinLockout     = time.Minute
+)
+
+// restrictedRoutes are the only requests restricted profiles may make:
+// reading items, their thumbnails, artwork and pages, and collections.
+// Everything else, from scans to exports and statistics, is refused, so
+// new endpoints are closed to them until they enforce the restriction.
+var restrictedRoutes = []struct {
+	method string
+	path   *regexp.Regexp
+}{
+	{http.MethodGet, regexp.MustCompile(`^/$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/media$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/media/onthisday$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/media/\d+$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/media/\d+/(thumbnail|artwork)$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/media/\d+/pages/[^/]+$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/collections$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/collections/[^/]+/media$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/smart-collections(/[^/]+(/media)?)?$`)},
+	{http.MethodGet, regexp.MustCompile(`^/api/profile$`)},
+	{http.MethodPost, regexp.MustCompile(`^/api/profile$`)},
+}
+
+// ratingAges are the minimum ages of the US film and TV ratings and the UK
+// film ratings. Other ratings are read by the age in them, e.g. "FSK 12".
+var ratingAges = map[string]int{
+	"G": 0, "PG": 10, "PG-13": 13, "R": 17, "NC-17": 18,
+	"TV-Y": 0, "TV-Y7": 7, "TV-G": 0, "TV-PG": 10, "TV-14": 14, "TV-MA": 17,
+	"U": 0, "12A": 12, "R18": 18,
+}
+
+// ratingAge returns the minimum age of a content rating as NFO files write
+// it, e.g. "Rated PG-13", "US:PG-13" or "Germany:FSK 16". ok is false for
+// unknown ratings and "Not Rated".
+func ratingAge(rating string) (age int, ok bool) {
+	if i := strings.LastIndex(rating, ":"); i >= 0 {
+		rating = rating[i+1:]
+	}
+	rating = strings.ToUpper(strings.TrimSpace(rating))
+	rating = strings.TrimSpace(strings.TrimPrefix(rating, "RATED "))
+	if age, ok := ratingAges[rating]; ok {
+		return age, true
+	}
+
+	digits := strings.TrimSuffix(strings.TrimSpace(strings.TrimLeft(rating, "ABCDEFGHIJKLMNOPQRSTUVWXYZ -")), "+")
+	if age, err := strconv.Atoi(digits); err == nil && age >= 0 && age <= 21 {
+		return age, true
+	}
+	return 0, false
+}
+
+// restriction is what a restricted profile can see, resolved from its
+// configuration.
+type restriction struct {
+	name string
+	// prefixes are the volumes of the profile's libraries, each with a
+	// trailing separator.
+	prefixes []string
+	tags     []string
+	// maxAge is the age of the profile's rating ceiling, nil if it has
+	// none.
+	maxAge       *int
+	blockUnrated bool
+}
+
+// newRestrictions validates the restricted profiles and resolves them, by
+// name.
+func newRestrictions(config *Config) (map[string]*restriction, error) {
+	profiles := config.Profiles
+	restrictions := map[string]*restriction{}
+	if len(profiles.Restricted) == 0 {
+		if profiles.Default != "" {
+			return nil, fmt.Errorf("default profile %q is not configured", profiles.Default)
+		}
+		return restrictions, nil
+	}
+	if profiles.PIN == "" {
+		return nil, errors.New("restricted profiles need a pin to switch between them")
+	}
+
+	for _, p := range profiles.Restricted {
+		if p.Name == "" {
+			return nil, errors.New("restricted profile without a name")
+		}
+		if restrictions[p.Name] != nil {
+			return nil, fmt.Errorf("profile %q is configured twice", p.Name)
+		}
+
+		res := &restriction{name: p.Name, tags: p.Tags, blockUnrated: p.BlockUnrated}
+		for _, name := range p.Libraries {
+			lib := config.library(name)
+			if lib == nil {
+				return nil, fmt.Errorf("profile %q: unknown library %q", p.Name, name)
+			}
+			for _, v := range lib.volumes() {
+				res.prefixes = append(res.prefixes, strings.TrimSuffix(v, string(os.PathSeparator))+string(os.PathSeparator))
+			}
+		}
+		if p.MaxRating != "" {
+			age, ok := ratingAge(p.MaxRating)
+			if !ok {
+				return nil, fmt.Errorf("profile %q: unknown rating %q", p.Name, p.MaxRating)
+			}
+			res.maxAge = &age
+		}
+		restrictions[p.Name] = res
+	}
+
+	if profiles.Default != "" && restrictions[profiles.Default] == nil {
+		return nil, fmt.Errorf("default profile %q is not configured", profiles.Default)
+	}
+	return restrictions, nil
+}
+
+// where returns the SQL condition matching the items the profile can see:
+// those in one of its libraries or with one of its tags, or below it in
+// the tag hierarchy, if it lists any, and rated at most its ceiling.
+func (res *restriction) where() (string, []interface{}) {
+	var grants, conds []string
+	var args []interface{}
+	for _, prefix := range res.prefixes {
+		grants = append(grants, "substr(path, 1, length(?)) = ?")
+		args = append(args, prefix, prefix)
+	}
+	for _, tag := range res.tags {
+		grants = append(grants, `id IN (SELECT media_id FROM media_tags WHERE tag_id IN (
+			WITH RECURSIVE below(id) AS (
+				SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ?
+				UNION SELECT t.id FROM tags t JOIN below ON t.parent_id = below.id
+			) SELECT id FROM below))`)
+		args = append(args, tag, tag)
+	}
+	if len(grants) > 0 {
+		conds = append(conds, "("+strings.Join(grants, " OR ")+")")
+	}
+
+	// Photos are rarely rated, so only unrated videos can be blocked
+	unrated := "rating_age IS NULL"
+	if res.blockUnrated {
+		unrated = "(rating_age IS NULL AND type != 'video')"
+	}
+	switch {
+	case res.maxAge != nil:
+		conds = append(conds, "(rating_age <= ? OR "+unrated+")")
+		args = append(args, *res.maxAge)
+	case res.blockUnrated:
+		conds = append(conds, "(rating_age IS NOT NULL OR "+unrated+")")
+	}
+
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+type profileKey struct{}
+
+// profileOf returns the restriction of the profile a request is made in,
+// nil if it is unrestricted.
+func profileOf(r *http.Request) *restriction {
+	res, _ := r.Context().Value(profileKey{}).(*restriction)
+	return res
+}
+
+// pinAttempts counts the wrong PINs given to switch profiles.
+type pinAttempts struct {
+	mu          sync.Mutex
+	failures    int
+	lockedUntil time.Time
+}
+
+// session returns the name of the profile of the request's session, and
+// false if it has none, or one of a profile no longer configured.
+func (app *App) session(r *http.Request) (string, bool) {
+	token := r.Header.Get(profileHeader)
+	if cookie, err := r.Cookie(profileCookie); err == nil && token == "" {
+		token = cookie.Value
+	}
+	if token == "" {
+		return "", false
+	}
+
+	var name string
+	err := app.DB.Get(&name, "SELECT profile FROM profile_sessions WHERE token = ?", token)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Warn("Failed to look up profile session:", err)
+		}
+		return "", false
+	}
+	if name != "" && app.Restrictions[name] == nil {
+		return "", false
+	}
+	return name, true
+}
+
+// restrict resolves the profile of every request: that of its session, or
+// the default profile without one, so clearing cookies doesn't lift a
+// restriction. Restricted profiles are confined to restrictedRoutes.
+func (app *App) restrict(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(app.Restrictions) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name, ok := app.session(r)
+		if !ok {
+			name = app.Config.Profiles.Default
+		}
+		res := app.Restrictions[name]
+		if res == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, route := range restrictedRoutes {
+			if r.Method == route.method && route.path.MatchString(r.URL.Path) {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), profileKey{}, res)))
+				return
+			}
+		}
+		http.Error(w, "Not available in a restricted profile", http.StatusForbidden)
+	})
+}
+
+// visible reports whether the profile of a request can see an item.
+func (app *App) visible(r *http.Request, id int) (bool, error) {
+	res := profileOf(r)
+	if res == nil {
+		return true, nil
+	}
+	cond, args := res.where()
+	var n int
+	err := app.DB.Get(&n, "SELECT COUNT(*) FROM media WHERE id = ? AND "+cond, append([]interface{}{id}, args...)...)
+	return n > 0, err
+}
+
+// hideExtras removes the extras a restricted profile can't see from the
+// details of items it can.
+func (app *App) hideExtras(details []MediaDetail, res *restriction) error {
+	cond, args := res.where()
+	for i := range details {
+		extras := details[i].Extras[:0]
+		for _, extra := range details[i].Extras {
+			var n int
+			err := app.DB.Get(&n, "SELECT COUNT(*) FROM media WHERE id = ? AND "+cond, append([]interface{}{extra.ID}, args...)...)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				extras = append(extras, extra)
+			}
+		}
+		details[i].Extras = extras
+	}
+	return nil
+}
+
+// getProfile returns the profile the client is in and the profiles it can
+// switch to.
+func (app *App) getProfile(w http.ResponseWriter, r *http.Request) {
+	names := []string{}
+	for _, p := range app.Config.Profiles.Restricted {
+		names = append(names, p.Name)
+	}
+
+	current := ""
+	if res := profileOf(r); res != nil {
+		current = res.name
+	}
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"profile":    current,
+		"restricted": current != "",
+		"profiles":   names,
+	})
+}
+
+// switchProfile moves the client to another profile, or to no profile with
+// an empty name. Leaving a restricted profile takes the PIN.
+func (app *App) switchProfile(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Profile string `json:"profile"`
+		PIN     string `json:"pin"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(app.Restrictions) == 0 {
+		http.Error(w, "No restricted profiles are configured", http.StatusNotFound)
+		return
+	}
+	if req.Profile != "" && app.Restrictions[req.Profile] == nil {
+		http.Error(w, fmt.Sprintf("Unknown profile: %s", req.Profile), http.StatusBadRequest)
+		return
+	}
+
+	if current := profileOf(r); current != nil && current.name != req.Profile {
+		if err := app.checkPIN(req.PIN); err != nil {
+			status := http.StatusForbidden
+			if err == errPINLockout {
+				status = http.StatusTooManyRequests
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error("Failed to create profile session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(b)
+
+	if old, err := r.Cookie(profileCookie); err == nil {
+		app.DB.Exec("DELETE FROM profile_sessions WHERE token = ?", old.Value)
+	}
+	if old := r.Header.Get(profileHeader); old != "" {
+		app.DB.Exec("DELETE FROM profile_sessions WHERE token = ?", old)
+	}
+	_, err := app.DB.Exec(
+		"INSERT INTO profile_sessions (token, profile, created_at) VALUES (?, ?, ?)",
+		token, req.Profile, time.Now().UTC(),
+	)
+	if err != nil {
+		log.Error("Failed to create profile session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     profileCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Infof("Switched a client to profile %q", req.Profile)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"profile":    req.Profile,
+		"restricted": req.Profile != "",
+		"token":      token,
+	})
+}
+
+// errPINLockout is returned while switching profiles is refused after too
+// many wrong PINs.
+var errPINLockout = errors.New("too many wrong PINs; try again later")
+
+// checkPIN compares a PIN with the configured one, counting failures.
+func (app *App) checkPIN(pin string) error {
+	s := &app.PINAttempts
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if time.Now().Before(s.lockedUntil) {
+		return errPINLockout
+	}
+	if subtle.ConstantTimeCompare([]byte(pin), []byte(app.Config.Profiles.PIN)) == 1 {
+		s.failures = 0
+		return nil
+	}
+
+	if s.failures++; s.failures >= maxPINFailures {
+		s.failures = 0
+		s.lockedUntil = time.Now().Add(pinLockout)
+		log.Warnf("Too many wrong profile PINs; refusing to switch profiles for %s", pinLockout)
+	}
+	return errors.New("wrong PIN")
+}
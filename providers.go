@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// Providers are the external services the application calls.
+const (
+	providerGeocoding = "geocoding"
+	providerArtwork   = "artwork"
+)
+
+// Retried requests wait retryBackoff, doubling after every attempt up to
+// maxRetryBackoff. A longer Retry-After from the service is honored up to
+// maxRetryAfter.
+const (
+	retryBackoff    = time.Second
+	maxRetryBackoff = 30 * time.Second
+	maxRetryAfter   = time.Minute
+)
+
+// providerDefaults are the settings of each provider that the
+// configuration doesn't override. Nominatim's usage policy allows one
+// request per second; artwork has a file cache of its own.
+var providerDefaults = map[string]apiSettings{
+	providerGeocoding: {RequestsPerSecond: 1, Retries: 3, CacheTTL: 30 * 24 * time.Hour, AllowPrivate: true},
+	providerArtwork:   {RequestsPerSecond: 0, Retries: 2, CacheTTL: 0},
+}
+
+// errPrivateAddress is returned for requests to loopback, link-local or
+// private addresses by providers that fetch URLs clients give, so clients
+// can't reach the server's own network through them.
+var errPrivateAddress = errors.New("address is not public")
+
+// apiSettings are the limits of a provider's client.
+type apiSettings struct {
+	// RequestsPerSecond spaces out requests, including retries; zero means
+	// no limit.
+	RequestsPerSecond float64
+	// Retries is how many times a request failing with a network error,
+	// 429 Too Many Requests or a 5xx status is retried.
+	Retries int
+	// CacheTTL is how long successful responses are cached; zero disables
+	// the cache.
+	CacheTTL time.Duration
+	// AllowPrivate allows requests to loopback, link-local and private
+	// addresses. The geocoding service is configured by the admin;
+	// artwork URLs come from clients, so they must be public by default.
+	AllowPrivate bool
+}
+
+// apiResponse is a response of an external service, read in full.
+type apiResponse struct {
+	Status      int
+	ContentType string
+	Body        []byte
+}
+
+// apiClient calls one external service. Every outbound request goes
+// through one, so bulk jobs stay within the service's rate limit however
+// many items they look up.
+type apiClient struct {
+	name     string
+	settings apiSettings
+	db       *sqlx.DB
+	client   *http.Client
+
+	mu sync.Mutex
+	// next is the earliest time the next request may start.
+	next  time.Time
+	stats ProviderStats
+}
+
+// ProviderStats count the requests made through a provider's client since
+// the server started.
+type ProviderStats struct {
+	Requests  int `json:"requests"`
+	CacheHits int `json:"cache_hits"`
+	// Retried counts the retries, Failures the requests that failed
+	// after them.
+	Retried  int `json:"retried"`
+	Failures int `json:"failures"`
+}
+
+// newAPIClients creates the client of every provider, applying the
+// configured overrides to the defaults.
+func newAPIClients(db *sqlx.DB, config map[string]ProviderConfig) (map[string]*apiClient, error) {
+	for name := range config {
+		if _, ok := providerDefaults[name]; !ok {
+			return nil, fmt.Errorf("unknown provider %q: use geocoding or artwork", name)
+		}
+	}
+
+	clients := map[string]*apiClient{}
+	for name, settings := range providerDefaults {
+		c := config[name]
+		if c.RequestsPerSecond != nil {
+			settings.RequestsPerSecond = *c.RequestsPerSecond
+		}
+		if c.Retries != nil {
+			settings.Retries = *c.Retries
+		}
+		if c.CacheHours != nil {
+			settings.CacheTTL = time.Duration(*c.CacheHours * float64(time.Hour))
+		}
+		if c.AllowPrivate != nil {
+			settings.AllowPrivate = *c.AllowPrivate
+		}
+		if settings.RequestsPerSecond < 0 || settings.Retries < 0 || settings.CacheTTL < 0 {
+			return nil, fmt.Errorf("provider %q: limits can't be negative", name)
+		}
+
+		client := &http.Client{Timeout: 30 * time.Second}
+		if !settings.AllowPrivate {
+			// Checked on connecting, so names resolving to private
+			// addresses, and redirects to them, are refused too
+			dialer := &net.Dialer{Timeout: 30 * time.Second, Control: publicOnly}
+			transport := http.DefaultTransport.(*http.Transport).Clone()
+			transport.DialContext = dialer.DialContext
+			client.Transport = transport
+		}
+		clients[name] = &apiClient{
+			name:     name,
+			settings: settings,
+			db:       db,
+			client:   client,
+		}
+	}
+	return clients, nil
+}
+
+// publicOnly refuses connections to addresses that aren't public.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%s: %w", host, errPrivateAddress)
+	}
+	return nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// get fetches rawURL, from the cache if a fresh copy is there. Failures
+// worth retrying are retried with backoff; other error statuses are
+// returned as they are, without being cached. Bodies over maxSize bytes
+// are an error.
+func (c *apiClient) get(rawURL string, maxSize int64) (*apiResponse, error) {
+	if resp, err := c.cached(rawURL); err != nil {
+		log.Warnf("Failed to read the %s cache: %v", c.name, err)
+	} else if resp != nil {
+		c.count(func(s *ProviderStats) { s.CacheHits++ })
+		return resp, nil
+	}
+
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		c.wait()
+		c.count(func(s *ProviderStats) { s.Requests++ })
+
+		resp, retryAfter, err := c.fetch(rawURL, maxSize)
+		retry := (err != nil && !errors.Is(err, errPrivateAddress)) ||
+			(err == nil && (resp.Status == http.StatusTooManyRequests || resp.Status >= 500))
+		if !retry || attempt >= c.settings.Retries {
+			if err != nil || resp.Status != http.StatusOK {
+				c.count(func(s *ProviderStats) { s.Failures++ })
+			}
+			if err == nil && resp.Status == http.StatusOK {
+				if err := c.store(rawURL, resp); err != nil {
+					log.Warnf("Failed to cache a %s response: %v", c.name, err)
+				}
+			}
+			return resp, err
+		}
+
+		delay := backoff
+		if retryAfter > delay {
+			delay = retryAfter
+		}
+		if err != nil {
+			log.Warnf("%s request failed, retrying in %v: %v", c.name, delay, err)
+		} else {
+			log.Warnf("%s request returned %d, retrying in %v", c.name, resp.Status, delay)
+		}
+		c.count(func(s *ProviderStats) { s.Retried++ })
+		time.Sleep(delay)
+
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// wait blocks until the rate limit allows another request, reserving its
+// slot so concurrent callers queue up behind each other.
+func (c *apiClient) wait() {
+	if c.settings.RequestsPerSecond == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	now := time.Now()
+	start := c.next
+	if start.Before(now) {
+		start = now
+	}
+	c.next = start.Add(time.Duration(float64(time.Second) / c.settings.RequestsPerSecond))
+	c.mu.Unlock()
+
+	time.Sleep(time.Until(start))
+}
+
+// fetch makes one request, returning how long the service asked to wait
+// before the next one, if it did.
+func (c *apiClient) fetch(rawURL string, maxSize int64) (*apiResponse, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("User-Agent", "media-organizer-mvp")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+		if retryAfter > maxRetryAfter {
+			retryAfter = maxRetryAfter
+		}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, retryAfter, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, retryAfter, fmt.Errorf("response exceeds %d bytes", maxSize)
+	}
+
+	return &apiResponse{
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        body,
+	}, retryAfter, nil
+}
+
+// cached returns the cached response for rawURL, or nil if there is no
+// fresh one.
+func (c *apiClient) cached(rawURL string) (*apiResponse, error) {
+	if c.settings.CacheTTL == 0 {
+		return nil, nil
+	}
+
+	var row struct {
+		ContentType string    `db:"content_type"`
+		Body        []byte    `db:"body"`
+		FetchedAt   time.Time `db:"fetched_at"`
+	}
+	err := c.db.Get(&row, "SELECT content_type, body, fetched_at FROM api_cache WHERE provider = ? AND url = ?", c.name, rawURL)
+	if err == sql.ErrNoRows || (err == nil && time.Since(row.FetchedAt) > c.settings.CacheTTL) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &apiResponse{Status: http.StatusOK, ContentType: row.ContentType, Body: row.Body}, nil
+}
+
+// store caches a successful response, dropping the provider's expired
+// entries while at it.
+func (c *apiClient) store(rawURL string, resp *apiResponse) error {
+	if c.settings.CacheTTL == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if _, err := c.db.Exec("DELETE FROM api_cache WHERE provider = ? AND fetched_at < ?", c.name, now.Add(-c.settings.CacheTTL)); err != nil {
+		return err
+	}
+	_, err := c.db.Exec(
+		`INSERT INTO api_cache (provider, url, content_type, body, fetched_at) VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (provider, url) DO UPDATE SET content_type = excluded.content_type,
+				body = excluded.body, fetched_at = excluded.fetched_at`,
+		c.name, rawURL, resp.ContentType, resp.Body, now,
+	)
+	return err
+}
+
+func (c *apiClient) count(update func(*ProviderStats)) {
+	c.mu.Lock()
+	update(&c.stats)
+	c.mu.Unlock()
+}
+
+// Provider is the state of a provider's client.
+type Provider struct {
+	Name              string  `json:"name"`
+	RequestsPerSecond float64 `json:"requests_per_second"`
+	Retries           int     `json:"retries"`
+	CacheHours        float64 `json:"cache_hours"`
+	// Cached is the number of responses in the cache, including expired
+	// ones not dropped yet.
+	Cached int `json:"cached"`
+	ProviderStats
+}
+
+// getProviders lists the external services with their limits and how much
+// they have been used.
+func (app *App) getProviders(w http.ResponseWriter, r *http.Request) {
+	var counts []struct {
+		Provider string `db:"provider"`
+		Count    int    `db:"count"`
+	}
+	if err := app.DB.Select(&counts, "SELECT provider, COUNT(*) AS count FROM api_cache GROUP BY provider"); err != nil {
+		log.Error("Failed to count cached responses:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cached := map[string]int{}
+	for _, count := range counts {
+		cached[count.Provider] = count.Count
+	}
+
+	providers := []Provider{}
+	for name, c := range app.Providers {
+		c.mu.Lock()
+		stats := c.stats
+		c.mu.Unlock()
+		providers = append(providers, Provider{
+			Name:              name,
+			RequestsPerSecond: c.settings.RequestsPerSecond,
+			Retries:           c.settings.Retries,
+			CacheHours:        c.settings.CacheTTL.Hours(),
+			Cached:            cached[name],
+			ProviderStats:     stats,
+		})
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name < providers[j].Name })
+
+	app.writeJSON(w, r, http.StatusOK, providers)
+}
+
+// clearProviderCache drops the cached responses of a provider, e.g. after
+// the service corrected its data.
+func (app *App) clearProviderCache(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if app.Providers[name] == nil {
+		http.Error(w, "Provider not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := app.DB.Exec("DELETE FROM api_cache WHERE provider = ?", name)
+	if err != nil {
+		log.Error("Failed to clear provider cache:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cleared, _ := res.RowsAffected()
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"cleared": cleared,
+	})
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// extraRAW is the kind of extra of a RAW file shot together with a JPEG,
+// which belongs to the JPEG.
+const extraRAW = "raw"
+
+// TIFF tags that locate the JPEG previews embedded in RAW files.
+const (
+	tagCompression     = 0x0103
+	tagStripOffsets    = 0x0111
+	tagStripByteCounts = 0x0117
+	tagSubIFDs         = 0x014a
+	tagJPEGOffset      = 0x0201
+	tagJPEGLength      = 0x0202
+)
+
+// rawPreview returns the largest JPEG preview embedded in a RAW file, with
+// the file's EXIF data. CR2, NEF, ARW and DNG files are TIFF structures
+// whose directories point to their previews; RAF and CR3 files keep theirs
+// in a header and a box of their own.
+func rawPreview(path string) ([]byte, *exifData, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var candidates [][]byte
+	exif := &exifData{}
+	switch {
+	case bytes.HasPrefix(b, []byte("FUJIFILMCCD-RAW")):
+		// The preview is a complete JPEG with the EXIF data
+		if len(b) < 92 {
+			return nil, nil, errUnknownImageFormat
+		}
+		preview := byteRange(b, binary.BigEndian.Uint32(b[84:]), binary.BigEndian.Uint32(b[88:]))
+		if tiff, err := jpegEXIF(bytes.NewReader(preview)); err == nil {
+			exif, _ = parseEXIF(tiff)
+		}
+		candidates = append(candidates, preview)
+	case len(b) >= 12 && string(b[4:8]) == "ftyp" && string(b[8:12]) == "crx ":
+		candidates = append(candidates, cr3Preview(b))
+		// The CMT1 box holds the first TIFF directory
+		if i := bytes.Index(b, []byte("CMT1")); i >= 0 {
+			exif, _ = parseEXIF(b[i+4:])
+		}
+	case bytes.HasPrefix(b, []byte("II*\x00")), bytes.HasPrefix(b, []byte("MM\x00*")):
+		candidates = tiffPreviews(b)
+		exif, _ = parseEXIF(b)
+	default:
+		return nil, nil, errUnknownImageFormat
+	}
+	if exif == nil {
+		exif = &exifData{}
+	}
+
+	// Lossless JPEG raw data looks like a preview but doesn't decode
+	var preview []byte
+	largest := 0
+	for _, candidate := range candidates {
+		config, err := jpeg.DecodeConfig(bytes.NewReader(candidate))
+		if err == nil && config.Width*config.Height > largest {
+			preview, largest = candidate, config.Width*config.Height
+		}
+	}
+	if preview == nil {
+		return nil, nil, errUnknownImageFormat
+	}
+	return preview, exif, nil
+}
+
+// byteRange returns length bytes of b from offset, or nil if they're out of
+// range.
+func byteRange(b []byte, offset, length uint32) []byte {
+	if length == 0 || uint64(offset)+uint64(length) > uint64(len(b)) {
+		return nil
+	}
+	return b[offset : offset+length]
+}
+
+// tiffPreviews returns the JPEG images the directories of a TIFF based RAW
+// file point to: every directory in the chain from IFD0, and their
+// sub-directories.
+func tiffPreviews(b []byte) [][]byte {
+	// The header ends with the offset of IFD0
+	if len(b) < 8 {
+		return nil
+	}
+	t := &tiffReader{b: b, order: binary.LittleEndian}
+	if b[0] == 'M' {
+		t.order = binary.BigEndian
+	}
+
+	var candidates [][]byte
+	queue := []uint32{t.order.Uint32(b[4:])}
+	seen := map[uint32]bool{}
+	for len(queue) > 0 {
+		offset := queue[0]
+		queue = queue[1:]
+		if offset == 0 || seen[offset] {
+			continue
+		}
+		seen[offset] = true
+
+		entries, err := t.ifd(offset)
+		if err != nil {
+			continue
+		}
+
+		if start, ok := t.long(entries[tagJPEGOffset]); ok {
+			if length, ok := t.long(entries[tagJPEGLength]); ok {
+				candidates = append(candidates, byteRange(b, start, length))
+			}
+		}
+		// Previews stored as a single strip of JPEG data
+		if compression, _ := t.long(entries[tagCompression]); compression == 6 || compression == 7 {
+			start, okStart := t.long(entries[tagStripOffsets])
+			length, okLength := t.long(entries[tagStripByteCounts])
+			if okStart && okLength && entries[tagStripOffsets].count == 1 {
+				candidates = append(candidates, byteRange(b, start, length))
+			}
+		}
+
+		if e, ok := entries[tagSubIFDs]; ok && (e.typ == 4 || e.typ == 13) {
+			for i := 0; i+4 <= len(e.value); i += 4 {
+				queue = append(queue, t.order.Uint32(e.value[i:]))
+			}
+		}
+		// The offset of the next directory follows the entries
+		next := uint64(offset) + 2 + uint64(t.order.Uint16(b[offset:]))*12
+		if next+4 <= uint64(len(b)) {
+			queue = append(queue, t.order.Uint32(b[next:]))
+		}
+	}
+	return candidates
+}
+
+// cr3Preview returns the preview of a CR3 file, the JPEG in its PRVW box.
+func cr3Preview(b []byte) []byte {
+	i := bytes.Index(b, []byte("PRVW"))
+	if i < 4 {
+		return nil
+	}
+	size := binary.BigEndian.Uint32(b[i-4:])
+	box := byteRange(b, uint32(i-4), size)
+	if start := bytes.Index(box, []byte{0xff, 0xd8, 0xff}); start >= 0 {
+		return box[start:]
+	}
+	return nil
+}
+
+// probeRAW stores the dimensions, orientation, capture time and GPS
+// position of a RAW file and renders its thumbnail, all from its embedded
+// preview.
+func (app *App) probeRAW(item *MediaItem) error {
+	preview, exif, err := rawPreview(item.Path)
+	if err != nil {
+		return err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(preview))
+	if err != nil {
+		return err
+	}
+
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if sideways(exif.Orientation) {
+		width, height = height, width
+	}
+	item.Orientation = exif.Orientation
+
+	thumbnail, err := writeThumbnail(item, img)
+	if err != nil {
+		log.Warnf("Failed to render thumbnail of %s: %v", item.Path, err)
+	}
+
+	_, err = app.DB.Exec(
+		`UPDATE media SET width = ?, height = ?, orientation = ?, latitude = ?, longitude = ?,
+			taken_at = COALESCE(taken_at, ?), thumbnail = ?, probed = 1 WHERE id = ?`,
+		width, height, exif.Orientation, exif.Latitude, exif.Longitude, exif.TakenAt, thumbnail, item.ID,
+	)
+	if err != nil {
+		return err
+	}
+	if exif.TakenAt != nil {
+		item.TakenAt = exif.TakenAt
+	}
+
+	item.Width = width
+	item.Height = height
+	item.Latitude = exif.Latitude
+	item.Longitude = exif.Longitude
+	item.Thumbnail = thumbnail
+	item.Probed = true
+
+	if err := app.geocode(item); err != nil {
+		log.Warnf("Failed to geocode %s: %v", item.Path, err)
+	}
+	return nil
+}
+
+// pairRAWs links the RAW files in dirs to the JPEGs shot with them, those
+// with the same name but for the extension, as extras of the JPEG. Locked
+// items and items that are already classified are left alone.
+func (app *App) pairRAWs(dirs map[string]bool) error {
+	for dir := range dirs {
+		prefix := filepath.Clean(dir) + string(os.PathSeparator)
+
+		var items []MediaItem
+		err := app.DB.Select(&items,
+			"SELECT * FROM media WHERE type IN ('image', 'raw') AND substr(path, 1, length(?)) = ? ORDER BY id",
+			prefix, prefix,
+		)
+		if err != nil {
+			return err
+		}
+
+		jpegs := map[string]*MediaItem{}
+		for i := range items {
+			item := &items[i]
+			ext := strings.ToLower(filepath.Ext(item.Path))
+			if filepath.Dir(item.Path) == filepath.Clean(dir) && (ext == ".jpg" || ext == ".jpeg") {
+				jpegs[stem(item.Path)] = item
+			}
+		}
+
+		for _, item := range items {
+			if item.Type != "raw" || item.Extra != "" || item.Locked || filepath.Dir(item.Path) != filepath.Clean(dir) {
+				continue
+			}
+			main := jpegs[stem(item.Path)]
+			if main == nil {
+				continue
+			}
+
+			log.Infof("Paired %s with %s", item.Path, main.Path)
+			_, err := app.DB.Exec("UPDATE media SET extra = ?, parent_id = ? WHERE id = ?", extraRAW, main.ID, item.ID)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// stem returns the filename of path without its extension, lowercased so
+// IMG_0001.CR2 pairs with IMG_0001.jpg.
+func stem(path string) string {
+	name := filepath.Base(path)
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+}
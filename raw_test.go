@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRawPreviewTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"tiff header only", "II*\x00"},
+		{"tiff short offset", "II*\x00\x08"},
+		{"tiff big endian short offset", "MM\x00*\x00\x00\x00"},
+		{"tiff offset past end", "II*\x00\xff\xff\xff\xff"},
+		{"tiff truncated directory", "II*\x00\x08\x00\x00\x00\x05\x00\x11\x01"},
+		{"tiff entry pointing past end", "II*\x00\x08\x00\x00\x00\x01\x00\x4a\x01\x04\x00\xff\x00\x00\x00\xf0\xff\xff\xff"},
+		{"raf short header", "FUJIFILMCCD-RAW 0201"},
+		{"cr3 without boxes", "\x00\x00\x00\x18ftypcrx "},
+		{"cr3 truncated preview box", "\x00\x00\x00\x18ftypcrx \xff\xff\xff\xffPRVW\xff\xd8"},
+		{"cr3 truncated metadata", "\x00\x00\x00\x18ftypcrx CMT1II*\x00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "photo.dng")
+			if err := os.WriteFile(path, []byte(tt.data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := rawPreview(path); err == nil {
+				t.Errorf("rawPreview(%q) succeeded, want an error", tt.data)
+			}
+		})
+	}
+}
+
+func FuzzTiffPreviews(f *testing.F) {
+	f.Add([]byte("II*\x00\x08\x00\x00\x00\x01\x00\x4a\x01\x04\x00\x01\x00\x00\x00\x08\x00\x00\x00"))
+	f.Add([]byte("MM\x00*\x00\x00\x00\x08\x00\x00"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tiffPreviews(b)
+		parseEXIF(b)
+		cr3Preview(b)
+	})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const actionRelinkMedia = "relink_media"
+
+// relinkSampleSize is the number of matches listed in a relink preview.
+const relinkSampleSize = 20
+
+// Ways an exported record is matched to a file, tried in this order. Each
+// needs a single candidate; more than one makes the record ambiguous.
+const (
+	relinkByPath         = "path"
+	relinkByChecksum     = "checksum"
+	relinkByOshash       = "oshash"
+	relinkByFilenameSize = "filename_size"
+)
+
+// RelinkMatch is a record of an export matched to a file. ID is zero for
+// files found under the searched root that aren't in the library yet;
+// they are imported when the relink is made.
+type RelinkMatch struct {
+	OldPath string `json:"old_path"`
+	ID      int    `json:"id"`
+	Path    string `json:"path"`
+	By      string `json:"by"`
+}
+
+// relinkEntry is a match with the metadata of its record, which a relink
+// restores.
+type relinkEntry struct {
+	RelinkMatch
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Year        int        `json:"year"`
+	TakenAt     *time.Time `json:"taken_at"`
+	Artist      string     `json:"artist"`
+	Album       string     `json:"album"`
+	Locked      bool       `json:"locked"`
+}
+
+// relinkFile is a file under the searched root.
+type relinkFile struct {
+	path   string
+	size   int64
+	oshash string
+}
+
+// relinkMatcher finds the files exported records belong to: items of the
+// library, and optionally files under a root that the library doesn't
+// have yet, e.g. a library moved to another disk.
+type relinkMatcher struct {
+	app    *App
+	files  []*relinkFile
+	bySize map[int64][]*relinkFile
+	// claimed are the targets already matched, by item ID or path, so two
+	// records never relink to the same file.
+	claimed map[interface{}]bool
+}
+
+// newRelinkMatcher indexes the supported files under root that aren't in
+// the library. An empty root only matches library items.
+func (app *App) newRelinkMatcher(root string) (*relinkMatcher, error) {
+	m := &relinkMatcher{app: app, bySize: map[int64][]*relinkFile{}, claimed: map[interface{}]bool{}}
+	if root == "" {
+		return m, nil
+	}
+
+	var paths []string
+	if err := app.DB.Select(&paths, "SELECT path FROM media UNION ALL SELECT path FROM media_files"); err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, path := range paths {
+		known[path] = true
+	}
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			log.Warnf("Relink: skipping %s: %v", path, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() || known[path] {
+			return nil
+		}
+		if _, ok := supportedExtensions[strings.ToLower(filepath.Ext(path))]; !ok {
+			return nil
+		}
+		f := &relinkFile{path: path, size: info.Size()}
+		m.files = append(m.files, f)
+		m.bySize[f.size] = append(m.bySize[f.size], f)
+		return nil
+	})
+	return m, err
+}
+
+// match finds the file of an exported record. It returns nil if there is
+// none, and ambiguous if a way of matching found several candidates.
+func (m *relinkMatcher) match(record *MediaItem) (match *RelinkMatch, ambiguous bool, err error) {
+	lookups := []struct {
+		by    string
+		query string
+		arg   interface{}
+	}{
+		{relinkByPath, "path = ?", record.Path},
+		{relinkByChecksum, "checksum = ?", record.Checksum},
+		{relinkByOshash, "oshash = ?", record.Oshash},
+	}
+
+	for _, lookup := range lookups {
+		if lookup.arg == "" {
+			continue
+		}
+		// A record whose file is gone is what needs relinking, even if
+		// the library still has an item for it
+		if lookup.by == relinkByPath {
+			if _, err := os.Stat(record.Path); err != nil {
+				continue
+			}
+		}
+		match, ambiguous, err := m.matchItem(lookup.by, "SELECT * FROM media WHERE "+lookup.query+" LIMIT 2", lookup.arg)
+		if match != nil || ambiguous || err != nil {
+			return match, ambiguous, err
+		}
+
+		// A file's oshash is computed only if its size fits
+		if lookup.by == relinkByOshash {
+			var found []*relinkFile
+			for _, f := range m.bySize[record.Size] {
+				if f.oshash == "" {
+					if f.oshash, err = fileOshash(f.path); err != nil {
+						log.Warnf("Relink: failed to hash %s: %v", f.path, err)
+						continue
+					}
+				}
+				if f.oshash == record.Oshash {
+					found = append(found, f)
+				}
+			}
+			if match, ambiguous := m.matchFile(relinkByOshash, found); match != nil || ambiguous {
+				return match, ambiguous, nil
+			}
+		}
+	}
+
+	// Fall back to the name and size, which a moved file keeps
+	name := filepath.Base(record.Path)
+	match, ambiguous, err = m.matchItem(relinkByFilenameSize,
+		"SELECT * FROM media WHERE filename = ? AND size = ? LIMIT 2", name, record.Size)
+	if match != nil || ambiguous || err != nil {
+		return match, ambiguous, err
+	}
+	var found []*relinkFile
+	for _, f := range m.bySize[record.Size] {
+		if strings.EqualFold(filepath.Base(f.path), name) {
+			found = append(found, f)
+		}
+	}
+	match, ambiguous = m.matchFile(relinkByFilenameSize, found)
+	return match, ambiguous, nil
+}
+
+// matchItem looks a record up in the library.
+func (m *relinkMatcher) matchItem(by, query string, args ...interface{}) (*RelinkMatch, bool, error) {
+	var items []MediaItem
+	if err := m.app.DB.Select(&items, query, args...); err != nil {
+		return nil, false, err
+	}
+	switch {
+	case len(items) == 0:
+		return nil, false, nil
+	case len(items) > 1 || m.claimed[items[0].ID]:
+		return nil, true, nil
+	}
+	m.claimed[items[0].ID] = true
+	return &RelinkMatch{ID: items[0].ID, Path: items[0].Path, By: by}, false, nil
+}
+
+// matchFile picks the one file found under the root.
+func (m *relinkMatcher) matchFile(by string, found []*relinkFile) (*RelinkMatch, bool) {
+	switch {
+	case len(found) == 0:
+		return nil, false
+	case len(found) > 1 || m.claimed[found[0].path]:
+		return nil, true
+	}
+	m.claimed[found[0].path] = true
+	return &RelinkMatch{Path: found[0].path, By: by}, false
+}
+
+// readExport reads the records of an export, gzip compressed or not.
+// Lines that aren't media items are returned as errors.
+func readExport(r io.Reader) ([]MediaItem, []ImportError, error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+
+	var records []MediaItem
+	errors := []ImportError{}
+	sc := bufio.NewScanner(br)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		if strings.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		var item MediaItem
+		if err := json.Unmarshal(sc.Bytes(), &item); err != nil {
+			errors = append(errors, ImportError{Row: line, Error: err.Error()})
+			continue
+		}
+		if item.Path == "" {
+			errors = append(errors, ImportError{Row: line, Error: "record has no path"})
+			continue
+		}
+		records = append(records, item)
+	}
+	return records, errors, sc.Err()
+}
+
+// previewRelink matches the records of an export, as /api/media/export
+// writes it, to the files they now belong to, and returns a token that
+// restores their metadata. ?root= also searches a directory for files the
+// library doesn't have yet.
+func (app *App) previewRelink(w http.ResponseWriter, r *http.Request) {
+	root := r.URL.Query().Get("root")
+	if root != "" {
+		if !filepath.IsAbs(root) {
+			http.Error(w, "root must be absolute", http.StatusBadRequest)
+			return
+		}
+		root = filepath.Clean(root)
+	}
+
+	records, errors, err := readExport(http.MaxBytesReader(w, r.Body, maxImportFileSize))
+	if err != nil {
+		http.Error(w, "Invalid export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	m, err := app.newRelinkMatcher(root)
+	if os.IsNotExist(err) {
+		http.Error(w, "Directory not found: "+root, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to index files for relinking:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var entries []relinkEntry
+	matches := []RelinkMatch{}
+	by := map[string]int{}
+	unmatched := []string{}
+	ambiguous := 0
+	for i := range records {
+		record := &records[i]
+		match, isAmbiguous, err := m.match(record)
+		if err != nil {
+			log.Error("Failed to match exported records:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if isAmbiguous {
+			ambiguous++
+			continue
+		}
+		if match == nil {
+			unmatched = append(unmatched, record.Path)
+			continue
+		}
+
+		match.OldPath = record.Path
+		by[match.By]++
+		matches = append(matches, *match)
+		entries = append(entries, relinkEntry{
+			RelinkMatch: *match,
+			Title:       record.Title,
+			Description: record.Description,
+			Year:        record.Year,
+			TakenAt:     record.TakenAt,
+			Artist:      record.Artist,
+			Album:       record.Album,
+			Locked:      record.Locked,
+		})
+	}
+
+	sample := matches
+	if len(sample) > relinkSampleSize {
+		sample = sample[:relinkSampleSize]
+	}
+
+	preview := map[string]interface{}{
+		"records":   len(records),
+		"matched":   len(matches),
+		"by":        by,
+		"ambiguous": ambiguous,
+		"unmatched": unmatched,
+		"errors":    errors,
+		"sample":    sample,
+	}
+
+	if len(entries) > 0 {
+		token, expires, err := app.issueConfirmation(actionRelinkMedia, entries)
+		if err != nil {
+			log.Error("Failed to issue confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		preview["token"] = token
+		preview["expires_at"] = expires
+	}
+
+	app.writeJSON(w, r, http.StatusOK, preview)
+}
+
+// relinkMedia makes a previewed relink: files found under the root are
+// imported, the records' metadata is restored onto the items they matched
+// and their old paths are kept as aliases. Locked items are left alone.
+func (app *App) relinkMedia(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "token is required; request a preview first", http.StatusBadRequest)
+		return
+	}
+
+	var entries []relinkEntry
+	err := app.redeemConfirmation(req.Token, actionRelinkMedia, &entries)
+	if err == errInvalidConfirmation {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to redeem confirmation token:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	updated, imported, locked, failed := 0, 0, 0, 0
+	for _, entry := range entries {
+		restored, err := app.relink(&entry)
+		if err != nil {
+			log.Warnf("Failed to relink %s to %s: %v", entry.OldPath, entry.Path, err)
+			failed++
+			continue
+		}
+		if entry.ID == 0 {
+			imported++
+		}
+		if !restored {
+			locked++
+			continue
+		}
+		updated++
+	}
+
+	log.Infof("Relinked %d exported records", updated)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"updated":  updated,
+		"imported": imported,
+		"locked":   locked,
+		"failed":   failed,
+	})
+}
+
+// relink restores the metadata of an exported record onto the item it
+// matched, importing the file first if it isn't in the library. Locked
+// items only get the alias, and restored is false for them.
+func (app *App) relink(entry *relinkEntry) (restored bool, err error) {
+	var item *MediaItem
+	if entry.ID == 0 {
+		if item, _, err = app.importFile(entry.Path); err != nil {
+			return false, err
+		}
+	} else {
+		item = &MediaItem{}
+		if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", entry.ID); err != nil {
+			return false, err
+		}
+	}
+
+	if entry.OldPath != item.Path {
+		if err := app.addAlias(item.ID, filepath.Base(entry.OldPath), entry.OldPath); err != nil {
+			return false, err
+		}
+	}
+	if item.Locked {
+		return false, nil
+	}
+
+	// Empty values in the record don't clear what the item has since
+	// gained
+	columns := map[string]interface{}{}
+	for column, v := range map[string]string{
+		"title":       entry.Title,
+		"description": entry.Description,
+		"artist":      entry.Artist,
+		"album":       entry.Album,
+	} {
+		if v != "" {
+			columns[column] = v
+		}
+	}
+	if entry.Year != 0 {
+		columns["year"] = entry.Year
+	}
+	if entry.TakenAt != nil {
+		columns["taken_at"] = entry.TakenAt
+	}
+	if entry.Locked {
+		columns["locked"] = true
+	}
+	for column, v := range columns {
+		if _, err := app.DB.Exec("UPDATE media SET "+column+" = ? WHERE id = ?", v, item.ID); err != nil {
+			return false, err
+		}
+	}
+
+	if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err != nil {
+		return false, err
+	}
+	app.writeBack(item)
+	return true, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const actionRename = "rename"
+
+// renameRequest renames files in place, keeping their directory and
+// extension. The name is changed by a find-and-replace, with Find a literal
+// string unless Regex is set, in which case Replace can refer to its groups
+// as $1 or ${name}; or it is made from Template, with the placeholders of
+// organize templates.
+type renameRequest struct {
+	Find       string `json:"find"`
+	Replace    string `json:"replace"`
+	Regex      bool   `json:"regex"`
+	IgnoreCase bool   `json:"ignore_case"`
+	Template   string `json:"template"`
+}
+
+// compile validates the request and returns its pattern, which is nil for
+// a template.
+func (req *renameRequest) compile() (*regexp.Regexp, error) {
+	switch {
+	case req.Find != "" && req.Template != "":
+		return nil, fmt.Errorf("give either find or a template, not both")
+	case req.Template != "":
+		for _, m := range organizePlaceholder.FindAllStringSubmatch(req.Template, -1) {
+			if _, ok := organizeFields[m[1]]; !ok {
+				return nil, fmt.Errorf("unknown placeholder {%s}", m[1])
+			}
+		}
+		if strings.ContainsAny(req.Template, `/\`) {
+			return nil, fmt.Errorf("template is a filename, without a directory")
+		}
+		return nil, nil
+	case req.Find == "":
+		return nil, fmt.Errorf("find or template is required")
+	}
+
+	pattern := req.Find
+	if !req.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if req.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	return re, nil
+}
+
+// rename returns the new path of an item.
+func (req *renameRequest) rename(re *regexp.Regexp, item *MediaItem, tags []string) (string, error) {
+	dir, filename := filepath.Split(item.Path)
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext)
+
+	switch {
+	case re == nil:
+		name = organizePlaceholder.ReplaceAllStringFunc(req.Template, func(m string) string {
+			return organizeElement(organizeFields[m[1:len(m)-1]](item, tags))
+		})
+	case req.Regex:
+		name = re.ReplaceAllString(name, req.Replace)
+	default:
+		name = re.ReplaceAllLiteralString(name, req.Replace)
+	}
+	name = strings.TrimSpace(name)
+
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "", fmt.Errorf("the new name is empty")
+	case strings.ContainsAny(name, `/\`):
+		return "", fmt.Errorf("the new name %q contains a path separator", name)
+	}
+	return filepath.Join(dir, name+ext), nil
+}
+
+// previewRename works out the new names of the selected items' files and
+// returns the planned renames with the token needed to make them. Nothing
+// is renamed by this request.
+func (app *App) previewRename(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		renameRequest
+		IDs    []int        `json:"ids"`
+		Filter *MediaFilter `json:"filter"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// An empty filter matches everything, so it has to be given explicitly
+	if len(req.IDs) == 0 && req.Filter == nil {
+		http.Error(w, "ids or filter is required", http.StatusBadRequest)
+		return
+	}
+	re, err := req.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := app.selectMedia(req.IDs, req.Filter)
+	if err != nil {
+		log.Error("Failed to select media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tags := map[int][]string{}
+	if strings.Contains(req.Template, "{tag}") {
+		if tags, err = app.itemTagNames(items); err != nil {
+			log.Error("Failed to plan renames:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	moves, err := app.planDestinations(items, func(item *MediaItem) (string, error) {
+		return req.rename(re, item, tags[item.ID])
+	})
+	if err != nil {
+		log.Error("Failed to plan renames:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeMovePreview(w, r, actionRename, len(items), moves)
+}
+
+// renameMedia makes the renames of a previewed rename, as one move batch:
+// if any file can't be renamed, those already renamed are renamed back.
+func (app *App) renameMedia(w http.ResponseWriter, r *http.Request) {
+	app.confirmMoves(w, r, actionRename)
+}
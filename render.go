@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Field casing and time formats understood by the API. Structs are tagged
+// with snake_case names and time.Time values encode as RFC 3339, which is
+// what clients get unless they ask for something else.
+const (
+	caseSnake = "snake"
+	caseCamel = "camel"
+
+	timeRFC3339 = "rfc3339"
+	timeUnix    = "unix"
+)
+
+// jsonProfile describes the shape of JSON responses.
+type jsonProfile struct {
+	Case string
+	Time string
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// responseProfile returns the configured JSON profile, overridden by any
+// tokens in the request's Accept-Profile header, e.g.
+// "Accept-Profile: camel, unix".
+func (app *App) responseProfile(r *http.Request) jsonProfile {
+	profile := jsonProfile{
+		Case: app.Config.API.FieldCase,
+		Time: app.Config.API.TimeFormat,
+	}
+
+	for _, token := range strings.Split(r.Header.Get("Accept-Profile"), ",") {
+		switch token = strings.ToLower(strings.TrimSpace(token)); token {
+		case caseSnake, caseCamel:
+			profile.Case = token
+		case timeRFC3339, timeUnix:
+			profile.Time = token
+		}
+	}
+
+	return profile
+}
+
+// writeJSON encodes v as the response body in the JSON profile requested by
+// the client.
+func (app *App) writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	profile := app.responseProfile(r)
+	if profile.Case == caseCamel || profile.Time == timeUnix {
+		v = profile.shape(reflect.ValueOf(v))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+// shape converts v into plain maps, slices and scalars, renaming keys and
+// formatting times according to the profile. It follows encoding/json's
+// rules for struct tags so the default profile output is unchanged.
+func (p jsonProfile) shape(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+
+	if v.Type() == timeType {
+		t := v.Interface().(time.Time)
+		if p.Time == timeUnix {
+			return t.Unix()
+		}
+		return t.Format(time.RFC3339Nano)
+	}
+
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.Type().Implements(marshalerType) {
+		return v.Interface()
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return p.shape(v.Elem())
+
+	case reflect.Struct:
+		out := map[string]interface{}{}
+		p.shapeFields(v, out)
+		return out
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		out := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			out[p.key(iter.Key().String())] = p.shape(iter.Value())
+		}
+		return out
+
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+
+	case reflect.Array:
+		out := make([]interface{}, v.Len())
+		for i := range out {
+			out[i] = p.shape(v.Index(i))
+		}
+		return out
+	}
+
+	return v.Interface()
+}
+
+// shapeFields adds the fields of struct v to out.
+func (p jsonProfile) shapeFields(v reflect.Value, out map[string]interface{}) {
+	jsonFields(v, func(name string, fv reflect.Value) {
+		out[p.key(name)] = p.shape(fv)
+	})
+}
+
+// jsonFields calls fn with the name and value of every field of struct v
+// that encoding/json would encode, flattening untagged embedded structs and
+// honouring "-" and omitempty.
+func jsonFields(v reflect.Value, fn func(name string, fv reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+
+		if field.Anonymous && name == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				jsonFields(fv, fn)
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+		if strings.Contains(opts, "omitempty") && isEmptyValue(fv) {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		fn(name, fv)
+	}
+}
+
+// project returns the fields of struct v for which keep returns true, keyed
+// by their JSON names. The values are left as they are so writeJSON can
+// still shape them.
+func project(v interface{}, keep func(name string) bool) map[string]interface{} {
+	out := map[string]interface{}{}
+
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	jsonFields(rv, func(name string, fv reflect.Value) {
+		if keep(name) {
+			out[name] = fv.Interface()
+		}
+	})
+
+	return out
+}
+
+// isEmptyValue reports whether encoding/json would treat v as empty for the
+// purposes of omitempty.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Ptr:
+		return v.IsZero()
+	}
+	return false
+}
+
+// key returns a snake_case field name in the profile's casing.
+func (p jsonProfile) key(name string) string {
+	if p.Case != caseCamel || !strings.Contains(name, "_") {
+		return name
+	}
+
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		runes := []rune(parts[i])
+		runes[0] = unicode.ToUpper(runes[0])
+		parts[i] = string(runes)
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// replaceSampleSize is the number of changes listed in a replace preview.
+const replaceSampleSize = 20
+
+const actionReplaceMetadata = "replace_metadata"
+
+// replaceFields are the metadata fields find-and-replace works on.
+var replaceFields = map[string]bool{
+	"title":       true,
+	"description": true,
+	"tags":        true,
+}
+
+// replaceRequest describes a find-and-replace. Find is a literal string
+// unless Regex is set, in which case Replace can refer to its groups as
+// $1 or ${name}.
+type replaceRequest struct {
+	Fields     []string `json:"fields"`
+	Find       string   `json:"find"`
+	Replace    string   `json:"replace"`
+	Regex      bool     `json:"regex"`
+	IgnoreCase bool     `json:"ignore_case"`
+}
+
+// replacePlan is what a replace confirmation token executes: the request
+// and the items it was previewed on.
+type replacePlan struct {
+	replaceRequest
+	IDs []int `json:"ids"`
+}
+
+// MetadataChange is one value a find-and-replace changes. For tags, an
+// empty After removes the tag from the item.
+type MetadataChange struct {
+	MediaID int    `json:"media_id"`
+	Field   string `json:"field"`
+	Before  string `json:"before"`
+	After   string `json:"after"`
+}
+
+// compile validates the request and returns its pattern.
+func (req *replaceRequest) compile() (*regexp.Regexp, error) {
+	if len(req.Fields) == 0 {
+		return nil, fmt.Errorf("fields is required: title, description or tags")
+	}
+	for _, field := range req.Fields {
+		if !replaceFields[field] {
+			return nil, fmt.Errorf("unknown field %q: use title, description or tags", field)
+		}
+	}
+	if req.Find == "" {
+		return nil, fmt.Errorf("find is required")
+	}
+
+	pattern := req.Find
+	if !req.Regex {
+		pattern = regexp.QuoteMeta(pattern)
+	}
+	if req.IgnoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %v", err)
+	}
+	return re, nil
+}
+
+// replace applies the request to a value.
+func (req *replaceRequest) replace(re *regexp.Regexp, s string) string {
+	if req.Regex {
+		return re.ReplaceAllString(s, req.Replace)
+	}
+	return re.ReplaceAllLiteralString(s, req.Replace)
+}
+
+// plannedChanges works out the changes the request makes to the items.
+// Replacements that would leave a tag with an invalid name are an error.
+func (app *App) plannedChanges(req *replaceRequest, re *regexp.Regexp, items []MediaItem) ([]MetadataChange, error) {
+	tags := map[int][]string{}
+	for _, field := range req.Fields {
+		if field != "tags" || len(items) == 0 {
+			continue
+		}
+
+		ids := make([]int, len(items))
+		for i, item := range items {
+			ids[i] = item.ID
+		}
+		query, args, err := sqlx.In(
+			"SELECT mt.media_id, t.name FROM media_tags mt JOIN tags t ON t.id = mt.tag_id WHERE mt.media_id IN (?) ORDER BY t.name",
+			ids,
+		)
+		if err != nil {
+			return nil, err
+		}
+		var rows []struct {
+			MediaID int    `db:"media_id"`
+			Name    string `db:"name"`
+		}
+		if err := app.DB.Select(&rows, app.DB.Rebind(query), args...); err != nil {
+			return nil, err
+		}
+		for _, row := range rows {
+			tags[row.MediaID] = append(tags[row.MediaID], row.Name)
+		}
+	}
+
+	changes := []MetadataChange{}
+	for _, item := range items {
+		for _, field := range req.Fields {
+			var values []string
+			switch field {
+			case "title":
+				values = []string{item.Title}
+			case "description":
+				values = []string{item.Description}
+			case "tags":
+				values = tags[item.ID]
+			}
+
+			for _, before := range values {
+				after := req.replace(re, before)
+				if after == before {
+					continue
+				}
+				if field == "tags" && after != "" {
+					name, err := tagName(after)
+					if err != nil {
+						return nil, fmt.Errorf("item %d: %v", item.ID, err)
+					}
+					after = name
+				}
+				changes = append(changes, MetadataChange{MediaID: item.ID, Field: field, Before: before, After: after})
+			}
+		}
+	}
+	return changes, nil
+}
+
+// previewReplace works out what a find-and-replace would change and
+// returns a sample of the changes with the token needed to make them.
+// Nothing is changed by this request.
+func (app *App) previewReplace(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		replaceRequest
+		IDs    []int        `json:"ids"`
+		Filter *MediaFilter `json:"filter"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// An empty filter matches everything, so it has to be given explicitly
+	if len(req.IDs) == 0 && req.Filter == nil {
+		http.Error(w, "ids or filter is required", http.StatusBadRequest)
+		return
+	}
+	re, err := req.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items, err := app.selectMedia(req.IDs, req.Filter)
+	if err != nil {
+		log.Error("Failed to select media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Locked items are never changed in bulk, only reported
+	var unlocked []MediaItem
+	locked := 0
+	for _, item := range items {
+		if item.Locked {
+			locked++
+			continue
+		}
+		unlocked = append(unlocked, item)
+	}
+
+	changes, err := app.plannedChanges(&req.replaceRequest, re, unlocked)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ids []int
+	for _, change := range changes {
+		if len(ids) == 0 || ids[len(ids)-1] != change.MediaID {
+			ids = append(ids, change.MediaID)
+		}
+	}
+
+	sample := changes
+	if len(sample) > replaceSampleSize {
+		sample = sample[:replaceSampleSize]
+	}
+
+	preview := map[string]interface{}{
+		"count":   len(ids),
+		"changes": len(changes),
+		"locked":  locked,
+		"sample":  sample,
+	}
+
+	// The token is bound to the previewed IDs, so items matching the
+	// filter by the time it is used are not changed unseen
+	if len(ids) > 0 {
+		token, expires, err := app.issueConfirmation(actionReplaceMetadata, replacePlan{req.replaceRequest, ids})
+		if err != nil {
+			log.Error("Failed to issue confirmation token:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		preview["token"] = token
+		preview["expires_at"] = expires
+	}
+
+	app.writeJSON(w, r, http.StatusOK, preview)
+}
+
+// replaceMetadata makes the changes of a previewed find-and-replace. The
+// replacement is applied to the items' current values, and the changed
+// items are written back to their files if their library asks for it.
+func (app *App) replaceMetadata(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Token string `json:"token"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		http.Error(w, "token is required; request a preview first", http.StatusBadRequest)
+		return
+	}
+
+	var plan replacePlan
+	err := app.redeemConfirmation(req.Token, actionReplaceMetadata, &plan)
+	if err == errInvalidConfirmation {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to redeem confirmation token:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	re, err := plan.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := app.selectMedia(plan.IDs, nil)
+	if err != nil {
+		log.Error("Failed to select media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Items locked since the preview are left alone
+	var unlocked []MediaItem
+	for _, item := range items {
+		if !item.Locked {
+			unlocked = append(unlocked, item)
+		}
+	}
+	changes, err := app.plannedChanges(&plan.replaceRequest, re, unlocked)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.applyChanges(changes); err != nil {
+		log.Error("Failed to replace metadata:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	changed := map[int]bool{}
+	for _, change := range changes {
+		changed[change.MediaID] = true
+	}
+	for i := range unlocked {
+		item := &unlocked[i]
+		if !changed[item.ID] {
+			continue
+		}
+		if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err == nil {
+			app.writeBack(item)
+		}
+	}
+
+	log.Infof("Replaced metadata of %d media items", len(changed))
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"count":   len(changed),
+		"changes": len(changes),
+	})
+}
+
+// applyChanges makes the changes in one transaction. Tags are replaced
+// through their aliases, like tags added by users.
+func (app *App) applyChanges(changes []MetadataChange) error {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, change := range changes {
+		switch change.Field {
+		case "title", "description":
+			_, err = tx.Exec("UPDATE media SET "+change.Field+" = ? WHERE id = ?", change.After, change.MediaID)
+		case "tags":
+			_, err = tx.Exec(
+				"DELETE FROM media_tags WHERE media_id = ? AND tag_id = (SELECT id FROM tags WHERE name = ?)",
+				change.MediaID, change.Before,
+			)
+			if err == nil && change.After != "" {
+				err = tagMedia(tx, change.MediaID, change.After)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReviewLimit = 50
+	maxReviewLimit     = 500
+)
+
+// getReviewQueue serves the next batch of items that haven't been reviewed,
+// oldest first, so a big import can be worked through a batch at a time:
+// tag, title or delete the items, mark them organized and fetch the next
+// batch. The media filters narrow the queue, e.g. to untagged videos.
+// Extras are listed with their item rather than on their own unless the
+// filter asks for them.
+func (app *App) getReviewQueue(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultReviewLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < maxReviewLimit {
+			limit = n
+		} else {
+			limit = maxReviewLimit
+		}
+	}
+
+	view, err := parseMediaView(r.URL.Query(), false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	organized := false
+	filter.Organized = &organized
+	if filter.Extra == nil {
+		extra := false
+		filter.Extra = &extra
+	}
+	filter.profile = profileOf(r)
+	view.profile = filter.profile
+	where, args := filter.where()
+
+	var remaining int
+	if err := app.DB.Get(&remaining, "SELECT COUNT(*) FROM media"+where, args...); err != nil {
+		log.Error("Failed to count unreviewed media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var items []MediaItem
+	err = app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY created_at, id LIMIT ?", append(args, limit)...)
+	if err != nil {
+		log.Error("Failed to fetch unreviewed media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := app.presentMedia(items, view)
+	if err != nil {
+		log.Error("Failed to fetch media details:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"remaining": remaining,
+		"items":     out,
+	})
+}
+
+// setOrganized marks an item as reviewed, or returns it to the review
+// queue. Locked items can be marked too, since it doesn't change them.
+func (app *App) setOrganized(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		Organized *bool `json:"organized"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Organized == nil {
+		http.Error(w, "organized is required", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := app.DB.Exec("UPDATE media SET organized = ? WHERE id = ?", *req.Organized, item.ID); err != nil {
+		log.Error("Failed to update organized state:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	item.Organized = *req.Organized
+
+	app.writeJSON(w, r, http.StatusOK, item)
+}
@@ -0,0 +1,891 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// scanBatchSize is the number of new items inserted per transaction.
+// Committing every row individually makes large scans spend most of their
+// time syncing SQLite's journal.
+const scanBatchSize = 500
+
+// scanCheckpointInterval is the number of files visited between checkpoints
+// when no batch fills up in between, e.g. while rescanning a library that
+// has nothing new.
+const scanCheckpointInterval = 1000
+
+// scanProgressInterval is the minimum time between progress events of a
+// scan.
+const scanProgressInterval = 250 * time.Millisecond
+
+// ScanOptions controls which files a scan imports. They are stored with the
+// scan so an interrupted scan resumes with the same settings.
+type ScanOptions struct {
+	MinSize           int64   `json:"min_size"`
+	MaxSize           int64   `json:"max_size"`
+	SkipHidden        bool    `json:"skip_hidden"`
+	NoMediaMarker     string  `json:"nomedia_marker"`
+	MaxFilesPerSecond float64 `json:"max_files_per_second"`
+	IdlePriority      bool    `json:"idle_priority"`
+}
+
+// ScanRecord is the history entry of a single scan.
+type ScanRecord struct {
+	ID         int        `db:"id" json:"id"`
+	Path       string     `db:"path" json:"path"`
+	Status     string     `db:"status" json:"status"`
+	StartedAt  time.Time  `db:"started_at" json:"started_at"`
+	FinishedAt *time.Time `db:"finished_at" json:"finished_at"`
+	Added      int        `db:"added" json:"added"`
+	Skipped    int        `db:"skipped" json:"skipped"`
+	Errors     int        `db:"errors" json:"errors"`
+	Error      string     `db:"error" json:"error"`
+	Options    string     `db:"options" json:"-"`
+	// Moved counts the items whose file was found at a new path and
+	// followed there, instead of being added again.
+	Moved int `db:"moved" json:"moved"`
+	// Checkpoint is the last path whose results are committed. Resuming
+	// the scan skips everything the walk visits before it.
+	Checkpoint string `db:"checkpoint" json:"checkpoint"`
+	// Directories is the JSON encoded []ScanDirSummary.
+	Directories string `db:"directories" json:"-"`
+}
+
+// ScanError is a file or directory a scan couldn't handle.
+type ScanError struct {
+	ID        int       `db:"id" json:"id"`
+	ScanID    int       `db:"scan_id" json:"scan_id"`
+	Path      string    `db:"path" json:"path"`
+	Error     string    `db:"error" json:"error"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// ScanDirSummary counts what a scan did in one top-level directory below its
+// root. Files directly in the root are counted under ".".
+type ScanDirSummary struct {
+	Directory string `json:"directory"`
+	Added     int    `json:"added"`
+	Moved     int    `json:"moved"`
+	Skipped   int    `json:"skipped"`
+	Errors    int    `json:"errors"`
+}
+
+// ScanProgress is the data of scan_progress events.
+type ScanProgress struct {
+	ScanID int64 `json:"scan_id"`
+	// Root is the scanned directory and Path the file currently visited.
+	Root    string `json:"root"`
+	Path    string `json:"path"`
+	Visited int    `json:"visited"`
+	Added   int    `json:"added"`
+	Skipped int    `json:"skipped"`
+	Errors  int    `json:"errors"`
+}
+
+// Scan event types.
+const (
+	eventScanStarted  = "scan_started"
+	eventScanProgress = "scan_progress"
+	eventScanFinished = "scan_finished"
+)
+
+const (
+	scanRunning     = "running"
+	scanCompleted   = "completed"
+	scanFailed      = "failed"
+	scanInterrupted = "interrupted"
+)
+
+// errScanNotInterrupted is returned when resuming a scan that isn't
+// interrupted.
+var errScanNotInterrupted = errors.New("scan is not interrupted")
+
+type scanner struct {
+	app     *App
+	id      int64
+	root    string
+	options ScanOptions
+	pending []MediaItem
+
+	added   int
+	moved   int
+	skipped int
+	errors  int
+	visited int
+	dirs    map[string]*ScanDirSummary
+
+	// throttle limits the rate files and directories are visited at.
+	throttle *rateLimiter
+
+	// lastProgress is when the last progress event was published.
+	lastProgress time.Time
+
+	// resumeFrom is the checkpoint of the interrupted scan being resumed.
+	// It is cleared once the walk gets past it.
+	resumeFrom string
+
+	// known holds every path already in the library, so the walk never
+	// has to ask the database whether a file is new.
+	known map[string]struct{}
+	// incomplete holds the known paths without file times or oshash,
+	// which are filled in as the walk comes across them.
+	incomplete map[string]struct{}
+	completed  []MediaItem
+
+	// followed are the items already followed to a new path by this
+	// scan, so two copies of a moved file don't both claim it.
+	followed map[int]bool
+
+	// videoDirs are the directories videos were added to, whose extras
+	// are classified once the walk is done.
+	videoDirs map[string]bool
+	// photoDirs are the directories photos and RAW files were added to,
+	// whose RAW files are paired with their JPEGs once the walk is done.
+	photoDirs map[string]bool
+
+	// ignores holds the exclusions in effect at the current point of the
+	// walk.
+	ignores ignoreStack
+}
+
+// scan walks root and adds every supported media file that isn't in the
+// library yet. The scan is recorded in the scan history, and the final
+// record is returned along with any error that ended it early.
+func (app *App) scan(root string, options ScanOptions) (*ScanRecord, error) {
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := app.DB.Exec(
+		"INSERT INTO scans (path, status, options) VALUES (?, ?, ?)",
+		root, scanRunning, string(encoded),
+	)
+	if err != nil {
+		return nil, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+
+	return app.runScan(&scanner{
+		app:      app,
+		id:       id,
+		root:     root,
+		options:  options,
+		dirs:     make(map[string]*ScanDirSummary),
+		throttle: newRateLimiter(options.MaxFilesPerSecond),
+	})
+}
+
+// resume continues an interrupted scan from its checkpoint, with the options
+// it was started with.
+func (app *App) resume(record *ScanRecord) (*ScanRecord, error) {
+	// Scans from before options were stored fall back to the defaults
+	options := app.Config.Scan.options()
+	if err := json.Unmarshal([]byte(record.Options), &options); err != nil {
+		return nil, fmt.Errorf("invalid scan options: %w", err)
+	}
+
+	var dirs []ScanDirSummary
+	if err := json.Unmarshal([]byte(record.Directories), &dirs); err != nil {
+		return nil, fmt.Errorf("invalid scan directories: %w", err)
+	}
+
+	// Claim the scan, so two requests can't resume it at the same time
+	res, err := app.DB.Exec(
+		"UPDATE scans SET status = ?, finished_at = NULL, error = '' WHERE id = ? AND status = ?",
+		scanRunning, record.ID, scanInterrupted,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 0 {
+		return nil, errScanNotInterrupted
+	}
+
+	s := &scanner{
+		app:        app,
+		id:         int64(record.ID),
+		root:       record.Path,
+		options:    options,
+		added:      record.Added,
+		moved:      record.Moved,
+		skipped:    record.Skipped,
+		errors:     record.Errors,
+		dirs:       make(map[string]*ScanDirSummary, len(dirs)),
+		throttle:   newRateLimiter(options.MaxFilesPerSecond),
+		resumeFrom: record.Checkpoint,
+	}
+	for i := range dirs {
+		s.dirs[dirs[i].Directory] = &dirs[i]
+	}
+
+	return app.runScan(s)
+}
+
+// runScan performs the walk of a scan already recorded as running.
+func (app *App) runScan(s *scanner) (*ScanRecord, error) {
+	app.Events.publish(eventScanStarted, s.progress(s.root))
+
+	var err error
+	if s.options.IdlePriority {
+		err = runIdle(s.walk)
+	} else {
+		err = s.walk()
+	}
+
+	status, message := scanCompleted, ""
+	if err != nil {
+		status, message = scanFailed, err.Error()
+		s.errors++
+	}
+
+	// Samples and trailers are only recognisable next to their main
+	// video, which the walk may reach after them
+	if err := app.classifyExtras(s.videoDirs); err != nil {
+		log.Warnf("Scan %d: failed to classify extras: %v", s.id, err)
+	}
+	if err := app.pairRAWs(s.photoDirs); err != nil {
+		log.Warnf("Scan %d: failed to pair RAW files: %v", s.id, err)
+	}
+	if err := app.addGalleries(s.photoDirs); err != nil {
+		log.Warnf("Scan %d: failed to add galleries: %v", s.id, err)
+	}
+
+	// A failed walk may not have got far enough to tell what is missing
+	if err == nil {
+		if err := app.flagMissing(s.root); err != nil {
+			log.Warnf("Scan %d: failed to flag missing files: %v", s.id, err)
+		}
+		if err := app.checkUnchanged(s.root); err != nil {
+			log.Warnf("Scan %d: failed to check immutable files: %v", s.id, err)
+		}
+	}
+	if err := app.flagDuplicates(); err != nil {
+		log.Warnf("Scan %d: failed to flag duplicates: %v", s.id, err)
+	}
+
+	_, dbErr := app.DB.Exec(
+		`UPDATE scans SET status = ?, finished_at = CURRENT_TIMESTAMP,
+			added = ?, moved = ?, skipped = ?, errors = ?, error = ?, directories = ? WHERE id = ?`,
+		status, s.added, s.moved, s.skipped, s.errors, message, s.encodeDirs(), s.id,
+	)
+	if dbErr != nil {
+		log.Warnf("Failed to record scan %d: %v", s.id, dbErr)
+	}
+
+	var record ScanRecord
+	if dbErr := app.DB.Get(&record, "SELECT * FROM scans WHERE id = ?", s.id); dbErr != nil {
+		return nil, dbErr
+	}
+	app.Events.publish(eventScanFinished, record)
+
+	return &record, err
+}
+
+// walk loads what the scan needs and walks the tree, committing what it
+// finds.
+func (s *scanner) walk() error {
+	err := s.loadKnownPaths()
+	if err == nil {
+		s.ignores, err = s.app.scanIgnores(s.root)
+	}
+	if err != nil {
+		return err
+	}
+
+	// A root the library excludes has nothing to add
+	if dir := s.ignores.excludedDir(s.root); dir != "" {
+		log.Infof("Skipping %s: %s is excluded", s.root, dir)
+		return nil
+	}
+
+	err = filepath.Walk(s.root, s.visit)
+
+	// Keep whatever was found before a walk error
+	if flushErr := s.flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+// interruptScans marks the scans a previous run of the server left running
+// as interrupted, so they can be resumed.
+func (app *App) interruptScans() error {
+	res, err := app.DB.Exec("UPDATE scans SET status = ? WHERE status = ?", scanInterrupted, scanRunning)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		log.Warnf("Marked %d unfinished scan(s) as interrupted", n)
+	}
+	return nil
+}
+
+func (s *scanner) visit(path string, info os.FileInfo, err error) error {
+	// An unreadable root ends the scan; anything below it is recorded and
+	// skipped
+	if err != nil {
+		if path == s.root {
+			return err
+		}
+		s.fail(path, info != nil && info.IsDir(), err)
+		return nil
+	}
+
+	if s.resumeFrom != "" && path != s.root && s.behind(path, info.IsDir()) {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+
+	s.throttle.wait(1)
+
+	if err := s.check(path, info); err != nil || info.IsDir() {
+		return err
+	}
+
+	s.visited++
+	if time.Since(s.lastProgress) >= scanProgressInterval {
+		s.app.Events.publish(eventScanProgress, s.progress(path))
+		s.lastProgress = time.Now()
+	}
+
+	if len(s.pending)+len(s.completed) >= scanBatchSize || s.visited%scanCheckpointInterval == 0 {
+		return s.checkpoint(path)
+	}
+
+	return nil
+}
+
+// progress returns the scan's progress at path. Pending items count as
+// added.
+func (s *scanner) progress(path string) ScanProgress {
+	return ScanProgress{
+		ScanID:  s.id,
+		Root:    s.root,
+		Path:    path,
+		Visited: s.visited,
+		Added:   s.added + len(s.pending),
+		Skipped: s.skipped,
+		Errors:  s.errors,
+	}
+}
+
+// behind reports whether the walk handled path before the checkpoint being
+// resumed from. Directories containing the checkpoint aren't behind it.
+func (s *scanner) behind(path string, isDir bool) bool {
+	if isDir && strings.HasPrefix(s.resumeFrom, path+string(filepath.Separator)) {
+		return false
+	}
+	if path == s.resumeFrom || walkOrderLess(path, s.resumeFrom) {
+		return true
+	}
+
+	s.resumeFrom = ""
+	return false
+}
+
+// walkOrderLess reports whether filepath.Walk visits a before b. The walk
+// goes depth first with each directory's entries sorted by name, so paths
+// are compared element by element rather than as plain strings.
+func walkOrderLess(a, b string) bool {
+	as := strings.Split(a, string(filepath.Separator))
+	bs := strings.Split(b, string(filepath.Separator))
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] != bs[i] {
+			return as[i] < bs[i]
+		}
+	}
+	return len(as) < len(bs)
+}
+
+// excluded applies the hidden file, ignore and marker rules of the options
+// to a path met while walking root, keeping ignores in step with the walk.
+// It reports whether the path is left out, and returns the error of a
+// broken ignore file below root, which only loses that file's rules.
+func (options ScanOptions) excluded(ignores *ignoreStack, root, path string, info os.FileInfo) (bool, error) {
+	// Prune dot-directories (.git, .Trash-1000) and dotfiles (.DS_Store),
+	// but never the walk's root itself
+	if options.SkipHidden && path != root && strings.HasPrefix(info.Name(), ".") {
+		return true, nil
+	}
+
+	if path != root {
+		*ignores = ignores.enter(filepath.Dir(path))
+		if ignores.ignored(path, info.IsDir()) {
+			return true, nil
+		}
+	}
+
+	if !info.IsDir() {
+		return false, nil
+	}
+	if options.NoMediaMarker != "" {
+		if _, err := os.Stat(filepath.Join(path, options.NoMediaMarker)); err == nil {
+			log.Debugf("Skipping %s: contains %s", path, options.NoMediaMarker)
+			return true, nil
+		}
+	}
+
+	// The root's ignore file was loaded with the library's rules
+	if path != root {
+		rules, err := loadIgnoreFile(filepath.Join(path, mediaIgnoreFile))
+		if err != nil {
+			return false, err
+		}
+		if rules != nil {
+			*ignores = append(*ignores, ignoreScope{dir: path, rules: rules})
+		}
+	}
+	return false, nil
+}
+
+// check applies the scan's exclusions to a path and queues it for insertion
+// if it is a new media file.
+func (s *scanner) check(path string, info os.FileInfo) error {
+	excluded, err := s.options.excluded(&s.ignores, s.root, path, info)
+	if err != nil {
+		s.fail(filepath.Join(path, mediaIgnoreFile), false, err)
+	}
+	if excluded {
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		s.skip(path)
+		return nil
+	}
+	if info.IsDir() {
+		return nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(path))
+	mediaType, ok := supportedExtensions[ext]
+	if !ok {
+		s.skip(path)
+		return nil
+	}
+
+	// Skip files outside the configured size range
+	if info.Size() < s.options.MinSize || (s.options.MaxSize > 0 && info.Size() > s.options.MaxSize) {
+		s.skip(path)
+		return nil
+	}
+
+	modTime, birthTime := fileTimes(info)
+	item := MediaItem{
+		Path:          path,
+		Filename:      info.Name(),
+		Size:          info.Size(),
+		Type:          mediaType,
+		FileModTime:   &modTime,
+		FileBirthTime: birthTime,
+	}
+
+	// Check if file already exists
+	if _, ok := s.known[path]; ok {
+		if _, ok := s.incomplete[path]; ok {
+			item.Oshash = s.oshash(path, info.Size())
+			s.completed = append(s.completed, item)
+		}
+		s.skip(path)
+		return nil
+	}
+
+	item.Oshash = s.oshash(path, info.Size())
+	s.pending = append(s.pending, item)
+
+	return nil
+}
+
+// oshash returns the oshash of a file, or an empty string if it is empty
+// or can't be read. An unreadable file is still added; it just can't be
+// matched by hash.
+func (s *scanner) oshash(path string, size int64) string {
+	if size == 0 {
+		return ""
+	}
+	hash, err := fileOshash(path)
+	if err != nil {
+		log.Warnf("Scan %d: failed to hash %s: %v", s.id, path, err)
+		return ""
+	}
+	return hash
+}
+
+// checkpoint commits the pending items and records path, the last one
+// visited, as the point an interrupted scan resumes from.
+func (s *scanner) checkpoint(path string) error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+
+	_, err := s.app.DB.Exec(
+		"UPDATE scans SET checkpoint = ?, added = ?, moved = ?, skipped = ?, errors = ?, directories = ? WHERE id = ?",
+		path, s.added, s.moved, s.skipped, s.errors, s.encodeDirs(), s.id,
+	)
+	return err
+}
+
+// dir returns the counts of the top-level directory holding path, or of
+// path itself if it is a top-level directory.
+func (s *scanner) dir(path string, isDir bool) *ScanDirSummary {
+	name := "."
+	if rel, err := filepath.Rel(s.root, path); err == nil && rel != "." {
+		if i := strings.IndexRune(rel, filepath.Separator); i >= 0 {
+			name = rel[:i]
+		} else if isDir {
+			name = rel
+		}
+	}
+
+	d, ok := s.dirs[name]
+	if !ok {
+		d = &ScanDirSummary{Directory: name}
+		s.dirs[name] = d
+	}
+	return d
+}
+
+// skip counts a file the scan doesn't import.
+func (s *scanner) skip(path string) {
+	s.skipped++
+	s.dir(path, false).Skipped++
+}
+
+// encodeDirs returns the per-directory counts as stored in the scan history,
+// sorted by directory.
+func (s *scanner) encodeDirs() string {
+	dirs := make([]ScanDirSummary, 0, len(s.dirs))
+	for _, d := range s.dirs {
+		dirs = append(dirs, *d)
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].Directory < dirs[j].Directory
+	})
+
+	data, err := json.Marshal(dirs)
+	if err != nil {
+		return "[]"
+	}
+	return string(data)
+}
+
+func (s *scanner) loadKnownPaths() error {
+	// Versions are files of their item, so they aren't added on their own
+	rows, err := s.app.DB.Query("SELECT path, file_mod_time IS NULL OR oshash = '' FROM media UNION ALL SELECT path, 0 FROM media_files")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	s.known = make(map[string]struct{})
+	s.incomplete = make(map[string]struct{})
+	for rows.Next() {
+		var path string
+		var incomplete bool
+		if err := rows.Scan(&path, &incomplete); err != nil {
+			return err
+		}
+		s.known[path] = struct{}{}
+		if incomplete {
+			s.incomplete[path] = struct{}{}
+		}
+	}
+
+	return rows.Err()
+}
+
+// flush inserts the pending items, and fills in the file times and oshash
+// of known ones, in a single transaction.
+func (s *scanner) flush() error {
+	if len(s.pending) == 0 && len(s.completed) == 0 {
+		return nil
+	}
+
+	tx, err := s.app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+
+	for _, media := range s.completed {
+		// A locked item's file times and hash are still facts about its
+		// file
+		_, err := tx.Exec(
+			"UPDATE media SET file_mod_time = ?, file_birth_time = ?, oshash = ? WHERE path = ?",
+			media.FileModTime, media.FileBirthTime, media.Oshash, media.Path,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	// Files that turn out to be items moved elsewhere update those items
+	// instead of being added
+	var moved []MediaItem
+	pending := s.pending[:0]
+	for _, media := range s.pending {
+		followed, err := s.follow(tx, &media)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if followed {
+			moved = append(moved, media)
+		} else {
+			pending = append(pending, media)
+		}
+	}
+	s.pending = pending
+
+	stmt, err := tx.PrepareNamed(
+		`INSERT INTO media (path, filename, size, type, oshash, file_mod_time, file_birth_time)
+			VALUES (:path, :filename, :size, :type, :oshash, :file_mod_time, :file_birth_time)`,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	var added []MediaItem
+	failed := make(map[string]error)
+	for _, media := range s.pending {
+		res, err := stmt.Exec(media)
+		if err == nil {
+			var id int64
+			id, err = res.LastInsertId()
+			media.ID = int(id)
+		}
+		if err != nil {
+			failed[media.Path] = err
+			continue
+		}
+		added = append(added, media)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	s.added += len(added)
+	s.moved += len(moved)
+	for _, media := range moved {
+		log.Infof("Scan %d: item %d moved to %s", s.id, media.ID, media.Path)
+		s.dir(media.Path, false).Moved++
+	}
+	for i := range added {
+		s.dir(added[i].Path, false).Added++
+
+		s.app.probeOrDefer(&added[i])
+		s.app.baselineOrDefer(&added[i])
+		s.app.Events.publish(eventMediaAdded, added[i])
+
+		switch added[i].Type {
+		case "video":
+			if s.videoDirs == nil {
+				s.videoDirs = make(map[string]bool)
+			}
+			s.videoDirs[filepath.Dir(added[i].Path)] = true
+		case "image", "raw":
+			if s.photoDirs == nil {
+				s.photoDirs = make(map[string]bool)
+			}
+			s.photoDirs[filepath.Dir(added[i].Path)] = true
+		}
+	}
+	for path, err := range failed {
+		s.fail(path, false, err)
+	}
+	s.pending = s.pending[:0]
+	s.completed = s.completed[:0]
+	return nil
+}
+
+// follow checks whether a new file is an item whose file has moved: one
+// with the same size and oshash whose own path is gone. If exactly one
+// such item exists, it is moved to the file's path, keeping everything
+// recorded about it, and its old path is kept as an alias. Locked items
+// aren't followed, as their paths can't change. It reports whether the
+// file was followed, setting media's ID to the item's.
+func (s *scanner) follow(tx *sqlx.Tx, media *MediaItem) (bool, error) {
+	if media.Oshash == "" {
+		return false, nil
+	}
+
+	var candidates []MediaItem
+	err := tx.Select(&candidates,
+		"SELECT * FROM media WHERE oshash = ? AND size = ? AND path != ?",
+		media.Oshash, media.Size, media.Path,
+	)
+	if err != nil {
+		return false, err
+	}
+	var gone []MediaItem
+	for _, item := range candidates {
+		if _, err := os.Lstat(item.Path); os.IsNotExist(err) && !s.followed[item.ID] {
+			gone = append(gone, item)
+		}
+	}
+	// Several would be a guess
+	if len(gone) != 1 || gone[0].Locked {
+		return false, nil
+	}
+	item := gone[0]
+
+	_, err = tx.Exec(
+		"UPDATE media SET path = ?, filename = ?, file_mod_time = ?, file_birth_time = ? WHERE id = ?",
+		media.Path, media.Filename, media.FileModTime, media.FileBirthTime, item.ID,
+	)
+	if err == nil {
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO media_aliases (media_id, filename, path) VALUES (?, ?, ?)",
+			item.ID, item.Filename, item.Path,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM media_flags WHERE media_id = ? AND flag = ?", item.ID, flagMissing)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if s.followed == nil {
+		s.followed = make(map[int]bool)
+	}
+	s.followed[item.ID] = true
+	media.ID = item.ID
+	return true, nil
+}
+
+// fail records a path the scan couldn't handle. It must not be called while
+// a transaction is open, since SQLite allows only one writer.
+func (s *scanner) fail(path string, isDir bool, err error) {
+	log.Warnf("Scan %d: %s: %v", s.id, path, err)
+	s.errors++
+	s.dir(path, isDir).Errors++
+
+	_, dbErr := s.app.DB.Exec(
+		"INSERT INTO scan_errors (scan_id, path, error) VALUES (?, ?, ?)",
+		s.id, path, err.Error(),
+	)
+	if dbErr != nil {
+		log.Warnf("Failed to record scan error for %s: %v", path, dbErr)
+	}
+}
+
+func (app *App) getScans(w http.ResponseWriter, r *http.Request) {
+	scans := []ScanRecord{}
+	if err := app.DB.Select(&scans, "SELECT * FROM scans ORDER BY id DESC"); err != nil {
+		log.Error("Failed to fetch scan history:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, scans)
+}
+
+func (app *App) getScanErrors(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid scan ID", http.StatusBadRequest)
+		return
+	}
+
+	var exists bool
+	if err := app.DB.Get(&exists, "SELECT EXISTS (SELECT 1 FROM scans WHERE id = ?)", id); err != nil {
+		log.Error("Failed to fetch scan:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		http.Error(w, "Scan not found", http.StatusNotFound)
+		return
+	}
+
+	scanErrors := []ScanError{}
+	if err := app.DB.Select(&scanErrors, "SELECT * FROM scan_errors WHERE scan_id = ? ORDER BY id", id); err != nil {
+		log.Error("Failed to fetch scan errors:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, scanErrors)
+}
+
+func (app *App) resumeScan(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid scan ID", http.StatusBadRequest)
+		return
+	}
+
+	var record ScanRecord
+	err = app.DB.Get(&record, "SELECT * FROM scans WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Scan not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to fetch scan:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Resuming scan %d of directory %s from %q", record.ID, record.Path, record.Checkpoint)
+
+	resumed, err := app.resume(&record)
+	if err == errScanNotInterrupted {
+		http.Error(w, "Only interrupted scans can be resumed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to resume scan:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	log.Infof("Scan complete. Added %d new items", resumed.Added)
+
+	app.writeScanResult(w, r, resumed)
+}
+
+// writeScanResult writes the response to a finished scan request.
+func (app *App) writeScanResult(w http.ResponseWriter, r *http.Request, record *ScanRecord) {
+	dirs := []ScanDirSummary{}
+	if err := json.Unmarshal([]byte(record.Directories), &dirs); err != nil {
+		log.Warnf("Invalid directory counts for scan %d: %v", record.ID, err)
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":     true,
+		"scan_id":     record.ID,
+		"count":       record.Added,
+		"moved":       record.Moved,
+		"skipped":     record.Skipped,
+		"errors":      record.Errors,
+		"directories": dirs,
+		"message":     fmt.Sprintf("Successfully scanned and added %d items", record.Added),
+	})
+}
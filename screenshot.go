@@ -0,0 +1,94 @@
+package main
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// screenshotName matches the names screenshots are saved under by phones
+// and desktops, in the languages macOS and Windows name them in.
+var screenshotName = regexp.MustCompile(`(?i)(screen[ _-]?shot|screen[ _-]?capture|bildschirmfoto|capture d.écran|` +
+	`captura de pantalla|schermafbeelding|skärmavbild|istantanea schermo|snímek obrazovky)`)
+
+// screenResolutions are the resolutions of common phone, tablet and desktop
+// screens, in landscape, which screenshots have exactly.
+var screenResolutions = map[[2]int]bool{
+	// Phones
+	{1280, 720}: true, {1334, 750}: true, {1136, 640}: true, {1920, 1080}: true,
+	{2208, 1242}: true, {2340, 1080}: true, {2400, 1080}: true, {2436, 1125}: true,
+	{1792, 828}: true, {2688, 1242}: true, {2532, 1170}: true, {2556, 1179}: true,
+	{2778, 1284}: true, {2796, 1290}: true, {2560, 1440}: true, {3040, 1440}: true,
+	{3120, 1440}: true, {3200, 1440}: true,
+	// Tablets
+	{2048, 1536}: true, {2160, 1620}: true, {2224, 1668}: true, {2360, 1640}: true,
+	{2388, 1668}: true, {2732, 2048}: true, {2000, 1200}: true, {2560, 1600}: true,
+	// Desktops
+	{1366, 768}: true, {1440, 900}: true, {1536, 864}: true, {1600, 900}: true,
+	{1680, 1050}: true, {1920, 1200}: true, {2560, 1080}: true, {2880, 1800}: true,
+	{3024, 1964}: true, {3456, 2234}: true, {3440, 1440}: true, {3840, 2160}: true,
+	{5120, 2880}: true, {2736, 1824}: true, {1280, 800}: true,
+}
+
+// isScreenshot reports whether an image is likely a screenshot rather than
+// a photo: it has no camera in its EXIF data, and either a screenshot's
+// name, or is a PNG the exact size of a common screen. width and height
+// are as stored, before any EXIF rotation.
+func isScreenshot(item *MediaItem, exif *exifData, width, height int) bool {
+	if item.Type != "image" || exif.Camera != "" {
+		return false
+	}
+	if screenshotName.MatchString(filepath.Base(item.Path)) {
+		return true
+	}
+	if strings.ToLower(filepath.Ext(item.Path)) != ".png" {
+		return false
+	}
+	if width < height {
+		width, height = height, width
+	}
+	return screenResolutions[[2]int{width, height}]
+}
+
+// classifyScreenshot sets or clears the screenshot flag of an image. Flags
+// set by users are kept, whatever the image looks like.
+func (app *App) classifyScreenshot(item *MediaItem, exif *exifData, width, height int) error {
+	if isScreenshot(item, exif, width, height) {
+		return app.setFlag(item.ID, flagScreenshot, sourceProbe)
+	}
+	_, err := app.DB.Exec(
+		"DELETE FROM media_flags WHERE media_id = ? AND flag = ? AND source = ?",
+		item.ID, flagScreenshot, sourceProbe,
+	)
+	return err
+}
+
+// classifyScreenshots classifies the probed images of the library, e.g.
+// those probed before screenshots were recognised, and returns how many
+// are flagged as screenshots.
+func (app *App) classifyScreenshots() (int, error) {
+	var items []MediaItem
+	if err := app.DB.Select(&items, "SELECT * FROM media WHERE type = 'image' AND probed"); err != nil {
+		return 0, err
+	}
+
+	for i := range items {
+		item := &items[i]
+		// Only a camera can keep a JPEG named like a screenshot from
+		// being one, so other images needn't be read
+		exif := &exifData{}
+		ext := strings.ToLower(filepath.Ext(item.Path))
+		if (ext == ".jpg" || ext == ".jpeg") && screenshotName.MatchString(filepath.Base(item.Path)) {
+			if read, err := readEXIF(item.Path); err == nil {
+				exif = read
+			}
+		}
+		if err := app.classifyScreenshot(item, exif, item.Width, item.Height); err != nil {
+			return 0, err
+		}
+	}
+
+	var screenshots int
+	err := app.DB.Get(&screenshots, "SELECT COUNT(*) FROM media_flags WHERE flag = ?", flagScreenshot)
+	return screenshots, err
+}
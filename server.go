@@ -0,0 +1,23 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// maxPortFallback is the number of ports after the configured one tried
+// when port fallback is enabled.
+const maxPortFallback = 20
+
+// listen opens the HTTP listener on port. With fallback set, a port that is
+// already in use is skipped for the next one.
+func listen(port int, fallback bool) (net.Listener, error) {
+	for attempt := 0; ; attempt++ {
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port+attempt))
+		if err == nil || !fallback || attempt >= maxPortFallback || !errors.Is(err, syscall.EADDRINUSE) {
+			return ln, err
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"image"
+	"net/http"
+	"os"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// sharpnessSize is the longest side images are scaled down to before their
+// sharpness is measured, so scores of photos of different resolutions are
+// comparable and large photos don't take long.
+const sharpnessSize = 1024
+
+// sharpness measures how sharp an image is as the variance of its
+// Laplacian: edges give large second derivatives, which blur smooths out.
+// Scores are on 8 bit brightness values; photos scoring below about 100
+// usually look blurry.
+func sharpness(img image.Image) float64 {
+	img = scaleImage(img, sharpnessSize)
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 3 || h < 3 {
+		return 0
+	}
+
+	gray := make([]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+			gray[y*w+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)) / 257
+		}
+	}
+
+	var sum, sumSq float64
+	for y := 1; y < h-1; y++ {
+		for x := 1; x < w-1; x++ {
+			i := y*w + x
+			l := gray[i-w] + gray[i+w] + gray[i-1] + gray[i+1] - 4*gray[i]
+			sum += l
+			sumSq += l * l
+		}
+	}
+	n := float64((w - 2) * (h - 2))
+	mean := sum / n
+	return sumSq/n - mean*mean
+}
+
+// imageSharpness decodes the image at path and measures its sharpness.
+func imageSharpness(path string) (float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err == image.ErrFormat {
+		return 0, errUnknownImageFormat
+	}
+	if err != nil {
+		return 0, err
+	}
+	return sharpness(img), nil
+}
+
+// analyzeSharpness scores the sharpness of the images matching the media
+// filters in the query string. Images already scored, and those that can't
+// be decoded, are skipped; force=true scores images again.
+func (app *App) analyzeSharpness(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	force := false
+	if v := r.URL.Query().Get("force"); v != "" {
+		if force, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid force: "+v, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var items []MediaItem
+	where, args := filter.where()
+	if err := app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY id", args...); err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	analyzed, skipped, failed := 0, 0, 0
+	for i := range items {
+		item := &items[i]
+		// RAW photos can't be decoded; their JPEG twin is scored instead
+		if item.Type != "image" || (item.Sharpness != nil && !force) {
+			skipped++
+			continue
+		}
+
+		score, err := imageSharpness(item.Path)
+		// The standard library has no WebP decoder
+		if err == errUnknownImageFormat {
+			skipped++
+			continue
+		}
+		if err == nil {
+			_, err = app.DB.Exec("UPDATE media SET sharpness = ? WHERE id = ?", score, item.ID)
+		}
+		if err != nil {
+			log.Warnf("Failed to measure the sharpness of %s: %v", item.Path, err)
+			failed++
+			continue
+		}
+		analyzed++
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"analyzed": analyzed,
+		"skipped":  skipped,
+		"failed":   failed,
+	})
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// Images are near-duplicates if their perceptual hashes differ in at most
+// defaultMaxDistance of 64 bits and they were captured at most
+// defaultBurstWindow apart, unless asked otherwise.
+const (
+	defaultMaxDistance = 10
+	defaultBurstWindow = 5 * time.Minute
+)
+
+// phashSize is the side of the grayscale image that perceptual hashes are
+// computed from.
+const phashSize = 32
+
+// phash computes the perceptual hash of an image: the lowest 8x8
+// frequencies of the discrete cosine transform of a 32x32 grayscale copy,
+// each bit telling whether one is above their median. Scaling,
+// recompression and small edits leave it nearly unchanged.
+func phash(img image.Image) uint64 {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var gray [phashSize][phashSize]float64
+	for y := 0; y < phashSize; y++ {
+		y0, y1 := y*h/phashSize, (y+1)*h/phashSize
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < phashSize; x++ {
+			x0, x1 := x*w/phashSize, (x+1)*w/phashSize
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+			var sum float64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					r, g, bl, _ := img.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(bl)
+				}
+			}
+			gray[y][x] = sum / float64((y1-y0)*(x1-x0))
+		}
+	}
+
+	// Only the 8x8 lowest frequencies are needed
+	var cos [8][phashSize]float64
+	for u := 0; u < 8; u++ {
+		for x := 0; x < phashSize; x++ {
+			cos[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * phashSize))
+		}
+	}
+	var rows [phashSize][8]float64
+	for y := 0; y < phashSize; y++ {
+		for u := 0; u < 8; u++ {
+			for x := 0; x < phashSize; x++ {
+				rows[y][u] += gray[y][x] * cos[u][x]
+			}
+		}
+	}
+	coeffs := make([]float64, 0, 64)
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			var sum float64
+			for y := 0; y < phashSize; y++ {
+				sum += rows[y][u] * cos[v][y]
+			}
+			coeffs = append(coeffs, sum)
+		}
+	}
+
+	// The first coefficient is the average brightness, which would skew
+	// the median
+	sorted := append([]float64{}, coeffs[1:]...)
+	sort.Float64s(sorted)
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for _, c := range coeffs {
+		hash <<= 1
+		if c > median {
+			hash |= 1
+		}
+	}
+	return hash
+}
+
+// hashImage stores the perceptual hash of an image, computed from its
+// thumbnail, which is upright and small. Images without a thumbnail aren't
+// hashed.
+func (app *App) hashImage(item *MediaItem) error {
+	if item.Thumbnail == "" {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(thumbnailDir, item.Thumbnail))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return err
+	}
+	item.PHash = fmt.Sprintf("%016x", phash(img))
+	_, err = app.DB.Exec("UPDATE media SET phash = ? WHERE id = ?", item.PHash, item.ID)
+	return err
+}
+
+// hashImages hashes the images probed before perceptual hashes were
+// computed and returns how many images have a hash.
+func (app *App) hashImages() (int, error) {
+	var items []MediaItem
+	if err := app.DB.Select(&items, "SELECT * FROM media WHERE type = 'image' AND phash = '' AND thumbnail != ''"); err != nil {
+		return 0, err
+	}
+	for i := range items {
+		if err := app.hashImage(&items[i]); err != nil {
+			log.Warnf("Failed to hash %s: %v", items[i].Path, err)
+		}
+	}
+
+	var hashed int
+	err := app.DB.Get(&hashed, "SELECT COUNT(*) FROM media WHERE type = 'image' AND phash != ''")
+	return hashed, err
+}
+
+// captureTime is when an item was captured, as far as is known, like
+// captureDate in SQL.
+func captureTime(item *MediaItem) time.Time {
+	if item.TakenAt != nil {
+		return *item.TakenAt
+	}
+	if item.FileModTime != nil {
+		return *item.FileModTime
+	}
+	return item.CreatedAt
+}
+
+// similarity are the limits of near-duplicates given in the query string:
+// max_distance in bits, and window in seconds, 0 to ignore capture times.
+type similarity struct {
+	maxDistance int
+	window      time.Duration
+}
+
+func parseSimilarity(r *http.Request) (similarity, error) {
+	s := similarity{maxDistance: defaultMaxDistance, window: defaultBurstWindow}
+	query := r.URL.Query()
+	if v := query.Get("max_distance"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 64 {
+			return s, fmt.Errorf("invalid max_distance: %s", v)
+		}
+		s.maxDistance = n
+	}
+	if v := query.Get("window"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return s, fmt.Errorf("invalid window: %s", v)
+		}
+		s.window = time.Duration(n) * time.Second
+	}
+	return s, nil
+}
+
+// hashedImage is an image with its perceptual hash decoded.
+type hashedImage struct {
+	MediaItem
+	hash    uint64
+	capture time.Time
+}
+
+// hashedImages returns the hashed images, ordered by capture time.
+func (app *App) hashedImages() ([]hashedImage, error) {
+	var items []MediaItem
+	err := app.DB.Select(&items, "SELECT * FROM media WHERE type = 'image' AND phash != '' ORDER BY "+captureDate+", id")
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]hashedImage, 0, len(items))
+	for i := range items {
+		hash, err := strconv.ParseUint(items[i].PHash, 16, 64)
+		if err != nil {
+			log.Warnf("Invalid perceptual hash of media item %d: %v", items[i].ID, err)
+			continue
+		}
+		images = append(images, hashedImage{items[i], hash, captureTime(&items[i])})
+	}
+	return images, nil
+}
+
+// similar reports whether two images are near-duplicates.
+func (s similarity) similar(a, b *hashedImage) bool {
+	if s.window > 0 {
+		apart := b.capture.Sub(a.capture)
+		if apart < 0 {
+			apart = -apart
+		}
+		if apart > s.window {
+			return false
+		}
+	}
+	return bits.OnesCount64(a.hash^b.hash) <= s.maxDistance
+}
+
+// clusters groups near-duplicate images, ordered by capture time: images
+// are in the same cluster if a chain of near-duplicates links them.
+// Images without a near-duplicate are left out.
+func (s similarity) clusters(images []hashedImage) [][]*hashedImage {
+	parent := make([]int, len(images))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range images {
+		for j := i + 1; j < len(images); j++ {
+			// Ordered by capture time, later images are only further away
+			if s.window > 0 && images[j].capture.Sub(images[i].capture) > s.window {
+				break
+			}
+			if s.similar(&images[i], &images[j]) {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := map[int][]*hashedImage{}
+	var roots []int
+	for i := range images {
+		root := find(i)
+		if members[root] == nil {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], &images[i])
+	}
+	var clusters [][]*hashedImage
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			clusters = append(clusters, members[root])
+		}
+	}
+	return clusters
+}
+
+// bestShot picks the image of a cluster worth keeping: the sharpest if
+// they were scored, else the one with the most pixels, else the largest
+// file.
+func bestShot(cluster []*hashedImage) *hashedImage {
+	best := cluster[0]
+	for _, img := range cluster[1:] {
+		switch {
+		case img.Sharpness != nil && best.Sharpness != nil:
+			if *img.Sharpness > *best.Sharpness {
+				best = img
+			}
+		case img.Sharpness != nil || best.Sharpness != nil:
+			if img.Sharpness != nil {
+				best = img
+			}
+		case img.Width*img.Height != best.Width*best.Height:
+			if img.Width*img.Height > best.Width*best.Height {
+				best = img
+			}
+		case img.Size > best.Size:
+			best = img
+		}
+	}
+	return best
+}
+
+// ImageCluster is a group of near-duplicate images, such as a burst, with
+// the one suggested to keep.
+type ImageCluster struct {
+	Best  int         `json:"best"`
+	Items []MediaItem `json:"items"`
+}
+
+// SimilarImage is a near-duplicate of an image, with the number of bits
+// their perceptual hashes differ in and the seconds between their capture.
+type SimilarImage struct {
+	Distance     int       `json:"distance"`
+	SecondsApart float64   `json:"seconds_apart"`
+	Item         MediaItem `json:"item"`
+}
+
+// getSimilarImages lists the near-duplicates of an image, closest first.
+func (app *App) getSimilarImages(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+	s, err := parseSimilarity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	images, err := app.hashedImages()
+	if err != nil {
+		log.Error("Failed to fetch hashed images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	similar := []SimilarImage{}
+	var self *hashedImage
+	for i := range images {
+		if images[i].ID == item.ID {
+			self = &images[i]
+		}
+	}
+	if self != nil {
+		for i := range images {
+			other := &images[i]
+			if other.ID == self.ID || !s.similar(self, other) {
+				continue
+			}
+			similar = append(similar, SimilarImage{
+				Distance:     bits.OnesCount64(self.hash ^ other.hash),
+				SecondsApart: math.Abs(other.capture.Sub(self.capture).Seconds()),
+				Item:         other.MediaItem,
+			})
+		}
+	}
+	sort.SliceStable(similar, func(i, j int) bool {
+		return similar[i].Distance < similar[j].Distance
+	})
+
+	app.writeJSON(w, r, http.StatusOK, similar)
+}
+
+// getImageClusters lists the clusters of near-duplicate images for review,
+// oldest first, each with the shot suggested to keep.
+func (app *App) getImageClusters(w http.ResponseWriter, r *http.Request) {
+	s, err := parseSimilarity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	images, err := app.hashedImages()
+	if err != nil {
+		log.Error("Failed to fetch hashed images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	clusters := []ImageCluster{}
+	for _, members := range s.clusters(images) {
+		cluster := ImageCluster{Best: bestShot(members).ID}
+		for _, img := range members {
+			cluster.Items = append(cluster.Items, img.MediaItem)
+		}
+		clusters = append(clusters, cluster)
+	}
+
+	app.writeJSON(w, r, http.StatusOK, clusters)
+}
+
+// keepShot resolves the cluster of an image by keeping it: the other images
+// of its cluster are flagged rejected, ready for a bulk delete, and the
+// image loses the flag if it had it.
+func (app *App) keepShot(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	s, err := parseSimilarity(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	images, err := app.hashedImages()
+	if err != nil {
+		log.Error("Failed to fetch hashed images:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var cluster []*hashedImage
+	for _, members := range s.clusters(images) {
+		for _, img := range members {
+			if img.ID == id {
+				cluster = members
+			}
+		}
+	}
+	if cluster == nil {
+		http.Error(w, "Media item has no near-duplicates", http.StatusNotFound)
+		return
+	}
+
+	rejected := []int{}
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to keep shot:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM media_flags WHERE media_id = ? AND flag = ?", id, flagRejected)
+	for _, img := range cluster {
+		if err != nil {
+			break
+		}
+		if img.ID == id {
+			continue
+		}
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO media_flags (media_id, flag, source) VALUES (?, ?, ?)",
+			img.ID, flagRejected, sourceUser,
+		)
+		rejected = append(rejected, img.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error("Failed to keep shot:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success":  true,
+		"kept":     id,
+		"rejected": rejected,
+	})
+}
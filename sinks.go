@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// Sink types. Kafka is reached through a Confluent-compatible REST Proxy,
+// since its wire protocol needs a client library.
+const (
+	sinkWebhook = "webhook"
+	sinkMQTT    = "mqtt"
+	sinkNATS    = "nats"
+	sinkKafka   = "kafka"
+)
+
+// defaultSinkTopic is the MQTT topic prefix, NATS subject prefix or Kafka
+// topic of sinks that don't set one.
+const defaultSinkTopic = "media-organizer"
+
+// sinkTimeout bounds connecting to a sink and every delivery.
+const sinkTimeout = 10 * time.Second
+
+// Events waiting for a sink are kept in the outbox, read sinkBatchSize at a
+// time.
+const sinkBatchSize = 100
+
+// sinkEvents are the events that can be published to sinks. Unless a sink
+// lists the events it wants, it gets all of them but the progress events,
+// which are only useful while watching a job.
+var sinkEvents = map[string]bool{
+	eventMediaAdded:     true,
+	eventScanStarted:    true,
+	eventScanProgress:   false,
+	eventScanFinished:   true,
+	eventDedupProgress:  false,
+	eventDedupFinished:  true,
+	eventIntegrityAlert: true,
+	eventOnThisDay:      true,
+}
+
+// sinkPublisher delivers events to one broker or URL. A publisher that
+// fails is closed and its event delivered again, so it must connect again
+// as needed.
+type sinkPublisher interface {
+	publish(e *outboxEvent, body []byte) error
+	close()
+}
+
+// outboxEvent is an event waiting to be delivered to a sink. Data is the
+// event encoded as JSON.
+type outboxEvent struct {
+	ID        int64     `db:"id" json:"id"`
+	Sink      string    `db:"sink" json:"-"`
+	Type      string    `db:"type" json:"type"`
+	Data      string    `db:"data" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"time"`
+}
+
+// SinkStatus describes the delivery of events to a sink since the server
+// started.
+type SinkStatus struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Pending   int        `json:"pending"`
+	Delivered int        `json:"delivered"`
+	Dropped   int        `json:"dropped"`
+	LastError string     `json:"last_error"`
+	FailingAt *time.Time `json:"failing_at"`
+}
+
+// eventSink delivers the events it wants to one publisher, in the order
+// they were published, retrying until they are delivered.
+type eventSink struct {
+	config    SinkConfig
+	events    map[string]bool
+	publisher sinkPublisher
+	db        *sqlx.DB
+	// wake is signalled when an event is added to the outbox.
+	wake chan struct{}
+
+	mu     sync.Mutex
+	status SinkStatus
+}
+
+// eventSinks are the sinks of the deployment.
+type eventSinks struct {
+	db    *sqlx.DB
+	sinks []*eventSink
+}
+
+// newEventSinks validates the configured sinks and starts delivering the
+// events left in the outbox by the last run.
+func newEventSinks(db *sqlx.DB, configs []SinkConfig) (*eventSinks, error) {
+	s := &eventSinks{db: db}
+	names := map[string]bool{}
+	// The empty name keeps the list of names from being empty
+	configured := []string{""}
+	for _, c := range configs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("sink of type %q has no name", c.Type)
+		}
+		if names[c.Name] {
+			return nil, fmt.Errorf("sink %q is configured twice", c.Name)
+		}
+		if c.MaxOutbox < 0 {
+			return nil, fmt.Errorf("sink %q: max_outbox must not be negative", c.Name)
+		}
+		names[c.Name] = true
+		configured = append(configured, c.Name)
+		if c.Topic == "" {
+			c.Topic = defaultSinkTopic
+		}
+
+		publisher, err := newSinkPublisher(c)
+		if err != nil {
+			return nil, fmt.Errorf("sink %q: %w", c.Name, err)
+		}
+
+		events := map[string]bool{}
+		for name, byDefault := range sinkEvents {
+			events[name] = byDefault && len(c.Events) == 0
+		}
+		for _, name := range c.Events {
+			if _, ok := sinkEvents[name]; !ok {
+				return nil, fmt.Errorf("sink %q: unknown event %q", c.Name, name)
+			}
+			events[name] = true
+		}
+
+		s.sinks = append(s.sinks, &eventSink{
+			config:    c,
+			events:    events,
+			publisher: publisher,
+			db:        db,
+			wake:      make(chan struct{}, 1),
+			status:    SinkStatus{Name: c.Name, Type: c.Type},
+		})
+	}
+
+	// Events of sinks no longer configured would never be delivered
+	query, args, err := sqlx.In("DELETE FROM event_outbox WHERE sink NOT IN (?)", configured)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	for _, sink := range s.sinks {
+		go sink.run()
+	}
+	return s, nil
+}
+
+// newSinkPublisher returns the publisher of a sink's type.
+func newSinkPublisher(c SinkConfig) (sinkPublisher, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c.Type {
+	case sinkWebhook, sinkKafka:
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("%s URL must be http or https", c.Type)
+		}
+		return &httpPublisher{kafka: c.Type == sinkKafka, url: c.URL, topic: c.Topic,
+			client: &http.Client{Timeout: sinkTimeout}}, nil
+	case sinkMQTT:
+		if u.Scheme != "mqtt" && u.Scheme != "mqtts" {
+			return nil, fmt.Errorf("mqtt URL must be mqtt:// or mqtts://")
+		}
+		return newMQTTPublisher(u, c)
+	case sinkNATS:
+		if u.Scheme != "nats" {
+			return nil, fmt.Errorf("nats URL must be nats://")
+		}
+		return newNATSPublisher(u, c)
+	}
+	return nil, fmt.Errorf("unknown type %q: use webhook, mqtt, nats or kafka", c.Type)
+}
+
+// enqueue adds an event to the outbox of every sink that wants it.
+func (s *eventSinks) enqueue(typ string, data interface{}) {
+	var encoded []byte
+	for _, sink := range s.sinks {
+		if !sink.events[typ] {
+			continue
+		}
+		if encoded == nil {
+			var err error
+			if encoded, err = json.Marshal(data); err != nil {
+				log.Errorf("Failed to encode %s event for sinks: %v", typ, err)
+				return
+			}
+		}
+
+		_, err := s.db.Exec(
+			"INSERT INTO event_outbox (sink, type, data, created_at) VALUES (?, ?, ?, ?)",
+			sink.config.Name, typ, string(encoded), time.Now().UTC(),
+		)
+		if err != nil {
+			log.Errorf("Failed to queue %s event for sink %s: %v", typ, sink.config.Name, err)
+			continue
+		}
+		select {
+		case sink.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// run delivers the sink's events for as long as the server runs. An event
+// that fails is retried, with a growing delay, before any later one.
+func (sink *eventSink) run() {
+	backoff := retryBackoff
+	for {
+		var batch []outboxEvent
+		err := sink.db.Select(&batch,
+			"SELECT * FROM event_outbox WHERE sink = ? ORDER BY id LIMIT ?", sink.config.Name, sinkBatchSize)
+		if err != nil {
+			log.Errorf("Failed to read outbox of sink %s: %v", sink.config.Name, err)
+		}
+		if len(batch) == 0 {
+			<-sink.wake
+			continue
+		}
+
+		for i := range batch {
+			if err = sink.deliver(&batch[i]); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			backoff = retryBackoff
+			continue
+		}
+
+		sink.publisher.close()
+		if sink.failed(err) {
+			log.Warnf("Failed to publish events to sink %s, retrying: %v", sink.config.Name, err)
+		}
+		sink.trim()
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// deliver publishes an event and removes it from the outbox.
+func (sink *eventSink) deliver(e *outboxEvent) error {
+	body, err := json.Marshal(struct {
+		*outboxEvent
+		Data json.RawMessage `json:"data"`
+	}{e, json.RawMessage(e.Data)})
+	if err != nil {
+		return err
+	}
+	if err := sink.publisher.publish(e, body); err != nil {
+		return err
+	}
+	if _, err := sink.db.Exec("DELETE FROM event_outbox WHERE id = ?", e.ID); err != nil {
+		return err
+	}
+
+	sink.mu.Lock()
+	if sink.status.FailingAt != nil {
+		log.Infof("Sink %s is receiving events again", sink.config.Name)
+	}
+	sink.status.Delivered++
+	sink.status.FailingAt = nil
+	sink.mu.Unlock()
+	return nil
+}
+
+// failed records a failed delivery. It reports whether the sink was
+// working until now, so an outage is logged once rather than every retry.
+func (sink *eventSink) failed(err error) bool {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+
+	sink.status.LastError = err.Error()
+	if sink.status.FailingAt != nil {
+		return false
+	}
+	now := time.Now()
+	sink.status.FailingAt = &now
+	return true
+}
+
+// trim drops the oldest events of a sink that is down once it has more
+// than its max_outbox waiting. Without one, nothing is dropped.
+func (sink *eventSink) trim() {
+	if sink.config.MaxOutbox == 0 {
+		return
+	}
+	res, err := sink.db.Exec(
+		`DELETE FROM event_outbox WHERE sink = ? AND id < (
+			SELECT id FROM event_outbox WHERE sink = ? ORDER BY id DESC LIMIT 1 OFFSET ?)`,
+		sink.config.Name, sink.config.Name, sink.config.MaxOutbox-1,
+	)
+	if err != nil {
+		log.Errorf("Failed to trim outbox of sink %s: %v", sink.config.Name, err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Warnf("Dropped %d events of sink %s while it is down", n, sink.config.Name)
+		sink.mu.Lock()
+		sink.status.Dropped += int(n)
+		sink.mu.Unlock()
+	}
+}
+
+// httpPublisher posts events to a webhook, or to a topic of a Kafka REST
+// Proxy keyed by event type.
+type httpPublisher struct {
+	kafka  bool
+	url    string
+	topic  string
+	client *http.Client
+}
+
+func (p *httpPublisher) publish(e *outboxEvent, body []byte) error {
+	target, contentType := p.url, "application/json"
+	if p.kafka {
+		target = strings.TrimSuffix(p.url, "/") + "/topics/" + url.PathEscape(p.topic)
+		contentType = "application/vnd.kafka.json.v2+json"
+		records, err := json.Marshal(map[string]interface{}{
+			"records": []interface{}{
+				map[string]interface{}{"key": e.Type, "value": json.RawMessage(body)},
+			},
+		})
+		if err != nil {
+			return err
+		}
+		body = records
+	}
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Event-Type", e.Type)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (p *httpPublisher) close() {}
+
+// getSinks reports the delivery of events to each configured sink.
+func (app *App) getSinks(w http.ResponseWriter, r *http.Request) {
+	sinks := []SinkStatus{}
+	for _, sink := range app.Events.sinks.sinks {
+		var pending int
+		err := app.DB.Get(&pending, "SELECT COUNT(*) FROM event_outbox WHERE sink = ?", sink.config.Name)
+		if err != nil {
+			log.Error("Failed to count pending events:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sink.mu.Lock()
+		status := sink.status
+		sink.mu.Unlock()
+		status.Pending = pending
+		sinks = append(sinks, status)
+	}
+	app.writeJSON(w, r, http.StatusOK, sinks)
+}
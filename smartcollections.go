@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// errSmartCollection is the error for changes to the members of smart
+// collections.
+const errSmartCollection = "Smart collections are defined by their filter; change it at /api/smart-collections"
+
+// SmartCollection is a saved search: a named filter whose items are
+// computed every time it is read, like the virtual collections of
+// config.json, but created through the API.
+type SmartCollection struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Filter is as it was given.
+	Filter    json.RawMessage `json:"filter"`
+	Count     int             `json:"count"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// storedSmartCollection is a row of smart_collections, with its filter as
+// JSON.
+type storedSmartCollection struct {
+	ID          string    `db:"id"`
+	Name        string    `db:"name"`
+	Description string    `db:"description"`
+	Filter      string    `db:"filter"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+// decodeFilter reads a smart collection's filter, refusing unknown fields
+// so a misspelled one doesn't silently match everything.
+func decodeFilter(data []byte) (MediaFilter, error) {
+	var filter MediaFilter
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		return filter, errors.New("must be an object")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&filter)
+	return filter, err
+}
+
+// smartCollection returns the smart collection with the given ID as a
+// collection definition, or nil.
+func (app *App) smartCollection(id string) (*CollectionConfig, error) {
+	var c storedSmartCollection
+	err := app.DB.Get(&c, "SELECT * FROM smart_collections WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter, err := decodeFilter([]byte(c.Filter))
+	if err != nil {
+		return nil, err
+	}
+	return &CollectionConfig{Name: c.Name, Description: c.Description, Filter: filter}, nil
+}
+
+// collectionIDTaken reports whether a collection of any kind has the ID,
+// since they are all listed and read at /api/collections.
+func (app *App) collectionIDTaken(id string) (bool, error) {
+	if app.virtualCollection(id) != nil {
+		return true, nil
+	}
+	var n int
+	err := app.DB.Get(&n,
+		"SELECT (SELECT COUNT(*) FROM collections WHERE id = ?) + (SELECT COUNT(*) FROM smart_collections WHERE id = ?)",
+		id, id,
+	)
+	return n > 0, err
+}
+
+// presentSmartCollection returns a smart collection as listed, counting
+// the items the profile of the request can see.
+func (app *App) presentSmartCollection(r *http.Request, c *storedSmartCollection) (*SmartCollection, error) {
+	filter, err := decodeFilter([]byte(c.Filter))
+	if err != nil {
+		return nil, err
+	}
+	out := &SmartCollection{ID: c.ID, Name: c.Name, Description: c.Description, Filter: json.RawMessage(c.Filter), CreatedAt: c.CreatedAt}
+
+	filter.profile = profileOf(r)
+	where, args := filter.where()
+	if err := app.DB.Get(&out.Count, "SELECT COUNT(*) FROM media"+where, args...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// smartCollectionFromURL loads the smart collection identified by the {id}
+// URL parameter, writing an error response and returning nil if it can't.
+func (app *App) smartCollectionFromURL(w http.ResponseWriter, r *http.Request) *storedSmartCollection {
+	var c storedSmartCollection
+	err := app.DB.Get(&c, "SELECT * FROM smart_collections WHERE id = ?", chi.URLParam(r, "id"))
+	if err == sql.ErrNoRows {
+		http.Error(w, "Smart collection not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return &c
+}
+
+func (app *App) getSmartCollections(w http.ResponseWriter, r *http.Request) {
+	var stored []storedSmartCollection
+	if err := app.DB.Select(&stored, "SELECT * FROM smart_collections ORDER BY name COLLATE NOCASE, id"); err != nil {
+		log.Error("Failed to fetch smart collections:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out := []SmartCollection{}
+	for i := range stored {
+		c, err := app.presentSmartCollection(r, &stored[i])
+		if err != nil {
+			log.Errorf("Failed to count smart collection %s: %v", stored[i].Name, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		out = append(out, *c)
+	}
+	app.writeJSON(w, r, http.StatusOK, out)
+}
+
+func (app *App) getSmartCollection(w http.ResponseWriter, r *http.Request) {
+	c := app.smartCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+	out, err := app.presentSmartCollection(r, c)
+	if err != nil {
+		log.Error("Failed to count smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, out)
+}
+
+// createSmartCollection saves a filter as a smart collection. Its ID is
+// derived from its name like those of other collections, and stays the
+// same if it is renamed.
+func (app *App) createSmartCollection(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name        string          `json:"name"`
+		Description string          `json:"description"`
+		Filter      json.RawMessage `json:"filter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c := storedSmartCollection{
+		ID:          slugify(req.Name),
+		Name:        strings.TrimSpace(req.Name),
+		Description: req.Description,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if c.ID == "" {
+		http.Error(w, "Name must contain letters or digits", http.StatusBadRequest)
+		return
+	}
+	// An empty filter matches everything, so it has to be given explicitly
+	if len(req.Filter) == 0 || string(req.Filter) == "null" {
+		http.Error(w, "filter is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := decodeFilter(req.Filter); err != nil {
+		http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var filter bytes.Buffer
+	json.Compact(&filter, req.Filter)
+	c.Filter = filter.String()
+
+	taken, err := app.collectionIDTaken(c.ID)
+	if err != nil {
+		log.Error("Failed to create smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "A collection with this ID already exists", http.StatusConflict)
+		return
+	}
+
+	_, err = app.DB.NamedExec(
+		`INSERT INTO smart_collections (id, name, description, filter, created_at)
+			VALUES (:id, :name, :description, :filter, :created_at)`,
+		c,
+	)
+	if err != nil {
+		log.Error("Failed to create smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := app.presentSmartCollection(r, &c)
+	if err != nil {
+		log.Error("Failed to count smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Created smart collection %s", c.ID)
+	app.writeJSON(w, r, http.StatusCreated, out)
+}
+
+// updateSmartCollection renames a smart collection, or changes its
+// description or filter. A new filter replaces the old one entirely.
+func (app *App) updateSmartCollection(w http.ResponseWriter, r *http.Request) {
+	c := app.smartCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+
+	var req struct {
+		Name        *string         `json:"name"`
+		Description *string         `json:"description"`
+		Filter      json.RawMessage `json:"filter"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Name != nil {
+		if slugify(*req.Name) == "" {
+			http.Error(w, "Name must contain letters or digits", http.StatusBadRequest)
+			return
+		}
+		c.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Description != nil {
+		c.Description = *req.Description
+	}
+	if len(req.Filter) > 0 && string(req.Filter) != "null" {
+		if _, err := decodeFilter(req.Filter); err != nil {
+			http.Error(w, "invalid filter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var filter bytes.Buffer
+		json.Compact(&filter, req.Filter)
+		c.Filter = filter.String()
+	}
+
+	_, err := app.DB.NamedExec(
+		"UPDATE smart_collections SET name = :name, description = :description, filter = :filter WHERE id = :id", c)
+	if err != nil {
+		log.Error("Failed to update smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	out, err := app.presentSmartCollection(r, c)
+	if err != nil {
+		log.Error("Failed to count smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeJSON(w, r, http.StatusOK, out)
+}
+
+// deleteSmartCollection deletes a smart collection. Its items are
+// unaffected.
+func (app *App) deleteSmartCollection(w http.ResponseWriter, r *http.Request) {
+	c := app.smartCollectionFromURL(w, r)
+	if c == nil {
+		return
+	}
+
+	if _, err := app.DB.Exec("DELETE FROM smart_collections WHERE id = ?", c.ID); err != nil {
+		log.Error("Failed to delete smart collection:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is how much of a file content type detection looks at.
+const sniffLen = 512
+
+// sniffedTypes maps the content types http.DetectContentType recognizes in
+// media files to media types. It doesn't know MOV, WMV or FLV, which are
+// sniffed as application/octet-stream, and EPUB and CBZ files sniff as ZIP
+// archives. M4A files are MP4 files and FLAC isn't recognized.
+var sniffedTypes = map[string]string{
+	"video/mp4":       "video",
+	"video/webm":      "video",
+	"video/avi":       "video",
+	"image/jpeg":      "image",
+	"image/png":       "image",
+	"image/gif":       "image",
+	"image/webp":      "image",
+	"audio/mpeg":      "audio",
+	"application/ogg": "audio",
+	"application/pdf": "document",
+	"application/zip": "document",
+}
+
+// extensionMIMEs are the content types files with the extensions sniff as.
+// Files with other extensions, e.g. MKV files which sniff as WebM, are
+// only expected to have content of their media type.
+var extensionMIMEs = map[string]string{
+	".mp4":  "video/mp4",
+	".webm": "video/webm",
+	".avi":  "video/avi",
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".mp3":  "audio/mpeg",
+	".ogg":  "application/ogg",
+	".m4a":  "video/mp4",
+	".pdf":  "application/pdf",
+	".epub": "application/zip",
+	".cbz":  "application/zip",
+}
+
+// sniffMIME detects the content type of the file at path from its first
+// bytes, without any parameters such as the charset.
+func sniffMIME(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	contentType := http.DetectContentType(buf[:n])
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return contentType, nil
+}
+
+// contentMismatch reports whether the content of an item doesn't match its
+// extension, e.g. a JPEG file named .png. Content that isn't recognized
+// only counts if it's text, as a web page or a text file saved under a
+// media extension is.
+func contentMismatch(item *MediaItem, mimeType string) bool {
+	sniffed, ok := sniffedTypes[mimeType]
+	if !ok {
+		return strings.HasPrefix(mimeType, "text/")
+	}
+	if expected, ok := extensionMIMEs[strings.ToLower(filepath.Ext(item.Path))]; ok {
+		return mimeType != expected
+	}
+	// CBR comics are as often ZIP archives as RAR ones
+	if item.Type == "comic" && mimeType == "application/zip" {
+		return false
+	}
+	return sniffed != item.Type
+}
+
+// sniffMedia stores the content type of an item and flags it if the
+// content doesn't match its extension, clearing the flag if it does again.
+func (app *App) sniffMedia(item *MediaItem) error {
+	mimeType, err := sniffMIME(item.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := app.DB.Exec("UPDATE media SET mime_type = ? WHERE id = ?", mimeType, item.ID); err != nil {
+		return err
+	}
+	item.MimeType = mimeType
+
+	if contentMismatch(item, mimeType) {
+		return app.setFlag(item.ID, flagMismatch, sourceProbe)
+	}
+	return app.clearFlag(item.ID, flagMismatch)
+}
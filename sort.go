@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const sortNatural = "filename_natural"
+
+// captureDate is when an item was captured, as far as is known. Without a
+// recorded capture time the file's modification time is the best guess,
+// as cameras set it when shooting and copies usually keep it.
+const captureDate = "COALESCE(taken_at, file_mod_time, created_at)"
+
+// mediaSorts maps the values accepted by the sort query parameter to ORDER BY
+// clauses. Natural filename order can't be expressed in SQLite, so those
+// results are sorted in Go after loading.
+var mediaSorts = map[string]string{
+	"":           "created_at DESC, id DESC",
+	"created_at": "created_at DESC, id DESC",
+	"date":       captureDate + " DESC, id DESC",
+	"filename":   "filename COLLATE NOCASE, id",
+	"size":       "size DESC, id",
+	"duration":   "duration DESC, id",
+	"sharpness":  "sharpness IS NULL, sharpness, id",
+	sortNatural:  "id",
+}
+
+// orderBy returns the ORDER BY clause (including the keyword) for a sort
+// parameter.
+func orderBy(sort string) (string, error) {
+	clause, ok := mediaSorts[sort]
+	if !ok {
+		return "", fmt.Errorf("invalid sort: %s", sort)
+	}
+	return " ORDER BY " + clause, nil
+}
+
+// sortMedia applies the parts of a sort that have to happen in Go.
+func sortMedia(items []MediaItem, order string) {
+	if order == sortNatural {
+		sort.SliceStable(items, func(i, j int) bool {
+			return naturalLess(items[i].Filename, items[j].Filename)
+		})
+	}
+}
+
+// naturalLess compares strings the way people expect filenames to sort:
+// case-insensitively, with runs of digits compared by numeric value, so
+// "Episode 2" sorts before "Episode 10".
+func naturalLess(a, b string) bool {
+	// Numbers with equal values but different leading zeros only decide
+	// the order if nothing else does
+	zeros := 0
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		ra, wa := utf8.DecodeRuneInString(a[i:])
+		rb, wb := utf8.DecodeRuneInString(b[j:])
+
+		if isDigit(ra) && isDigit(rb) {
+			ea, eb := digitsEnd(a, i), digitsEnd(b, j)
+			na := strings.TrimLeft(a[i:ea], "0")
+			nb := strings.TrimLeft(b[j:eb], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			if zeros == 0 {
+				zeros = (ea - i) - (eb - j)
+			}
+			i, j = ea, eb
+			continue
+		}
+
+		la, lb := unicode.ToLower(ra), unicode.ToLower(rb)
+		if la != lb {
+			return la < lb
+		}
+		i += wa
+		j += wb
+	}
+
+	if len(a)-i != len(b)-j {
+		return len(a)-i < len(b)-j
+	}
+	if zeros != 0 {
+		return zeros < 0
+	}
+	return a < b
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func digitsEnd(s string, i int) int {
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
@@ -0,0 +1,653 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// stagingTTL is how long a staging session is kept after it was last used.
+const stagingTTL = 24 * time.Hour
+
+// StagingSession is a set of uploads waiting to be reviewed and committed
+// to a library, or discarded.
+type StagingSession struct {
+	ID string `db:"id" json:"id"`
+	// Library is where files without a library of their own are
+	// committed to.
+	Library   string       `db:"library" json:"library"`
+	CreatedAt time.Time    `db:"created_at" json:"created_at"`
+	ExpiresAt time.Time    `db:"expires_at" json:"expires_at"`
+	Files     []StagedFile `db:"-" json:"files"`
+}
+
+// StagedFile is an upload in a staging session.
+type StagedFile struct {
+	ID        int    `db:"id" json:"id"`
+	SessionID string `db:"session_id" json:"session_id"`
+	Filename  string `db:"filename" json:"filename"`
+	Size      int64  `db:"size" json:"size"`
+	Type      string `db:"type" json:"type"`
+	Checksum  string `db:"checksum" json:"checksum"`
+	// Library overrides the session's library for this file.
+	Library string `db:"library" json:"library"`
+	// Tags are given to the file's item when it is committed.
+	Tags      []string  `db:"-" json:"tags"`
+	TagsJSON  string    `db:"tags" json:"-"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// decodeTags fills in Tags from the stored list.
+func (f *StagedFile) decodeTags() error {
+	return json.Unmarshal([]byte(f.TagsJSON), &f.Tags)
+}
+
+// path returns where the staged file's content is stored. Files are stored
+// by ID so uploads with the same name don't collide.
+func (f *StagedFile) path() string {
+	return filepath.Join(stagingDir, f.SessionID, strconv.Itoa(f.ID))
+}
+
+// stagingResult is the outcome of committing one staged file.
+type stagingResult struct {
+	File    StagedFile `json:"file"`
+	Item    *MediaItem `json:"item,omitempty"`
+	Created bool       `json:"created"`
+	Error   string     `json:"error,omitempty"`
+}
+
+// expireStaging discards the sessions that haven't been used for
+// stagingTTL, along with their files.
+func (app *App) expireStaging() error {
+	var ids []string
+	if err := app.DB.Select(&ids, "SELECT id FROM staging_sessions WHERE expires_at < ?", time.Now().UTC()); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if err := app.discardSession(id); err != nil {
+			return err
+		}
+		log.Infof("Discarded expired staging session %s", id)
+	}
+	return nil
+}
+
+// discardSession deletes a session and its files.
+func (app *App) discardSession(id string) error {
+	if _, err := app.DB.Exec("DELETE FROM staging_sessions WHERE id = ?", id); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(stagingDir, id))
+}
+
+// sessionFromURL loads the unexpired staging session identified by the {id}
+// URL parameter and extends its lifetime, writing an error response and
+// returning nil if it can't.
+func (app *App) sessionFromURL(w http.ResponseWriter, r *http.Request) *StagingSession {
+	var session StagingSession
+	err := app.DB.Get(&session,
+		"SELECT * FROM staging_sessions WHERE id = ? AND expires_at >= ?",
+		chi.URLParam(r, "id"), time.Now().UTC(),
+	)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Staging session not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch staging session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	session.ExpiresAt = time.Now().UTC().Add(stagingTTL)
+	if _, err := app.DB.Exec("UPDATE staging_sessions SET expires_at = ? WHERE id = ?", session.ExpiresAt, session.ID); err != nil {
+		log.Warnf("Failed to extend staging session %s: %v", session.ID, err)
+	}
+
+	return &session
+}
+
+// stagedFromURL loads the staged file identified by the {fileID} URL
+// parameter within the session, writing an error response and returning nil
+// if it can't.
+func (app *App) stagedFromURL(w http.ResponseWriter, r *http.Request, session *StagingSession) *StagedFile {
+	id, err := strconv.Atoi(chi.URLParam(r, "fileID"))
+	if err != nil {
+		http.Error(w, "Invalid file ID", http.StatusBadRequest)
+		return nil
+	}
+
+	var file StagedFile
+	err = app.DB.Get(&file, "SELECT * FROM staged_files WHERE id = ? AND session_id = ?", id, session.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Staged file not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch staged file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if err := file.decodeTags(); err != nil {
+		log.Error("Failed to read staged file tags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return &file
+}
+
+// loadFiles fills in the session's files.
+func (app *App) loadFiles(session *StagingSession) error {
+	session.Files = []StagedFile{}
+	err := app.DB.Select(&session.Files, "SELECT * FROM staged_files WHERE session_id = ? ORDER BY id", session.ID)
+	if err != nil {
+		return err
+	}
+	for i := range session.Files {
+		if err := session.Files[i].decodeTags(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (app *App) createStaging(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Library string `json:"library"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Library != "" && app.Config.library(req.Library) == nil {
+		http.Error(w, fmt.Sprintf("Unknown library %q", req.Library), http.StatusBadRequest)
+		return
+	}
+
+	if err := app.expireStaging(); err != nil {
+		log.Warn("Failed to discard expired staging sessions:", err)
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Error("Failed to create staging session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	session := StagingSession{
+		ID:        hex.EncodeToString(b),
+		Library:   req.Library,
+		CreatedAt: now,
+		ExpiresAt: now.Add(stagingTTL),
+		Files:     []StagedFile{},
+	}
+
+	_, err := app.DB.NamedExec(
+		`INSERT INTO staging_sessions (id, library, created_at, expires_at)
+			VALUES (:id, :library, :created_at, :expires_at)`,
+		session,
+	)
+	if err != nil {
+		log.Error("Failed to create staging session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusCreated, session)
+}
+
+func (app *App) getStaging(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+
+	if err := app.loadFiles(session); err != nil {
+		log.Error("Failed to fetch staged files:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, session)
+}
+
+func (app *App) discardStaging(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+
+	if err := app.discardSession(session.ID); err != nil {
+		log.Error("Failed to discard staging session:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+func (app *App) stageFile(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	library := r.FormValue("library")
+	if library != "" && app.Config.library(library) == nil {
+		http.Error(w, fmt.Sprintf("Unknown library %q", library), http.StatusBadRequest)
+		return
+	}
+
+	src, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer src.Close()
+
+	file := StagedFile{
+		SessionID: session.ID,
+		Filename:  filepath.Base(header.Filename),
+		Library:   library,
+		Tags:      []string{},
+		CreatedAt: time.Now().UTC(),
+	}
+	mediaType, ok := supportedExtensions[strings.ToLower(filepath.Ext(file.Filename))]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported file type: %s", file.Filename), http.StatusBadRequest)
+		return
+	}
+	file.Type = mediaType
+
+	res, err := app.DB.NamedExec(
+		`INSERT INTO staged_files (session_id, filename, type, library, created_at)
+			VALUES (:session_id, :filename, :type, :library, :created_at)`,
+		file,
+	)
+	if err == nil {
+		var id int64
+		id, err = res.LastInsertId()
+		file.ID = int(id)
+	}
+	if err != nil {
+		log.Error("Failed to stage file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Hash while writing, so committing can skip duplicates without
+	// reading the file again
+	h := md5.New()
+	err = os.MkdirAll(filepath.Dir(file.path()), 0755)
+	if err == nil {
+		var out *os.File
+		out, err = os.Create(file.path())
+		if err == nil {
+			file.Size, err = io.Copy(io.MultiWriter(out, h), src)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err == nil {
+		file.Checksum = hex.EncodeToString(h.Sum(nil))
+		_, err = app.DB.Exec("UPDATE staged_files SET size = ?, checksum = ? WHERE id = ?", file.Size, file.Checksum, file.ID)
+	}
+	if err != nil {
+		os.Remove(file.path())
+		app.DB.Exec("DELETE FROM staged_files WHERE id = ?", file.ID)
+		log.Error("Failed to write staged file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusCreated, file)
+}
+
+// getStagedFile serves a staged file's content for previews.
+func (app *App) getStagedFile(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+	file := app.stagedFromURL(w, r, session)
+	if file == nil {
+		return
+	}
+
+	f, err := os.Open(file.path())
+	if err != nil {
+		log.Error("Failed to open staged file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	// The content type comes from the original filename
+	http.ServeContent(w, r, file.Filename, file.CreatedAt, f)
+}
+
+// updateStagedFile renames a staged file, assigns it a library or sets its
+// tags.
+func (app *App) updateStagedFile(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+	file := app.stagedFromURL(w, r, session)
+	if file == nil {
+		return
+	}
+
+	var req struct {
+		Filename *string  `json:"filename"`
+		Library  *string  `json:"library"`
+		Tags     []string `json:"tags"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Filename != nil {
+		filename := filepath.Base(*req.Filename)
+		mediaType, ok := supportedExtensions[strings.ToLower(filepath.Ext(filename))]
+		if !ok || filename != *req.Filename {
+			http.Error(w, fmt.Sprintf("Invalid filename: %s", *req.Filename), http.StatusBadRequest)
+			return
+		}
+		file.Filename, file.Type = filename, mediaType
+	}
+	if req.Library != nil {
+		if *req.Library != "" && app.Config.library(*req.Library) == nil {
+			http.Error(w, fmt.Sprintf("Unknown library %q", *req.Library), http.StatusBadRequest)
+			return
+		}
+		file.Library = *req.Library
+	}
+	if req.Tags != nil {
+		tags := make([]string, 0, len(req.Tags))
+		for _, name := range req.Tags {
+			name, err := tagName(name)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			tags = append(tags, name)
+		}
+		file.Tags = tags
+	}
+	tagsJSON, err := json.Marshal(file.Tags)
+	if err != nil {
+		log.Error("Failed to encode staged file tags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.DB.Exec(
+		"UPDATE staged_files SET filename = ?, type = ?, library = ?, tags = ? WHERE id = ?",
+		file.Filename, file.Type, file.Library, string(tagsJSON), file.ID,
+	)
+	if err != nil {
+		log.Error("Failed to update staged file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, file)
+}
+
+func (app *App) discardStagedFile(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+	file := app.stagedFromURL(w, r, session)
+	if file == nil {
+		return
+	}
+
+	if err := app.unstage(file); err != nil {
+		log.Error("Failed to discard staged file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{"success": true})
+}
+
+// unstage removes a file from its session.
+func (app *App) unstage(file *StagedFile) error {
+	if _, err := app.DB.Exec("DELETE FROM staged_files WHERE id = ?", file.ID); err != nil {
+		return err
+	}
+	if err := os.Remove(file.path()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// commitStaging moves the session's files into their libraries and adds
+// them to the library. Files that fail, or have no library, stay staged.
+func (app *App) commitStaging(w http.ResponseWriter, r *http.Request) {
+	session := app.sessionFromURL(w, r)
+	if session == nil {
+		return
+	}
+
+	if err := app.loadFiles(session); err != nil {
+		log.Error("Failed to fetch staged files:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	results := make([]stagingResult, 0, len(session.Files))
+	success := true
+	for i := range session.Files {
+		result := app.commitFile(session, &session.Files[i])
+		if result.Error != "" {
+			success = false
+		}
+		results = append(results, result)
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": success,
+		"results": results,
+	})
+}
+
+// commitFile moves a staged file into its library and imports it. Content
+// that is already in the library is discarded, as it is for uploads.
+func (app *App) commitFile(session *StagingSession, file *StagedFile) stagingResult {
+	result := stagingResult{File: *file}
+
+	name := file.Library
+	if name == "" {
+		name = session.Library
+	}
+	lib := app.Config.library(name)
+	if lib == nil {
+		result.Error = "No library assigned"
+		if name != "" {
+			result.Error = fmt.Sprintf("Unknown library %q", name)
+		}
+		return result
+	}
+
+	existing, err := app.findByContent(file.Checksum, file.Size)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if existing != nil {
+		app.keepDuplicate(existing, file.Filename)
+		result.Item = existing
+	} else {
+		if err := app.checkQuota(lib, file.Size); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		if path := existingName(lib, file.Filename); path != "" {
+			result.Error = fmt.Sprintf("File already exists: %s", path)
+			return result
+		}
+		volume, err := app.Placer.place(lib, supportedExtensions[strings.ToLower(filepath.Ext(file.Filename))], file.Size)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		dest := filepath.Join(volume, file.Filename)
+		if err := moveFile(file.path(), dest); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+
+		item, created, err := app.importFile(dest)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.Item, result.Created = item, created
+		log.Infof("Committed staged file %s to library %s", dest, lib.Name)
+	}
+
+	if err := app.tagCommitted(result.Item, file.Tags); err != nil {
+		log.Warnf("Failed to tag committed staged file %s: %v", result.Item.Path, err)
+	}
+	if err := app.unstage(file); err != nil {
+		log.Warnf("Failed to remove committed staged file %d: %v", file.ID, err)
+	}
+	return result
+}
+
+// tagCommitted gives the item of a committed staged file the file's tags.
+func (app *App) tagCommitted(item *MediaItem, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, name := range tags {
+		if err := tagMedia(tx, item.ID, name); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	app.writeBack(item)
+	return nil
+}
+
+// moveFile moves src to dst without replacing an existing file, copying
+// when they are on different file systems. A move interrupted after dst
+// was linked, by a crash or a failure to remove src, is finished rather
+// than refused.
+func moveFile(src, dst string) error {
+	// A copy is linked into place once complete, so dst is never partial.
+	// The partial file is removed last: while it's linked to dst, an
+	// interrupted move can tell its copy was complete.
+	partial := dst + ".partial"
+
+	err := os.Link(src, dst)
+	switch {
+	case err == nil, os.IsExist(err) && linkedFiles(src, dst):
+		return os.Remove(src)
+	case copiedOnDisk(dst):
+		if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Remove(partial)
+	case os.IsExist(err):
+		return fmt.Errorf("File already exists: %s", dst)
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return fmt.Errorf("File already exists: %s", dst)
+	}
+	// Left over from an interrupted copy
+	if err := os.Remove(partial); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Link(partial, dst)
+		if os.IsExist(err) {
+			err = fmt.Errorf("File already exists: %s", dst)
+		}
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	if err := os.Remove(src); err != nil {
+		return err
+	}
+	return os.Remove(partial)
+}
+
+// copiedOnDisk reports whether dst is the complete copy of a move across
+// file systems that was interrupted before its source was removed.
+func copiedOnDisk(dst string) bool {
+	return linkedFiles(dst+".partial", dst)
+}
+
+// linkedFiles reports whether a and b are names of the same file on disk.
+func linkedFiles(a, b string) bool {
+	aInfo, err := os.Lstat(a)
+	if err != nil {
+		return false
+	}
+	bInfo, err := os.Lstat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(aInfo, bInfo)
+}
@@ -0,0 +1,669 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxTagName is the maximum length of tag names and aliases.
+const maxTagName = 100
+
+// errUnknownParentTag is returned for a parent tag that doesn't exist.
+var errUnknownParentTag = errors.New("Parent tag not found")
+
+// Tag is a label items can be given. Its aliases are other names for it,
+// e.g. translations, which resolve to it wherever a tag is named: tagging
+// an item as "hund" gives it the tag "dog". Tags form a hierarchy through
+// their parents, e.g. Animals > Dogs > Corgi.
+type Tag struct {
+	ID        int       `db:"id" json:"id"`
+	Name      string    `db:"name" json:"name"`
+	ParentID  *int      `db:"parent_id" json:"parent_id"`
+	Aliases   []string  `db:"-" json:"aliases"`
+	Count     int       `db:"count" json:"count"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// TagNode is a tag with the tags below it in the hierarchy.
+type TagNode struct {
+	Tag
+	Children []*TagNode `json:"children"`
+}
+
+// tagError is a reason a tag can't be created or changed that lies with
+// the caller, because the name is invalid or already taken.
+type tagError string
+
+func (e tagError) Error() string {
+	return string(e)
+}
+
+// tagName validates a tag name or alias, returning it without surrounding
+// spaces. Names are lists in the tag filter, so they can't have commas.
+func tagName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > maxTagName || strings.Contains(name, ",") {
+		return "", tagError(fmt.Sprintf("Invalid tag name %q: use up to %d characters without commas", name, maxTagName))
+	}
+	return name, nil
+}
+
+// findTag returns the ID of the tag with the name or alias, ignoring case,
+// or sql.ErrNoRows.
+func findTag(tx *sqlx.Tx, name string) (int, error) {
+	var id int
+	err := tx.Get(&id, "SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ? LIMIT 1", name, name)
+	return id, err
+}
+
+// checkTagName returns a tagError if the name is already a tag or alias.
+func checkTagName(tx *sqlx.Tx, name string) error {
+	_, err := findTag(tx, name)
+	switch err {
+	case nil:
+		return tagError(fmt.Sprintf("Tag name already in use: %s", name))
+	case sql.ErrNoRows:
+		return nil
+	default:
+		return err
+	}
+}
+
+// checkTagParent returns an error if the tag can't be moved below parent,
+// because the parent doesn't exist or is the tag itself or one of its
+// descendants. A parent of 0 moves the tag to the top level.
+func checkTagParent(tx *sqlx.Tx, id, parent int) error {
+	if parent == 0 {
+		return nil
+	}
+
+	var exists bool
+	if err := tx.Get(&exists, "SELECT EXISTS (SELECT 1 FROM tags WHERE id = ?)", parent); err != nil {
+		return err
+	}
+	if !exists {
+		return errUnknownParentTag
+	}
+
+	below, err := tagDescends(tx, parent, id)
+	if err != nil {
+		return err
+	}
+	if parent == id || below {
+		return tagError("A tag can't be moved below itself")
+	}
+	return nil
+}
+
+// tagDescends reports whether the tag id is below ancestor in the
+// hierarchy.
+func tagDescends(tx *sqlx.Tx, id, ancestor int) (bool, error) {
+	var below bool
+	err := tx.Get(&below,
+		`WITH RECURSIVE up(id) AS (
+			SELECT parent_id FROM tags WHERE id = ?
+			UNION SELECT t.parent_id FROM tags t JOIN up ON t.id = up.id
+		) SELECT EXISTS (SELECT 1 FROM up WHERE id = ?)`,
+		id, ancestor,
+	)
+	return below, err
+}
+
+// nullableTag stores a parent of 0 as NULL.
+func nullableTag(id int) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// resolveTag returns the ID of the tag with the name or alias, creating the
+// tag if there is none, so importers and users adding a known alias keep
+// the vocabulary from fragmenting.
+func resolveTag(tx *sqlx.Tx, name string) (int, error) {
+	id, err := findTag(tx, name)
+	if err != sql.ErrNoRows {
+		return id, err
+	}
+
+	res, err := tx.Exec("INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+	lastID, err := res.LastInsertId()
+	return int(lastID), err
+}
+
+// tagMedia gives an item the tag with the name or alias.
+func tagMedia(tx *sqlx.Tx, mediaID int, name string) error {
+	id, err := resolveTag(tx, name)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT OR IGNORE INTO media_tags (media_id, tag_id) VALUES (?, ?)", mediaID, id)
+	return err
+}
+
+// loadTags returns the tags matching the condition, with their aliases and
+// item counts.
+func (app *App) loadTags(where string, args ...interface{}) ([]Tag, error) {
+	tags := []Tag{}
+	err := app.DB.Select(&tags,
+		`SELECT t.id, t.name, t.parent_id, t.created_at, (SELECT COUNT(*) FROM media_tags mt WHERE mt.tag_id = t.id) AS count
+			FROM tags t`+where+` ORDER BY t.name`,
+		args...,
+	)
+	if err != nil || len(tags) == 0 {
+		return tags, err
+	}
+
+	var aliases []struct {
+		TagID int    `db:"tag_id"`
+		Name  string `db:"name"`
+	}
+	err = app.DB.Select(&aliases,
+		"SELECT tag_id, name FROM tag_aliases WHERE tag_id IN (SELECT t.id FROM tags t"+where+") ORDER BY name",
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[int]*Tag, len(tags))
+	for i := range tags {
+		tags[i].Aliases = []string{}
+		index[tags[i].ID] = &tags[i]
+	}
+	for _, alias := range aliases {
+		if tag := index[alias.TagID]; tag != nil {
+			tag.Aliases = append(tag.Aliases, alias.Name)
+		}
+	}
+	return tags, nil
+}
+
+// tagFromURL fetches the tag named by the id URL parameter, writing an
+// error response and returning nil if it can't.
+func (app *App) tagFromURL(w http.ResponseWriter, r *http.Request) *Tag {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid tag ID", http.StatusBadRequest)
+		return nil
+	}
+	return app.loadTag(w, id)
+}
+
+// loadTag fetches a tag, writing an error response and returning nil if it
+// doesn't exist or can't be loaded.
+func (app *App) loadTag(w http.ResponseWriter, id int) *Tag {
+	tags, err := app.loadTags(" WHERE t.id = ?", id)
+	if err != nil {
+		log.Error("Failed to fetch tag:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	if len(tags) == 0 {
+		http.Error(w, "Tag not found", http.StatusNotFound)
+		return nil
+	}
+	return &tags[0]
+}
+
+// writeTagTxError rolls back a failed tag change and writes the error
+// response: 409 Conflict for names already in use and hierarchy cycles.
+func writeTagTxError(w http.ResponseWriter, tx *sqlx.Tx, err error) {
+	tx.Rollback()
+	if _, ok := err.(tagError); ok {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err == errUnknownParentTag {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Error("Failed to update tags:", err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+func (app *App) getTags(w http.ResponseWriter, r *http.Request) {
+	tags, err := app.loadTags("")
+	if err != nil {
+		log.Error("Failed to fetch tags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, tags)
+}
+
+// getTagTree returns the tags as a hierarchy, the top-level tags first.
+func (app *App) getTagTree(w http.ResponseWriter, r *http.Request) {
+	tags, err := app.loadTags("")
+	if err != nil {
+		log.Error("Failed to fetch tags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nodes := make(map[int]*TagNode, len(tags))
+	for _, tag := range tags {
+		nodes[tag.ID] = &TagNode{Tag: tag, Children: []*TagNode{}}
+	}
+	roots := []*TagNode{}
+	for _, tag := range tags {
+		if tag.ParentID == nil {
+			roots = append(roots, nodes[tag.ID])
+		} else {
+			parent := nodes[*tag.ParentID]
+			parent.Children = append(parent.Children, nodes[tag.ID])
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, roots)
+}
+
+func (app *App) getTag(w http.ResponseWriter, r *http.Request) {
+	if tag := app.tagFromURL(w, r); tag != nil {
+		app.writeJSON(w, r, http.StatusOK, tag)
+	}
+}
+
+// createTag creates a tag, optionally with aliases and below a parent.
+// Neither the name nor the aliases may already be in use by another tag.
+func (app *App) createTag(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name     string   `json:"name"`
+		Aliases  []string `json:"aliases"`
+		ParentID int      `json:"parent_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	names := append([]string{req.Name}, req.Aliases...)
+	for i, name := range names {
+		clean, err := tagName(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		names[i] = clean
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to create tag:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var id int64
+	err = checkTagParent(tx, 0, req.ParentID)
+	for i, name := range names {
+		if err != nil {
+			break
+		}
+		if err = checkTagName(tx, name); err != nil {
+			break
+		}
+		if i == 0 {
+			var res sql.Result
+			if res, err = tx.Exec("INSERT INTO tags (name, parent_id) VALUES (?, ?)", name, nullableTag(req.ParentID)); err == nil {
+				id, err = res.LastInsertId()
+			}
+		} else {
+			_, err = tx.Exec("INSERT INTO tag_aliases (name, tag_id) VALUES (?, ?)", name, id)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTagTxError(w, tx, err)
+		return
+	}
+
+	if tag := app.loadTag(w, int(id)); tag != nil {
+		app.writeJSON(w, r, http.StatusCreated, tag)
+	}
+}
+
+// updateTag renames a tag or moves it in the hierarchy, along with the
+// tags below it. A parent_id of 0 moves it to the top level.
+func (app *App) updateTag(w http.ResponseWriter, r *http.Request) {
+	tag := app.tagFromURL(w, r)
+	if tag == nil {
+		return
+	}
+
+	var req struct {
+		Name     *string `json:"name"`
+		ParentID *int    `json:"parent_id"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := tag.Name
+	if req.Name != nil {
+		clean, err := tagName(*req.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name = clean
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to update tag:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Changing the case of the tag's own name doesn't clash with it
+	if !strings.EqualFold(name, tag.Name) {
+		err = checkTagName(tx, name)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE tags SET name = ? WHERE id = ?", name, tag.ID)
+	}
+	if err == nil && req.ParentID != nil {
+		if err = checkTagParent(tx, tag.ID, *req.ParentID); err == nil {
+			_, err = tx.Exec("UPDATE tags SET parent_id = ? WHERE id = ?", nullableTag(*req.ParentID), tag.ID)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTagTxError(w, tx, err)
+		return
+	}
+
+	if tag := app.loadTag(w, tag.ID); tag != nil {
+		app.writeJSON(w, r, http.StatusOK, tag)
+	}
+}
+
+// deleteTag deletes a tag and its aliases, untagging its items. The tags
+// below it move up to its parent.
+func (app *App) deleteTag(w http.ResponseWriter, r *http.Request) {
+	tag := app.tagFromURL(w, r)
+	if tag == nil {
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to delete tag:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec("UPDATE tags SET parent_id = ? WHERE parent_id = ?", tag.ParentID, tag.ID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM tags WHERE id = ?", tag.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTagTxError(w, tx, err)
+		return
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+	})
+}
+
+// addTagAlias adds another name for a tag.
+func (app *App) addTagAlias(w http.ResponseWriter, r *http.Request) {
+	tag := app.tagFromURL(w, r)
+	if tag == nil {
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name, err := tagName(req.Name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to add tag alias:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = checkTagName(tx, name)
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO tag_aliases (name, tag_id) VALUES (?, ?)", name, tag.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTagTxError(w, tx, err)
+		return
+	}
+
+	if tag := app.loadTag(w, tag.ID); tag != nil {
+		app.writeJSON(w, r, http.StatusCreated, tag)
+	}
+}
+
+func (app *App) deleteTagAlias(w http.ResponseWriter, r *http.Request) {
+	tag := app.tagFromURL(w, r)
+	if tag == nil {
+		return
+	}
+
+	_, err := app.DB.Exec("DELETE FROM tag_aliases WHERE tag_id = ? AND name = ?", tag.ID, chi.URLParam(r, "name"))
+	if err != nil {
+		log.Error("Failed to delete tag alias:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if tag := app.loadTag(w, tag.ID); tag != nil {
+		app.writeJSON(w, r, http.StatusOK, tag)
+	}
+}
+
+// mergeTags folds the tag into another: its items get the other tag, and
+// its name and aliases become aliases of the other tag, so anything still
+// using them resolves to it from then on. The tags below it move below the
+// other tag.
+func (app *App) mergeTags(w http.ResponseWriter, r *http.Request) {
+	tag := app.tagFromURL(w, r)
+	if tag == nil {
+		return
+	}
+
+	var req struct {
+		Into int `json:"into"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Into == tag.ID {
+		http.Error(w, "Can't merge a tag into itself", http.StatusBadRequest)
+		return
+	}
+	into := app.loadTag(w, req.Into)
+	if into == nil {
+		return
+	}
+
+	var mediaIDs []int
+	if err := app.DB.Select(&mediaIDs, "SELECT media_id FROM media_tags WHERE tag_id = ?", tag.ID); err != nil {
+		log.Error("Failed to fetch tagged media:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to merge tags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A tag merged into one of its descendants leaves that descendant in
+	// its place, so the hierarchy can't loop
+	below, err := tagDescends(tx, into.ID, tag.ID)
+	if err == nil && below {
+		_, err = tx.Exec("UPDATE tags SET parent_id = ? WHERE id = ?", tag.ParentID, into.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE tags SET parent_id = ? WHERE parent_id = ?", into.ID, tag.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec(
+			"INSERT OR IGNORE INTO media_tags (media_id, tag_id) SELECT media_id, ? FROM media_tags WHERE tag_id = ?",
+			into.ID, tag.ID,
+		)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE media_markers SET tag_id = ? WHERE tag_id = ?", into.ID, tag.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE tag_aliases SET tag_id = ? WHERE tag_id = ?", into.ID, tag.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM tags WHERE id = ?", tag.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO tag_aliases (name, tag_id) VALUES (?, ?)", tag.Name, into.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTagTxError(w, tx, err)
+		return
+	}
+
+	for _, id := range mediaIDs {
+		var item MediaItem
+		if err := app.DB.Get(&item, "SELECT * FROM media WHERE id = ?", id); err == nil {
+			app.writeBack(&item)
+		}
+	}
+
+	if tag := app.loadTag(w, into.ID); tag != nil {
+		app.writeJSON(w, r, http.StatusOK, tag)
+	}
+}
+
+// itemTags returns the names of the tags of a media item, writing an error
+// response and returning nil if it can't.
+func (app *App) itemTags(w http.ResponseWriter, item *MediaItem) []string {
+	tags := []string{}
+	err := app.DB.Select(&tags,
+		"SELECT t.name FROM tags t JOIN media_tags mt ON mt.tag_id = t.id WHERE mt.media_id = ? ORDER BY t.name",
+		item.ID,
+	)
+	if err != nil {
+		log.Error("Failed to fetch tags:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return tags
+}
+
+func (app *App) getMediaTags(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	if tags := app.itemTags(w, item); tags != nil {
+		app.writeJSON(w, r, http.StatusOK, tags)
+	}
+}
+
+// addMediaTag tags an item by tag name or alias, creating the tag if the
+// name is new.
+func (app *App) addMediaTag(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	name, err := tagName(chi.URLParam(r, "name"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to tag media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = tagMedia(tx, item.ID, name)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		writeTagTxError(w, tx, err)
+		return
+	}
+	app.writeBack(item)
+
+	if tags := app.itemTags(w, item); tags != nil {
+		app.writeJSON(w, r, http.StatusOK, tags)
+	}
+}
+
+// removeMediaTag untags an item, by tag name or alias.
+func (app *App) removeMediaTag(w http.ResponseWriter, r *http.Request) {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	name := chi.URLParam(r, "name")
+	_, err := app.DB.Exec(
+		`DELETE FROM media_tags WHERE media_id = ? AND tag_id IN (
+			SELECT id FROM tags WHERE name = ? UNION SELECT tag_id FROM tag_aliases WHERE name = ?)`,
+		item.ID, name, name,
+	)
+	if err != nil {
+		log.Error("Failed to untag media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	app.writeBack(item)
+
+	if tags := app.itemTags(w, item); tags != nil {
+		app.writeJSON(w, r, http.StatusOK, tags)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// takeoutMaxName is the longest sidecar filename Google Takeout writes;
+// longer names are cut short before the ".json".
+const takeoutMaxName = 51
+
+// takeoutDuplicate matches the " (1)" style suffix Takeout adds to
+// duplicate filenames, which goes after the extension in the sidecar's
+// name: IMG(1).jpg has the sidecar IMG.jpg(1).json.
+var takeoutDuplicate = regexp.MustCompile(`^(.*)(\(\d+\))$`)
+
+// takeoutSidecar is the part of a Google Takeout metadata file that is
+// imported.
+type takeoutSidecar struct {
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"photoTakenTime"`
+	GeoData     takeoutGeo `json:"geoData"`
+	GeoDataExif takeoutGeo `json:"geoDataExif"`
+	People      []struct {
+		Name string `json:"name"`
+	} `json:"people"`
+}
+
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// findSidecar returns the path of the Takeout sidecar of a media file, or
+// an empty string if it has none. Edited copies ("IMG-edited.jpg") share
+// the sidecar of the original.
+func findSidecar(path string) string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	dup := ""
+	if m := takeoutDuplicate.FindStringSubmatch(stem); m != nil {
+		stem, dup = m[1], m[2]
+	}
+	stem = strings.TrimSuffix(stem, "-edited")
+
+	// Newer exports name sidecars IMG.jpg.supplemental-metadata.json
+	for _, base := range []string{stem + ext, stem + ext + ".supplemental-metadata"} {
+		candidate := base + dup + ".json"
+		if len(candidate) > takeoutMaxName {
+			candidate = base[:takeoutMaxName-len(".json")] + ".json"
+		}
+		if info, err := os.Stat(filepath.Join(dir, candidate)); err == nil && info.Mode().IsRegular() {
+			return filepath.Join(dir, candidate)
+		}
+	}
+	return ""
+}
+
+// applySidecar merges the Takeout sidecar of an item, if it has one: the
+// time the photo was taken, its description, the people in it and where it
+// was taken, unless the EXIF data already had a position. Locked items are
+// left alone.
+func (app *App) applySidecar(item *MediaItem) error {
+	if item.Locked {
+		return nil
+	}
+	path := findSidecar(item.Path)
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sidecar takeoutSidecar
+	if err := json.Unmarshal(data, &sidecar); err != nil {
+		return err
+	}
+
+	if ts, err := strconv.ParseInt(sidecar.PhotoTakenTime.Timestamp, 10, 64); err == nil && ts > 0 {
+		t := time.Unix(ts, 0).UTC()
+		item.TakenAt = &t
+	}
+	if sidecar.Description != "" {
+		item.Description = sidecar.Description
+	}
+
+	// Takeout writes zeros when there is no position. geoData has the
+	// position as edited in Google Photos, geoDataExif the original.
+	positioned := false
+	if item.Latitude == nil {
+		for _, geo := range []takeoutGeo{sidecar.GeoData, sidecar.GeoDataExif} {
+			if geo.Latitude != 0 || geo.Longitude != 0 {
+				lat, lon := geo.Latitude, geo.Longitude
+				item.Latitude, item.Longitude = &lat, &lon
+				positioned = true
+				break
+			}
+		}
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"UPDATE media SET taken_at = ?, description = ?, latitude = ?, longitude = ? WHERE id = ?",
+		item.TakenAt, item.Description, item.Latitude, item.Longitude, item.ID,
+	)
+	for _, person := range sidecar.People {
+		if err != nil {
+			break
+		}
+		if name := strings.TrimSpace(person.Name); name != "" {
+			err = linkPerson(tx, item.ID, name)
+		}
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if positioned {
+		return app.geocode(item)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"runtime"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimiter spaces out work to at most a given rate per second. A nil
+// limiter never waits.
+type rateLimiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// newRateLimiter returns a limiter for rate units per second, or nil if rate
+// isn't positive.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until n more units may be used.
+func (l *rateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+
+	now := time.Now()
+	if l.next.After(now) {
+		time.Sleep(l.next.Sub(now))
+	} else {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+}
+
+// runIdle runs fn on its own OS thread at idle CPU and IO priority, so it
+// only uses the disk and processor when nothing else wants them.
+func runIdle(fn func() error) error {
+	done := make(chan error, 1)
+
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// instead of going back to the scheduler with lowered priority
+		runtime.LockOSThread()
+		if err := setIdlePriority(); err != nil {
+			log.Warn("Failed to lower priority:", err)
+		}
+		done <- fn()
+	}()
+
+	return <-done
+}
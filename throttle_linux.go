@@ -0,0 +1,25 @@
+package main
+
+import (
+	"syscall"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// setIdlePriority moves the calling thread to the idle IO scheduling class
+// and the lowest CPU priority.
+func setIdlePriority() error {
+	tid := syscall.Gettid()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET,
+		ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+
+	return syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19)
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// setIdlePriority is only implemented on Linux.
+func setIdlePriority() error {
+	return errors.New("idle priority is not supported on this platform")
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	log "github.com/sirupsen/logrus"
+)
+
+// workerTimeout bounds a thumbnail worker request, including sending the
+// file.
+const workerTimeout = 2 * time.Minute
+
+// maxThumbnailBytes is the largest thumbnail accepted from a worker.
+const maxThumbnailBytes = 16 << 20
+
+// defaultWorkerMaxBytes is the largest file a thumbnail worker accepts
+// unless told otherwise.
+const defaultWorkerMaxBytes = 8 << 30
+
+// errNoThumbnail is returned by thumbnailers that can't render thumbnails
+// of an item's type.
+var errNoThumbnail = errors.New("no thumbnail renderer for this type")
+
+// thumbnailer renders the thumbnail of an item as JPEG, scaled down to
+// thumbnailSize and turned upright.
+type thumbnailer interface {
+	thumbnail(item *MediaItem) ([]byte, error)
+}
+
+// newThumbnailer returns the thumbnailer the configuration asks for: the
+// workers if there are any, otherwise the local one, which renders video
+// frames with ffmpeg.
+func newThumbnailer(config ThumbnailsConfig, ffmpeg string) (thumbnailer, error) {
+	local := &localThumbnailer{ffmpeg: ffmpeg}
+	if len(config.Workers) == 0 {
+		return local, nil
+	}
+
+	w := &workerThumbnailer{client: &http.Client{Timeout: workerTimeout}, token: config.Token}
+	for _, s := range config.Workers {
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid worker URL %q", s)
+		}
+		w.workers = append(w.workers, strings.TrimSuffix(s, "/"))
+	}
+	if config.LocalFallback {
+		w.fallback = local
+	}
+	return w, nil
+}
+
+// renderThumbnail renders the thumbnail of an item and writes it to the
+// thumbnail directory, returning its name. It returns errNoThumbnail if
+// there is no way to render one.
+func (app *App) renderThumbnail(item *MediaItem) (string, error) {
+	data, err := app.Thumbnailer.thumbnail(item)
+	if err != nil {
+		return "", err
+	}
+	return saveThumbnail(item, data)
+}
+
+// localThumbnailer decodes images itself, except WebP, which the standard
+// library can't, and video frames taken with ffmpeg.
+type localThumbnailer struct {
+	ffmpeg string
+}
+
+func (t *localThumbnailer) thumbnail(item *MediaItem) ([]byte, error) {
+	var img image.Image
+	var err error
+	switch {
+	case item.Type == "image" && strings.ToLower(filepath.Ext(item.Path)) != ".webp":
+		img, err = decodeImage(item.Path)
+	case item.Type == "video" && t.ffmpeg != "":
+		img, err = t.videoFrame(item)
+	default:
+		return nil, errNoThumbnail
+	}
+	if err != nil {
+		return nil, err
+	}
+	return encodeThumbnail(item, img)
+}
+
+// videoFrame takes the frame at 10% of a video, past intros and fades from
+// black.
+func (t *localThumbnailer) videoFrame(item *MediaItem) (image.Image, error) {
+	out, err := runTool(t.ffmpeg,
+		"-v", "error", "-ss", strconv.FormatFloat(item.Duration*0.1, 'f', 3, 64), "-i", item.Path,
+		"-frames:v", "1", "-f", "image2pipe", "-vcodec", "png", "-",
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New("no video frame")
+	}
+	img, _, err := image.Decode(bytes.NewReader(out))
+	return img, err
+}
+
+// workerThumbnailer sends items to external thumbnail workers, so the heavy
+// decoding runs on another machine. Items are spread across the workers in
+// turn; if one fails the next is tried, and then the fallback, if any.
+//
+// The protocol is a POST of the file to the worker's /thumbnail, with the
+// item's type, filename, EXIF orientation and duration as query
+// parameters, and the shared token in an X-Worker-Token header. The worker
+// answers with the thumbnail as image/jpeg, or 415 Unsupported Media Type
+// if it can't render that kind of file.
+type workerThumbnailer struct {
+	workers  []string
+	token    string
+	fallback thumbnailer
+	client   *http.Client
+
+	mu   sync.Mutex
+	next int
+}
+
+func (t *workerThumbnailer) thumbnail(item *MediaItem) ([]byte, error) {
+	t.mu.Lock()
+	first := t.next
+	t.next = (t.next + 1) % len(t.workers)
+	t.mu.Unlock()
+
+	var err error
+	for i := range t.workers {
+		worker := t.workers[(first+i)%len(t.workers)]
+		var data []byte
+		if data, err = t.request(worker, item); err == nil || err == errNoThumbnail {
+			return data, err
+		}
+		log.Warnf("Thumbnail worker %s failed on %s: %v", worker, item.Path, err)
+	}
+	if t.fallback != nil {
+		return t.fallback.thumbnail(item)
+	}
+	return nil, err
+}
+
+func (t *workerThumbnailer) request(worker string, item *MediaItem) ([]byte, error) {
+	f, err := os.Open(item.Path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("type", item.Type)
+	query.Set("filename", filepath.Base(item.Path))
+	query.Set("orientation", strconv.Itoa(item.Orientation))
+	query.Set("duration", strconv.FormatFloat(item.Duration, 'f', -1, 64))
+	req, err := http.NewRequest(http.MethodPost, worker+"/thumbnail?"+query.Encode(), f)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if t.token != "" {
+		req.Header.Set("X-Worker-Token", t.token)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return io.ReadAll(io.LimitReader(resp.Body, maxThumbnailBytes))
+	case http.StatusUnsupportedMediaType:
+		return nil, errNoThumbnail
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+// thumbnailWorker serves the worker protocol with a local thumbnailer.
+type thumbnailWorker struct {
+	local *localThumbnailer
+	// token, if set, must be sent in an X-Worker-Token header.
+	token    string
+	maxBytes int64
+}
+
+// runThumbnailWorker runs a thumbnail worker, started as "media-organizer
+// thumbnailer" on the machine that should do the decoding, e.g. one with a
+// GPU for ffmpeg. It needs no database or configuration file. It listens
+// on the loopback interface unless told otherwise.
+func runThumbnailWorker(args []string) error {
+	flags := flag.NewFlagSet("thumbnailer", flag.ContinueOnError)
+	listen := flags.String("listen", "127.0.0.1:9998", "address to listen on")
+	token := flags.String("token", os.Getenv("MEDIA_ORGANIZER_WORKER_TOKEN"), "shared token the server must send; defaults to $MEDIA_ORGANIZER_WORKER_TOKEN")
+	maxBytes := flags.Int64("max-bytes", defaultWorkerMaxBytes, "largest file accepted, in bytes")
+	ffmpeg := flags.String("ffmpeg", "ffmpeg", "ffmpeg binary for video frames; empty disables videos")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	t := &thumbnailWorker{
+		local:    &localThumbnailer{ffmpeg: findTool(*ffmpeg, "video thumbnails")},
+		token:    *token,
+		maxBytes: *maxBytes,
+	}
+	r := chi.NewRouter()
+	r.Post("/thumbnail", t.serveThumbnail)
+
+	if t.token == "" {
+		log.Warn("Thumbnail worker has no token; anyone who can reach it can use it")
+	}
+	log.Infof("Thumbnail worker listening on %s", *listen)
+	return http.ListenAndServe(*listen, r)
+}
+
+// serveThumbnail answers a thumbnail request of the worker protocol.
+func (t *thumbnailWorker) serveThumbnail(w http.ResponseWriter, r *http.Request) {
+	if t.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Worker-Token")), []byte(t.token)) != 1 {
+		http.Error(w, "Invalid worker token", http.StatusUnauthorized)
+		return
+	}
+	if r.ContentLength > t.maxBytes {
+		http.Error(w, fmt.Sprintf("File exceeds %d bytes", t.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, t.maxBytes)
+
+	query := r.URL.Query()
+	item := &MediaItem{Type: query.Get("type")}
+	item.Orientation, _ = strconv.Atoi(query.Get("orientation"))
+	item.Duration, _ = strconv.ParseFloat(query.Get("duration"), 64)
+
+	// The extension is kept, since it tells WebP images apart
+	tmp, err := os.CreateTemp("", "thumbnail-*"+filepath.Ext(query.Get("filename")))
+	if err != nil {
+		log.Error("Failed to create temporary file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, r.Body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		http.Error(w, fmt.Sprintf("File exceeds %d bytes", t.maxBytes), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	item.Path = tmp.Name()
+
+	data, err := t.local.thumbnail(item)
+	if err == errNoThumbnail || err == errUnknownImageFormat {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Warnf("Failed to render thumbnail of %s: %v", query.Get("filename"), err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Write(data)
+}
+
+// encodeThumbnail scales an image of an item down, turns it upright and
+// encodes it as JPEG.
+func encodeThumbnail(item *MediaItem, img image.Image) ([]byte, error) {
+	// Scaling first leaves fewer pixels to turn
+	img = orientImage(scaleImage(img, thumbnailSize), item.Orientation)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: thumbnailQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// trashPurgeInterval is how often items past the trash retention are
+// purged.
+const trashPurgeInterval = time.Hour
+
+// sqliteTime is the layout go-sqlite3 stores times in, so times kept in
+// the trash are put back exactly as they were.
+const sqliteTime = "2006-01-02 15:04:05.999999999-07:00"
+
+// errTrashConflict is returned when restoring an item whose path has been
+// taken since it was trashed.
+var errTrashConflict = errors.New("path is taken")
+
+// trashTables are the tables holding an item's rows besides its own, which
+// are kept with it in the trash and put back when it is restored.
+var trashTables = []string{
+	"media_aliases",
+	"media_flags",
+	"media_people",
+	"media_genres",
+	"media_attributes",
+	"media_tags",
+	"media_attachments",
+	"media_markers",
+	"media_files",
+	"collection_items",
+	"video_fingerprints",
+}
+
+// TrashItem is an item deleted from the library, which can be restored
+// until the trash is emptied or its retention runs out. File is where its
+// file was moved within the trash, if it was.
+type TrashItem struct {
+	ID          int        `db:"id" json:"id"`
+	MediaID     int        `db:"media_id" json:"media_id"`
+	Path        string     `db:"path" json:"path"`
+	Filename    string     `db:"filename" json:"filename"`
+	Type        string     `db:"type" json:"type"`
+	Size        int64      `db:"size" json:"size"`
+	File        string     `db:"file" json:"-"`
+	FileTrashed bool       `db:"-" json:"file_trashed"`
+	Snapshot    string     `db:"snapshot" json:"-"`
+	TrashedAt   time.Time  `db:"trashed_at" json:"trashed_at"`
+	ExpiresAt   *time.Time `db:"-" json:"expires_at"`
+}
+
+// trashSnapshot is an item's row and the rows of trashTables that refer
+// to it, as column values.
+type trashSnapshot struct {
+	Media map[string]interface{}              `json:"media"`
+	Rows  map[string][]map[string]interface{} `json:"rows"`
+}
+
+// snapshotRow reads a row as column values that survive a trip through
+// JSON and back into the database.
+func snapshotRow(rows *sqlx.Rows) (map[string]interface{}, error) {
+	row := map[string]interface{}{}
+	if err := rows.MapScan(row); err != nil {
+		return nil, err
+	}
+	for column, v := range row {
+		switch v := v.(type) {
+		case []byte:
+			row[column] = string(v)
+		case time.Time:
+			row[column] = v.Format(sqliteTime)
+		}
+	}
+	return row, nil
+}
+
+// snapshotRows reads the rows a query returns.
+func snapshotRows(tx *sqlx.Tx, query string, args ...interface{}) ([]map[string]interface{}, error) {
+	rows, err := tx.Queryx(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []map[string]interface{}
+	for rows.Next() {
+		row, err := snapshotRow(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
+
+// insertRow inserts the column values of a snapshot row into table.
+func insertRow(tx *sqlx.Tx, table string, row map[string]interface{}) error {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	args := make([]interface{}, len(columns))
+	for i, column := range columns {
+		args[i] = row[column]
+		// Numbers are decoded as json.Number, so large integers keep
+		// their precision
+		if n, ok := args[i].(json.Number); ok {
+			if v, err := n.Int64(); err == nil {
+				args[i] = v
+			} else if v, err := n.Float64(); err == nil {
+				args[i] = v
+			}
+		}
+	}
+	_, err := tx.Exec(
+		"INSERT INTO "+table+" ("+strings.Join(columns, ", ")+") VALUES (?"+strings.Repeat(", ?", len(columns)-1)+")",
+		args...,
+	)
+	return err
+}
+
+// trashMediaItems moves the unlocked items among ids to the trash, with
+// their files if files is set, and returns how many were trashed. Files of
+// immutable libraries stay where they are.
+func (app *App) trashMediaItems(ids []int, files bool) (int, error) {
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	trashed := map[int]*MediaItem{}
+	for _, id := range ids {
+		// Items locked since the preview are left alone
+		var item MediaItem
+		err := tx.Get(&item, "SELECT * FROM media WHERE id = ? AND NOT locked", id)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		snapshot := trashSnapshot{Rows: map[string][]map[string]interface{}{}}
+		media, err := snapshotRows(tx, "SELECT * FROM media WHERE id = ?", id)
+		if err != nil {
+			return 0, err
+		}
+		snapshot.Media = media[0]
+		for _, table := range trashTables {
+			rows, err := snapshotRows(tx, "SELECT * FROM "+table+" WHERE media_id = ?", id)
+			if err != nil {
+				return 0, err
+			}
+			if len(rows) > 0 {
+				snapshot.Rows[table] = rows
+			}
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return 0, err
+		}
+
+		res, err := tx.Exec(
+			`INSERT INTO trash (media_id, path, filename, type, size, snapshot, trashed_at)
+				VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			item.ID, item.Path, item.Filename, item.Type, item.Size, string(data), now,
+		)
+		if err != nil {
+			return 0, err
+		}
+		trashID, err := res.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("DELETE FROM media WHERE id = ?", id); err != nil {
+			return 0, err
+		}
+		trashed[int(trashID)] = &item
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	if files {
+		for trashID, item := range trashed {
+			if app.immutable(item) {
+				continue
+			}
+			if err := app.trashFile(trashID, item.Path); err != nil {
+				log.Warnf("Failed to move %s to the trash; it stays in place: %v", item.Path, err)
+			}
+		}
+	}
+	return len(trashed), nil
+}
+
+// trashFile moves the file of a trashed item into the trash folder.
+func (app *App) trashFile(trashID int, path string) error {
+	if err := os.MkdirAll(trashDir, 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(trashDir, strconv.Itoa(trashID)+filepath.Ext(path))
+	if err := moveFile(path, dst); err != nil {
+		return err
+	}
+	_, err := app.DB.Exec("UPDATE trash SET file = ? WHERE id = ?", dst, trashID)
+	return err
+}
+
+// restoreTrashItem puts a trashed item back in the library with its rows,
+// and its file back at its path. Rows referring to tags or collections
+// deleted in the meantime are dropped; people named by snapshots older
+// than people records are linked by name or alias, or created. It returns
+// errTrashConflict if the path was taken since.
+func (app *App) restoreTrashItem(t *TrashItem) error {
+	var snapshot trashSnapshot
+	dec := json.NewDecoder(strings.NewReader(t.Snapshot))
+	dec.UseNumber()
+	if err := dec.Decode(&snapshot); err != nil {
+		return err
+	}
+
+	var taken int
+	if err := app.DB.Get(&taken, "SELECT COUNT(*) FROM media WHERE path = ?", t.Path); err != nil {
+		return err
+	}
+	if taken > 0 {
+		return errTrashConflict
+	}
+	if t.File != "" {
+		if _, err := os.Lstat(t.Path); err == nil {
+			return errTrashConflict
+		}
+		if err := os.MkdirAll(filepath.Dir(t.Path), 0755); err != nil {
+			return err
+		}
+		if err := moveFile(t.File, t.Path); err != nil {
+			return err
+		}
+	}
+
+	err := func() error {
+		tx, err := app.DB.Beginx()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		if err := insertRow(tx, "media", snapshot.Media); err != nil {
+			return err
+		}
+		for _, table := range trashTables {
+			for _, row := range snapshot.Rows[table] {
+				// Items trashed before people were records of their own
+				// name them instead
+				if name, ok := row["name"].(string); ok && table == "media_people" {
+					if err := linkPerson(tx, t.MediaID, name); err != nil {
+						log.Warnf("Restoring media item %d: dropped person %q: %v", t.MediaID, name, err)
+					}
+					continue
+				}
+				if err := insertRow(tx, table, row); err != nil {
+					log.Warnf("Restoring media item %d: dropped a row of %s: %v", t.MediaID, table, err)
+				}
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM trash WHERE id = ?", t.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}()
+	if err != nil && t.File != "" {
+		if moveErr := moveFile(t.Path, t.File); moveErr != nil {
+			log.Warnf("Failed to move %s back to the trash: %v", t.Path, moveErr)
+		}
+	}
+	return err
+}
+
+// removeGeneratedFiles removes what is stored for an item that is gone for
+// good: its thumbnail and attachments.
+func removeGeneratedFiles(mediaID int, thumbnail string) error {
+	if thumbnail != "" {
+		err := os.Remove(filepath.Join(thumbnailDir, thumbnail))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(attachmentDir, strconv.Itoa(mediaID)))
+}
+
+// purgeTrash deletes the trashed items trashed before the given time for
+// good, with their files in the trash, attachments and thumbnails.
+func (app *App) purgeTrash(before time.Time) (int, error) {
+	var items []TrashItem
+	if err := app.DB.Select(&items, "SELECT * FROM trash WHERE trashed_at < ?", before.UTC()); err != nil {
+		return 0, err
+	}
+
+	for _, t := range items {
+		var snapshot trashSnapshot
+		if err := json.Unmarshal([]byte(t.Snapshot), &snapshot); err != nil {
+			return 0, err
+		}
+		if t.File != "" {
+			if err := os.Remove(t.File); err != nil && !os.IsNotExist(err) {
+				return 0, err
+			}
+		}
+		thumbnail, _ := snapshot.Media["thumbnail"].(string)
+		if err := removeGeneratedFiles(t.MediaID, thumbnail); err != nil {
+			return 0, err
+		}
+		if _, err := app.DB.Exec("DELETE FROM trash WHERE id = ?", t.ID); err != nil {
+			return 0, err
+		}
+	}
+	return len(items), nil
+}
+
+// scheduleTrashPurge purges the items past the configured retention now
+// and then every trashPurgeInterval. A retention of zero keeps them until
+// the trash is emptied.
+func (app *App) scheduleTrashPurge() {
+	days := app.Config.Trash.RetentionDays
+	if days <= 0 {
+		return
+	}
+
+	go func() {
+		for {
+			n, err := app.purgeTrash(time.Now().AddDate(0, 0, -days))
+			if err != nil {
+				log.Warn("Failed to purge the trash:", err)
+			} else if n > 0 {
+				log.Infof("Purged %d media items from the trash", n)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
+
+// getTrash lists the trashed items, most recently trashed first.
+func (app *App) getTrash(w http.ResponseWriter, r *http.Request) {
+	items := []TrashItem{}
+	if err := app.DB.Select(&items, "SELECT * FROM trash ORDER BY trashed_at DESC, id DESC"); err != nil {
+		log.Error("Failed to fetch trash:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for i := range items {
+		items[i].FileTrashed = items[i].File != ""
+		if days := app.Config.Trash.RetentionDays; days > 0 {
+			expires := items[i].TrashedAt.AddDate(0, 0, days)
+			items[i].ExpiresAt = &expires
+		}
+	}
+	app.writeJSON(w, r, http.StatusOK, items)
+}
+
+// restoreTrash puts a trashed item back in the library, under its old ID.
+func (app *App) restoreTrash(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.Error(w, "Invalid trash ID", http.StatusBadRequest)
+		return
+	}
+
+	var t TrashItem
+	err = app.DB.Get(&t, "SELECT * FROM trash WHERE id = ?", id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Trashed item not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to fetch trashed item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.restoreTrashItem(&t)
+	if err == errTrashConflict {
+		http.Error(w, fmt.Sprintf("Can't restore to %s: %v", t.Path, err), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to restore media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var item MediaItem
+	if err := app.DB.Get(&item, "SELECT * FROM media WHERE id = ?", t.MediaID); err != nil {
+		log.Error("Failed to fetch restored media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Restored media item %d from the trash", item.ID)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"item":    item,
+	})
+}
+
+// emptyTrash deletes everything in the trash for good.
+func (app *App) emptyTrash(w http.ResponseWriter, r *http.Request) {
+	purged, err := app.purgeTrash(time.Now().Add(time.Second))
+	if err != nil {
+		log.Error("Failed to empty trash:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Emptied the trash of %d media items", purged)
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"purged":  purged,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// statsPeriods are the calendar periods /api/stats compares. Weeks start on
+// Monday.
+var statsPeriods = map[string]bool{"day": true, "week": true, "month": true, "year": true}
+
+// PeriodTotals are what happened to the library in a period, from the
+// change log. Bytes are the sizes of the items when they were added or
+// deleted.
+type PeriodTotals struct {
+	Added        int   `json:"added"`
+	BytesAdded   int64 `json:"bytes_added"`
+	Deleted      int   `json:"deleted"`
+	BytesDeleted int64 `json:"bytes_deleted"`
+}
+
+// PeriodStats are the totals of a period, from Start up to but not
+// including End.
+type PeriodStats struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	PeriodTotals
+}
+
+// StatsComparison compares the current period so far with the whole
+// previous one. Change is current minus previous.
+type StatsComparison struct {
+	Period   string       `json:"period"`
+	Current  PeriodStats  `json:"current"`
+	Previous PeriodStats  `json:"previous"`
+	Change   PeriodTotals `json:"change"`
+}
+
+// periodStart returns the start of the period containing t, in local time.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.Local()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+	switch period {
+	case "week":
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	case "month":
+		return day.AddDate(0, 0, 1-day.Day())
+	case "year":
+		return time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.Local)
+	}
+	return day
+}
+
+// compareStats compares the period containing now with the one before it.
+func (app *App) compareStats(period string, now time.Time) (*StatsComparison, error) {
+	if !statsPeriods[period] {
+		return nil, fmt.Errorf("invalid compare: %s", period)
+	}
+
+	start := periodStart(period, now)
+	c := &StatsComparison{
+		Period:   period,
+		Current:  PeriodStats{Start: start, End: now},
+		Previous: PeriodStats{Start: periodStart(period, start.Add(-time.Nanosecond)), End: start},
+	}
+	for _, p := range []*PeriodStats{&c.Current, &c.Previous} {
+		totals, err := app.periodTotals(p.Start, p.End)
+		if err != nil {
+			return nil, err
+		}
+		p.PeriodTotals = *totals
+	}
+
+	c.Change = PeriodTotals{
+		Added:        c.Current.Added - c.Previous.Added,
+		BytesAdded:   c.Current.BytesAdded - c.Previous.BytesAdded,
+		Deleted:      c.Current.Deleted - c.Previous.Deleted,
+		BytesDeleted: c.Current.BytesDeleted - c.Previous.BytesDeleted,
+	}
+	return c, nil
+}
+
+// periodTotals counts the items added and deleted between start and end.
+func (app *App) periodTotals(start, end time.Time) (*PeriodTotals, error) {
+	// changed_at is stored by SQLite as UTC text with whole seconds, so
+	// the changes made in the second end falls in are counted
+	const layout = "2006-01-02 15:04:05"
+	if t := end.Truncate(time.Second); t.Before(end) {
+		end = t.Add(time.Second)
+	}
+	var rows []struct {
+		Op    string `db:"op"`
+		Count int    `db:"count"`
+		Bytes int64  `db:"bytes"`
+	}
+	err := app.DB.Select(&rows,
+		`SELECT op, COUNT(*) AS count, COALESCE(SUM(size), 0) AS bytes FROM media_changes
+			WHERE op IN ('created', 'deleted') AND changed_at >= ? AND changed_at < ? GROUP BY op`,
+		start.UTC().Format(layout), end.UTC().Format(layout),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	var totals PeriodTotals
+	for _, row := range rows {
+		if row.Op == "created" {
+			totals.Added, totals.BytesAdded = row.Count, row.Bytes
+		} else {
+			totals.Deleted, totals.BytesDeleted = row.Count, row.Bytes
+		}
+	}
+	return &totals, nil
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gitmvp-com/media-organizer-mvp/client"
+)
+
+// tuiPageSize is the number of items the terminal UI lists per page.
+const tuiPageSize = 20
+
+// tui is the terminal UI, a menu driven client of a running server for
+// boxes without a browser at hand.
+type tui struct {
+	api *client.Client
+	in  *bufio.Scanner
+	out io.Writer
+	ctx context.Context
+}
+
+// runTUI starts the terminal UI, run as "media-organizer tui". It talks to
+// the server at -server, by default the local one on the configured port.
+func runTUI(args []string) error {
+	server := "http://localhost:9999"
+	if config, err := loadConfig(configFile); err == nil {
+		server = fmt.Sprintf("http://localhost:%d", config.Server.Port)
+	}
+
+	flags := flag.NewFlagSet("tui", flag.ContinueOnError)
+	flags.StringVar(&server, "server", server, "address of the Media Organizer server")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	t := &tui{
+		api: client.New(server),
+		in:  bufio.NewScanner(os.Stdin),
+		out: os.Stdout,
+		ctx: context.Background(),
+	}
+	if _, err := t.api.Stats(t.ctx); err != nil {
+		return fmt.Errorf("can't reach the server at %s: %w", server, err)
+	}
+
+	for {
+		t.clear()
+		fmt.Fprintf(t.out, "Media Organizer - %s\n\n", server)
+		fmt.Fprintln(t.out, "  [b] Browse the library")
+		fmt.Fprintln(t.out, "  [s] Statistics")
+		fmt.Fprintln(t.out, "  [n] Scan a directory")
+		fmt.Fprintln(t.out, "  [d] Duplicate videos")
+		fmt.Fprintln(t.out, "  [q] Quit")
+
+		choice, ok := t.prompt("\n> ")
+		if !ok {
+			return nil
+		}
+		switch choice {
+		case "b":
+			t.browse()
+		case "s":
+			t.stats()
+		case "n":
+			t.scan()
+		case "d":
+			t.duplicates()
+		case "q":
+			return nil
+		}
+	}
+}
+
+// prompt reads a trimmed line of input. ok is false at the end of input.
+func (t *tui) prompt(label string) (string, bool) {
+	fmt.Fprint(t.out, label)
+	if !t.in.Scan() {
+		return "", false
+	}
+	return strings.TrimSpace(t.in.Text()), true
+}
+
+// pause waits for enter, so output stays on screen until it is read.
+func (t *tui) pause() {
+	t.prompt("\nPress enter to continue")
+}
+
+// clear clears the terminal with ANSI escapes.
+func (t *tui) clear() {
+	fmt.Fprint(t.out, "\033[H\033[2J")
+}
+
+// fail shows an error and waits for it to be read.
+func (t *tui) fail(err error) {
+	fmt.Fprintf(t.out, "\nError: %v\n", err)
+	t.pause()
+}
+
+// browse lists the items matching a search, a page at a time, and shows
+// the details of the one picked by its ID.
+func (t *tui) browse() {
+	query, ok := t.prompt("Search (empty for everything): ")
+	if !ok {
+		return
+	}
+	typ, ok := t.prompt("Type (video, image, audio, document, comic, raw; empty for all): ")
+	if !ok {
+		return
+	}
+	items, err := t.api.ListMedia(t.ctx, &client.ListOptions{Query: query, Type: typ})
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	page := 0
+	for {
+		t.clear()
+		start := page * tuiPageSize
+		end := start + tuiPageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		fmt.Fprintf(t.out, "%d items", len(items))
+		if len(items) > 0 {
+			fmt.Fprintf(t.out, ", %d-%d", start+1, end)
+		}
+		fmt.Fprint(t.out, "\n\n")
+		for _, item := range items[start:end] {
+			fmt.Fprintf(t.out, "%6d  %-8s %10s  %s\n", item.ID, item.Type, formatSize(item.Size), item.Path)
+		}
+
+		choice, ok := t.prompt("\n[n] next  [p] previous  [id] details  [b] back\n> ")
+		if !ok {
+			return
+		}
+		switch choice {
+		case "n":
+			if end < len(items) {
+				page++
+			}
+		case "p":
+			if page > 0 {
+				page--
+			}
+		case "b", "q":
+			return
+		default:
+			if id, err := strconv.Atoi(choice); err == nil {
+				t.details(id)
+			}
+		}
+	}
+}
+
+// details shows a media item.
+func (t *tui) details(id int) {
+	item, err := t.api.GetMedia(t.ctx, id)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	t.clear()
+	fmt.Fprintf(t.out, "%s\n\n", item.Path)
+	fmt.Fprintf(t.out, "  ID:       %d\n", item.ID)
+	fmt.Fprintf(t.out, "  Type:     %s\n", item.Type)
+	fmt.Fprintf(t.out, "  Size:     %s\n", formatSize(item.Size))
+	fmt.Fprintf(t.out, "  Added:    %s\n", item.CreatedAt.Local().Format("2006-01-02 15:04"))
+	if item.Title != "" {
+		fmt.Fprintf(t.out, "  Title:    %s\n", item.Title)
+	}
+	if item.Width > 0 {
+		fmt.Fprintf(t.out, "  Pixels:   %dx%d\n", item.Width, item.Height)
+	}
+	if item.Duration > 0 {
+		fmt.Fprintf(t.out, "  Duration: %s\n", formatDuration(item.Duration))
+	}
+	if item.Checksum != "" {
+		fmt.Fprintf(t.out, "  Checksum: %s\n", item.Checksum)
+	}
+	if item.Locked {
+		fmt.Fprintln(t.out, "  Locked")
+	}
+	t.pause()
+}
+
+// stats shows the library statistics.
+func (t *tui) stats() {
+	stats, err := t.api.Stats(t.ctx)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	t.clear()
+	fmt.Fprintf(t.out, "Total:     %d\n", stats.Total)
+	fmt.Fprintf(t.out, "Videos:    %d\n", stats.Videos)
+	fmt.Fprintf(t.out, "Images:    %d\n", stats.Images)
+	fmt.Fprintf(t.out, "RAWs:      %d\n", stats.RAWs)
+	fmt.Fprintf(t.out, "Audio:     %d\n", stats.Audio)
+	fmt.Fprintf(t.out, "Documents: %d\n", stats.Documents)
+	fmt.Fprintf(t.out, "Comics:    %d\n", stats.Comics)
+	if len(stats.Quotas) > 0 {
+		fmt.Fprintln(t.out, "\nQuotas:")
+		for _, q := range stats.Quotas {
+			fmt.Fprintf(t.out, "  %-20s %10s of %s\n", q.Library, formatSize(q.Used), formatSize(q.Quota))
+		}
+	}
+	t.pause()
+}
+
+// scan scans a directory on the server and shows the outcome.
+func (t *tui) scan() {
+	path, ok := t.prompt("Directory on the server: ")
+	if !ok || path == "" {
+		return
+	}
+	fmt.Fprintln(t.out, "Scanning...")
+	result, err := t.api.Scan(t.ctx, client.ScanRequest{Path: path})
+	if err != nil {
+		t.fail(err)
+		return
+	}
+
+	fmt.Fprintf(t.out, "\n%s\n\n", result.Message)
+	for _, dir := range result.Directories {
+		fmt.Fprintf(t.out, "  %-30s %6d added %6d skipped %6d errors\n", dir.Directory, dir.Added, dir.Skipped, dir.Errors)
+	}
+	t.pause()
+}
+
+// duplicates steps through the probable duplicate videos, removing the
+// copy picked from the library.
+func (t *tui) duplicates() {
+	pairs, err := t.api.VideoDuplicates(t.ctx, 0)
+	if err != nil {
+		t.fail(err)
+		return
+	}
+	if len(pairs) == 0 {
+		fmt.Fprintln(t.out, "\nNo duplicate videos found. Fingerprint videos with POST /api/media/fingerprint first.")
+		t.pause()
+		return
+	}
+
+	// A video removed as a copy in one pair drops out of the later ones
+	removed := map[int]bool{}
+	for i, pair := range pairs {
+		if removed[pair.Items[0].ID] || removed[pair.Items[1].ID] {
+			continue
+		}
+
+		t.clear()
+		fmt.Fprintf(t.out, "Pair %d of %d, %.1f%% similar\n\n", i+1, len(pairs), pair.Similarity*100)
+		for n, item := range pair.Items {
+			fmt.Fprintf(t.out, "  [%d] %s\n      %s, %dx%d, %s, %s\n", n+1, item.Path,
+				formatSize(item.Size), item.Width, item.Height, formatDuration(item.Duration), item.VideoCodec)
+		}
+
+		choice, ok := t.prompt("\nRemove [1] or [2] from the library (files stay on disk), [s] skip, [b] back\n> ")
+		if !ok || choice == "b" || choice == "q" {
+			return
+		}
+		n, err := strconv.Atoi(choice)
+		if err != nil || n < 1 || n > len(pair.Items) {
+			continue
+		}
+
+		item := pair.Items[n-1]
+		deleted, err := t.api.DeleteMedia(t.ctx, []int{item.ID})
+		if err != nil {
+			t.fail(err)
+			continue
+		}
+		if deleted == 0 {
+			fmt.Fprintln(t.out, "The item is locked and was kept.")
+			t.pause()
+			continue
+		}
+		removed[item.ID] = true
+	}
+}
+
+// formatSize formats a number of bytes for people.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatDuration formats seconds as h:mm:ss or m:ss.
+func formatDuration(seconds float64) string {
+	s := int(seconds + 0.5)
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
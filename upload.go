@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxUploadMemory is how much of a multipart upload is buffered in memory
+// before the rest is spooled to a temporary file.
+const maxUploadMemory = 32 << 20
+
+// libraryUsage returns the total size in bytes of all media stored on the
+// library's volumes.
+func (app *App) libraryUsage(lib *LibraryConfig) (int64, error) {
+	var total int64
+	for _, v := range lib.volumes() {
+		used, err := app.pathUsage(v)
+		if err != nil {
+			return 0, err
+		}
+		total += used
+	}
+	return total, nil
+}
+
+// pathUsage returns the total size in bytes of all media below dir.
+func (app *App) pathUsage(dir string) (int64, error) {
+	prefix := filepath.Clean(dir) + string(os.PathSeparator)
+
+	var used int64
+	err := app.DB.Get(&used,
+		"SELECT COALESCE(SUM(size), 0) FROM media WHERE substr(path, 1, length(?)) = ?",
+		prefix, prefix,
+	)
+	return used, err
+}
+
+// quotaError is returned when storing a file would exceed a library's quota.
+type quotaError string
+
+func (e quotaError) Error() string {
+	return string(e)
+}
+
+// checkQuota returns a quotaError if adding size bytes to the library would
+// exceed its quota.
+func (app *App) checkQuota(lib *LibraryConfig, size int64) error {
+	if lib.Quota <= 0 {
+		return nil
+	}
+
+	used, err := app.libraryUsage(lib)
+	if err != nil {
+		return err
+	}
+
+	if used+size > lib.Quota {
+		return quotaError(fmt.Sprintf(
+			"Upload of %d bytes would exceed the quota of library %q (%d of %d bytes used)",
+			size, lib.Name, used, lib.Quota,
+		))
+	}
+	return nil
+}
+
+// keepDuplicate records filename as an alias of the existing item whose
+// content was uploaded again, so the name isn't lost.
+func (app *App) keepDuplicate(existing *MediaItem, filename string) {
+	log.Infof("Upload %s duplicates %s, not storing a second copy", filename, existing.Path)
+	if filename != existing.Filename && !existing.Locked {
+		if err := app.addAlias(existing.ID, filename, ""); err != nil {
+			log.Warnf("Failed to record alias %s: %v", filename, err)
+		}
+	}
+}
+
+func (app *App) uploadMedia(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(maxUploadMemory); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	libraryName := r.FormValue("library")
+	lib := app.Config.library(libraryName)
+	if lib == nil {
+		http.Error(w, fmt.Sprintf("Unknown library %q", libraryName), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "File is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	filename := filepath.Base(header.Filename)
+	mediaType, ok := supportedExtensions[strings.ToLower(filepath.Ext(filename))]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unsupported file type: %s", filename), http.StatusBadRequest)
+		return
+	}
+
+	// Hash the upload first so content that is already in the library is
+	// never stored twice.
+	h := md5.New()
+	if _, err := io.Copy(h, file); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	checksum := hex.EncodeToString(h.Sum(nil))
+
+	existing, err := app.findByContent(checksum, header.Size)
+	if err != nil {
+		log.Error("Failed to look up duplicate content:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if existing != nil {
+		app.keepDuplicate(existing, filename)
+		app.writeJSON(w, r, http.StatusOK, existing)
+		return
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		log.Error("Failed to rewind upload:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := app.checkQuota(lib, header.Size); err != nil {
+		if _, ok := err.(quotaError); ok {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		log.Error("Failed to compute library usage:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if path := existingName(lib, filename); path != "" {
+		http.Error(w, fmt.Sprintf("File already exists: %s", path), http.StatusConflict)
+		return
+	}
+	volume, err := app.Placer.place(lib, mediaType, header.Size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	dest := filepath.Join(volume, filename)
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		http.Error(w, fmt.Sprintf("File already exists: %s", dest), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error("Failed to create upload file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	size, err := io.Copy(out, file)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+		log.Error("Failed to write upload file:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	media := MediaItem{
+		Path:     dest,
+		Filename: filename,
+		Size:     size,
+		Type:     mediaType,
+		Checksum: checksum,
+	}
+	if info, err := os.Stat(dest); err == nil {
+		modTime, birthTime := fileTimes(info)
+		media.FileModTime, media.FileBirthTime = &modTime, birthTime
+	}
+	if size > 0 {
+		if media.Oshash, err = fileOshash(dest); err != nil {
+			log.Warnf("Failed to hash %s: %v", dest, err)
+		}
+	}
+
+	res, err := app.DB.NamedExec(
+		`INSERT INTO media (path, filename, size, type, checksum, oshash, file_mod_time, file_birth_time)
+			VALUES (:path, :filename, :size, :type, :checksum, :oshash, :file_mod_time, :file_birth_time)`,
+		media,
+	)
+	if err == nil {
+		var id int64
+		id, err = res.LastInsertId()
+		if err == nil {
+			err = app.DB.Get(&media, "SELECT * FROM media WHERE id = ?", id)
+		}
+	}
+	if err != nil {
+		os.Remove(dest)
+		log.Error("Failed to insert uploaded media item:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.probeOrDefer(&media)
+	app.classifyNew(&media)
+	app.Events.publish(eventMediaAdded, media)
+
+	log.Infof("Uploaded %s to library %s", dest, lib.Name)
+
+	app.writeJSON(w, r, http.StatusCreated, media)
+}
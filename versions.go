@@ -0,0 +1,493 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// MediaFile is a file of an item besides its primary file, such as a 4K
+// copy of a 1080p video or the RAW file a JPEG was developed from. The
+// item's own columns describe its primary file; its other files are
+// versions of it, which share its metadata and are listed with it rather
+// than on their own.
+type MediaFile struct {
+	ID            int        `db:"id" json:"id"`
+	MediaID       int        `db:"media_id" json:"media_id"`
+	Path          string     `db:"path" json:"path"`
+	Filename      string     `db:"filename" json:"filename"`
+	Size          int64      `db:"size" json:"size"`
+	Type          string     `db:"type" json:"type"`
+	MimeType      string     `db:"mime_type" json:"mime_type"`
+	Checksum      string     `db:"checksum" json:"checksum"`
+	Oshash        string     `db:"oshash" json:"oshash"`
+	FileModTime   *time.Time `db:"file_mod_time" json:"file_mod_time"`
+	FileBirthTime *time.Time `db:"file_birth_time" json:"file_birth_time"`
+	Width         int        `db:"width" json:"width"`
+	Height        int        `db:"height" json:"height"`
+	Duration      float64    `db:"duration" json:"duration"`
+	VideoCodec    string     `db:"video_codec" json:"video_codec"`
+	AudioCodec    string     `db:"audio_codec" json:"audio_codec"`
+	Bitrate       int64      `db:"bitrate" json:"bitrate"`
+	Container     string     `db:"container" json:"container"`
+	// CreatedAt is when the file was added to the library.
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// fileColumns are the columns media_files shares with media, which move
+// between the two when a file becomes the primary or stops being one.
+// created_at is shared too, but an item keeps its own when its primary
+// changes.
+var fileColumns = []string{
+	"path", "filename", "size", "type", "mime_type", "checksum", "oshash",
+	"file_mod_time", "file_birth_time", "width", "height", "duration",
+	"video_codec", "audio_codec", "bitrate", "container",
+}
+
+// probedColumns are the other columns of media read from the primary file,
+// and the value each has until it is probed again.
+var probedColumns = map[string]string{
+	"verified_at":     "NULL",
+	"frame_rate":      "0",
+	"projection":      "''",
+	"hdr":             "''",
+	"stereo_mode":     "''",
+	"color_primaries": "''",
+	"color_transfer":  "''",
+	"color_space":     "''",
+	"bit_depth":       "0",
+	"animated":        "0",
+	"frames":          "0",
+	"orientation":     "0",
+	"audio_tracks":    "0",
+	"audio_channels":  "0",
+	"channel_layout":  "''",
+	"sample_rate":     "0",
+	"audio_languages": "''",
+	"pages":           "0",
+	"content":         "''",
+	"thumbnail":       "''",
+	"sharpness":       "NULL",
+	"phash":           "''",
+	"probed":          "0",
+}
+
+// itemColumns are the columns describing an item as a whole rather than
+// its file, which a file linked as a version fills in where the item has
+// none, and the value each has when not set.
+var itemColumns = map[string]string{
+	"title":          "''",
+	"description":    "''",
+	"year":           "0",
+	"taken_at":       "NULL",
+	"artist":         "''",
+	"album":          "''",
+	"content_rating": "''",
+	"rating_age":     "NULL",
+	"organized":      "0",
+}
+
+// itemTables are the tables linking an item as a whole, rather than its
+// file, to its tags, people, genres, attributes, albums, attachments and
+// markers, and the column that tells an item's rows apart.
+var itemTables = map[string]string{
+	"media_tags":        "tag_id",
+	"media_people":      "person_id",
+	"media_genres":      "name",
+	"media_attributes":  "key",
+	"collection_items":  "collection_id",
+	"media_attachments": "id",
+	"media_markers":     "id",
+}
+
+// versionKind returns the kind of media versions are compared by, which
+// is the type but for RAW files, versions of the JPEGs shot with them.
+func versionKind(mediaType string) string {
+	if mediaType == "raw" {
+		return "image"
+	}
+	return mediaType
+}
+
+// itemVersions returns the versions of an item.
+func (app *App) itemVersions(id int) ([]MediaFile, error) {
+	versions := []MediaFile{}
+	err := app.DB.Select(&versions, "SELECT * FROM media_files WHERE media_id = ? ORDER BY id", id)
+	return versions, err
+}
+
+// writeVersions writes the response to a change of versions: the item,
+// described by its primary file, with its versions, and whatever else is
+// in extra.
+func (app *App) writeVersions(w http.ResponseWriter, r *http.Request, id int, extra map[string]interface{}) {
+	var primary MediaItem
+	err := app.DB.Get(&primary, "SELECT * FROM media WHERE id = ?", id)
+	var versions []MediaFile
+	if err == nil {
+		versions, err = app.itemVersions(id)
+	}
+	if err != nil {
+		log.Error("Failed to fetch versions:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]interface{}{
+		"primary":  primary,
+		"versions": versions,
+	}
+	for k, v := range extra {
+		resp[k] = v
+	}
+	app.writeJSON(w, r, http.StatusOK, resp)
+}
+
+// primaryFromURL loads the media item identified by the {id} URL parameter
+// for a change of its versions, writing an error response and returning
+// nil if it can't or the item is an extra of another.
+func (app *App) primaryFromURL(w http.ResponseWriter, r *http.Request) *MediaItem {
+	item := app.mediaFromURL(w, r)
+	if item == nil {
+		return nil
+	}
+	if item.ParentID != nil {
+		http.Error(w, fmt.Sprintf("Media item is a %s of item %d", item.Extra, *item.ParentID), http.StatusBadRequest)
+		return nil
+	}
+	return item
+}
+
+// mergeItem folds the item from into the item to, whose file it becomes a
+// version of. What is recorded about to wins, and from fills in what to
+// lacks; from's versions and extras move over, and from is deleted.
+// Attachments are moved in the database only; the caller moves their
+// files once the transaction commits.
+func mergeItem(tx *sqlx.Tx, from, to int) error {
+	for column, unset := range itemColumns {
+		_, err := tx.Exec(
+			"UPDATE media SET "+column+" = COALESCE(NULLIF("+column+", "+unset+"), (SELECT "+column+" FROM media WHERE id = ?)) WHERE id = ?",
+			from, to,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	for table, key := range itemTables {
+		_, err := tx.Exec("DELETE FROM "+table+" WHERE media_id = ? AND "+key+" IN (SELECT "+key+" FROM "+table+" WHERE media_id = ?)", from, to)
+		if err == nil {
+			_, err = tx.Exec("UPDATE "+table+" SET media_id = ? WHERE media_id = ?", to, from)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	columns := strings.Join(fileColumns, ", ")
+	_, err := tx.Exec("INSERT INTO media_files (media_id, "+columns+", created_at) SELECT ?, "+columns+", created_at FROM media WHERE id = ?", to, from)
+	if err == nil {
+		_, err = tx.Exec("UPDATE media_files SET media_id = ? WHERE media_id = ?", to, from)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE media SET parent_id = ? WHERE parent_id = ?", to, from)
+	}
+	if err == nil {
+		_, err = tx.Exec("UPDATE collections SET cover_id = ? WHERE cover_id = ?", to, from)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM media WHERE id = ?", from)
+	}
+	return err
+}
+
+// moveAttachmentFiles moves the files of attachments that went from one
+// item to another.
+func moveAttachmentFiles(attachments []Attachment, to int) {
+	for _, a := range attachments {
+		src := a.path()
+		a.MediaID = to
+		if err := os.MkdirAll(filepath.Dir(a.path()), 0755); err != nil {
+			log.Warnf("Failed to move attachment %d: %v", a.ID, err)
+			continue
+		}
+		if err := os.Rename(src, a.path()); err != nil {
+			log.Warnf("Failed to move attachment %d: %v", a.ID, err)
+		}
+	}
+}
+
+// removeThumbnail removes a thumbnail that no longer belongs to an item.
+func removeThumbnail(name string) {
+	if name == "" {
+		return
+	}
+	if err := os.Remove(filepath.Join(thumbnailDir, name)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove thumbnail %s: %v", name, err)
+	}
+}
+
+func (app *App) getVersions(w http.ResponseWriter, r *http.Request) {
+	item := app.primaryFromURL(w, r)
+	if item == nil {
+		return
+	}
+	app.writeVersions(w, r, item.ID, nil)
+}
+
+// addVersions links the files of other items to an item as versions of
+// it. The other items are merged into it: their title and other metadata,
+// tags, people, genres, attributes, albums, attachments and markers fill
+// in what the item lacks, and their own versions and extras come along.
+func (app *App) addVersions(w http.ResponseWriter, r *http.Request) {
+	item := app.primaryFromURL(w, r)
+	if item == nil {
+		return
+	}
+	if item.Locked {
+		http.Error(w, "Media item is locked", http.StatusConflict)
+		return
+	}
+
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.IDs) == 0 {
+		http.Error(w, "ids is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to link versions:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var attachments []Attachment
+	var thumbnails []string
+	for _, id := range req.IDs {
+		var version MediaItem
+		err := tx.Get(&version, "SELECT * FROM media WHERE id = ?", id)
+		if err == sql.ErrNoRows {
+			http.Error(w, fmt.Sprintf("Media item %d not found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Error("Failed to link versions:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		switch {
+		case id == item.ID:
+			http.Error(w, "A media item can't be a version of itself", http.StatusBadRequest)
+			return
+		case version.Locked:
+			http.Error(w, fmt.Sprintf("Media item %d is locked", id), http.StatusConflict)
+			return
+		case version.Extra != "":
+			http.Error(w, fmt.Sprintf("Media item %d is a %s", id, version.Extra), http.StatusBadRequest)
+			return
+		case versionKind(version.Type) != versionKind(item.Type):
+			http.Error(w, fmt.Sprintf("Media item %d is of type %s, not %s", id, version.Type, item.Type), http.StatusBadRequest)
+			return
+		}
+
+		var moved []Attachment
+		err = tx.Select(&moved, "SELECT * FROM media_attachments WHERE media_id = ?", id)
+		if err == nil {
+			err = mergeItem(tx, id, item.ID)
+		}
+		if err != nil {
+			log.Error("Failed to link versions:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		attachments = append(attachments, moved...)
+		thumbnails = append(thumbnails, version.Thumbnail)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Error("Failed to link versions:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	moveAttachmentFiles(attachments, item.ID)
+	for _, name := range thumbnails {
+		removeThumbnail(name)
+	}
+	log.Infof("Linked %d versions to media item %d", len(req.IDs), item.ID)
+
+	if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err == nil {
+		app.writeBack(item)
+	}
+	app.writeVersions(w, r, item.ID, nil)
+}
+
+// loadVersion loads the version of the item with the ID given as a string,
+// writing an error response and returning nil if it can't.
+func (app *App) loadVersion(w http.ResponseWriter, item *MediaItem, param string) *MediaFile {
+	id, err := strconv.Atoi(param)
+	if err != nil {
+		http.Error(w, "Invalid version ID", http.StatusBadRequest)
+		return nil
+	}
+
+	var version MediaFile
+	err = app.DB.Get(&version, "SELECT * FROM media_files WHERE id = ? AND media_id = ?", id, item.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Version not found", http.StatusNotFound)
+		return nil
+	}
+	if err != nil {
+		log.Error("Failed to fetch version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	return &version
+}
+
+// removeVersion unlinks a version from its item, listing its file as an
+// item of its own again, without the item's metadata. Responds with the
+// item and its remaining versions, and the new item.
+func (app *App) removeVersion(w http.ResponseWriter, r *http.Request) {
+	item := app.primaryFromURL(w, r)
+	if item == nil {
+		return
+	}
+	version := app.loadVersion(w, item, chi.URLParam(r, "versionID"))
+	if version == nil {
+		return
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to unlink version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	columns := strings.Join(fileColumns, ", ")
+	res, err := tx.Exec("INSERT INTO media ("+columns+", created_at) SELECT "+columns+", created_at FROM media_files WHERE id = ?", version.ID)
+	var id int64
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM media_files WHERE id = ?", version.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Error("Failed to unlink version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var unlinked MediaItem
+	if err := app.DB.Get(&unlinked, "SELECT * FROM media WHERE id = ?", id); err != nil {
+		log.Error("Failed to fetch unlinked version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The client waits for the new item, so it isn't held back
+	if err := app.probeMedia(&unlinked); err != nil && err != errProbeUnavailable {
+		log.Warnf("Failed to probe %s: %v", unlinked.Path, err)
+	}
+	log.Infof("Unlinked %s from media item %d as item %d", version.Path, item.ID, unlinked.ID)
+
+	app.writeVersions(w, r, item.ID, map[string]interface{}{"item": unlinked})
+}
+
+// setPrimary makes a version the primary file of its item, and the old
+// primary a version. The item keeps its ID and everything recorded about
+// it; what was read from the old primary file is read again from the new
+// one. Responds with the item and its versions.
+func (app *App) setPrimary(w http.ResponseWriter, r *http.Request) {
+	item := app.primaryFromURL(w, r)
+	if item == nil {
+		return
+	}
+
+	var req struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	version := app.loadVersion(w, item, strconv.Itoa(req.ID))
+	if version == nil {
+		return
+	}
+	if item.Locked {
+		http.Error(w, "Media item is locked", http.StatusConflict)
+		return
+	}
+
+	var sets []string
+	for _, column := range fileColumns {
+		sets = append(sets, column+" = (SELECT "+column+" FROM media_files WHERE id = ?)")
+	}
+	args := make([]interface{}, 0, len(fileColumns)+1)
+	for range fileColumns {
+		args = append(args, version.ID)
+	}
+	for column, unset := range probedColumns {
+		sets = append(sets, column+" = "+unset)
+	}
+
+	tx, err := app.DB.Beginx()
+	if err != nil {
+		log.Error("Failed to set primary version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	columns := strings.Join(fileColumns, ", ")
+	_, err = tx.Exec("INSERT INTO media_files (media_id, "+columns+", created_at) SELECT id, "+columns+", created_at FROM media WHERE id = ?", item.ID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE media SET "+strings.Join(sets, ", ")+" WHERE id = ?", append(args, item.ID)...)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM media_files WHERE id = ?", version.ID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM video_fingerprints WHERE media_id = ?", item.ID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		tx.Rollback()
+		log.Error("Failed to set primary version:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	removeThumbnail(item.Thumbnail)
+	if err := app.DB.Get(item, "SELECT * FROM media WHERE id = ?", item.ID); err == nil {
+		// The client waits for the item, so it isn't held back
+		if err := app.probeMedia(item); err != nil && err != errProbeUnavailable {
+			log.Warnf("Failed to probe %s: %v", item.Path, err)
+		}
+	}
+	log.Infof("Made %s the primary file of media item %d", version.Path, item.ID)
+	app.writeVersions(w, r, item.ID, nil)
+}
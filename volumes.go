@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Placement policies for libraries with several volumes.
+const (
+	// placementMostFree puts new files on the volume with the most free
+	// space, so the volumes fill up evenly in absolute terms.
+	placementMostFree = "most_free"
+	// placementRoundRobin puts new files on each volume in turn.
+	placementRoundRobin = "round_robin"
+)
+
+// diskUsage is the size of a file system and the space left on it, in bytes.
+type diskUsage struct {
+	Total int64
+	Free  int64
+}
+
+// volumes returns the directories the library's files are stored in, the
+// library's path first.
+func (lib *LibraryConfig) volumes() []string {
+	volumes := []string{filepath.Clean(lib.Path)}
+	for _, v := range lib.Volumes {
+		volumes = append(volumes, filepath.Clean(v))
+	}
+	return volumes
+}
+
+// checkLibraries validates the settings of the libraries: the placement
+// policy must be known, types can only be pinned to the library's own
+// volumes, immutable libraries can't have metadata written to their files
+// and exclusions must be valid patterns.
+func checkLibraries(libs []LibraryConfig) error {
+	for i := range libs {
+		lib := &libs[i]
+		if lib.Immutable && lib.WriteMetadata {
+			return fmt.Errorf("library %q: an immutable library can't write metadata to its files", lib.Name)
+		}
+		if _, err := parseExcludes(lib.Exclude); err != nil {
+			return fmt.Errorf("library %q: exclude: %w", lib.Name, err)
+		}
+
+		switch lib.Placement {
+		case "", placementMostFree, placementRoundRobin:
+		default:
+			return fmt.Errorf("library %q: unknown placement %q", lib.Name, lib.Placement)
+		}
+
+		for mediaType, volume := range lib.Pinned {
+			if !knownType(mediaType) {
+				return fmt.Errorf("library %q: can't pin unknown type %q", lib.Name, mediaType)
+			}
+			found := false
+			for _, v := range lib.volumes() {
+				found = found || v == filepath.Clean(volume)
+			}
+			if !found {
+				return fmt.Errorf("library %q: %s is pinned to %s, which isn't one of its volumes", lib.Name, mediaType, volume)
+			}
+		}
+	}
+	return nil
+}
+
+// knownType reports whether files of the media type are supported.
+func knownType(mediaType string) bool {
+	for _, t := range supportedExtensions {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// volumePlacer chooses the volume new files of a library are stored on.
+type volumePlacer struct {
+	mu sync.Mutex
+	// next is the index of the volume each round robin library uses next.
+	next map[string]int
+}
+
+func newVolumePlacer() *volumePlacer {
+	return &volumePlacer{next: map[string]int{}}
+}
+
+// place returns the volume to store a new file of size bytes and the given
+// type on. A pinned type always goes to its volume. Otherwise volumes that
+// are known to be too full are passed over, and a quotaError is returned if
+// none has room.
+func (p *volumePlacer) place(lib *LibraryConfig, mediaType string, size int64) (string, error) {
+	if pinned, ok := lib.Pinned[mediaType]; ok {
+		return filepath.Clean(pinned), nil
+	}
+
+	volumes := lib.volumes()
+	if len(volumes) == 1 {
+		return volumes[0], nil
+	}
+
+	// Free space is unknown on platforms diskSpace doesn't support, and
+	// then every volume is assumed to have room
+	free := make([]int64, len(volumes))
+	for i, v := range volumes {
+		free[i] = -1
+		if space, err := diskSpace(v); err == nil {
+			free[i] = space.Free
+		}
+	}
+	fits := func(i int) bool {
+		return free[i] < 0 || free[i] >= size
+	}
+
+	if lib.Placement == placementRoundRobin {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		start := p.next[lib.Name]
+		for n := 0; n < len(volumes); n++ {
+			i := (start + n) % len(volumes)
+			if fits(i) {
+				p.next[lib.Name] = (i + 1) % len(volumes)
+				return volumes[i], nil
+			}
+		}
+	} else {
+		best := -1
+		for i := range volumes {
+			if fits(i) && (best < 0 || free[i] > free[best]) {
+				best = i
+			}
+		}
+		if best >= 0 {
+			return volumes[best], nil
+		}
+	}
+
+	return "", quotaError(fmt.Sprintf("No volume of library %q has room for %d bytes", lib.Name, size))
+}
+
+// existingName returns the path of a file called filename on any of the
+// library's volumes, or an empty string. Names are kept unique across the
+// volumes so the library reads as one directory.
+func existingName(lib *LibraryConfig, filename string) string {
+	for _, v := range lib.volumes() {
+		path := filepath.Join(v, filename)
+		if _, err := os.Lstat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// VolumeUsage is the utilization of one volume of a library.
+type VolumeUsage struct {
+	Library string `json:"library"`
+	Path    string `json:"path"`
+	// Pinned are the media types always stored on the volume.
+	Pinned []string `json:"pinned"`
+	// Used is the size of the library's media on the volume. Total and
+	// Free describe the whole file system, and are omitted where the
+	// platform can't report them.
+	Used  int64  `json:"used"`
+	Total *int64 `json:"total,omitempty"`
+	Free  *int64 `json:"free,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// getVolumes reports the utilization of every volume of every library.
+func (app *App) getVolumes(w http.ResponseWriter, r *http.Request) {
+	usage := []VolumeUsage{}
+	for i := range app.Config.Libraries {
+		lib := &app.Config.Libraries[i]
+		for _, v := range lib.volumes() {
+			u := VolumeUsage{Library: lib.Name, Path: v, Pinned: []string{}}
+			for mediaType, pinned := range lib.Pinned {
+				if filepath.Clean(pinned) == v {
+					u.Pinned = append(u.Pinned, mediaType)
+				}
+			}
+			sort.Strings(u.Pinned)
+
+			used, err := app.pathUsage(v)
+			if err != nil {
+				log.Error("Failed to compute volume usage:", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			u.Used = used
+
+			if space, err := diskSpace(v); err != nil {
+				u.Error = err.Error()
+			} else {
+				u.Total, u.Free = &space.Total, &space.Free
+			}
+			usage = append(usage, u)
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, usage)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "errors"
+
+// diskSpace is only implemented on Linux, macOS and FreeBSD.
+func diskSpace(path string) (diskUsage, error) {
+	return diskUsage{}, errors.New("disk space is not available on this platform")
+}
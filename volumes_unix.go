@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// diskSpace returns the size of the file system holding path and the space
+// on it available to unprivileged users.
+func diskSpace(path string) (diskUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return diskUsage{}, err
+	}
+	return diskUsage{
+		Total: int64(st.Blocks) * int64(st.Bsize),
+		Free:  int64(st.Bavail) * int64(st.Bsize),
+	}, nil
+}
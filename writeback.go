@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// errWriteBackUnavailable is returned when metadata can't be written to
+// files because exiftool wasn't found.
+var errWriteBackUnavailable = errors.New("exiftool is not available")
+
+// writableExtensions are the formats exiftool can write XMP metadata into.
+// Matroska, AVI and EPUB files aren't among them.
+var writableExtensions = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+	".webp": true,
+	".mp4":  true,
+	".mov":  true,
+	".m4v":  true,
+	".pdf":  true,
+}
+
+// findExifTool returns the path of exiftool, or an empty string if it
+// isn't found or no library writes metadata to its files.
+func findExifTool(config *Config) string {
+	writes := false
+	for _, lib := range config.Libraries {
+		writes = writes || lib.WriteMetadata
+	}
+	path := config.Metadata.ExifToolPath
+	if !writes || path == "" {
+		return ""
+	}
+
+	resolved, err := exec.LookPath(path)
+	if err != nil {
+		log.Warnf("%s not found (%v); metadata will not be written to files", path, err)
+		return ""
+	}
+	return resolved
+}
+
+// writeMetadata writes the title, description, people and tags of an item
+// into its file as XMP, so they survive outside the library. Fields that
+// are empty are cleared in the file, so removing the last tag removes it
+// there too. The item's size and hashes are updated to match the
+// rewritten file; its modification time is kept. It reports whether the
+// file was written: locked items and formats exiftool can't write are
+// left alone.
+func (app *App) writeMetadata(item *MediaItem) (bool, error) {
+	if app.ExifTool == "" {
+		return false, errWriteBackUnavailable
+	}
+	if item.Locked || !writableExtensions[strings.ToLower(filepath.Ext(item.Path))] {
+		return false, nil
+	}
+
+	var people []string
+	if err := app.DB.Select(&people, "SELECT p.name FROM people p JOIN media_people mp ON mp.person_id = p.id WHERE mp.media_id = ? ORDER BY p.name", item.ID); err != nil {
+		return false, err
+	}
+
+	var keywords []string
+	err := app.DB.Select(&keywords,
+		"SELECT t.name FROM tags t JOIN media_tags mt ON mt.tag_id = t.id WHERE mt.media_id = ? ORDER BY t.name",
+		item.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	// An empty assignment deletes the tag
+	tags := []string{"-XMP-dc:Title=" + item.Title, "-XMP-dc:Description=" + item.Description}
+	// Assigning a list tag several times in one run replaces its values
+	// with all of them
+	if len(people) == 0 {
+		tags = append(tags, "-XMP-iptcExt:PersonInImage=")
+	}
+	for _, person := range people {
+		tags = append(tags, "-XMP-iptcExt:PersonInImage="+person)
+	}
+	if len(keywords) == 0 {
+		tags = append(tags, "-XMP-dc:Subject=")
+	}
+	for _, keyword := range keywords {
+		tags = append(tags, "-XMP-dc:Subject="+keyword)
+	}
+
+	// -P keeps the modification time, which the capture date falls back to
+	args := append([]string{"-q", "-m", "-P", "-overwrite_original", "-charset", "filename=utf8"}, tags...)
+	if _, err := runTool(app.ExifTool, append(args, item.Path)...); err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(item.Path)
+	if err != nil {
+		return true, err
+	}
+	item.Size = info.Size()
+	if item.Oshash, err = fileOshash(item.Path); err != nil {
+		return true, err
+	}
+	// The checksum is computed on demand, so it's only refreshed if it was
+	if item.Checksum != "" {
+		if item.Checksum, err = fileChecksum(item.Path); err != nil {
+			return true, err
+		}
+	}
+
+	_, err = app.DB.Exec(
+		"UPDATE media SET size = ?, oshash = ?, checksum = ? WHERE id = ?",
+		item.Size, item.Oshash, item.Checksum, item.ID,
+	)
+	return true, err
+}
+
+// writesMetadata reports whether the item is in a library that writes
+// metadata to its files.
+func (app *App) writesMetadata(item *MediaItem) bool {
+	lib := app.Config.libraryOf(item.Path)
+	return lib != nil && lib.WriteMetadata
+}
+
+// writeBack writes the metadata of a new or updated item to its file if its
+// library asks for it. Failures are logged, as the item itself is fine.
+func (app *App) writeBack(item *MediaItem) {
+	if !app.writesMetadata(item) || app.ExifTool == "" {
+		return
+	}
+	if _, err := app.writeMetadata(item); err != nil {
+		log.Warnf("Failed to write metadata to %s: %v", item.Path, err)
+	}
+}
+
+// writeBackMedia writes the metadata of the items matching the media
+// filters in the query string to their files. Items outside the libraries
+// that write metadata are skipped.
+func (app *App) writeBackMedia(w http.ResponseWriter, r *http.Request) {
+	if app.ExifTool == "" {
+		http.Error(w, "Writing metadata to files is not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	filter, err := parseMediaFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items []MediaItem
+	where, args := filter.where()
+	if err := app.DB.Select(&items, "SELECT * FROM media"+where+" ORDER BY id", args...); err != nil {
+		log.Error("Failed to fetch media items:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	written, skipped, failed := 0, 0, 0
+	for i := range items {
+		if !app.writesMetadata(&items[i]) {
+			skipped++
+			continue
+		}
+
+		ok, err := app.writeMetadata(&items[i])
+		switch {
+		case err != nil:
+			log.Warnf("Failed to write metadata to %s: %v", items[i].Path, err)
+			failed++
+		case ok:
+			written++
+		default:
+			skipped++
+		}
+	}
+
+	app.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"written": written,
+		"skipped": skipped,
+		"failed":  failed,
+	})
+}